@@ -85,12 +85,28 @@ type Session struct {
 	Config    json.RawMessage
 }
 
+// BotOptions are the options for a bot user in a room, as if they had been set by a
+// m.room.bot.options state event. They are created for use with ConfigFile.
+type BotOptions struct {
+	UserID  string
+	RoomID  string
+	Options map[string]interface{}
+}
+
+// Room is a room which bot users should join. They are created for use with ConfigFile.
+type Room struct {
+	RoomID  string
+	UserIDs []string
+}
+
 // ConfigFile represents config.sample.yaml
 type ConfigFile struct {
-	Clients  []ClientConfig
-	Realms   []ConfigureAuthRealmRequest
-	Services []ConfigureServiceRequest
-	Sessions []Session
+	Clients    []ClientConfig
+	Realms     []ConfigureAuthRealmRequest
+	Services   []ConfigureServiceRequest
+	Sessions   []Session
+	BotOptions []BotOptions
+	Rooms      []Room
 }
 
 // Check validates the /configureService request
@@ -117,6 +133,22 @@ func (c *Session) Check() error {
 	return nil
 }
 
+// Check validates the bot options config
+func (o *BotOptions) Check() error {
+	if o.UserID == "" || o.RoomID == "" || o.Options == nil {
+		return errors.New(`Must supply a "UserID", a "RoomID" and "Options"`)
+	}
+	return nil
+}
+
+// Check validates the room config
+func (r *Room) Check() error {
+	if r.RoomID == "" || len(r.UserIDs) == 0 {
+		return errors.New(`Must supply a "RoomID" and "UserIDs"`)
+	}
+	return nil
+}
+
 // Check that the client has supplied the correct fields.
 func (c *ClientConfig) Check() error {
 	if c.UserID == "" || c.HomeserverURL == "" || c.AccessToken == "" {
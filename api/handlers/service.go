@@ -108,7 +108,7 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		return util.MessageResponse(400, "Unknown matrix client")
 	}
 
-	if err := checkClientForService(service, client); err != nil {
+	if err := checkClientForService(service, client, s.clients); err != nil {
 		return util.MessageResponse(400, err.Error())
 	}
 
@@ -225,7 +225,7 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 	}
 }
 
-func checkClientForService(service types.Service, client *gomatrix.Client) error {
+func checkClientForService(service types.Service, client *gomatrix.Client, clis *clients.Clients) error {
 	// If there are any commands or expansions for this Service then the service user ID
 	// MUST be a syncing client or else the Service will never get the incoming command/expansion!
 	cmds := service.Commands(client)
@@ -238,5 +238,14 @@ func checkClientForService(service types.Service, client *gomatrix.Client) error
 			)
 		}
 	}
+	// Any other users the Service sends messages as MUST be known clients. They only send, so
+	// they don't need to sync.
+	if multi, ok := service.(types.MultiSender); ok {
+		for _, userID := range multi.SenderUserIDs() {
+			if _, err := clis.Client(userID); err != nil {
+				return fmt.Errorf("Unknown matrix client for sender %s", userID)
+			}
+		}
+	}
 	return nil
 }
@@ -4,9 +4,11 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/eventstream"
 	"github.com/matrix-org/go-neb/metrics"
 	log "github.com/sirupsen/logrus"
 )
@@ -62,5 +64,28 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		"service_type": service.ServiceType(),
 	}).Print("Incoming webhook for service")
 	metrics.IncrementWebhook(service.ServiceType())
-	service.OnReceiveWebhook(w, req, cli)
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: 200}
+	service.OnReceiveWebhook(rec, req, cli)
+	eventstream.Publish(eventstream.Event{
+		Type:        eventstream.TypeWebhook,
+		ServiceID:   service.ServiceID(),
+		ServiceType: service.ServiceType(),
+		Data: map[string]interface{}{
+			"method":      req.Method,
+			"status":      rec.status,
+			"duration_ms": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		},
+	})
+}
+
+// statusRecorder remembers the status code a service responded to a webhook with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
@@ -0,0 +1,119 @@
+// Package apicache provides a shared HTTP cache for clients of external APIs such as GitHub and JIRA.
+//
+// Cached responses are revalidated with their ETag or Last-Modified date, so unchanged resources
+// cost a 304 Not Modified rather than a full response. GitHub does not count these conditional
+// requests against the rate limit. Responses are only shared between clients using the same
+// token, so one user can never see a response fetched with another user's credentials.
+//
+// The cache is held in memory and bounded by size, evicting the least recently used responses.
+// Rate limit headers on responses are exposed as metrics.
+package apicache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/die-net/lrucache"
+	"github.com/gregjones/httpcache"
+	"github.com/matrix-org/go-neb/metrics"
+)
+
+// MaxSizeBytes is the maximum size of all cached responses.
+const MaxSizeBytes = 20 * 1024 * 1024
+
+var sharedCache httpcache.Cache = lrucache.New(MaxSizeBytes, 0)
+
+// tokenCache is the part of the shared cache for one API token.
+type tokenCache struct {
+	prefix string
+}
+
+func (c tokenCache) Get(key string) ([]byte, bool) {
+	return sharedCache.Get(c.prefix + key)
+}
+
+func (c tokenCache) Set(key string, resp []byte) {
+	sharedCache.Set(c.prefix+key, resp)
+}
+
+func (c tokenCache) Delete(key string) {
+	sharedCache.Delete(c.prefix + key)
+}
+
+// contextKey is the request context key which records whether a cached request reached the network.
+type contextKey struct{}
+
+// cachingTransport serves requests from the cache and counts the results.
+type cachingTransport struct {
+	api   string
+	cache *httpcache.Transport
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var fetched bool
+	req = req.WithContext(context.WithValue(req.Context(), contextKey{}, &fetched))
+	resp, err := t.cache.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	result := "miss"
+	if resp.Header.Get(httpcache.XFromCache) == "1" {
+		if fetched {
+			result = "revalidated"
+		} else {
+			result = "hit"
+		}
+	}
+	metrics.IncrementAPIRequest(t.api, result)
+	return resp, nil
+}
+
+// networkTransport makes requests which the cache couldn't answer and records rate limits.
+type networkTransport struct {
+	api    string
+	client string
+	next   http.RoundTripper
+}
+
+func (t *networkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if fetched, ok := req.Context().Value(contextKey{}).(*bool); ok {
+		*fetched = true
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		metrics.SetAPIRateLimitRemaining(t.api, t.client, remaining)
+	}
+	if resp.StatusCode == 429 || (resp.StatusCode == 403 && resp.Header.Get("X-RateLimit-Remaining") == "0") {
+		metrics.IncrementAPIRateLimited(t.api)
+	}
+	return resp, nil
+}
+
+// Transport returns a RoundTripper for requests to the named API which are authenticated with
+// the given token, or no token. Responses are cached and shared with other clients for the same
+// API and token. The next RoundTripper should add the credentials to requests.
+func Transport(api, token string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	hash := sha256.Sum256([]byte(api + "\x00" + token))
+	id := hex.EncodeToString(hash[:])
+	client := id[:8]
+	if token == "" {
+		client = "anonymous"
+	}
+	return &cachingTransport{
+		api: api,
+		cache: &httpcache.Transport{
+			Transport:           &networkTransport{api, client, next},
+			Cache:               tokenCache{id + " "},
+			MarkCachedResponses: true,
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package apicache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// bearerTransport authenticates requests like the oauth2 transport does.
+type bearerTransport struct {
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		etag := `"` + r.Header.Get("Authorization") + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=0")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(304)
+			return
+		}
+		w.Write([]byte("issue for " + r.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+
+	get := func(token string) string {
+		cli := &http.Client{Transport: Transport("test", token, &bearerTransport{token})}
+		res, err := cli.Get(srv.URL + "/repos/matrix-org/go-neb/issues/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	if body := get("alice"); body != "issue for Bearer alice" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if body := get("alice"); body != "issue for Bearer alice" {
+		t.Errorf("Expected the cached body, got %q", body)
+	}
+	if len(requests) != 2 || requests[1].Header.Get("If-None-Match") != `"Bearer alice"` {
+		t.Fatalf("Expected the cached response to be revalidated with its ETag, got %d requests", len(requests))
+	}
+
+	// Another token must not see alice's response
+	if body := get("bob"); body != "issue for Bearer bob" {
+		t.Errorf("Expected bob's own response, got %q", body)
+	}
+	if len(requests) != 3 || requests[2].Header.Get("If-None-Match") != "" {
+		t.Errorf("Expected bob's request not to use alice's cached response")
+	}
+}
+
+func TestTokenCacheIsolation(t *testing.T) {
+	a := Transport("github", "alice", nil).(*cachingTransport).cache.Cache
+	b := Transport("github", "bob", nil).(*cachingTransport).cache.Cache
+	j := Transport("jira", "alice", nil).(*cachingTransport).cache.Cache
+	a.Set("https://api.github.com/user", []byte("alice"))
+	if _, ok := b.Get("https://api.github.com/user"); ok {
+		t.Errorf("Expected tokens not to share cached responses")
+	}
+	if _, ok := j.Get("https://api.github.com/user"); ok {
+		t.Errorf("Expected APIs not to share cached responses")
+	}
+	if resp, ok := Transport("github", "alice", nil).(*cachingTransport).cache.Cache.Get("https://api.github.com/user"); !ok || string(resp) != "alice" {
+		t.Errorf("Expected new clients with the same token to share cached responses")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/eventstream"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/types"
@@ -163,6 +164,8 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 		}).Warn("Error loading services")
 	}
 
+	c.notifyEventListeners(client, services, event)
+
 	body, ok := event.Body()
 	if !ok || body == "" {
 		return
@@ -173,6 +176,14 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 		return
 	}
 
+	// commands can be sent as replies, which start with a quote of the replied to message
+	if matrix.InReplyTo(event) != "" {
+		body = matrix.StripReplyFallback(body)
+		if body == "" {
+			return
+		}
+	}
+
 	// replace all smart quotes with their normal counterparts so shellwords can parse it
 	body = strings.Replace(body, `‘`, `'`, -1)
 	body = strings.Replace(body, `’`, `'`, -1)
@@ -180,18 +191,33 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 	body = strings.Replace(body, `”`, `"`, -1)
 
 	var responses []interface{}
+	features := c.loadRoomFeatures(client.UserID, event.RoomID)
 
-	for _, service := range services {
-		if body[0] == '!' { // message is a command
-			args, err := shellwords.Parse(body[1:])
+	if body[0] == '!' { // message is a command
+		args, err := shellwords.Parse(body[1:])
+		if err != nil {
+			args = strings.Split(body[1:], " ")
+		}
+
+		if len(args) > 0 && strings.ToLower(args[0]) == "neb" {
+			content, err := c.runNebCommand(client, services, event, args[1:])
 			if err != nil {
-				args = strings.Split(body[1:], " ")
+				content = gomatrix.TextMessage{MsgType: "m.notice", Body: err.Error()}
 			}
-
-			if response := runCommandForService(service.Commands(client), event, args); response != nil {
-				responses = append(responses, response)
+			responses = append(responses, content)
+		} else {
+			for _, service := range services {
+				cmds := features.enabledCommands(service, service.Commands(client))
+				if response := runCommandForService(service, cmds, event, args); response != nil {
+					responses = append(responses, response)
+				}
+			}
+		}
+	} else { // message isn't a command, it might need expanding
+		for _, service := range services {
+			if features.expansionsDisabled(service) {
+				continue
 			}
-		} else { // message isn't a command, it might need expanding
 			expansions := runExpansionsForService(service.Expansions(client), event, body)
 			responses = append(responses, expansions...)
 		}
@@ -205,6 +231,12 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 				"user_id":    event.Sender,
 				"content":    content,
 			}).Print("Failed to send command response")
+			eventstream.Publish(eventstream.Event{
+				Type:   eventstream.TypeSendFailure,
+				RoomID: event.RoomID,
+				UserID: client.UserID,
+				Data:   map[string]interface{}{"error": err.Error()},
+			})
 		}
 	}
 }
@@ -213,7 +245,7 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 // the matching command with the longest path. Returns the JSON encodable
 // content of a single matrix message event to use as a response or nil if no
 // response is appropriate.
-func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments []string) interface{} {
+func runCommandForService(service types.Service, cmds []types.Command, event *gomatrix.Event, arguments []string) interface{} {
 	var bestMatch *types.Command
 	for i, command := range cmds {
 		matches := command.Matches(arguments)
@@ -233,7 +265,14 @@ func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments
 		"user_id": event.Sender,
 		"command": bestMatch.Path,
 	}).Info("Executing command")
-	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	var content interface{}
+	var err error
+	if bestMatch.EventCommand != nil {
+		content, err = bestMatch.EventCommand(event, cmdArgs)
+	} else {
+		content, err = bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	}
+	var status metrics.Status = metrics.StatusSuccess
 	if err != nil {
 		if content != nil {
 			log.WithFields(log.Fields{
@@ -244,11 +283,21 @@ func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments
 				"args":       cmdArgs,
 			}).Warn("Command returned both error and content.")
 		}
-		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusFailure)
+		status = metrics.StatusFailure
 		content = gomatrix.TextMessage{"m.notice", err.Error()}
-	} else {
-		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusSuccess)
 	}
+	metrics.IncrementCommand(bestMatch.Path[0], status)
+	eventstream.Publish(eventstream.Event{
+		Type:        eventstream.TypeCommand,
+		ServiceID:   service.ServiceID(),
+		ServiceType: service.ServiceType(),
+		RoomID:      event.RoomID,
+		UserID:      event.Sender,
+		Data: map[string]interface{}{
+			"command": strings.Join(bestMatch.Path, " "),
+			"status":  string(status),
+		},
+	})
 
 	return content
 }
@@ -275,6 +324,37 @@ func runExpansionsForService(expans []types.Expansion, event *gomatrix.Event, bo
 	return responses
 }
 
+// notifyEventListeners passes the event to each of the services which is an EventListener, unless
+// the service is disabled in the room.
+func (c *Clients) notifyEventListeners(client *gomatrix.Client, services []types.Service, event *gomatrix.Event) {
+	var features *roomFeatures
+	for _, service := range services {
+		listener, ok := service.(types.EventListener)
+		if !ok {
+			continue
+		}
+		if features == nil {
+			features = c.loadRoomFeatures(client.UserID, event.RoomID)
+		}
+		if !features.serviceDisabled(service) {
+			listener.OnReceiveEvent(client, event)
+		}
+	}
+}
+
+func (c *Clients) onEventForListeners(client *gomatrix.Client, event *gomatrix.Event) {
+	services, err := c.db.LoadServicesForUser(client.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:      err,
+			"room_id":         event.RoomID,
+			"service_user_id": client.UserID,
+		}).Warn("Error loading services")
+		return
+	}
+	c.notifyEventListeners(client, services, event)
+}
+
 func (c *Clients) onBotOptionsEvent(client *gomatrix.Client, event *gomatrix.Event) {
 	// see if these options are for us. The state key is the user ID with a leading _
 	// to get around restrictions in the HS about having user IDs as state keys.
@@ -282,13 +362,19 @@ func (c *Clients) onBotOptionsEvent(client *gomatrix.Client, event *gomatrix.Eve
 	if targetUserID != client.UserID {
 		return
 	}
-	// these options fully clobber what was there previously.
+	// these options fully clobber what was there previously, except for the features set with
+	// !neb enable|disable unless the event sets them too.
 	opts := types.BotOptions{
 		UserID:      client.UserID,
 		RoomID:      event.RoomID,
 		SetByUserID: event.Sender,
 		Options:     event.Content,
 	}
+	if _, ok := opts.Options[featuresOption]; !ok && opts.Options != nil {
+		if old, err := c.db.LoadBotOptions(client.UserID, event.RoomID); err == nil && old.Options[featuresOption] != nil {
+			opts.Options[featuresOption] = old.Options[featuresOption]
+		}
+	}
 	if _, err := c.db.StoreBotOptions(opts); err != nil {
 		log.WithFields(log.Fields{
 			log.ErrorKey:     err,
@@ -360,6 +446,18 @@ func (c *Clients) newClient(config api.ClientConfig) (*gomatrix.Client, error) {
 		})
 	}
 
+	syncer.OnEventType("m.room.member", func(event *gomatrix.Event) {
+		c.onEventForListeners(client, event)
+	})
+
+	syncer.OnEventType("m.reaction", func(event *gomatrix.Event) {
+		c.onEventForListeners(client, event)
+	})
+
+	syncer.OnEventType("m.room.redaction", func(event *gomatrix.Event) {
+		c.onEventForListeners(client, event)
+	})
+
 	log.WithFields(log.Fields{
 		"user_id":         config.UserID,
 		"sync":            config.Sync,
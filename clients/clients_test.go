@@ -1,9 +1,15 @@
 package clients
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/go-neb/database"
@@ -25,13 +31,18 @@ var commandParseTests = []struct {
 
 type MockService struct {
 	types.DefaultService
-	commands []types.Command
+	commands   []types.Command
+	expansions []types.Expansion
 }
 
 func (s *MockService) Commands(cli *gomatrix.Client) []types.Command {
 	return s.commands
 }
 
+func (s *MockService) Expansions(cli *gomatrix.Client) []types.Expansion {
+	return s.expansions
+}
+
 type MockStore struct {
 	database.NopStorage
 	service types.Service
@@ -93,3 +104,213 @@ func TestCommandParsing(t *testing.T) {
 	}
 
 }
+
+func TestReplyCommand(t *testing.T) {
+	var executedEvent *gomatrix.Event
+	var executedCmdArgs []string
+	cmds := []types.Command{
+		types.Command{
+			Path: []string{"test"},
+			EventCommand: func(event *gomatrix.Event, args []string) (interface{}, error) {
+				executedEvent = event
+				executedCmdArgs = args
+				return nil, nil
+			},
+		},
+	}
+	s := MockService{commands: cmds}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unhandled test path")
+	}
+	cli := &http.Client{
+		Transport: trans,
+	}
+	clients := New(&store, cli)
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+
+	event := gomatrix.Event{
+		Type:   "m.room.message",
+		Sender: "@someone:somewhere",
+		RoomID: "!foo:bar",
+		ID:     "$command",
+		Content: map[string]interface{}{
+			"body":    "> <@other:somewhere> it's broken\n> again\n\n!test 'the title'",
+			"msgtype": "m.text",
+			"m.relates_to": map[string]interface{}{
+				"m.in_reply_to": map[string]interface{}{"event_id": "$broken"},
+			},
+		},
+	}
+	clients.onMessageEvent(mxCli, &event)
+	if executedEvent != &event || !reflect.DeepEqual(executedCmdArgs, []string{"the title"}) {
+		t.Errorf("TestReplyCommand want the command with args [the title], got %v %s", executedEvent, executedCmdArgs)
+	}
+}
+
+// featureStore stores a single room's bot options.
+type featureStore struct {
+	MockStore
+	opts *types.BotOptions
+}
+
+func (d *featureStore) LoadBotOptions(userID, roomID string) (types.BotOptions, error) {
+	if d.opts == nil {
+		return types.BotOptions{}, sql.ErrNoRows
+	}
+	return *d.opts, nil
+}
+
+func (d *featureStore) StoreBotOptions(opts types.BotOptions) (types.BotOptions, error) {
+	d.opts = &opts
+	return opts, nil
+}
+
+func TestFeatureToggles(t *testing.T) {
+	var commands, expansions int
+	s := MockService{
+		DefaultService: types.NewDefaultService("github_id", "@service:user", "github"),
+		commands: []types.Command{
+			types.Command{
+				Path: []string{"github", "create"},
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					commands++
+					return nil, nil
+				},
+			},
+		},
+		expansions: []types.Expansion{
+			types.Expansion{
+				Regexp: regexp.MustCompile("#[0-9]+"),
+				Expand: func(roomID, userID string, matches []string) interface{} {
+					expansions++
+					return nil
+				},
+			},
+		},
+	}
+	store := featureStore{MockStore: MockStore{service: &s}}
+	database.SetServiceDB(&store)
+
+	var responses []string
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/state/m.room.power_levels") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"users":{"@mod:somewhere":50},"state_default":50}`)),
+			}, nil
+		}
+		var msg gomatrix.TextMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		responses = append(responses, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$response"}`)),
+		}, nil
+	}
+	cli := &http.Client{
+		Transport: trans,
+	}
+	clients := New(&store, cli)
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+
+	send := func(sender, body string) {
+		responses = nil
+		clients.onMessageEvent(mxCli, &gomatrix.Event{
+			Type:    "m.room.message",
+			Sender:  sender,
+			RoomID:  "!foo:bar",
+			Content: map[string]interface{}{"body": body, "msgtype": "m.text"},
+		})
+	}
+
+	send("@someone:somewhere", "!neb disable github expansions")
+	if len(responses) != 1 || responses[0] != "Only room moderators can enable and disable features" || store.opts != nil {
+		t.Fatalf("Expected a user who isn't a moderator to be rejected, got %v", responses)
+	}
+	send("@mod:somewhere", "!neb disable giphy")
+	if len(responses) != 1 || !strings.HasPrefix(responses[0], "Unknown service") {
+		t.Errorf("Expected an unknown feature to be rejected, got %v", responses)
+	}
+	send("@mod:somewhere", "!neb disable github expansions")
+	if len(responses) != 1 || responses[0] != "Disabled github expansions in this room." {
+		t.Fatalf("Unexpected response: %v", responses)
+	}
+	send("@someone:somewhere", "see #123")
+	send("@someone:somewhere", "!github create")
+	if expansions != 0 || commands != 1 {
+		t.Errorf("Expected only expansions to be disabled, got %d expansions and %d commands", expansions, commands)
+	}
+
+	send("@mod:somewhere", "!neb disable github create")
+	send("@someone:somewhere", "!github create")
+	if commands != 1 {
+		t.Errorf("Expected the disabled command not to run")
+	}
+
+	// Setting bot options with a state event keeps the features
+	clients.onBotOptionsEvent(mxCli, &gomatrix.Event{
+		Type:     "m.room.bot.options",
+		Sender:   "@mod:somewhere",
+		RoomID:   "!foo:bar",
+		StateKey: &[]string{"_@service:user"}[0],
+		Content:  map[string]interface{}{"github": map[string]interface{}{"default_repo": "a/b"}},
+	})
+	send("@mod:somewhere", "!neb features")
+	if len(responses) != 1 || responses[0] != "Disabled in this room: github create, github expansions" {
+		t.Errorf("Unexpected features: %v", responses)
+	}
+
+	send("@mod:somewhere", "!neb enable github create")
+	send("@someone:somewhere", "!github create")
+	if commands != 2 {
+		t.Errorf("Expected the enabled command to run")
+	}
+	// Features of services which have since been removed can still be enabled
+	store.opts.Options[featuresOption] = map[string]interface{}{"disabled": []interface{}{"giphy"}}
+	send("@mod:somewhere", "!neb enable giphy")
+	if len(responses) != 1 || responses[0] != "Enabled giphy in this room." {
+		t.Errorf("Expected a disabled feature which is no longer known to be enabled, got %v", responses)
+	}
+}
+
+type listenerService struct {
+	MockService
+	events int
+}
+
+func (s *listenerService) OnReceiveEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	s.events++
+}
+
+func TestEventListenerToggles(t *testing.T) {
+	s := listenerService{MockService: MockService{DefaultService: types.NewDefaultService("search_id", "@service:user", "search")}}
+	store := featureStore{MockStore: MockStore{service: &s}}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+	mxCli, _ := gomatrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	event := &gomatrix.Event{
+		Type:    "m.room.redaction",
+		Sender:  "@someone:somewhere",
+		RoomID:  "!foo:bar",
+		Redacts: "$secret",
+	}
+
+	clients.onEventForListeners(mxCli, event)
+	if s.events != 1 {
+		t.Fatalf("Expected the listener to be passed the event, got %d events", s.events)
+	}
+	store.opts = &types.BotOptions{Options: map[string]interface{}{
+		featuresOption: map[string]interface{}{"disabled": []interface{}{"search"}},
+	}}
+	clients.onEventForListeners(mxCli, event)
+	if s.events != 1 {
+		t.Errorf("Expected a disabled service not to be passed events, got %d events", s.events)
+	}
+}
@@ -0,0 +1,240 @@
+package clients
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// featuresOption is the bot options key which holds the features disabled in a room, e.g.
+//    { "features": { "disabled": ["giphy", "github expansions", "github create"] } }
+// A feature is one of:
+//  - a service type or ID, which disables all of the service's commands and expansions.
+//  - a service type or ID followed by "commands" or "expansions".
+//  - a command path, or the start of one, e.g. "github create" or "argocd".
+const featuresOption = "features"
+
+const nebUsage = "Usage: !neb enable|disable <service|command|expansion>, !neb features"
+
+// roomFeatures are the features which are disabled for a bot in a room.
+type roomFeatures struct {
+	disabled []string
+}
+
+func (f *roomFeatures) isDisabled(feature string) bool {
+	for _, d := range f.disabled {
+		if strings.EqualFold(d, feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceDisabled returns true if all of the service's commands and expansions are disabled.
+func (f *roomFeatures) serviceDisabled(service types.Service) bool {
+	return f.isDisabled(service.ServiceType()) || f.isDisabled(service.ServiceID())
+}
+
+func (f *roomFeatures) expansionsDisabled(service types.Service) bool {
+	return f.serviceDisabled(service) ||
+		f.isDisabled(service.ServiceType()+" expansions") || f.isDisabled(service.ServiceID()+" expansions")
+}
+
+// disabledBy returns the disabled feature which disables the command, or "".
+func (f *roomFeatures) disabledBy(service types.Service, cmd *types.Command) string {
+	for _, feature := range []string{
+		service.ServiceType(), service.ServiceID(),
+		service.ServiceType() + " commands", service.ServiceID() + " commands",
+	} {
+		if f.isDisabled(feature) {
+			return feature
+		}
+	}
+	for i := range cmd.Path {
+		if prefix := strings.Join(cmd.Path[:i+1], " "); f.isDisabled(prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// enabledCommands returns the service's commands which aren't disabled.
+func (f *roomFeatures) enabledCommands(service types.Service, cmds []types.Command) []types.Command {
+	if len(f.disabled) == 0 {
+		return cmds
+	}
+	var enabled []types.Command
+	for i := range cmds {
+		if f.disabledBy(service, &cmds[i]) == "" {
+			enabled = append(enabled, cmds[i])
+		}
+	}
+	return enabled
+}
+
+// loadRoomFeatures loads the disabled features of the bot options for the bot in the room.
+func (c *Clients) loadRoomFeatures(userID, roomID string) *roomFeatures {
+	opts, err := c.db.LoadBotOptions(userID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{
+				log.ErrorKey:  err,
+				"room_id":     roomID,
+				"bot_user_id": userID,
+			}).Error("Failed to load bot options")
+		}
+		return &roomFeatures{}
+	}
+	return featuresFromOptions(opts.Options)
+}
+
+func featuresFromOptions(options map[string]interface{}) *roomFeatures {
+	var f roomFeatures
+	featureOpts, _ := options[featuresOption].(map[string]interface{})
+	disabled, _ := featureOpts["disabled"].([]interface{})
+	for _, d := range disabled {
+		if s, ok := d.(string); ok {
+			f.disabled = append(f.disabled, s)
+		}
+	}
+	return &f
+}
+
+// knownFeature returns true if the feature names something which the bot's services provide.
+func knownFeature(client *gomatrix.Client, services []types.Service, feature string) bool {
+	for _, service := range services {
+		for _, name := range []string{service.ServiceType(), service.ServiceID()} {
+			if strings.EqualFold(feature, name) ||
+				strings.EqualFold(feature, name+" commands") ||
+				strings.EqualFold(feature, name+" expansions") {
+				return true
+			}
+		}
+		for _, cmd := range service.Commands(client) {
+			for i := range cmd.Path {
+				if strings.EqualFold(feature, strings.Join(cmd.Path[:i+1], " ")) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// powerLevels is the part of the m.room.power_levels content which is used.
+type powerLevels struct {
+	Users        map[string]int `json:"users"`
+	UsersDefault int            `json:"users_default"`
+	Events       map[string]int `json:"events"`
+	StateDefault *int           `json:"state_default"`
+}
+
+// canSetBotOptions returns true if the user is allowed to send m.room.bot.options into the room,
+// which is usually a room moderator.
+func canSetBotOptions(client *gomatrix.Client, roomID, userID string) (bool, error) {
+	var pl powerLevels
+	if err := client.StateEvent(roomID, "m.room.power_levels", "", &pl); err != nil {
+		return false, err
+	}
+	required, ok := pl.Events["m.room.bot.options"]
+	if !ok {
+		required = 50
+		if pl.StateDefault != nil {
+			required = *pl.StateDefault
+		}
+	}
+	level, ok := pl.Users[userID]
+	if !ok {
+		level = pl.UsersDefault
+	}
+	return level >= required, nil
+}
+
+// runNebCommand runs the built-in !neb commands which enable and disable features in a room:
+//    !neb disable <feature>
+//    !neb enable <feature>
+//    !neb features
+func (c *Clients) runNebCommand(client *gomatrix.Client, services []types.Service, event *gomatrix.Event, args []string) (interface{}, error) {
+	if len(args) == 1 && strings.EqualFold(args[0], "features") {
+		f := c.loadRoomFeatures(client.UserID, event.RoomID)
+		if len(f.disabled) == 0 {
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Everything is enabled in this room."}, nil
+		}
+		disabled := append([]string{}, f.disabled...)
+		sort.Strings(disabled)
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Disabled in this room: " + strings.Join(disabled, ", ")}, nil
+	}
+	if len(args) < 2 {
+		return nil, errors.New(nebUsage)
+	}
+	var enable bool
+	switch strings.ToLower(args[0]) {
+	case "enable":
+		enable = true
+	case "disable":
+		enable = false
+	default:
+		return nil, errors.New(nebUsage)
+	}
+	feature := strings.ToLower(strings.Join(args[1:], " "))
+	// Features which are already disabled can always be enabled, even if nothing provides them now
+	alreadyDisabled := enable && c.loadRoomFeatures(client.UserID, event.RoomID).isDisabled(feature)
+	if !alreadyDisabled && !knownFeature(client, services, feature) {
+		return nil, fmt.Errorf("Unknown service, command or expansion: %s", feature)
+	}
+	allowed, err := canSetBotOptions(client, event.RoomID, event.Sender)
+	if err != nil {
+		log.WithError(err).WithField("room_id", event.RoomID).Error("Failed to load power levels")
+		return nil, errors.New("Failed to check your power level")
+	}
+	if !allowed {
+		return nil, errors.New("Only room moderators can enable and disable features")
+	}
+
+	opts, err := c.db.LoadBotOptions(client.UserID, event.RoomID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if opts.Options == nil {
+		opts.Options = make(map[string]interface{})
+	}
+	var disabled []interface{}
+	for _, d := range featuresFromOptions(opts.Options).disabled {
+		if !strings.EqualFold(d, feature) {
+			disabled = append(disabled, d)
+		}
+	}
+	if !enable {
+		disabled = append(disabled, feature)
+	}
+	opts.Options[featuresOption] = map[string]interface{}{"disabled": disabled}
+	opts.UserID = client.UserID
+	opts.RoomID = event.RoomID
+	opts.SetByUserID = event.Sender
+	if _, err := c.db.StoreBotOptions(opts); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:     err,
+			"room_id":        event.RoomID,
+			"bot_user_id":    client.UserID,
+			"set_by_user_id": event.Sender,
+		}).Error("Failed to persist bot options")
+		return nil, errors.New("Failed to save the room's features")
+	}
+
+	if !enable {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Disabled " + feature + " in this room."}, nil
+	}
+	// A broader feature may still be disabled, e.g. enabling "github create" when "github" is disabled.
+	for _, d := range disabled {
+		if s := d.(string); strings.HasPrefix(feature, s+" ") {
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: fmt.Sprintf("Enabled %s, but %s is still disabled in this room.", feature, s)}, nil
+		}
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Enabled " + feature + " in this room."}, nil
+}
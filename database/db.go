@@ -11,7 +11,8 @@ import (
 
 // A ServiceDB stores the configuration for the services
 type ServiceDB struct {
-	db *sql.DB
+	db     *sql.DB
+	search *searchDialect
 }
 
 // A single global instance of the service DB.
@@ -42,7 +43,11 @@ func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
 		// https://github.com/mattn/go-sqlite3/issues/274
 		db.SetMaxOpenConns(1)
 	}
-	serviceDB = &ServiceDB{db: db}
+	search, err := createSearchIndex(db, databaseType)
+	if err != nil {
+		return
+	}
+	serviceDB = &ServiceDB{db: db, search: search}
 	return
 }
 
@@ -273,6 +278,418 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// StoreQueuedNotification stores a notification which is being held back from a room.
+func (d *ServiceDB) StoreQueuedNotification(n types.QueuedNotification) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertQueuedNotificationTxn(txn, n)
+	})
+}
+
+// LoadQueuedNotifications loads all held back notifications, oldest first.
+// Returns an empty list if there are no queued notifications.
+func (d *ServiceDB) LoadQueuedNotifications() (notifs []types.QueuedNotification, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		notifs, err = selectQueuedNotificationsTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteQueuedNotifications deletes the held back notifications for the given user and room
+// which were queued at or before the given timestamp in milliseconds.
+func (d *ServiceDB) DeleteQueuedNotifications(userID, roomID string, upToMs int64) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteQueuedNotificationsTxn(txn, userID, roomID, upToMs)
+	})
+}
+
+// StoreStatusEntry stores a status board entry, clobbering based on the tuple of
+// user ID, room ID and entry name.
+func (d *ServiceDB) StoreStatusEntry(entry types.StatusEntry) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return upsertStatusEntryTxn(txn, entry)
+	})
+}
+
+// LoadStatusEntries loads all status board entries for the given user in the given room,
+// ordered by name. Returns an empty list if there are no entries.
+func (d *ServiceDB) LoadStatusEntries(userID, roomID string) (entries []types.StatusEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectStatusEntriesTxn(txn, userID, roomID)
+		return err
+	})
+	return
+}
+
+// DeleteStatusEntry removes a status board entry. No error is returned if the entry did
+// not exist in the first place.
+func (d *ServiceDB) DeleteStatusEntry(userID, roomID, name string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteStatusEntryTxn(txn, userID, roomID, name)
+	})
+}
+
+// LoadStatusBoard loads the status board for the given user in the given room.
+// Returns sql.ErrNoRows if the board isn't in the database.
+func (d *ServiceDB) LoadStatusBoard(userID, roomID string) (board types.StatusBoard, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		board, err = selectStatusBoardTxn(txn, userID, roomID)
+		return err
+	})
+	return
+}
+
+// LoadStatusBoards loads every status board.
+func (d *ServiceDB) LoadStatusBoards() (boards []types.StatusBoard, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		boards, err = selectStatusBoardsTxn(txn)
+		return err
+	})
+	return
+}
+
+// StoreStatusBoard stores a status board, clobbering based on the tuple of user ID and room ID.
+func (d *ServiceDB) StoreStatusBoard(board types.StatusBoard) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		_, err := selectStatusBoardTxn(txn, board.UserID, board.RoomID)
+		if err == sql.ErrNoRows {
+			return insertStatusBoardTxn(txn, board)
+		} else if err != nil {
+			return err
+		}
+		return updateStatusBoardTxn(txn, board)
+	})
+}
+
+// IncrementRoomStats adds the counts in stats to the stored counts for the service, room and
+// day. The stored active member count is replaced if stats has a higher count.
+func (d *ServiceDB) IncrementRoomStats(stats types.RoomStats) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return incrementRoomStatsTxn(txn, stats)
+	})
+}
+
+// IncrementThreadStats adds the number of replies in stats to the stored count for the service,
+// room, day and thread.
+func (d *ServiceDB) IncrementThreadStats(stats types.ThreadStats) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return incrementThreadStatsTxn(txn, stats)
+	})
+}
+
+// LoadRoomStats loads the daily stats for the given room between the given days inclusive,
+// ordered by day. Days are of the form YYYY-MM-DD. Days with no activity are not returned.
+func (d *ServiceDB) LoadRoomStats(serviceID, roomID, fromDay, toDay string) (stats []types.RoomStats, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		stats, err = selectRoomStatsTxn(txn, serviceID, roomID, fromDay, toDay)
+		return err
+	})
+	return
+}
+
+// LoadTopThreads loads the threads with the most replies in the given room between the given
+// days inclusive. The Day of each returned ThreadStats is empty.
+func (d *ServiceDB) LoadTopThreads(serviceID, roomID, fromDay, toDay string, limit int) (threads []types.ThreadStats, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		threads, err = selectTopThreadsTxn(txn, serviceID, roomID, fromDay, toDay, limit)
+		return err
+	})
+	return
+}
+
+// DeleteRoomStats deletes all room and thread stats for the given service before the given day.
+func (d *ServiceDB) DeleteRoomStats(serviceID, beforeDay string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteRoomStatsTxn(txn, serviceID, beforeDay)
+	})
+}
+
+// InsertTicket inserts a new helpdesk ticket, setting its TicketID to the next ticket number for
+// the service.
+func (d *ServiceDB) InsertTicket(ticket *types.Ticket) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertTicketTxn(txn, ticket)
+	})
+}
+
+// UpdateTicket updates the thread, status, assignee and timestamps of an existing helpdesk ticket.
+func (d *ServiceDB) UpdateTicket(ticket types.Ticket) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateTicketTxn(txn, ticket)
+	})
+}
+
+// LoadTicket loads a helpdesk ticket by number. Returns sql.ErrNoRows if the ticket doesn't exist.
+func (d *ServiceDB) LoadTicket(serviceID string, ticketID int64) (ticket types.Ticket, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		ticket, err = selectTicketTxn(txn, serviceID, ticketID)
+		return err
+	})
+	return
+}
+
+// LoadTicketByThread loads the helpdesk ticket for the thread with the given root event ID.
+// Returns sql.ErrNoRows if there is no ticket for the thread.
+func (d *ServiceDB) LoadTicketByThread(serviceID, threadEventID string) (ticket types.Ticket, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		ticket, err = selectTicketByThreadTxn(txn, serviceID, threadEventID)
+		return err
+	})
+	return
+}
+
+// LoadLatestTicketForRoom loads the most recent helpdesk ticket opened from the given DM room.
+// Returns sql.ErrNoRows if no ticket has been opened from the room.
+func (d *ServiceDB) LoadLatestTicketForRoom(serviceID, dmRoomID string) (ticket types.Ticket, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		ticket, err = selectLatestTicketForRoomTxn(txn, serviceID, dmRoomID)
+		return err
+	})
+	return
+}
+
+// LoadUnresolvedTickets loads every helpdesk ticket for the service which hasn't been resolved.
+func (d *ServiceDB) LoadUnresolvedTickets(serviceID string) (tickets []types.Ticket, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		tickets, err = selectUnresolvedTicketsTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// StoreEmailDigestEntry stores a notification to be emailed to a recipient as part of a digest.
+func (d *ServiceDB) StoreEmailDigestEntry(entry types.EmailDigestEntry) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertEmailDigestEntryTxn(txn, entry)
+	})
+}
+
+// LoadEmailDigestEntries loads all notifications waiting to be emailed in digests, oldest first.
+// Returns an empty list if there are none.
+func (d *ServiceDB) LoadEmailDigestEntries() (entries []types.EmailDigestEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectEmailDigestEntriesTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteEmailDigestEntries deletes the digest entries for the given address, bot user and room
+// which were stored at or before the given timestamp in milliseconds.
+func (d *ServiceDB) DeleteEmailDigestEntries(address, userID, roomID string, upToMs int64) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteEmailDigestEntriesTxn(txn, address, userID, roomID, upToMs)
+	})
+}
+
+// StoreEmailUnsubscribe records that an address no longer wants emails of the notifications
+// which the given bot user sends into the given room.
+func (d *ServiceDB) StoreEmailUnsubscribe(address, userID, roomID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertEmailUnsubscribeTxn(txn, address, userID, roomID, time.Now().UnixNano()/1000000)
+	})
+}
+
+// IsEmailUnsubscribed returns true if the address has unsubscribed from the notifications which
+// the given bot user sends into the given room.
+func (d *ServiceDB) IsEmailUnsubscribed(address, userID, roomID string) (unsubscribed bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		unsubscribed, err = selectEmailUnsubscribedTxn(txn, address, userID, roomID)
+		return err
+	})
+	return
+}
+
+// DeleteEmailUnsubscribe undoes an unsubscribe, so that the address is emailed the notifications
+// which the given bot user sends into the given room again.
+func (d *ServiceDB) DeleteEmailUnsubscribe(address, userID, roomID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteEmailUnsubscribeTxn(txn, address, userID, roomID)
+	})
+}
+
+// InsertApprovalRequest inserts a new approval request, setting its RequestID to the next request
+// number for the service.
+func (d *ServiceDB) InsertApprovalRequest(req *types.ApprovalRequest) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertApprovalRequestTxn(txn, req)
+	})
+}
+
+// UpdateApprovalRequest updates the event ID, status, callback status and decision time of an
+// existing approval request.
+func (d *ServiceDB) UpdateApprovalRequest(req types.ApprovalRequest) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateApprovalRequestTxn(txn, req)
+	})
+}
+
+// LoadApprovalRequest loads an approval request by number. Returns sql.ErrNoRows if the request
+// doesn't exist.
+func (d *ServiceDB) LoadApprovalRequest(serviceID string, requestID int64) (req types.ApprovalRequest, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		req, err = selectApprovalRequestTxn(txn, serviceID, requestID)
+		return err
+	})
+	return
+}
+
+// LoadApprovalRequestByEvent loads the approval request which was posted as the given event.
+// Returns sql.ErrNoRows if the event isn't an approval request.
+func (d *ServiceDB) LoadApprovalRequestByEvent(serviceID, eventID string) (req types.ApprovalRequest, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		req, err = selectApprovalRequestByEventTxn(txn, serviceID, eventID)
+		return err
+	})
+	return
+}
+
+// LoadOutstandingApprovalRequests loads every approval request for the service which is still
+// pending or whose callback hasn't been delivered yet.
+func (d *ServiceDB) LoadOutstandingApprovalRequests(serviceID string) (reqs []types.ApprovalRequest, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		reqs, err = selectOutstandingApprovalRequestsTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// InsertApprovalAudit adds an entry to the audit trail of an approval request.
+func (d *ServiceDB) InsertApprovalAudit(entry types.ApprovalAuditEntry) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertApprovalAuditTxn(txn, entry)
+	})
+}
+
+// LoadApprovalAudit loads the audit trail of an approval request, oldest first.
+func (d *ServiceDB) LoadApprovalAudit(serviceID string, requestID int64) (entries []types.ApprovalAuditEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectApprovalAuditTxn(txn, serviceID, requestID)
+		return err
+	})
+	return
+}
+
+// InsertMonitoringProblem inserts a new monitoring problem, setting its ProblemID to the next
+// problem number for the service.
+func (d *ServiceDB) InsertMonitoringProblem(problem *types.MonitoringProblem) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertProblemTxn(txn, problem)
+	})
+}
+
+// UpdateMonitoringProblem updates the severity, summary, status and acknowledgement of an existing
+// monitoring problem.
+func (d *ServiceDB) UpdateMonitoringProblem(problem types.MonitoringProblem) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateProblemTxn(txn, problem)
+	})
+}
+
+// LoadMonitoringProblem loads a monitoring problem by number. Returns sql.ErrNoRows if the problem
+// doesn't exist.
+func (d *ServiceDB) LoadMonitoringProblem(serviceID string, problemID int64) (problem types.MonitoringProblem, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		problem, err = selectProblemTxn(txn, serviceID, problemID)
+		return err
+	})
+	return
+}
+
+// LoadOpenMonitoringProblem loads the latest monitoring problem with the given key which hasn't
+// recovered. Returns sql.ErrNoRows if there is no such problem.
+func (d *ServiceDB) LoadOpenMonitoringProblem(serviceID, key string) (problem types.MonitoringProblem, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		problem, err = selectOpenProblemByKeyTxn(txn, serviceID, key)
+		return err
+	})
+	return
+}
+
+// StoreMonitoringMessage stores the event ID of the message about a monitoring problem in a room.
+func (d *ServiceDB) StoreMonitoringMessage(serviceID string, problemID int64, roomID, eventID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertProblemMessageTxn(txn, serviceID, problemID, roomID, eventID)
+	})
+}
+
+// LoadMonitoringMessages loads the messages about a monitoring problem, as a map of room ID to
+// event ID.
+func (d *ServiceDB) LoadMonitoringMessages(serviceID string, problemID int64) (messages map[string]string, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		messages, err = selectProblemMessagesTxn(txn, serviceID, problemID)
+		return err
+	})
+	return
+}
+
+// StoreStatusPageIncident links a status page incident to a room, or updates the link if it exists.
+func (d *ServiceDB) StoreStatusPageIncident(incident types.StatusPageIncident) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return upsertStatusPageIncidentTxn(txn, incident)
+	})
+}
+
+// LoadStatusPageIncidents loads the links from a status page incident to rooms. Returns an empty
+// list if the incident isn't linked to any rooms.
+func (d *ServiceDB) LoadStatusPageIncidents(serviceID, incidentID string) (incidents []types.StatusPageIncident, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		incidents, err = selectStatusPageIncidentRoomsTxn(txn, serviceID, incidentID)
+		return err
+	})
+	return
+}
+
+// LoadOpenStatusPageIncidents loads the unresolved status page incidents linked to a room, most
+// recently updated first.
+func (d *ServiceDB) LoadOpenStatusPageIncidents(serviceID, roomID string) (incidents []types.StatusPageIncident, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		incidents, err = selectOpenStatusPageIncidentsTxn(txn, serviceID, roomID)
+		return err
+	})
+	return
+}
+
+// StoreSearchMessage adds a message to the search index, replacing it if it is already there.
+func (d *ServiceDB) StoreSearchMessage(message types.SearchMessage) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertSearchMessageTxn(txn, d.search, message)
+	})
+}
+
+// UpdateSearchMessage replaces the body of an indexed message when its sender edits it. Does nothing
+// if the message isn't indexed or was sent by someone else.
+func (d *ServiceDB) UpdateSearchMessage(serviceID, eventID, sender, body string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateSearchMessageTxn(txn, d.search, serviceID, eventID, sender, body)
+	})
+}
+
+// DeleteSearchMessage removes a message from the search index, e.g. when it is redacted. If sender
+// isn't empty, the message is only removed if they sent it.
+func (d *ServiceDB) DeleteSearchMessage(serviceID, eventID, sender string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteSearchMessageTxn(txn, serviceID, eventID, sender)
+	})
+}
+
+// DeleteSearchMessages removes the messages sent before beforeMs in a room from the search index.
+// If roomID is empty then messages in all rooms are removed.
+func (d *ServiceDB) DeleteSearchMessages(serviceID, roomID string, beforeMs int64) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteSearchMessagesTxn(txn, serviceID, roomID, beforeMs)
+	})
+}
+
+// SearchMessages returns the indexed messages which match a query, newest first.
+func (d *ServiceDB) SearchMessages(query types.SearchQuery) (messages []types.SearchMessage, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		messages, err = selectSearchMessagesTxn(txn, d.search, query)
+		return err
+	})
+	return
+}
+
 // InsertFromConfig inserts entries from the config file into the database. This only really
 // makes sense for in-memory databases.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
@@ -321,7 +738,22 @@ func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 		}
 	}
 
-	// Do not insert services yet, they require more work to set up.
+	// Insert bot options
+	for _, o := range cfg.BotOptions {
+		if err := o.Check(); err != nil {
+			return err
+		}
+		opts := types.BotOptions{
+			UserID:  o.UserID,
+			RoomID:  o.RoomID,
+			Options: o.Options,
+		}
+		if _, err := d.StoreBotOptions(opts); err != nil {
+			return err
+		}
+	}
+
+	// Do not insert services or join rooms yet, they require more work to set up.
 	return nil
 }
 
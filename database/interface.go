@@ -32,6 +32,63 @@ type Storer interface {
 	LoadBotOptions(userID, roomID string) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
 
+	StoreQueuedNotification(n types.QueuedNotification) error
+	LoadQueuedNotifications() (notifs []types.QueuedNotification, err error)
+	DeleteQueuedNotifications(userID, roomID string, upToMs int64) error
+
+	StoreStatusEntry(entry types.StatusEntry) error
+	LoadStatusEntries(userID, roomID string) (entries []types.StatusEntry, err error)
+	DeleteStatusEntry(userID, roomID, name string) error
+	LoadStatusBoard(userID, roomID string) (board types.StatusBoard, err error)
+	LoadStatusBoards() (boards []types.StatusBoard, err error)
+	StoreStatusBoard(board types.StatusBoard) error
+
+	IncrementRoomStats(stats types.RoomStats) error
+	IncrementThreadStats(stats types.ThreadStats) error
+	LoadRoomStats(serviceID, roomID, fromDay, toDay string) (stats []types.RoomStats, err error)
+	LoadTopThreads(serviceID, roomID, fromDay, toDay string, limit int) (threads []types.ThreadStats, err error)
+	DeleteRoomStats(serviceID, beforeDay string) error
+
+	InsertTicket(ticket *types.Ticket) error
+	UpdateTicket(ticket types.Ticket) error
+	LoadTicket(serviceID string, ticketID int64) (ticket types.Ticket, err error)
+	LoadTicketByThread(serviceID, threadEventID string) (ticket types.Ticket, err error)
+	LoadLatestTicketForRoom(serviceID, dmRoomID string) (ticket types.Ticket, err error)
+	LoadUnresolvedTickets(serviceID string) (tickets []types.Ticket, err error)
+
+	StoreEmailDigestEntry(entry types.EmailDigestEntry) error
+	LoadEmailDigestEntries() (entries []types.EmailDigestEntry, err error)
+	DeleteEmailDigestEntries(address, userID, roomID string, upToMs int64) error
+
+	StoreEmailUnsubscribe(address, userID, roomID string) error
+	IsEmailUnsubscribed(address, userID, roomID string) (unsubscribed bool, err error)
+	DeleteEmailUnsubscribe(address, userID, roomID string) error
+
+	InsertApprovalRequest(req *types.ApprovalRequest) error
+	UpdateApprovalRequest(req types.ApprovalRequest) error
+	LoadApprovalRequest(serviceID string, requestID int64) (req types.ApprovalRequest, err error)
+	LoadApprovalRequestByEvent(serviceID, eventID string) (req types.ApprovalRequest, err error)
+	LoadOutstandingApprovalRequests(serviceID string) (reqs []types.ApprovalRequest, err error)
+	InsertApprovalAudit(entry types.ApprovalAuditEntry) error
+	LoadApprovalAudit(serviceID string, requestID int64) (entries []types.ApprovalAuditEntry, err error)
+
+	InsertMonitoringProblem(problem *types.MonitoringProblem) error
+	UpdateMonitoringProblem(problem types.MonitoringProblem) error
+	LoadMonitoringProblem(serviceID string, problemID int64) (problem types.MonitoringProblem, err error)
+	LoadOpenMonitoringProblem(serviceID, key string) (problem types.MonitoringProblem, err error)
+	StoreMonitoringMessage(serviceID string, problemID int64, roomID, eventID string) error
+	LoadMonitoringMessages(serviceID string, problemID int64) (messages map[string]string, err error)
+
+	StoreStatusPageIncident(incident types.StatusPageIncident) error
+	LoadStatusPageIncidents(serviceID, incidentID string) (incidents []types.StatusPageIncident, err error)
+	LoadOpenStatusPageIncidents(serviceID, roomID string) (incidents []types.StatusPageIncident, err error)
+
+	StoreSearchMessage(message types.SearchMessage) error
+	UpdateSearchMessage(serviceID, eventID, sender, body string) error
+	DeleteSearchMessage(serviceID, eventID, sender string) error
+	DeleteSearchMessages(serviceID, roomID string, beforeMs int64) error
+	SearchMessages(query types.SearchQuery) (messages []types.SearchMessage, err error)
+
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
@@ -134,6 +191,241 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// StoreQueuedNotification NOP
+func (s *NopStorage) StoreQueuedNotification(n types.QueuedNotification) error {
+	return nil
+}
+
+// LoadQueuedNotifications NOP
+func (s *NopStorage) LoadQueuedNotifications() (notifs []types.QueuedNotification, err error) {
+	return
+}
+
+// DeleteQueuedNotifications NOP
+func (s *NopStorage) DeleteQueuedNotifications(userID, roomID string, upToMs int64) error {
+	return nil
+}
+
+// StoreStatusEntry NOP
+func (s *NopStorage) StoreStatusEntry(entry types.StatusEntry) error {
+	return nil
+}
+
+// LoadStatusEntries NOP
+func (s *NopStorage) LoadStatusEntries(userID, roomID string) (entries []types.StatusEntry, err error) {
+	return
+}
+
+// DeleteStatusEntry NOP
+func (s *NopStorage) DeleteStatusEntry(userID, roomID, name string) error {
+	return nil
+}
+
+// LoadStatusBoard NOP
+func (s *NopStorage) LoadStatusBoard(userID, roomID string) (board types.StatusBoard, err error) {
+	return
+}
+
+// LoadStatusBoards NOP
+func (s *NopStorage) LoadStatusBoards() (boards []types.StatusBoard, err error) {
+	return
+}
+
+// StoreStatusBoard NOP
+func (s *NopStorage) StoreStatusBoard(board types.StatusBoard) error {
+	return nil
+}
+
+// IncrementRoomStats NOP
+func (s *NopStorage) IncrementRoomStats(stats types.RoomStats) error {
+	return nil
+}
+
+// IncrementThreadStats NOP
+func (s *NopStorage) IncrementThreadStats(stats types.ThreadStats) error {
+	return nil
+}
+
+// LoadRoomStats NOP
+func (s *NopStorage) LoadRoomStats(serviceID, roomID, fromDay, toDay string) (stats []types.RoomStats, err error) {
+	return
+}
+
+// LoadTopThreads NOP
+func (s *NopStorage) LoadTopThreads(serviceID, roomID, fromDay, toDay string, limit int) (threads []types.ThreadStats, err error) {
+	return
+}
+
+// DeleteRoomStats NOP
+func (s *NopStorage) DeleteRoomStats(serviceID, beforeDay string) error {
+	return nil
+}
+
+// InsertTicket NOP
+func (s *NopStorage) InsertTicket(ticket *types.Ticket) error {
+	return nil
+}
+
+// UpdateTicket NOP
+func (s *NopStorage) UpdateTicket(ticket types.Ticket) error {
+	return nil
+}
+
+// LoadTicket NOP
+func (s *NopStorage) LoadTicket(serviceID string, ticketID int64) (ticket types.Ticket, err error) {
+	return
+}
+
+// LoadTicketByThread NOP
+func (s *NopStorage) LoadTicketByThread(serviceID, threadEventID string) (ticket types.Ticket, err error) {
+	return
+}
+
+// LoadLatestTicketForRoom NOP
+func (s *NopStorage) LoadLatestTicketForRoom(serviceID, dmRoomID string) (ticket types.Ticket, err error) {
+	return
+}
+
+// LoadUnresolvedTickets NOP
+func (s *NopStorage) LoadUnresolvedTickets(serviceID string) (tickets []types.Ticket, err error) {
+	return
+}
+
+// StoreEmailDigestEntry NOP
+func (s *NopStorage) StoreEmailDigestEntry(entry types.EmailDigestEntry) error {
+	return nil
+}
+
+// LoadEmailDigestEntries NOP
+func (s *NopStorage) LoadEmailDigestEntries() (entries []types.EmailDigestEntry, err error) {
+	return
+}
+
+// DeleteEmailDigestEntries NOP
+func (s *NopStorage) DeleteEmailDigestEntries(address, userID, roomID string, upToMs int64) error {
+	return nil
+}
+
+// StoreEmailUnsubscribe NOP
+func (s *NopStorage) StoreEmailUnsubscribe(address, userID, roomID string) error {
+	return nil
+}
+
+// IsEmailUnsubscribed NOP
+func (s *NopStorage) IsEmailUnsubscribed(address, userID, roomID string) (unsubscribed bool, err error) {
+	return
+}
+
+// DeleteEmailUnsubscribe NOP
+func (s *NopStorage) DeleteEmailUnsubscribe(address, userID, roomID string) error {
+	return nil
+}
+
+// InsertApprovalRequest NOP
+func (s *NopStorage) InsertApprovalRequest(req *types.ApprovalRequest) error {
+	return nil
+}
+
+// UpdateApprovalRequest NOP
+func (s *NopStorage) UpdateApprovalRequest(req types.ApprovalRequest) error {
+	return nil
+}
+
+// LoadApprovalRequest NOP
+func (s *NopStorage) LoadApprovalRequest(serviceID string, requestID int64) (req types.ApprovalRequest, err error) {
+	return
+}
+
+// LoadApprovalRequestByEvent NOP
+func (s *NopStorage) LoadApprovalRequestByEvent(serviceID, eventID string) (req types.ApprovalRequest, err error) {
+	return
+}
+
+// LoadOutstandingApprovalRequests NOP
+func (s *NopStorage) LoadOutstandingApprovalRequests(serviceID string) (reqs []types.ApprovalRequest, err error) {
+	return
+}
+
+// InsertApprovalAudit NOP
+func (s *NopStorage) InsertApprovalAudit(entry types.ApprovalAuditEntry) error {
+	return nil
+}
+
+// LoadApprovalAudit NOP
+func (s *NopStorage) LoadApprovalAudit(serviceID string, requestID int64) (entries []types.ApprovalAuditEntry, err error) {
+	return
+}
+
+// InsertMonitoringProblem NOP
+func (s *NopStorage) InsertMonitoringProblem(problem *types.MonitoringProblem) error {
+	return nil
+}
+
+// UpdateMonitoringProblem NOP
+func (s *NopStorage) UpdateMonitoringProblem(problem types.MonitoringProblem) error {
+	return nil
+}
+
+// LoadMonitoringProblem NOP
+func (s *NopStorage) LoadMonitoringProblem(serviceID string, problemID int64) (problem types.MonitoringProblem, err error) {
+	return
+}
+
+// LoadOpenMonitoringProblem NOP
+func (s *NopStorage) LoadOpenMonitoringProblem(serviceID, key string) (problem types.MonitoringProblem, err error) {
+	return
+}
+
+// StoreMonitoringMessage NOP
+func (s *NopStorage) StoreMonitoringMessage(serviceID string, problemID int64, roomID, eventID string) error {
+	return nil
+}
+
+// LoadMonitoringMessages NOP
+func (s *NopStorage) LoadMonitoringMessages(serviceID string, problemID int64) (messages map[string]string, err error) {
+	return
+}
+
+// StoreStatusPageIncident NOP
+func (s *NopStorage) StoreStatusPageIncident(incident types.StatusPageIncident) error {
+	return nil
+}
+
+// LoadStatusPageIncidents NOP
+func (s *NopStorage) LoadStatusPageIncidents(serviceID, incidentID string) (incidents []types.StatusPageIncident, err error) {
+	return
+}
+
+// LoadOpenStatusPageIncidents NOP
+func (s *NopStorage) LoadOpenStatusPageIncidents(serviceID, roomID string) (incidents []types.StatusPageIncident, err error) {
+	return
+}
+
+// StoreSearchMessage NOP
+func (s *NopStorage) StoreSearchMessage(message types.SearchMessage) error {
+	return nil
+}
+
+// UpdateSearchMessage NOP
+func (s *NopStorage) UpdateSearchMessage(serviceID, eventID, sender, body string) error {
+	return nil
+}
+
+// DeleteSearchMessage NOP
+func (s *NopStorage) DeleteSearchMessage(serviceID, eventID, sender string) error {
+	return nil
+}
+
+// DeleteSearchMessages NOP
+func (s *NopStorage) DeleteSearchMessages(serviceID, roomID string, beforeMs int64) error {
+	return nil
+}
+
+// SearchMessages NOP
+func (s *NopStorage) SearchMessages(query types.SearchQuery) (messages []types.SearchMessage, err error) {
+	return
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/go-neb/api"
@@ -60,6 +62,152 @@ CREATE TABLE IF NOT EXISTS bot_options (
 	time_updated_ms BIGINT NOT NULL,
 	UNIQUE(user_id, room_id)
 );
+
+CREATE TABLE IF NOT EXISTS queued_notifications (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	content_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queued_notifications_room_idx ON queued_notifications(user_id, room_id);
+
+CREATE TABLE IF NOT EXISTS status_entries (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	text TEXT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, room_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS status_boards (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	text TEXT NOT NULL,
+	UNIQUE(user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS room_stats (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	day TEXT NOT NULL,
+	messages BIGINT NOT NULL,
+	joins BIGINT NOT NULL,
+	leaves BIGINT NOT NULL,
+	active_members BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS room_thread_stats (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	day TEXT NOT NULL,
+	thread_id TEXT NOT NULL,
+	replies BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, day, thread_id)
+);
+
+CREATE TABLE IF NOT EXISTS helpdesk_tickets (
+	service_id TEXT NOT NULL,
+	ticket_id BIGINT NOT NULL,
+	user_id TEXT NOT NULL,
+	dm_room_id TEXT NOT NULL,
+	thread_event_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	assignee TEXT NOT NULL,
+	opened_ts BIGINT NOT NULL,
+	last_user_ts BIGINT NOT NULL,
+	last_staff_ts BIGINT NOT NULL,
+	reminded_ts BIGINT NOT NULL,
+	UNIQUE(service_id, ticket_id)
+);
+
+CREATE TABLE IF NOT EXISTS email_digest_entries (
+	address TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	content_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS email_digest_entries_idx ON email_digest_entries(address, user_id, room_id);
+
+CREATE TABLE IF NOT EXISTS email_unsubscribes (
+	address TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(address, user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS approval_requests (
+	service_id TEXT NOT NULL,
+	request_id BIGINT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	title TEXT NOT NULL,
+	description TEXT NOT NULL,
+	url TEXT NOT NULL,
+	required_approvals INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	callback_url TEXT NOT NULL,
+	callback_status TEXT NOT NULL,
+	callback_attempts INTEGER NOT NULL,
+	created_ts BIGINT NOT NULL,
+	expires_ts BIGINT NOT NULL,
+	decided_ts BIGINT NOT NULL,
+	UNIQUE(service_id, request_id)
+);
+
+CREATE TABLE IF NOT EXISTS approval_audit (
+	service_id TEXT NOT NULL,
+	request_id BIGINT NOT NULL,
+	user_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS approval_audit_request_idx ON approval_audit(service_id, request_id);
+
+CREATE TABLE IF NOT EXISTS monitoring_problems (
+	service_id TEXT NOT NULL,
+	problem_id BIGINT NOT NULL,
+	problem_key TEXT NOT NULL,
+	source TEXT NOT NULL,
+	host TEXT NOT NULL,
+	service TEXT NOT NULL,
+	severity TEXT NOT NULL,
+	state TEXT NOT NULL,
+	summary TEXT NOT NULL,
+	url TEXT NOT NULL,
+	external_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	acked_by TEXT NOT NULL,
+	ack_comment TEXT NOT NULL,
+	opened_ts BIGINT NOT NULL,
+	updated_ts BIGINT NOT NULL,
+	UNIQUE(service_id, problem_id)
+);
+CREATE INDEX IF NOT EXISTS monitoring_problems_key_idx ON monitoring_problems(service_id, problem_key);
+
+CREATE TABLE IF NOT EXISTS monitoring_messages (
+	service_id TEXT NOT NULL,
+	problem_id BIGINT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	UNIQUE(service_id, problem_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS statuspage_incidents (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	incident_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	status TEXT NOT NULL,
+	url TEXT NOT NULL,
+	updated_ts BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, incident_id)
+);
 `
 
 const selectMatrixClientConfigSQL = `
@@ -494,3 +642,875 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const insertQueuedNotificationSQL = `
+INSERT INTO queued_notifications(
+	user_id, room_id, content_json, time_added_ms
+) VALUES ($1, $2, $3, $4)
+`
+
+func insertQueuedNotificationTxn(txn *sql.Tx, n types.QueuedNotification) error {
+	_, err := txn.Exec(insertQueuedNotificationSQL, n.UserID, n.RoomID, []byte(n.Content), n.Timestamp)
+	return err
+}
+
+const selectQueuedNotificationsSQL = `
+SELECT user_id, room_id, content_json, time_added_ms FROM queued_notifications
+	ORDER BY time_added_ms
+`
+
+func selectQueuedNotificationsTxn(txn *sql.Tx) (notifs []types.QueuedNotification, err error) {
+	rows, err := txn.Query(selectQueuedNotificationsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n types.QueuedNotification
+		var contentJSON []byte
+		if err = rows.Scan(&n.UserID, &n.RoomID, &contentJSON, &n.Timestamp); err != nil {
+			return
+		}
+		n.Content = contentJSON
+		notifs = append(notifs, n)
+	}
+	return
+}
+
+const deleteQueuedNotificationsSQL = `
+DELETE FROM queued_notifications WHERE user_id = $1 AND room_id = $2 AND time_added_ms <= $3
+`
+
+func deleteQueuedNotificationsTxn(txn *sql.Tx, userID, roomID string, upToMs int64) error {
+	_, err := txn.Exec(deleteQueuedNotificationsSQL, userID, roomID, upToMs)
+	return err
+}
+
+const selectStatusEntrySQL = `
+SELECT text FROM status_entries WHERE user_id = $1 AND room_id = $2 AND name = $3
+`
+
+const insertStatusEntrySQL = `
+INSERT INTO status_entries(
+	user_id, room_id, name, text, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+const updateStatusEntrySQL = `
+UPDATE status_entries SET text = $1, time_updated_ms = $2
+	WHERE user_id = $3 AND room_id = $4 AND name = $5
+`
+
+func upsertStatusEntryTxn(txn *sql.Tx, e types.StatusEntry) error {
+	var text string
+	err := txn.QueryRow(selectStatusEntrySQL, e.UserID, e.RoomID, e.Name).Scan(&text)
+	if err == sql.ErrNoRows {
+		_, err = txn.Exec(insertStatusEntrySQL, e.UserID, e.RoomID, e.Name, e.Text, e.Timestamp)
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, err = txn.Exec(updateStatusEntrySQL, e.Text, e.Timestamp, e.UserID, e.RoomID, e.Name)
+	return err
+}
+
+const selectStatusEntriesSQL = `
+SELECT name, text, time_updated_ms FROM status_entries WHERE user_id = $1 AND room_id = $2 ORDER BY name
+`
+
+func selectStatusEntriesTxn(txn *sql.Tx, userID, roomID string) (entries []types.StatusEntry, err error) {
+	rows, err := txn.Query(selectStatusEntriesSQL, userID, roomID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := types.StatusEntry{UserID: userID, RoomID: roomID}
+		if err = rows.Scan(&e.Name, &e.Text, &e.Timestamp); err != nil {
+			return
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+const deleteStatusEntrySQL = `
+DELETE FROM status_entries WHERE user_id = $1 AND room_id = $2 AND name = $3
+`
+
+func deleteStatusEntryTxn(txn *sql.Tx, userID, roomID, name string) error {
+	_, err := txn.Exec(deleteStatusEntrySQL, userID, roomID, name)
+	return err
+}
+
+const selectStatusBoardSQL = `
+SELECT event_id, text FROM status_boards WHERE user_id = $1 AND room_id = $2
+`
+
+func selectStatusBoardTxn(txn *sql.Tx, userID, roomID string) (board types.StatusBoard, err error) {
+	board.UserID = userID
+	board.RoomID = roomID
+	err = txn.QueryRow(selectStatusBoardSQL, userID, roomID).Scan(&board.EventID, &board.Text)
+	return
+}
+
+const selectStatusBoardsSQL = `
+SELECT user_id, room_id, event_id, text FROM status_boards
+`
+
+func selectStatusBoardsTxn(txn *sql.Tx) (boards []types.StatusBoard, err error) {
+	rows, err := txn.Query(selectStatusBoardsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b types.StatusBoard
+		if err = rows.Scan(&b.UserID, &b.RoomID, &b.EventID, &b.Text); err != nil {
+			return
+		}
+		boards = append(boards, b)
+	}
+	return
+}
+
+const insertStatusBoardSQL = `
+INSERT INTO status_boards(user_id, room_id, event_id, text) VALUES ($1, $2, $3, $4)
+`
+
+func insertStatusBoardTxn(txn *sql.Tx, board types.StatusBoard) error {
+	_, err := txn.Exec(insertStatusBoardSQL, board.UserID, board.RoomID, board.EventID, board.Text)
+	return err
+}
+
+const updateStatusBoardSQL = `
+UPDATE status_boards SET event_id = $1, text = $2 WHERE user_id = $3 AND room_id = $4
+`
+
+func updateStatusBoardTxn(txn *sql.Tx, board types.StatusBoard) error {
+	_, err := txn.Exec(updateStatusBoardSQL, board.EventID, board.Text, board.UserID, board.RoomID)
+	return err
+}
+
+const selectRoomStatsDaySQL = `
+SELECT messages FROM room_stats WHERE service_id = $1 AND room_id = $2 AND day = $3
+`
+
+const insertRoomStatsSQL = `
+INSERT INTO room_stats(
+	service_id, room_id, day, messages, joins, leaves, active_members
+) VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+// Active members can't be summed as the same member may be counted twice, so keep the highest count.
+const updateRoomStatsSQL = `
+UPDATE room_stats SET messages = messages + $1, joins = joins + $2, leaves = leaves + $3,
+	active_members = CASE WHEN active_members > $4 THEN active_members ELSE $4 END
+	WHERE service_id = $5 AND room_id = $6 AND day = $7
+`
+
+func incrementRoomStatsTxn(txn *sql.Tx, st types.RoomStats) error {
+	var messages int64
+	err := txn.QueryRow(selectRoomStatsDaySQL, st.ServiceID, st.RoomID, st.Day).Scan(&messages)
+	if err == sql.ErrNoRows {
+		_, err = txn.Exec(
+			insertRoomStatsSQL, st.ServiceID, st.RoomID, st.Day, st.Messages, st.Joins, st.Leaves, st.ActiveMembers,
+		)
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		updateRoomStatsSQL, st.Messages, st.Joins, st.Leaves, st.ActiveMembers, st.ServiceID, st.RoomID, st.Day,
+	)
+	return err
+}
+
+const selectRoomStatsSQL = `
+SELECT day, messages, joins, leaves, active_members FROM room_stats
+	WHERE service_id = $1 AND room_id = $2 AND day >= $3 AND day <= $4 ORDER BY day
+`
+
+func selectRoomStatsTxn(txn *sql.Tx, serviceID, roomID, fromDay, toDay string) (stats []types.RoomStats, err error) {
+	rows, err := txn.Query(selectRoomStatsSQL, serviceID, roomID, fromDay, toDay)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		st := types.RoomStats{ServiceID: serviceID, RoomID: roomID}
+		if err = rows.Scan(&st.Day, &st.Messages, &st.Joins, &st.Leaves, &st.ActiveMembers); err != nil {
+			return
+		}
+		stats = append(stats, st)
+	}
+	return
+}
+
+const selectThreadStatsDaySQL = `
+SELECT replies FROM room_thread_stats WHERE service_id = $1 AND room_id = $2 AND day = $3 AND thread_id = $4
+`
+
+const insertThreadStatsSQL = `
+INSERT INTO room_thread_stats(service_id, room_id, day, thread_id, replies) VALUES ($1, $2, $3, $4, $5)
+`
+
+const updateThreadStatsSQL = `
+UPDATE room_thread_stats SET replies = replies + $1
+	WHERE service_id = $2 AND room_id = $3 AND day = $4 AND thread_id = $5
+`
+
+func incrementThreadStatsTxn(txn *sql.Tx, st types.ThreadStats) error {
+	var replies int64
+	err := txn.QueryRow(selectThreadStatsDaySQL, st.ServiceID, st.RoomID, st.Day, st.ThreadID).Scan(&replies)
+	if err == sql.ErrNoRows {
+		_, err = txn.Exec(insertThreadStatsSQL, st.ServiceID, st.RoomID, st.Day, st.ThreadID, st.Replies)
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, err = txn.Exec(updateThreadStatsSQL, st.Replies, st.ServiceID, st.RoomID, st.Day, st.ThreadID)
+	return err
+}
+
+const selectTopThreadsSQL = `
+SELECT thread_id, SUM(replies) AS total FROM room_thread_stats
+	WHERE service_id = $1 AND room_id = $2 AND day >= $3 AND day <= $4
+	GROUP BY thread_id ORDER BY total DESC, thread_id LIMIT $5
+`
+
+func selectTopThreadsTxn(txn *sql.Tx, serviceID, roomID, fromDay, toDay string, limit int) (threads []types.ThreadStats, err error) {
+	rows, err := txn.Query(selectTopThreadsSQL, serviceID, roomID, fromDay, toDay, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		st := types.ThreadStats{ServiceID: serviceID, RoomID: roomID}
+		if err = rows.Scan(&st.ThreadID, &st.Replies); err != nil {
+			return
+		}
+		threads = append(threads, st)
+	}
+	return
+}
+
+const deleteRoomStatsSQL = `
+DELETE FROM room_stats WHERE service_id = $1 AND day < $2
+`
+
+const deleteThreadStatsSQL = `
+DELETE FROM room_thread_stats WHERE service_id = $1 AND day < $2
+`
+
+func deleteRoomStatsTxn(txn *sql.Tx, serviceID, beforeDay string) error {
+	if _, err := txn.Exec(deleteRoomStatsSQL, serviceID, beforeDay); err != nil {
+		return err
+	}
+	_, err := txn.Exec(deleteThreadStatsSQL, serviceID, beforeDay)
+	return err
+}
+
+const ticketColumns = `ticket_id, user_id, dm_room_id, thread_event_id, status, assignee,
+	opened_ts, last_user_ts, last_staff_ts, reminded_ts`
+
+const selectMaxTicketIDSQL = `
+SELECT COALESCE(MAX(ticket_id), 0) FROM helpdesk_tickets WHERE service_id = $1
+`
+
+const insertTicketSQL = `
+INSERT INTO helpdesk_tickets(service_id, ` + ticketColumns + `)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+`
+
+func insertTicketTxn(txn *sql.Tx, t *types.Ticket) error {
+	var maxID int64
+	if err := txn.QueryRow(selectMaxTicketIDSQL, t.ServiceID).Scan(&maxID); err != nil {
+		return err
+	}
+	t.TicketID = maxID + 1
+	_, err := txn.Exec(
+		insertTicketSQL, t.ServiceID, t.TicketID, t.UserID, t.DMRoomID, t.ThreadEventID, t.Status, t.Assignee,
+		t.OpenedTimestamp, t.LastUserTimestamp, t.LastStaffTimestamp, t.RemindedTimestamp,
+	)
+	return err
+}
+
+const updateTicketSQL = `
+UPDATE helpdesk_tickets SET thread_event_id = $1, status = $2, assignee = $3,
+	last_user_ts = $4, last_staff_ts = $5, reminded_ts = $6
+	WHERE service_id = $7 AND ticket_id = $8
+`
+
+func updateTicketTxn(txn *sql.Tx, t types.Ticket) error {
+	_, err := txn.Exec(
+		updateTicketSQL, t.ThreadEventID, t.Status, t.Assignee, t.LastUserTimestamp, t.LastStaffTimestamp,
+		t.RemindedTimestamp, t.ServiceID, t.TicketID,
+	)
+	return err
+}
+
+func scanTicket(serviceID string, row interface {
+	Scan(dest ...interface{}) error
+}) (t types.Ticket, err error) {
+	t.ServiceID = serviceID
+	err = row.Scan(
+		&t.TicketID, &t.UserID, &t.DMRoomID, &t.ThreadEventID, &t.Status, &t.Assignee,
+		&t.OpenedTimestamp, &t.LastUserTimestamp, &t.LastStaffTimestamp, &t.RemindedTimestamp,
+	)
+	return
+}
+
+const selectTicketSQL = `
+SELECT ` + ticketColumns + ` FROM helpdesk_tickets WHERE service_id = $1 AND ticket_id = $2
+`
+
+func selectTicketTxn(txn *sql.Tx, serviceID string, ticketID int64) (types.Ticket, error) {
+	return scanTicket(serviceID, txn.QueryRow(selectTicketSQL, serviceID, ticketID))
+}
+
+const selectTicketByThreadSQL = `
+SELECT ` + ticketColumns + ` FROM helpdesk_tickets WHERE service_id = $1 AND thread_event_id = $2
+`
+
+func selectTicketByThreadTxn(txn *sql.Tx, serviceID, threadEventID string) (types.Ticket, error) {
+	return scanTicket(serviceID, txn.QueryRow(selectTicketByThreadSQL, serviceID, threadEventID))
+}
+
+const selectLatestTicketForRoomSQL = `
+SELECT ` + ticketColumns + ` FROM helpdesk_tickets WHERE service_id = $1 AND dm_room_id = $2
+	ORDER BY ticket_id DESC LIMIT 1
+`
+
+func selectLatestTicketForRoomTxn(txn *sql.Tx, serviceID, dmRoomID string) (types.Ticket, error) {
+	return scanTicket(serviceID, txn.QueryRow(selectLatestTicketForRoomSQL, serviceID, dmRoomID))
+}
+
+const selectUnresolvedTicketsSQL = `
+SELECT ` + ticketColumns + ` FROM helpdesk_tickets WHERE service_id = $1 AND status != 'resolved'
+	ORDER BY ticket_id
+`
+
+func selectUnresolvedTicketsTxn(txn *sql.Tx, serviceID string) (tickets []types.Ticket, err error) {
+	rows, err := txn.Query(selectUnresolvedTicketsSQL, serviceID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t types.Ticket
+		if t, err = scanTicket(serviceID, rows); err != nil {
+			return
+		}
+		tickets = append(tickets, t)
+	}
+	return
+}
+
+const insertEmailDigestEntrySQL = `
+INSERT INTO email_digest_entries(
+	address, user_id, room_id, content_json, time_added_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertEmailDigestEntryTxn(txn *sql.Tx, e types.EmailDigestEntry) error {
+	_, err := txn.Exec(insertEmailDigestEntrySQL, e.Address, e.UserID, e.RoomID, []byte(e.Content), e.Timestamp)
+	return err
+}
+
+const selectEmailDigestEntriesSQL = `
+SELECT address, user_id, room_id, content_json, time_added_ms FROM email_digest_entries
+	ORDER BY time_added_ms
+`
+
+func selectEmailDigestEntriesTxn(txn *sql.Tx) (entries []types.EmailDigestEntry, err error) {
+	rows, err := txn.Query(selectEmailDigestEntriesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e types.EmailDigestEntry
+		var contentJSON []byte
+		if err = rows.Scan(&e.Address, &e.UserID, &e.RoomID, &contentJSON, &e.Timestamp); err != nil {
+			return
+		}
+		e.Content = contentJSON
+		entries = append(entries, e)
+	}
+	return
+}
+
+const deleteEmailDigestEntriesSQL = `
+DELETE FROM email_digest_entries WHERE address = $1 AND user_id = $2 AND room_id = $3 AND time_added_ms <= $4
+`
+
+func deleteEmailDigestEntriesTxn(txn *sql.Tx, address, userID, roomID string, upToMs int64) error {
+	_, err := txn.Exec(deleteEmailDigestEntriesSQL, address, userID, roomID, upToMs)
+	return err
+}
+
+const selectEmailUnsubscribeSQL = `
+SELECT time_added_ms FROM email_unsubscribes WHERE address = $1 AND user_id = $2 AND room_id = $3
+`
+
+const insertEmailUnsubscribeSQL = `
+INSERT INTO email_unsubscribes(address, user_id, room_id, time_added_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertEmailUnsubscribeTxn(txn *sql.Tx, address, userID, roomID string, ts int64) error {
+	var existing int64
+	err := txn.QueryRow(selectEmailUnsubscribeSQL, address, userID, roomID).Scan(&existing)
+	if err == sql.ErrNoRows {
+		_, err = txn.Exec(insertEmailUnsubscribeSQL, address, userID, roomID, ts)
+	}
+	return err
+}
+
+const deleteEmailUnsubscribeSQL = `
+DELETE FROM email_unsubscribes WHERE address = $1 AND user_id = $2 AND room_id = $3
+`
+
+func deleteEmailUnsubscribeTxn(txn *sql.Tx, address, userID, roomID string) error {
+	_, err := txn.Exec(deleteEmailUnsubscribeSQL, address, userID, roomID)
+	return err
+}
+
+func selectEmailUnsubscribedTxn(txn *sql.Tx, address, userID, roomID string) (bool, error) {
+	var ts int64
+	err := txn.QueryRow(selectEmailUnsubscribeSQL, address, userID, roomID).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+const approvalColumns = `request_id, room_id, event_id, title, description, url, required_approvals, status,
+	callback_url, callback_status, callback_attempts, created_ts, expires_ts, decided_ts`
+
+const selectMaxApprovalRequestIDSQL = `
+SELECT COALESCE(MAX(request_id), 0) FROM approval_requests WHERE service_id = $1
+`
+
+const insertApprovalRequestSQL = `
+INSERT INTO approval_requests(service_id, ` + approvalColumns + `)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+`
+
+func insertApprovalRequestTxn(txn *sql.Tx, r *types.ApprovalRequest) error {
+	var maxID int64
+	if err := txn.QueryRow(selectMaxApprovalRequestIDSQL, r.ServiceID).Scan(&maxID); err != nil {
+		return err
+	}
+	r.RequestID = maxID + 1
+	_, err := txn.Exec(
+		insertApprovalRequestSQL, r.ServiceID, r.RequestID, r.RoomID, r.EventID, r.Title, r.Description, r.URL,
+		r.RequiredApprovals, r.Status, r.CallbackURL, r.CallbackStatus, r.CallbackAttempts,
+		r.CreatedTimestamp, r.ExpiresTimestamp, r.DecidedTimestamp,
+	)
+	return err
+}
+
+const updateApprovalRequestSQL = `
+UPDATE approval_requests SET event_id = $1, status = $2, callback_status = $3, callback_attempts = $4,
+	decided_ts = $5
+	WHERE service_id = $6 AND request_id = $7
+`
+
+func updateApprovalRequestTxn(txn *sql.Tx, r types.ApprovalRequest) error {
+	_, err := txn.Exec(
+		updateApprovalRequestSQL, r.EventID, r.Status, r.CallbackStatus, r.CallbackAttempts,
+		r.DecidedTimestamp, r.ServiceID, r.RequestID,
+	)
+	return err
+}
+
+func scanApprovalRequest(serviceID string, row interface {
+	Scan(dest ...interface{}) error
+}) (r types.ApprovalRequest, err error) {
+	r.ServiceID = serviceID
+	err = row.Scan(
+		&r.RequestID, &r.RoomID, &r.EventID, &r.Title, &r.Description, &r.URL, &r.RequiredApprovals, &r.Status,
+		&r.CallbackURL, &r.CallbackStatus, &r.CallbackAttempts, &r.CreatedTimestamp, &r.ExpiresTimestamp,
+		&r.DecidedTimestamp,
+	)
+	return
+}
+
+const selectApprovalRequestSQL = `
+SELECT ` + approvalColumns + ` FROM approval_requests WHERE service_id = $1 AND request_id = $2
+`
+
+func selectApprovalRequestTxn(txn *sql.Tx, serviceID string, requestID int64) (types.ApprovalRequest, error) {
+	return scanApprovalRequest(serviceID, txn.QueryRow(selectApprovalRequestSQL, serviceID, requestID))
+}
+
+const selectApprovalRequestByEventSQL = `
+SELECT ` + approvalColumns + ` FROM approval_requests WHERE service_id = $1 AND event_id = $2
+`
+
+func selectApprovalRequestByEventTxn(txn *sql.Tx, serviceID, eventID string) (types.ApprovalRequest, error) {
+	return scanApprovalRequest(serviceID, txn.QueryRow(selectApprovalRequestByEventSQL, serviceID, eventID))
+}
+
+const selectOutstandingApprovalRequestsSQL = `
+SELECT ` + approvalColumns + ` FROM approval_requests WHERE service_id = $1
+	AND (status = 'pending' OR callback_status = 'pending')
+	ORDER BY request_id
+`
+
+func selectOutstandingApprovalRequestsTxn(txn *sql.Tx, serviceID string) (reqs []types.ApprovalRequest, err error) {
+	rows, err := txn.Query(selectOutstandingApprovalRequestsSQL, serviceID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r types.ApprovalRequest
+		if r, err = scanApprovalRequest(serviceID, rows); err != nil {
+			return
+		}
+		reqs = append(reqs, r)
+	}
+	return
+}
+
+const insertApprovalAuditSQL = `
+INSERT INTO approval_audit(service_id, request_id, user_id, action, detail, ts)
+	VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func insertApprovalAuditTxn(txn *sql.Tx, e types.ApprovalAuditEntry) error {
+	_, err := txn.Exec(insertApprovalAuditSQL, e.ServiceID, e.RequestID, e.UserID, e.Action, e.Detail, e.Timestamp)
+	return err
+}
+
+const selectApprovalAuditSQL = `
+SELECT user_id, action, detail, ts FROM approval_audit WHERE service_id = $1 AND request_id = $2
+	ORDER BY ts
+`
+
+func selectApprovalAuditTxn(txn *sql.Tx, serviceID string, requestID int64) (entries []types.ApprovalAuditEntry, err error) {
+	rows, err := txn.Query(selectApprovalAuditSQL, serviceID, requestID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := types.ApprovalAuditEntry{ServiceID: serviceID, RequestID: requestID}
+		if err = rows.Scan(&e.UserID, &e.Action, &e.Detail, &e.Timestamp); err != nil {
+			return
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+const problemColumns = `problem_id, problem_key, source, host, service, severity, state, summary, url,
+	external_id, status, acked_by, ack_comment, opened_ts, updated_ts`
+
+const selectMaxProblemIDSQL = `
+SELECT COALESCE(MAX(problem_id), 0) FROM monitoring_problems WHERE service_id = $1
+`
+
+const insertProblemSQL = `
+INSERT INTO monitoring_problems(service_id, ` + problemColumns + `)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+`
+
+func insertProblemTxn(txn *sql.Tx, p *types.MonitoringProblem) error {
+	var maxID int64
+	if err := txn.QueryRow(selectMaxProblemIDSQL, p.ServiceID).Scan(&maxID); err != nil {
+		return err
+	}
+	p.ProblemID = maxID + 1
+	_, err := txn.Exec(
+		insertProblemSQL, p.ServiceID, p.ProblemID, p.Key, p.Source, p.Host, p.Service, p.Severity, p.State,
+		p.Summary, p.URL, p.ExternalID, p.Status, p.AckedBy, p.AckComment, p.OpenedTimestamp, p.UpdatedTimestamp,
+	)
+	return err
+}
+
+const updateProblemSQL = `
+UPDATE monitoring_problems SET severity = $1, state = $2, summary = $3, url = $4, status = $5,
+	acked_by = $6, ack_comment = $7, updated_ts = $8
+	WHERE service_id = $9 AND problem_id = $10
+`
+
+func updateProblemTxn(txn *sql.Tx, p types.MonitoringProblem) error {
+	_, err := txn.Exec(
+		updateProblemSQL, p.Severity, p.State, p.Summary, p.URL, p.Status, p.AckedBy, p.AckComment,
+		p.UpdatedTimestamp, p.ServiceID, p.ProblemID,
+	)
+	return err
+}
+
+func scanProblem(serviceID string, row interface {
+	Scan(dest ...interface{}) error
+}) (p types.MonitoringProblem, err error) {
+	p.ServiceID = serviceID
+	err = row.Scan(
+		&p.ProblemID, &p.Key, &p.Source, &p.Host, &p.Service, &p.Severity, &p.State, &p.Summary, &p.URL,
+		&p.ExternalID, &p.Status, &p.AckedBy, &p.AckComment, &p.OpenedTimestamp, &p.UpdatedTimestamp,
+	)
+	return
+}
+
+const selectProblemSQL = `
+SELECT ` + problemColumns + ` FROM monitoring_problems WHERE service_id = $1 AND problem_id = $2
+`
+
+func selectProblemTxn(txn *sql.Tx, serviceID string, problemID int64) (types.MonitoringProblem, error) {
+	return scanProblem(serviceID, txn.QueryRow(selectProblemSQL, serviceID, problemID))
+}
+
+const selectOpenProblemByKeySQL = `
+SELECT ` + problemColumns + ` FROM monitoring_problems WHERE service_id = $1 AND problem_key = $2
+	AND status != 'recovered' ORDER BY problem_id DESC LIMIT 1
+`
+
+func selectOpenProblemByKeyTxn(txn *sql.Tx, serviceID, key string) (types.MonitoringProblem, error) {
+	return scanProblem(serviceID, txn.QueryRow(selectOpenProblemByKeySQL, serviceID, key))
+}
+
+const insertProblemMessageSQL = `
+INSERT INTO monitoring_messages(service_id, problem_id, room_id, event_id) VALUES ($1, $2, $3, $4)
+`
+
+func insertProblemMessageTxn(txn *sql.Tx, serviceID string, problemID int64, roomID, eventID string) error {
+	_, err := txn.Exec(insertProblemMessageSQL, serviceID, problemID, roomID, eventID)
+	return err
+}
+
+const selectProblemMessagesSQL = `
+SELECT room_id, event_id FROM monitoring_messages WHERE service_id = $1 AND problem_id = $2
+`
+
+func selectProblemMessagesTxn(txn *sql.Tx, serviceID string, problemID int64) (map[string]string, error) {
+	rows, err := txn.Query(selectProblemMessagesSQL, serviceID, problemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make(map[string]string)
+	for rows.Next() {
+		var roomID, eventID string
+		if err := rows.Scan(&roomID, &eventID); err != nil {
+			return nil, err
+		}
+		messages[roomID] = eventID
+	}
+	return messages, nil
+}
+
+const selectStatusPageIncidentSQL = `
+SELECT 1 FROM statuspage_incidents WHERE service_id = $1 AND room_id = $2 AND incident_id = $3
+`
+
+const insertStatusPageIncidentSQL = `
+INSERT INTO statuspage_incidents(service_id, room_id, incident_id, name, status, url, updated_ts)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+const updateStatusPageIncidentSQL = `
+UPDATE statuspage_incidents SET name = $1, status = $2, url = $3, updated_ts = $4
+	WHERE service_id = $5 AND room_id = $6 AND incident_id = $7
+`
+
+func upsertStatusPageIncidentTxn(txn *sql.Tx, i types.StatusPageIncident) error {
+	var exists int
+	err := txn.QueryRow(selectStatusPageIncidentSQL, i.ServiceID, i.RoomID, i.IncidentID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		_, err = txn.Exec(
+			insertStatusPageIncidentSQL, i.ServiceID, i.RoomID, i.IncidentID, i.Name, i.Status, i.URL, i.UpdatedTimestamp,
+		)
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		updateStatusPageIncidentSQL, i.Name, i.Status, i.URL, i.UpdatedTimestamp, i.ServiceID, i.RoomID, i.IncidentID,
+	)
+	return err
+}
+
+func selectStatusPageIncidents(txn *sql.Tx, query string, args ...interface{}) ([]types.StatusPageIncident, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var incidents []types.StatusPageIncident
+	for rows.Next() {
+		var i types.StatusPageIncident
+		if err := rows.Scan(&i.ServiceID, &i.RoomID, &i.IncidentID, &i.Name, &i.Status, &i.URL, &i.UpdatedTimestamp); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, i)
+	}
+	return incidents, nil
+}
+
+const selectStatusPageIncidentRoomsSQL = `
+SELECT service_id, room_id, incident_id, name, status, url, updated_ts FROM statuspage_incidents
+	WHERE service_id = $1 AND incident_id = $2
+`
+
+func selectStatusPageIncidentRoomsTxn(txn *sql.Tx, serviceID, incidentID string) ([]types.StatusPageIncident, error) {
+	return selectStatusPageIncidents(txn, selectStatusPageIncidentRoomsSQL, serviceID, incidentID)
+}
+
+const selectOpenStatusPageIncidentsSQL = `
+SELECT service_id, room_id, incident_id, name, status, url, updated_ts FROM statuspage_incidents
+	WHERE service_id = $1 AND room_id = $2 AND status NOT IN ('resolved', 'postmortem', 'completed')
+	ORDER BY updated_ts DESC
+`
+
+func selectOpenStatusPageIncidentsTxn(txn *sql.Tx, serviceID, roomID string) ([]types.StatusPageIncident, error) {
+	return selectStatusPageIncidents(txn, selectOpenStatusPageIncidentsSQL, serviceID, roomID)
+}
+
+// searchDialect holds the SQL for the full-text search index, which is different for each database.
+type searchDialect struct {
+	insertSQL string
+	updateSQL string
+	searchSQL string
+	// query converts search terms into the database's query syntax.
+	query func(terms []string) string
+}
+
+const searchColumns = `service_id, room_id, event_id, sender, body, ts`
+
+// FTS5 is only available if go-sqlite3 was built with the sqlite_fts5 tag, so fall back to FTS4.
+const sqliteFTS5SearchSchemaSQL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS search_messages USING fts5(
+	body, service_id UNINDEXED, room_id UNINDEXED, event_id UNINDEXED, sender UNINDEXED, ts UNINDEXED
+);
+`
+
+const sqliteFTS4SearchSchemaSQL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS search_messages USING fts4(
+	body, service_id, room_id, event_id, sender, ts,
+	notindexed=service_id, notindexed=room_id, notindexed=event_id, notindexed=sender, notindexed=ts
+);
+`
+
+const postgresSearchSchemaSQL = `
+CREATE TABLE IF NOT EXISTS search_messages (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	body TEXT NOT NULL,
+	ts BIGINT NOT NULL,
+	body_tsv TSVECTOR NOT NULL,
+	UNIQUE(service_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS search_messages_tsv_idx ON search_messages USING GIN(body_tsv);
+CREATE INDEX IF NOT EXISTS search_messages_ts_idx ON search_messages(service_id, ts);
+`
+
+var sqliteSearch = searchDialect{
+	insertSQL: `INSERT INTO search_messages(` + searchColumns + `) VALUES ($1, $2, $3, $4, $5, $6)`,
+	updateSQL: `UPDATE search_messages SET body = $1 WHERE service_id = $2 AND event_id = $3 AND sender = $4`,
+	searchSQL: `
+SELECT ` + searchColumns + ` FROM search_messages WHERE search_messages MATCH $1
+	AND service_id = $2 AND room_id = $3 AND ($4 = '' OR sender = $5) AND ts >= $6 AND ts < $7
+	ORDER BY ts DESC LIMIT $8
+`,
+	// Quote each term as a phrase so that FTS operators in it are ignored. Terms are ANDed. FTS4
+	// can't escape quotes, but the tokenizer ignores them anyway.
+	query: func(terms []string) string {
+		var quoted []string
+		for _, t := range terms {
+			quoted = append(quoted, `"`+strings.Replace(t, `"`, " ", -1)+`"`)
+		}
+		return strings.Join(quoted, " ")
+	},
+}
+
+var postgresSearch = searchDialect{
+	insertSQL: `
+INSERT INTO search_messages(` + searchColumns + `, body_tsv) VALUES ($1, $2, $3, $4, $5, $6, to_tsvector('simple', $5))
+`,
+	updateSQL: `
+UPDATE search_messages SET body = $1, body_tsv = to_tsvector('simple', $1)
+	WHERE service_id = $2 AND event_id = $3 AND sender = $4
+`,
+	searchSQL: `
+SELECT ` + searchColumns + ` FROM search_messages WHERE body_tsv @@ plainto_tsquery('simple', $1)
+	AND service_id = $2 AND room_id = $3 AND ($4 = '' OR sender = $5) AND ts >= $6 AND ts < $7
+	ORDER BY ts DESC LIMIT $8
+`,
+	query: func(terms []string) string {
+		return strings.Join(terms, " ")
+	},
+}
+
+// createSearchIndex creates the search index for the type of database.
+func createSearchIndex(db *sql.DB, databaseType string) (*searchDialect, error) {
+	if databaseType == "postgres" {
+		_, err := db.Exec(postgresSearchSchemaSQL)
+		return &postgresSearch, err
+	}
+	if _, err := db.Exec(sqliteFTS5SearchSchemaSQL); err == nil {
+		return &sqliteSearch, nil
+	}
+	_, err := db.Exec(sqliteFTS4SearchSchemaSQL)
+	return &sqliteSearch, err
+}
+
+const deleteSearchMessageSQL = `
+DELETE FROM search_messages WHERE service_id = $1 AND event_id = $2 AND ($3 = '' OR sender = $4)
+`
+
+func insertSearchMessageTxn(txn *sql.Tx, dialect *searchDialect, m types.SearchMessage) error {
+	// Events can be seen twice, e.g. if Go-NEB restarts before saving the sync token
+	if _, err := txn.Exec(deleteSearchMessageSQL, m.ServiceID, m.EventID, "", ""); err != nil {
+		return err
+	}
+	_, err := txn.Exec(dialect.insertSQL, m.ServiceID, m.RoomID, m.EventID, m.Sender, m.Body, m.Timestamp)
+	return err
+}
+
+func updateSearchMessageTxn(txn *sql.Tx, dialect *searchDialect, serviceID, eventID, sender, body string) error {
+	_, err := txn.Exec(dialect.updateSQL, body, serviceID, eventID, sender)
+	return err
+}
+
+func deleteSearchMessageTxn(txn *sql.Tx, serviceID, eventID, sender string) error {
+	_, err := txn.Exec(deleteSearchMessageSQL, serviceID, eventID, sender, sender)
+	return err
+}
+
+const deleteSearchMessagesSQL = `
+DELETE FROM search_messages WHERE service_id = $1 AND ($2 = '' OR room_id = $3) AND ts < $4
+`
+
+func deleteSearchMessagesTxn(txn *sql.Tx, serviceID, roomID string, beforeMs int64) error {
+	_, err := txn.Exec(deleteSearchMessagesSQL, serviceID, roomID, roomID, beforeMs)
+	return err
+}
+
+func selectSearchMessagesTxn(txn *sql.Tx, dialect *searchDialect, q types.SearchQuery) ([]types.SearchMessage, error) {
+	before := q.Before
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	rows, err := txn.Query(
+		dialect.searchSQL, dialect.query(q.Terms), q.ServiceID, q.RoomID, q.Sender, q.Sender, q.After, before, q.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []types.SearchMessage
+	for rows.Next() {
+		var m types.SearchMessage
+		if err := rows.Scan(&m.ServiceID, &m.RoomID, &m.EventID, &m.Sender, &m.Body, &m.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSearchSQLite uses FTS5 when run with "-tags sqlite_fts5", and FTS4 otherwise.
+func TestSearchSQLite(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("Failed to open database: ", err)
+	}
+	testSearch(t, db)
+}
+
+func TestSearchSQLiteFTS4(t *testing.T) {
+	// An existing FTS4 index is used even if FTS5 is available
+	raw, err := sql.Open("sqlite3", "file:fts4?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal("Failed to open database: ", err)
+	}
+	defer raw.Close()
+	if _, err := raw.Exec(sqliteFTS4SearchSchemaSQL); err != nil {
+		t.Fatal("Failed to create FTS4 index: ", err)
+	}
+	db, err := Open("sqlite3", "file:fts4?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal("Failed to open database: ", err)
+	}
+	var schema string
+	if err := db.db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'search_messages'`).Scan(&schema); err != nil ||
+		!strings.Contains(schema, "fts4") {
+		t.Fatalf("Expected an FTS4 index, got %q (%v)", schema, err)
+	}
+	testSearch(t, db)
+}
+
+// TestSearchPostgres runs against the database in $POSTGRES_TEST_URL, e.g.
+// "postgres://postgres@localhost/goneb_test?sslmode=disable". Its search index is cleared.
+func TestSearchPostgres(t *testing.T) {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL isn't set")
+	}
+	db, err := Open("postgres", url)
+	if err != nil {
+		t.Fatal("Failed to open database: ", err)
+	}
+	if _, err := db.db.Exec("DELETE FROM search_messages"); err != nil {
+		t.Fatal("Failed to clear search index: ", err)
+	}
+	testSearch(t, db)
+}
+
+func testSearch(t *testing.T, db *ServiceDB) {
+	store := func(roomID, eventID, sender, body string, ts int64) {
+		err := db.StoreSearchMessage(types.SearchMessage{
+			ServiceID: "search", RoomID: roomID, EventID: eventID, Sender: sender, Body: body, Timestamp: ts,
+		})
+		if err != nil {
+			t.Fatalf("Failed to store %s: %s", eventID, err)
+		}
+	}
+	search := func(q types.SearchQuery) string {
+		q.ServiceID = "search"
+		if q.RoomID == "" {
+			q.RoomID = "!room:hyrule"
+		}
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		messages, err := db.SearchMessages(q)
+		if err != nil {
+			t.Fatalf("Failed to search for %v: %s", q.Terms, err)
+		}
+		var ids []string
+		for _, m := range messages {
+			ids = append(ids, m.EventID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	store("!room:hyrule", "$1", "@link:hyrule", "the master sword is in the forest", 1000)
+	store("!room:hyrule", "$2", "@zelda:hyrule", "I found the Master Sword", 2000)
+	store("!room:hyrule", "$3", "@zelda:hyrule", `the sword is in the "temple" OR NEAR* the lake`, 3000)
+	store("!other:hyrule", "$4", "@link:hyrule", "master sword", 2500)
+	// Events can be seen twice
+	store("!room:hyrule", "$2", "@zelda:hyrule", "I found the Master Sword", 2000)
+
+	for _, tc := range []struct {
+		q    types.SearchQuery
+		want string
+	}{
+		{types.SearchQuery{Terms: []string{"master", "sword"}}, "$2,$1"},
+		{types.SearchQuery{Terms: []string{"MASTER"}}, "$2,$1"},
+		{types.SearchQuery{Terms: []string{"sword"}, Limit: 2}, "$3,$2"},
+		{types.SearchQuery{Terms: []string{"sword"}, Sender: "@link:hyrule"}, "$1"},
+		{types.SearchQuery{Terms: []string{"sword"}, After: 2000}, "$3,$2"},
+		{types.SearchQuery{Terms: []string{"sword"}, Before: 2000}, "$1"},
+		{types.SearchQuery{Terms: []string{"sword"}, RoomID: "!other:hyrule"}, "$4"},
+		{types.SearchQuery{Terms: []string{"master", "temple"}}, ""},
+		// Query syntax in the terms is searched for rather than interpreted
+		{types.SearchQuery{Terms: []string{"OR"}}, "$3"},
+		{types.SearchQuery{Terms: []string{"NEAR*"}}, "$3"},
+		{types.SearchQuery{Terms: []string{`"temple`}}, "$3"},
+		{types.SearchQuery{Terms: []string{"forest", "OR", "found"}}, ""},
+	} {
+		if got := search(tc.q); got != tc.want {
+			t.Errorf("Search for %v (%+v): want %q got %q", tc.q.Terms, tc.q, tc.want, got)
+		}
+	}
+
+	// Only the sender can edit a message
+	if err := db.UpdateSearchMessage("search", "$2", "@ganon:hyrule", "the sword is mine"); err != nil {
+		t.Fatal("Failed to update message: ", err)
+	}
+	if err := db.UpdateSearchMessage("search", "$1", "@link:hyrule", "the master sword is in the lost woods"); err != nil {
+		t.Fatal("Failed to update message: ", err)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"lost"}}); got != "$1" {
+		t.Errorf("Expected the edited message to match, got %q", got)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"forest"}}); got != "" {
+		t.Errorf("Expected the message's old body not to match, got %q", got)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"mine"}}); got != "" {
+		t.Errorf("Expected an edit by someone else to be ignored, got %q", got)
+	}
+
+	// Only the sender can delete a message by editing it, but anyone can redact it
+	if err := db.DeleteSearchMessage("search", "$3", "@link:hyrule"); err != nil {
+		t.Fatal("Failed to delete message: ", err)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"temple"}}); got != "$3" {
+		t.Errorf("Expected a deletion by someone else to be ignored, got %q", got)
+	}
+	if err := db.DeleteSearchMessage("search", "$3", ""); err != nil {
+		t.Fatal("Failed to delete message: ", err)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"sword"}}); got != "$2,$1" {
+		t.Errorf("Expected the deleted message to be gone, got %q", got)
+	}
+	if err := db.DeleteSearchMessages("search", "!room:hyrule", 2000); err != nil {
+		t.Fatal("Failed to delete messages: ", err)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"sword"}}); got != "$2" {
+		t.Errorf("Expected messages before 2000 to be deleted, got %q", got)
+	}
+	if err := db.DeleteSearchMessages("search", "", 3000); err != nil {
+		t.Fatal("Failed to delete messages: ", err)
+	}
+	if got := search(types.SearchQuery{Terms: []string{"sword"}}) + search(types.SearchQuery{Terms: []string{"sword"}, RoomID: "!other:hyrule"}); got != "" {
+		t.Errorf("Expected messages in every room to be deleted, got %q", got)
+	}
+}
@@ -0,0 +1,347 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// smtpSink is a local SMTP server which accepts every message and keeps it.
+type smtpSink struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []sunkMessage
+}
+
+type sunkMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	s := &smtpSink{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ESMTP")
+	var msg sunkMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			tp.PrintfLine("250-sink")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			msg = sunkMessage{from: angleAddr(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, angleAddr(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			if msg.data, err = tp.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// angleAddr returns the address in the angle brackets of a MAIL or RCPT command.
+func angleAddr(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func (s *smtpSink) take() []sunkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.messages
+	s.messages = nil
+	return msgs
+}
+
+type mockStore struct {
+	database.NopStorage
+	email        map[string]interface{}
+	digests      []types.EmailDigestEntry
+	unsubscribes map[string]bool
+}
+
+func (s *mockStore) LoadBotOptions(userID, roomID string) (types.BotOptions, error) {
+	return types.BotOptions{
+		UserID:  userID,
+		RoomID:  roomID,
+		Options: map[string]interface{}{"email": s.email},
+	}, nil
+}
+
+func (s *mockStore) StoreEmailDigestEntry(e types.EmailDigestEntry) error {
+	s.digests = append(s.digests, e)
+	return nil
+}
+
+func (s *mockStore) LoadEmailDigestEntries() ([]types.EmailDigestEntry, error) {
+	return s.digests, nil
+}
+
+func (s *mockStore) DeleteEmailDigestEntries(address, userID, roomID string, upToMs int64) error {
+	var kept []types.EmailDigestEntry
+	for _, e := range s.digests {
+		if e.Address != address || e.UserID != userID || e.RoomID != roomID || e.Timestamp > upToMs {
+			kept = append(kept, e)
+		}
+	}
+	s.digests = kept
+	return nil
+}
+
+func (s *mockStore) StoreEmailUnsubscribe(address, userID, roomID string) error {
+	s.unsubscribes[address+" "+userID+" "+roomID] = true
+	return nil
+}
+
+func (s *mockStore) IsEmailUnsubscribed(address, userID, roomID string) (bool, error) {
+	return s.unsubscribes[address+" "+userID+" "+roomID], nil
+}
+
+func (s *mockStore) DeleteEmailUnsubscribe(address, userID, roomID string) error {
+	delete(s.unsubscribes, address+" "+userID+" "+roomID)
+	return nil
+}
+
+func setup(t *testing.T) (*smtpSink, *mockStore) {
+	sink := newSMTPSink(t)
+	err := Configure(Config{
+		URL:            "smtp://" + sink.ln.Addr().String(),
+		From:           "Go-NEB <neb@hyrule>",
+		Secret:         "hunter2",
+		UnsubscribeURL: "https://neb.hyrule/email/unsubscribe",
+	})
+	if err != nil {
+		t.Fatal("Failed to configure email: ", err)
+	}
+	store := &mockStore{
+		email: map[string]interface{}{
+			"name": "Ops",
+			"recipients": []interface{}{
+				map[string]interface{}{"address": "zelda@hyrule"},
+				map[string]interface{}{"address": "council@hyrule", "digest": "daily"},
+			},
+		},
+		unsubscribes: make(map[string]bool),
+	}
+	database.SetServiceDB(store)
+	return sink, store
+}
+
+// parts parses an email, returning its headers and its text/plain and text/html parts.
+func parts(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse email: ", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal("Failed to parse Content-Type: ", err)
+	}
+	bodies := make(map[string]string)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// The multipart reader decodes quoted-printable
+		b, _ := ioutil.ReadAll(p)
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		bodies[mediaType] = string(b)
+	}
+	return msg.Header, bodies
+}
+
+func TestDeliver(t *testing.T) {
+	sink, store := setup(t)
+	defer sink.ln.Close()
+	Deliver("@navi:hyrule", "!ops:hyrule", gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Body:          "Deploy finished: payments v1.2.3\nAll checks passed",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: "<b>Deploy finished</b>: payments v1.2.3<br>All checks passed",
+	})
+
+	msgs := sink.take()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(msgs))
+	}
+	if msgs[0].from != "neb@hyrule" || len(msgs[0].to) != 1 || msgs[0].to[0] != "zelda@hyrule" {
+		t.Errorf("Unexpected envelope: %s -> %v", msgs[0].from, msgs[0].to)
+	}
+	header, bodies := parts(t, msgs[0].data)
+	if subject := header.Get("Subject"); subject != "[Ops] Deploy finished: payments v1.2.3" {
+		t.Errorf("Unexpected subject: %s", subject)
+	}
+	if !strings.Contains(bodies["text/html"], "<b>Deploy finished</b>: payments v1.2.3<br>All checks passed") {
+		t.Errorf("Expected the HTML part to be the formatted body, got %s", bodies["text/html"])
+	}
+	if !strings.HasPrefix(bodies["text/plain"], "Deploy finished: payments v1.2.3\nAll checks passed") {
+		t.Errorf("Expected the text part to be the body, got %s", bodies["text/plain"])
+	}
+	link := strings.Trim(header.Get("List-Unsubscribe"), "<>")
+	if !strings.HasPrefix(link, "https://neb.hyrule/email/unsubscribe?") || !strings.Contains(bodies["text/plain"], link) {
+		t.Errorf("Expected an unsubscribe link, got %s", link)
+	}
+
+	// The digest recipient only gets an email after a day
+	if len(store.digests) != 1 || store.digests[0].Address != "council@hyrule" {
+		t.Fatalf("Expected the notification to be queued for the digest, got %v", store.digests)
+	}
+	Deliver("@navi:hyrule", "!ops:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "Disk <90% full"})
+	sink.take()
+	now := time.Now()
+	flush(now)
+	if msgs := sink.take(); len(msgs) != 0 {
+		t.Fatalf("Expected no digest yet, got %d emails", len(msgs))
+	}
+	flush(now.Add(25 * time.Hour))
+	msgs = sink.take()
+	if len(msgs) != 1 || msgs[0].to[0] != "council@hyrule" {
+		t.Fatalf("Expected a digest, got %v", msgs)
+	}
+	header, bodies = parts(t, msgs[0].data)
+	if subject := header.Get("Subject"); subject != "[Ops] 2 notification(s)" {
+		t.Errorf("Unexpected digest subject: %s", subject)
+	}
+	if !strings.Contains(bodies["text/html"], "<li><b>Deploy finished</b>") || !strings.Contains(bodies["text/html"], "<li>Disk &lt;90% full</li>") {
+		t.Errorf("Expected the digest to list both notifications, got %s", bodies["text/html"])
+	}
+	if len(store.digests) != 0 {
+		t.Errorf("Expected sent digest entries to be deleted, got %v", store.digests)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	sink, store := setup(t)
+	defer sink.ln.Close()
+	link, _ := url.Parse(unsubscribeLink("zelda@hyrule", "@navi:hyrule", "!ops:hyrule"))
+	h := &UnsubscribeHandler{}
+	do := func(method, rawQuery, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://neb.hyrule/email/unsubscribe?"+rawQuery, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	forged := link.Query()
+	forged.Set("address", "council@hyrule")
+	if w := do("POST", forged.Encode(), ""); w.Code != 403 {
+		t.Errorf("Expected a forged link to be rejected, got %d", w.Code)
+	}
+	// Following the link only shows a confirmation page
+	if w := do("GET", link.RawQuery, ""); w.Code != 200 || len(store.unsubscribes) != 0 {
+		t.Errorf("Expected GET to confirm without unsubscribing, got %d %v", w.Code, store.unsubscribes)
+	}
+	w := do("POST", link.RawQuery, "List-Unsubscribe=One-Click")
+	if w.Code != 200 {
+		t.Fatalf("Expected POST to unsubscribe, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `name="action" value="resubscribe"`) {
+		t.Errorf("Expected a way to undo the unsubscribe, got %s", w.Body.String())
+	}
+
+	Deliver("@navi:hyrule", "!ops:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "build passed"})
+	if msgs := sink.take(); len(msgs) != 0 {
+		t.Errorf("Expected no email to an unsubscribed address, got %d", len(msgs))
+	}
+	// Unsubscribing is per room
+	Deliver("@navi:hyrule", "!other:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "build passed"})
+	if msgs := sink.take(); len(msgs) != 1 {
+		t.Errorf("Expected an email from another room, got %d", len(msgs))
+	}
+
+	// Resubscribing needs a valid link too
+	if w := do("POST", forged.Encode(), "action=resubscribe"); w.Code != 403 || len(store.unsubscribes) != 1 {
+		t.Errorf("Expected a forged resubscribe to be rejected, got %d %v", w.Code, store.unsubscribes)
+	}
+	if w := do("POST", link.RawQuery, "action=resubscribe"); w.Code != 200 || len(store.unsubscribes) != 0 {
+		t.Fatalf("Expected POST to resubscribe, got %d %v", w.Code, store.unsubscribes)
+	}
+	Deliver("@navi:hyrule", "!ops:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "build passed"})
+	if msgs := sink.take(); len(msgs) != 1 {
+		t.Errorf("Expected an email after resubscribing, got %d", len(msgs))
+	}
+}
+
+func TestInvalidRecipients(t *testing.T) {
+	sink, store := setup(t)
+	defer sink.ln.Close()
+	store.email = map[string]interface{}{
+		"recipients": []interface{}{
+			map[string]interface{}{"address": "Zelda <zelda@hyrule>"},
+			map[string]interface{}{"address": "not an address"},
+			map[string]interface{}{"address": "ganon@hyrule\r\nBcc: everyone@hyrule"},
+		},
+	}
+	Deliver("@navi:hyrule", "!ops:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "build passed"})
+	msgs := sink.take()
+	if len(msgs) != 1 || len(msgs[0].to) != 1 || msgs[0].to[0] != "zelda@hyrule" {
+		t.Errorf("Expected only the valid address to be emailed, got %v", msgs)
+	}
+}
+
+func TestSubjectLine(t *testing.T) {
+	if s := subjectLine("  first line\nsecond line"); s != "first line" {
+		t.Errorf("Unexpected subject line: %q", s)
+	}
+	if s := subjectLine(strings.Repeat("é", 150)); len([]rune(s)) != 100 || !strings.HasSuffix(s, "…") {
+		t.Errorf("Expected a long subject line to be shortened, got %q", s)
+	}
+}
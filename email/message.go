@@ -0,0 +1,205 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// How long to spend talking to the SMTP server before giving up.
+const smtpTimeout = 30 * time.Second
+
+// An email of one or more notifications to a recipient.
+type email struct {
+	to      string
+	subject string
+	date    time.Time
+	// The notifications, as plain text and HTML.
+	text []string
+	html []string
+	// The link which unsubscribes the recipient.
+	unsubscribeURL string
+	roomID         string
+}
+
+func newEmail(to, userID, roomID string, now time.Time) *email {
+	return &email{
+		to:             to,
+		date:           now,
+		unsubscribeURL: unsubscribeLink(to, userID, roomID),
+		roomID:         roomID,
+	}
+}
+
+// addNotification adds a notification to the email. The HTML is the formatted_body of the message
+// if it has one, so emails look like the notification does in Matrix.
+func (e *email) addNotification(msg messageContent) {
+	e.text = append(e.text, msg.Body)
+	if msg.Format == "org.matrix.custom.html" && msg.FormattedBody != "" {
+		e.html = append(e.html, msg.FormattedBody)
+	} else {
+		e.html = append(e.html, strings.Replace(html.EscapeString(msg.Body), "\n", "<br>", -1))
+	}
+}
+
+func (e *email) plainText() string {
+	var buf bytes.Buffer
+	if len(e.text) == 1 {
+		buf.WriteString(e.text[0])
+	} else {
+		for _, t := range e.text {
+			buf.WriteString(" - " + strings.Replace(t, "\n", "\n   ", -1) + "\n")
+		}
+	}
+	fmt.Fprintf(&buf, "\n\n-- \nYou are receiving this because %s is subscribed to notifications from %s.\n", e.to, e.roomID)
+	fmt.Fprintf(&buf, "Unsubscribe: %s\n", e.unsubscribeURL)
+	return buf.String()
+}
+
+func (e *email) htmlText() string {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html><body>\n")
+	if len(e.html) == 1 {
+		buf.WriteString("<p>" + e.html[0] + "</p>\n")
+	} else {
+		buf.WriteString("<ul>\n")
+		for _, h := range e.html {
+			buf.WriteString("<li>" + h + "</li>\n")
+		}
+		buf.WriteString("</ul>\n")
+	}
+	fmt.Fprintf(&buf, "<hr>\n<p><small>You are receiving this because %s is subscribed to notifications from %s. <a href=\"%s\">Unsubscribe</a></small></p>\n",
+		html.EscapeString(e.to), html.EscapeString(e.roomID), html.EscapeString(e.unsubscribeURL))
+	buf.WriteString("</body></html>\n")
+	return buf.String()
+}
+
+// bytes renders the email as a multipart/alternative MIME message.
+func (e *email) bytes() ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", e.plainText()},
+		{"text/html; charset=utf-8", e.htmlText()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", config.From},
+		{"To", e.to},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.subject)},
+		{"Date", e.date.Format(time.RFC1123Z)},
+		{"Message-ID", messageID()},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+		{"Auto-Submitted", "auto-generated"},
+		{"List-Unsubscribe", "<" + e.unsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	} {
+		msg.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	domain := fromAddress[strings.LastIndex(fromAddress, "@")+1:]
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// send sends the email through the configured SMTP server.
+func (e *email) send() error {
+	msg, err := e.bytes()
+	if err != nil {
+		return err
+	}
+	host := smtpURL.Hostname()
+	port := smtpURL.Port()
+	if port == "" {
+		port = "25"
+		if smtpURL.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if smtpURL.Scheme == "smtps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if smtpURL.Scheme == "smtp" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if smtpURL.User != nil {
+		password, _ := smtpURL.User.Password()
+		// PlainAuth refuses to send the password over an unencrypted connection, except to localhost.
+		if err := c.Auth(smtp.PlainAuth("", smtpURL.User.Username(), password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(fromAddress); err != nil {
+		return err
+	}
+	if err := c.Rcpt(e.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
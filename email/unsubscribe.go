@@ -0,0 +1,99 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// unsubscribeToken signs an address, bot user and room so that unsubscribe links can't be forged.
+func unsubscribeToken(address, userID, roomID string) string {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(address + "\x00" + userID + "\x00" + roomID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeLink(address, userID, roomID string) string {
+	q := url.Values{}
+	q.Set("address", address)
+	q.Set("user_id", userID)
+	q.Set("room_id", roomID)
+	q.Set("token", unsubscribeToken(address, userID, roomID))
+	return config.UnsubscribeURL + "?" + q.Encode()
+}
+
+// UnsubscribeHandler serves the unsubscribe links in emails.
+//
+// A GET shows a page with a button which POSTs back to the same URL, so that mail scanners which
+// follow links don't unsubscribe anyone. A POST unsubscribes the address, which also lets mail
+// clients unsubscribe in one click with the List-Unsubscribe-Post header (RFC 8058). The page shown
+// after unsubscribing has a button which POSTs "action=resubscribe" to undo it.
+//
+// Request:
+//  POST /email/unsubscribe?address=cto%40example.com&user_id=%40neb%3Alocalhost&room_id=%21abc%3Alocalhost&token=4f1b...
+// Response:
+//  HTTP/1.1 200 OK
+//  Content-Type: text/html; charset=utf-8
+type UnsubscribeHandler struct{}
+
+func (h *UnsubscribeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	q := req.URL.Query()
+	address, userID, roomID := q.Get("address"), q.Get("user_id"), q.Get("room_id")
+	token := unsubscribeToken(address, userID, roomID)
+	if config == nil || !hmac.Equal([]byte(token), []byte(q.Get("token"))) {
+		w.WriteHeader(403)
+		w.Write([]byte("Invalid unsubscribe link"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method == "GET" {
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body><form method="POST" action="%s">`+
+			`<p>Stop emailing %s the notifications from %s?</p><button type="submit">Unsubscribe</button>`+
+			`</form></body></html>`,
+			html.EscapeString(req.URL.RequestURI()), html.EscapeString(address), html.EscapeString(roomID))
+		return
+	}
+	if req.PostFormValue("action") == "resubscribe" {
+		if err := database.GetServiceDB().DeleteEmailUnsubscribe(address, userID, roomID); err != nil {
+			log.WithError(err).WithField("address", address).Error("Failed to delete email unsubscribe")
+			w.WriteHeader(500)
+			w.Write([]byte("Failed to resubscribe, please try again later"))
+			return
+		}
+		log.WithFields(log.Fields{
+			"address":     address,
+			"room_id":     roomID,
+			"bot_user_id": userID,
+		}).Info("Resubscribed address to notification emails")
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body><p>%s will be emailed the notifications from %s again.</p></body></html>`,
+			html.EscapeString(address), html.EscapeString(roomID))
+		return
+	}
+	if err := database.GetServiceDB().StoreEmailUnsubscribe(address, userID, roomID); err != nil {
+		log.WithError(err).WithField("address", address).Error("Failed to store email unsubscribe")
+		w.WriteHeader(500)
+		w.Write([]byte("Failed to unsubscribe, please try again later"))
+		return
+	}
+	log.WithFields(log.Fields{
+		"address":     address,
+		"room_id":     roomID,
+		"bot_user_id": userID,
+	}).Info("Unsubscribed address from notification emails")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><body><form method="POST" action="%s">`+
+		`<p>%s will no longer be emailed the notifications from %s.</p>`+
+		`<input type="hidden" name="action" value="resubscribe"><button type="submit">Undo</button>`+
+		`</form></body></html>`,
+		html.EscapeString(req.URL.RequestURI()), html.EscapeString(address), html.EscapeString(roomID))
+}
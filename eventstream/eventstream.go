@@ -0,0 +1,209 @@
+// Package eventstream streams structured events about what Go-NEB is doing to external consumers,
+// such as dashboards and automation.
+//
+// Events are published by the rest of Go-NEB when commands are executed, webhooks are delivered,
+// services are polled and messages fail to send. The most recent events are kept in a bounded
+// buffer so consumers which reconnect can resume from where they left off. Consumers connect
+// using Server-Sent Events or a WebSocket: see Handler.
+package eventstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types which are published.
+const (
+	// A command was executed. Data contains "command" and "status" ("success" or "failure").
+	TypeCommand = "command"
+	// A webhook was delivered to a service. Data contains "method", "status" (the HTTP status
+	// code of the response) and "duration_ms".
+	TypeWebhook = "webhook"
+	// A service was polled. Data contains "duration_ms" and "next_poll_ts", the unix timestamp
+	// of the next poll or 0 if polling stopped.
+	TypePoll = "poll"
+	// A message failed to send. Data contains "error".
+	TypeSendFailure = "send_failure"
+	// Not published: sent to consumers when events they asked to resume from are no longer buffered.
+	TypeReset = "reset"
+)
+
+// DefaultBufferSize is the number of events which are kept for resuming.
+const DefaultBufferSize = 1000
+
+// subscriberBufferSize is how many events can be waiting to be written to a consumer before it
+// is disconnected for being too slow.
+const subscriberBufferSize = 256
+
+// Event is a single thing which Go-NEB did.
+type Event struct {
+	id int64
+	// An opaque token which can be used to resume the stream after this event.
+	Token string `json:"token"`
+	Type  string `json:"type"`
+	// Unix milliseconds.
+	Timestamp   int64  `json:"timestamp"`
+	ServiceID   string `json:"service_id,omitempty"`
+	ServiceType string `json:"service_type,omitempty"`
+	RoomID      string `json:"room_id,omitempty"`
+	UserID      string `json:"user_id,omitempty"`
+	// Type specific information.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Filter selects events. Empty fields match everything.
+type Filter struct {
+	ServiceIDs []string
+	RoomIDs    []string
+	Types      []string
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the event passes the filter.
+func (f *Filter) Matches(e *Event) bool {
+	return matchesAny(f.ServiceIDs, e.ServiceID) && matchesAny(f.RoomIDs, e.RoomID) && matchesAny(f.Types, e.Type)
+}
+
+// Subscription is a consumer of a Stream.
+type Subscription struct {
+	filter Filter
+	c      chan Event
+}
+
+// C receives the events which pass the subscription's filter. It is closed if the consumer falls
+// too far behind, in which case it should resume from the last token it received.
+func (s *Subscription) C() <-chan Event {
+	return s.c
+}
+
+// Stream is a bounded buffer of events with live subscribers.
+type Stream struct {
+	mu sync.Mutex
+	// A ring buffer of the most recent events. start is the index of the oldest.
+	buf   []Event
+	start int
+	// The ID of the next event. IDs are only unique within an epoch, which changes every time
+	// Go-NEB starts, so tokens from a previous run are not mistaken for current ones.
+	nextID int64
+	epoch  string
+	subs   map[*Subscription]bool
+}
+
+// New makes a new stream which buffers up to size events.
+func New(size int) *Stream {
+	return &Stream{
+		buf:    make([]Event, 0, size),
+		nextID: 1,
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:   make(map[*Subscription]bool),
+	}
+}
+
+// Publish adds an event to the stream, setting its token and timestamp.
+func (s *Stream) Publish(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.id = s.nextID
+	s.nextID++
+	e.Token = fmt.Sprintf("%s-%d", s.epoch, e.id)
+	if e.Timestamp == 0 {
+		e.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	if len(s.buf) < cap(s.buf) {
+		s.buf = append(s.buf, e)
+	} else {
+		s.buf[s.start] = e
+		s.start = (s.start + 1) % len(s.buf)
+	}
+	for sub := range s.subs {
+		if !sub.filter.Matches(&e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			close(sub.c)
+			delete(s.subs, sub)
+		}
+	}
+}
+
+// parseToken returns the event ID of a token, or false if the token is not from this stream.
+func (s *Stream) parseToken(token string) (int64, bool) {
+	i := strings.LastIndex(token, "-")
+	if i == -1 || token[:i] != s.epoch {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(token[i+1:], 10, 64)
+	if err != nil || id <= 0 || id >= s.nextID {
+		return 0, false
+	}
+	return id, true
+}
+
+// Subscribe starts receiving events which pass the filter. If a token is given, the buffered
+// events after it are returned. If some of those events are no longer buffered, or the token is
+// not recognised, reset is true and all buffered events are returned.
+func (s *Stream) Subscribe(filter Filter, token string) (sub *Subscription, backlog []Event, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub = &Subscription{
+		filter: filter,
+		c:      make(chan Event, subscriberBufferSize),
+	}
+	s.subs[sub] = true
+	if token == "" {
+		return
+	}
+	after, ok := s.parseToken(token)
+	if !ok {
+		reset = true
+	}
+	for i := 0; i < len(s.buf); i++ {
+		e := s.buf[(s.start+i)%len(s.buf)]
+		if i == 0 && ok && e.id > after+1 {
+			// The event after the token has been dropped from the buffer
+			reset = true
+		}
+		if (reset || e.id > after) && filter.Matches(&e) {
+			backlog = append(backlog, e)
+		}
+	}
+	return
+}
+
+// Unsubscribe stops sending events to the subscription.
+func (s *Stream) Unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[sub] {
+		delete(s.subs, sub)
+		close(sub.c)
+	}
+}
+
+var defaultStream = New(DefaultBufferSize)
+
+// Default returns the stream which Go-NEB publishes to.
+func Default() *Stream {
+	return defaultStream
+}
+
+// Publish adds an event to the default stream.
+func Publish(e Event) {
+	defaultStream.Publish(e)
+}
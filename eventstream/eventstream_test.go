@@ -0,0 +1,175 @@
+package eventstream
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestResume(t *testing.T) {
+	s := New(3)
+	sub, backlog, reset := s.Subscribe(Filter{}, "")
+	if len(backlog) != 0 || reset {
+		t.Fatalf("Expected no backlog without a token, got %v %v", backlog, reset)
+	}
+	for i := 0; i < 5; i++ {
+		s.Publish(Event{Type: TypePoll, ServiceID: fmt.Sprintf("svc%d", i)})
+	}
+	var tokens []string
+	for i := 0; i < 5; i++ {
+		e := <-sub.C()
+		tokens = append(tokens, e.Token)
+	}
+	s.Unsubscribe(sub)
+
+	// Events 3 and 4 are still buffered after event 2
+	_, backlog, reset = s.Subscribe(Filter{}, tokens[2])
+	if reset || len(backlog) != 2 || backlog[0].ServiceID != "svc3" || backlog[1].ServiceID != "svc4" {
+		t.Errorf("Unexpected backlog after token 2: %v %v", backlog, reset)
+	}
+	// Event 2 is still buffered after event 1, but event 1 isn't needed
+	_, backlog, reset = s.Subscribe(Filter{}, tokens[1])
+	if reset || len(backlog) != 3 {
+		t.Errorf("Unexpected backlog after token 1: %v %v", backlog, reset)
+	}
+	// Event 1 was dropped from the buffer
+	_, backlog, reset = s.Subscribe(Filter{}, tokens[0])
+	if !reset || len(backlog) != 3 || backlog[0].ServiceID != "svc2" {
+		t.Errorf("Expected a reset after token 0, got %v %v", backlog, reset)
+	}
+	// Tokens from another run
+	_, backlog, reset = s.Subscribe(Filter{}, "abc-2")
+	if !reset || len(backlog) != 3 {
+		t.Errorf("Expected a reset for a token from another run, got %v %v", backlog, reset)
+	}
+	// Up to date
+	_, backlog, reset = s.Subscribe(Filter{}, tokens[4])
+	if reset || len(backlog) != 0 {
+		t.Errorf("Expected nothing after the latest token, got %v %v", backlog, reset)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s := New(10)
+	sub, _, _ := s.Subscribe(Filter{ServiceIDs: []string{"a", "b"}, Types: []string{TypeWebhook}}, "")
+	s.Publish(Event{Type: TypeWebhook, ServiceID: "a"})
+	s.Publish(Event{Type: TypePoll, ServiceID: "a"})
+	s.Publish(Event{Type: TypeWebhook, ServiceID: "c"})
+	s.Publish(Event{Type: TypeWebhook, ServiceID: "b", RoomID: "!room:hs"})
+	s.Unsubscribe(sub)
+	var got []string
+	for e := range sub.C() {
+		got = append(got, e.ServiceID)
+	}
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("Expected events for a and b, got %v", got)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	s := New(10)
+	sub, _, _ := s.Subscribe(Filter{}, "")
+	for i := 0; i < subscriberBufferSize+1; i++ {
+		s.Publish(Event{Type: TypePoll})
+	}
+	n := 0
+	for range sub.C() {
+		n++
+	}
+	if n != subscriberBufferSize {
+		t.Errorf("Expected a slow subscriber to be closed after %d events, got %d", subscriberBufferSize, n)
+	}
+	// Unsubscribing after being closed is fine
+	s.Unsubscribe(sub)
+}
+
+func TestSSE(t *testing.T) {
+	s := New(10)
+	srv := httptest.NewServer(NewHandler(s, "s3cr3t"))
+	defer srv.Close()
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 401 {
+			t.Errorf("Expected auth %q to be refused, got %d", auth, res.StatusCode)
+		}
+	}
+
+	s.Publish(Event{Type: TypeCommand, RoomID: "!a:hs"})
+	res, err := http.Get(srv.URL + "?access_token=s3cr3t&room_id=!b:hs,!c:hs&since=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %s", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	if e := readEvent(); e != "event: reset\ndata: {}\n" {
+		t.Errorf("Expected a reset for an unknown token, got %q", e)
+	}
+	s.Publish(Event{Type: TypeCommand, RoomID: "!a:hs"})
+	s.Publish(Event{Type: TypeSendFailure, RoomID: "!c:hs", Timestamp: 42})
+	e := readEvent()
+	want := fmt.Sprintf("id: %s-3\nevent: send_failure\ndata: {\"token\":\"%s-3\",\"type\":\"send_failure\",\"timestamp\":42,\"room_id\":\"!c:hs\"}\n", s.epoch, s.epoch)
+	if e != want {
+		t.Errorf("Unexpected event:\n%s\nwant:\n%s", e, want)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := New(10)
+	srv := httptest.NewServer(NewHandler(s, "s3cr3t"))
+	defer srv.Close()
+
+	s.Publish(Event{Type: TypeWebhook, ServiceID: "a"})
+	s.Publish(Event{Type: TypeWebhook, ServiceID: "b"})
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "?access_token=s3cr3t&since=" + s.epoch + "-1"
+	ws, err := websocket.Dial(wsURL, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var e Event
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ServiceID != "b" || e.Token != s.epoch+"-2" {
+		t.Errorf("Expected the buffered event after the token, got %+v", e)
+	}
+	s.Publish(Event{Type: TypePoll, ServiceID: "c"})
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ServiceID != "c" || e.Type != TypePoll {
+		t.Errorf("Expected the live event, got %+v", e)
+	}
+}
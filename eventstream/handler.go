@@ -0,0 +1,208 @@
+package eventstream
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// How often to send something to idle consumers, so proxies don't close the connection.
+var keepaliveInterval = 30 * time.Second
+
+// Handler serves a Stream over HTTP. Consumers must present the access token either as
+// "Authorization: Bearer <token>" or as an "access_token" query parameter, since browser
+// EventSource and WebSocket clients can't set headers.
+//
+// The stream can be filtered with the query parameters "service_id", "room_id" and "type",
+// each of which may be repeated or comma separated.
+//
+// Requests with "Upgrade: websocket" receive each event as a JSON text message. Other requests
+// receive Server-Sent Events, where the event name is the event type, the data is the event JSON
+// and the event ID is the event's token.
+//
+// To resume, pass the token of the last event received as the "Last-Event-ID" header (which
+// EventSource does automatically when it reconnects) or the "since" query parameter. Buffered
+// events after it are sent first. If they are no longer all buffered, a "reset" event is sent
+// followed by every buffered event. Consumers which fall too far behind are disconnected and
+// should resume.
+//
+// Request:
+//  GET /events?type=webhook,send_failure&since=kg3h2xyz-42
+//  Authorization: Bearer <token>
+// Response:
+//  HTTP/1.1 200 OK
+//  Content-Type: text/event-stream
+//
+//  id: kg3h2xyz-43
+//  event: webhook
+//  data: {"token":"kg3h2xyz-43","type":"webhook","timestamp":1603900000000,"service_id":"alerts","service_type":"alertmanager","data":{"duration_ms":12,"method":"POST","status":200}}
+type Handler struct {
+	stream *Stream
+	token  string
+}
+
+// NewHandler returns a handler for the stream which requires the given access token.
+func NewHandler(stream *Stream, token string) *Handler {
+	return &Handler{stream, token}
+}
+
+func (h *Handler) authorised(req *http.Request) bool {
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func queryList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// ServeHTTP streams events to the consumer until it disconnects.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if !h.authorised(req) {
+		w.WriteHeader(401)
+		return
+	}
+	query := req.URL.Query()
+	filter := Filter{
+		ServiceIDs: queryList(query["service_id"]),
+		RoomIDs:    queryList(query["room_id"]),
+		Types:      queryList(query["type"]),
+	}
+	since := req.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = query.Get("since")
+	}
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			// Consumers are authenticated by token rather than by origin
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				h.serveWebSocket(ws, filter, since)
+			},
+		}.ServeHTTP(w, req)
+		return
+	}
+	h.serveSSE(w, req, filter, since)
+}
+
+func (h *Handler) serveSSE(w http.ResponseWriter, req *http.Request, filter Filter, since string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	sub, backlog, reset := h.stream.Subscribe(filter, since)
+	defer h.stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	if reset {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", TypeReset)
+	}
+	for _, e := range backlog {
+		if err := writeSSE(w, &e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, &e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w io.Writer, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Token, e.Type, data)
+	return err
+}
+
+func (h *Handler) serveWebSocket(ws *websocket.Conn, filter Filter, since string) {
+	defer ws.Close()
+	sub, backlog, reset := h.stream.Subscribe(filter, since)
+	defer h.stream.Unsubscribe(sub)
+
+	// Consumers don't send anything, but we need to read to notice when they go away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	if reset {
+		if err := websocket.JSON.Send(ws, Event{Type: TypeReset}); err != nil {
+			return
+		}
+	}
+	for _, e := range backlog {
+		if err := websocket.JSON.Send(ws, e); err != nil {
+			return
+		}
+	}
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				log.WithError(err).Debug("Failed to send event to WebSocket consumer")
+				return
+			}
+		case <-keepalive.C:
+			ws.PayloadType = websocket.PingFrame
+			if _, err := ws.Write(nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
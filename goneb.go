@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dugong"
@@ -15,22 +17,40 @@ import (
 	"github.com/matrix-org/go-neb/api/handlers"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/email"
+	"github.com/matrix-org/go-neb/eventstream"
 	_ "github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/polling"
 	_ "github.com/matrix-org/go-neb/realms/github"
 	_ "github.com/matrix-org/go-neb/realms/jira"
 	_ "github.com/matrix-org/go-neb/services/alertmanager"
+	_ "github.com/matrix-org/go-neb/services/approvals"
+	_ "github.com/matrix-org/go-neb/services/broker"
+	_ "github.com/matrix-org/go-neb/services/cloudevents"
 	_ "github.com/matrix-org/go-neb/services/echo"
 	_ "github.com/matrix-org/go-neb/services/giphy"
 	_ "github.com/matrix-org/go-neb/services/github"
+	_ "github.com/matrix-org/go-neb/services/gitops"
 	_ "github.com/matrix-org/go-neb/services/google"
 	_ "github.com/matrix-org/go-neb/services/guggy"
+	_ "github.com/matrix-org/go-neb/services/helpdesk"
 	_ "github.com/matrix-org/go-neb/services/imgur"
+	_ "github.com/matrix-org/go-neb/services/jenkins"
 	_ "github.com/matrix-org/go-neb/services/jira"
+	_ "github.com/matrix-org/go-neb/services/logs"
+	_ "github.com/matrix-org/go-neb/services/monitoring"
+	_ "github.com/matrix-org/go-neb/services/releases"
+	_ "github.com/matrix-org/go-neb/services/roomstats"
 	_ "github.com/matrix-org/go-neb/services/rssbot"
+	_ "github.com/matrix-org/go-neb/services/search"
 	_ "github.com/matrix-org/go-neb/services/slackapi"
+	_ "github.com/matrix-org/go-neb/services/statuspage"
+	_ "github.com/matrix-org/go-neb/services/synapseadmin"
+	_ "github.com/matrix-org/go-neb/services/syslog"
 	_ "github.com/matrix-org/go-neb/services/travisci"
 	_ "github.com/matrix-org/go-neb/services/wikipedia"
+	"github.com/matrix-org/go-neb/statusboard"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	_ "github.com/mattn/go-sqlite3"
@@ -39,8 +59,63 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
-// loadFromConfig loads a config file and returns a ConfigFile
-func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigFile, error) {
+// loadFromConfig loads a config file, or a directory of config files, and returns a ConfigFile
+func loadFromConfig(db *database.ServiceDB, configPath string) (*api.ConfigFile, error) {
+	paths, err := configFilePaths(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var c api.ConfigFile
+	for _, path := range paths {
+		fileCfg, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if err := mergeConfig(&c, fileCfg); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	// sanity check (at least 1 client and 1 service)
+	if len(c.Clients) == 0 || len(c.Services) == 0 {
+		return nil, fmt.Errorf("At least 1 client and 1 service must be specified")
+	}
+
+	return &c, nil
+}
+
+// configFilePaths returns the config files to load. If the path is a directory, this is every
+// YAML or JSON file in it, in name order, conf.d style.
+func configFilePaths(configPath string) ([]string, error) {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{configPath}, nil
+	}
+	files, err := ioutil.ReadDir(configPath) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		switch filepath.Ext(f.Name()) {
+		case ".yaml", ".yml", ".json":
+			paths = append(paths, filepath.Join(configPath, f.Name()))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No config files found in %s", configPath)
+	}
+	return paths, nil
+}
+
+// readConfigFile reads a single YAML or JSON config file.
+func readConfigFile(configFilePath string) (*api.ConfigFile, error) {
 	// ::Horrible hacks ahead::
 	// The config is represented as YAML, and we want to convert that into NEB types.
 	// However, NEB types make liberal use of json.RawMessage which the YAML parser
@@ -52,6 +127,7 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	// The hack that follows gets around this by type asserting all parsed YAML keys as
 	// strings then re-encoding/decoding as JSON. That is:
 	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
+	// JSON files are YAML too, so they go through the same path.
 
 	// Convert to YAML bytes
 	contents, err := ioutil.ReadFile(configFilePath)
@@ -79,13 +155,62 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	if err := json.Unmarshal(b, &c); err != nil {
 		return nil, fmt.Errorf("Failed to convert to config file: %s", err)
 	}
+	return &c, nil
+}
 
-	// sanity check (at least 1 client and 1 service)
-	if len(c.Clients) == 0 || len(c.Services) == 0 {
-		return nil, fmt.Errorf("At least 1 client and 1 service must be specified")
+// mergeConfig appends the sections of src to dst. It is an error for src to define something
+// with the same ID as something in dst, as one file would silently clobber another.
+func mergeConfig(dst, src *api.ConfigFile) error {
+	seen := make(map[string]bool)
+	add := func(kind, id string) error {
+		key := kind + " " + id
+		if seen[key] {
+			return fmt.Errorf("Duplicate %s", key)
+		}
+		seen[key] = true
+		return nil
 	}
-
-	return &c, nil
+	check := func(c *api.ConfigFile) error {
+		for _, cli := range c.Clients {
+			if err := add("client", cli.UserID); err != nil {
+				return err
+			}
+		}
+		for _, r := range c.Realms {
+			if err := add("realm", r.ID); err != nil {
+				return err
+			}
+		}
+		for _, srv := range c.Services {
+			if err := add("service", srv.ID); err != nil {
+				return err
+			}
+		}
+		for _, sess := range c.Sessions {
+			if err := add("session", sess.SessionID); err != nil {
+				return err
+			}
+		}
+		for _, o := range c.BotOptions {
+			if err := add("bot options", o.UserID+" in "+o.RoomID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := check(dst); err != nil {
+		return err
+	}
+	if err := check(src); err != nil {
+		return err
+	}
+	dst.Clients = append(dst.Clients, src.Clients...)
+	dst.Realms = append(dst.Realms, src.Realms...)
+	dst.Services = append(dst.Services, src.Services...)
+	dst.Sessions = append(dst.Sessions, src.Sessions...)
+	dst.BotOptions = append(dst.BotOptions, src.BotOptions...)
+	dst.Rooms = append(dst.Rooms, src.Rooms...)
+	return nil
 }
 
 func convertKeysToStrings(iface interface{}) interface{} {
@@ -135,6 +260,30 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 	return nil
 }
 
+// joinRoomsFromConfig makes bot users join the rooms listed in the config file. Failures are
+// logged rather than fatal, as rooms can be joined later.
+func joinRoomsFromConfig(clis *clients.Clients, rooms []api.Room) error {
+	for i, r := range rooms {
+		if err := r.Check(); err != nil {
+			return fmt.Errorf("config: Rooms[%d] : %s", i, err)
+		}
+		for _, userID := range r.UserIDs {
+			c, err := clis.Client(userID)
+			if err != nil {
+				return fmt.Errorf("config: Rooms[%d] : %s", i, err)
+			}
+			if _, err := c.JoinRoom(r.RoomID, "", nil); err != nil {
+				log.WithFields(log.Fields{
+					log.ErrorKey: err,
+					"room_id":    r.RoomID,
+					"user_id":    userID,
+				}).Error("Failed to join room from config")
+			}
+		}
+	}
+	return nil
+}
+
 func loadDatabase(databaseType, databaseURL, configYAML string) (*database.ServiceDB, error) {
 	if configYAML != "" {
 		databaseType = "sqlite3"
@@ -171,12 +320,15 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		log.Info("Inserted ", len(cfg.Clients), " clients")
 		log.Info("Inserted ", len(cfg.Realms), " realms")
 		log.Info("Inserted ", len(cfg.Sessions), " sessions")
+		log.Info("Inserted ", len(cfg.BotOptions), " bot options")
 	}
 
 	matrixClients := clients.New(db, matrixClient)
 	if err := matrixClients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
+	// Services need to look up the clients they send as when they are registered
+	notify.SetClients(matrixClients)
 
 	// Handle non-admin paths for normal NEB functioning
 	mux.Handle("/metrics", prometheus.Handler())
@@ -185,6 +337,21 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	mux.HandleFunc("/services/hooks/", prometheus.InstrumentHandlerFunc("webhookHandler", util.Protect(wh.Handle)))
 	rh := &handlers.RealmRedirect{db}
 	mux.HandleFunc("/realms/redirects/", prometheus.InstrumentHandlerFunc("realmRedirectHandler", util.Protect(rh.Handle)))
+	if e.EventStreamToken != "" {
+		mux.Handle("/events", eventstream.NewHandler(eventstream.Default(), e.EventStreamToken))
+	}
+	if e.SMTPURL != "" {
+		err := email.Configure(email.Config{
+			URL:            e.SMTPURL,
+			From:           e.SMTPFrom,
+			Secret:         e.EmailSecret,
+			UnsubscribeURL: strings.TrimSuffix(e.BaseURL, "/") + "/email/unsubscribe",
+		})
+		if err != nil {
+			log.WithError(err).Panic("Failed to configure email delivery")
+		}
+		mux.Handle("/email/unsubscribe", &email.UnsubscribeHandler{})
+	}
 
 	// Read exclusively from the config file if one was supplied.
 	// Otherwise, add HTTP listeners for new Services/Sessions/Clients/etc.
@@ -194,6 +361,10 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		}
 
 		log.Info("Inserted ", len(cfg.Services), " services")
+
+		if err := joinRoomsFromConfig(matrixClients, cfg.Rooms); err != nil {
+			log.WithError(err).Panic("Failed to join rooms")
+		}
 	} else {
 		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
 		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
@@ -207,6 +378,16 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
+	if err := notify.Start(); err != nil {
+		log.WithError(err).Panic("Failed to start notification delivery")
+	}
+	if err := email.Start(); err != nil {
+		log.WithError(err).Panic("Failed to start email digests")
+	}
+	statusboard.SetClients(matrixClients)
+	if err := statusboard.Start(); err != nil {
+		log.WithError(err).Panic("Failed to start status boards")
+	}
 }
 
 type envVars struct {
@@ -216,16 +397,25 @@ type envVars struct {
 	BaseURL      string
 	LogDir       string
 	ConfigFile   string
+	SMTPURL      string
+	SMTPFrom     string
+	// Not logged, as they are secrets.
+	EventStreamToken string
+	EmailSecret      string
 }
 
 func main() {
 	e := envVars{
-		BindAddress:  os.Getenv("BIND_ADDRESS"),
-		DatabaseType: os.Getenv("DATABASE_TYPE"),
-		DatabaseURL:  os.Getenv("DATABASE_URL"),
-		BaseURL:      os.Getenv("BASE_URL"),
-		LogDir:       os.Getenv("LOG_DIR"),
-		ConfigFile:   os.Getenv("CONFIG_FILE"),
+		BindAddress:      os.Getenv("BIND_ADDRESS"),
+		DatabaseType:     os.Getenv("DATABASE_TYPE"),
+		DatabaseURL:      os.Getenv("DATABASE_URL"),
+		BaseURL:          os.Getenv("BASE_URL"),
+		LogDir:           os.Getenv("LOG_DIR"),
+		ConfigFile:       os.Getenv("CONFIG_FILE"),
+		SMTPURL:          os.Getenv("SMTP_URL"),
+		SMTPFrom:         os.Getenv("SMTP_FROM"),
+		EventStreamToken: os.Getenv("EVENT_STREAM_TOKEN"),
+		EmailSecret:      os.Getenv("EMAIL_SECRET"),
 	}
 
 	if e.LogDir != "" {
@@ -241,7 +431,18 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Infof("Go-NEB (%+v)", e)
+	logged := e
+	if logged.EventStreamToken != "" {
+		logged.EventStreamToken = "<redacted>"
+	}
+	if logged.EmailSecret != "" {
+		logged.EmailSecret = "<redacted>"
+	}
+	if u, err := url.Parse(logged.SMTPURL); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		logged.SMTPURL = u.String()
+	}
+	log.Infof("Go-NEB (%+v)", logged)
 
 	setup(e, http.DefaultServeMux, http.DefaultClient)
 	log.Fatal(http.ListenAndServe(e.BindAddress, nil))
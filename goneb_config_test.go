@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goneb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const baseConfigYAML = `
+clients:
+  - UserID: "@link:hyrule"
+    AccessToken: "dangeroustogoalone"
+    HomeserverURL: "http://hyrule.loz"
+services:
+  - ID: "echo_service"
+    Type: "echo"
+    UserID: "@link:hyrule"
+    Config: {}
+`
+
+func TestLoadConfigDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"10-base.yaml": baseConfigYAML,
+		"20-team.json": `{
+			"services": [{"ID": "team_echo", "Type": "echo", "UserID": "@link:hyrule", "Config": {}}],
+			"botoptions": [{"UserID": "@link:hyrule", "RoomID": "!team:hyrule", "Options": {"quiet_hours": {"start": "22:00", "end": "07:00"}}}],
+			"rooms": [{"RoomID": "!team:hyrule", "UserIDs": ["@link:hyrule"]}]
+		}`,
+		"30-more.yml": `
+rooms:
+  - RoomID: "#castle:hyrule"
+    UserIDs: ["@link:hyrule"]
+`,
+		"README.md":    "not config",
+		".hidden.yaml": "services: [{ID: echo_service}]",
+	})
+	defer os.RemoveAll(dir)
+
+	cfg, err := loadFromConfig(nil, dir)
+	if err != nil {
+		t.Fatalf("Failed to load config directory: %s", err)
+	}
+	if len(cfg.Clients) != 1 || len(cfg.Services) != 2 || cfg.Services[1].ID != "team_echo" {
+		t.Errorf("Expected files to be merged in order, got %+v", cfg)
+	}
+	if len(cfg.BotOptions) != 1 || cfg.BotOptions[0].Options["quiet_hours"] == nil {
+		t.Errorf("Unexpected bot options: %+v", cfg.BotOptions)
+	}
+	if len(cfg.Rooms) != 2 || cfg.Rooms[1].RoomID != "#castle:hyrule" {
+		t.Errorf("Unexpected rooms: %+v", cfg.Rooms)
+	}
+
+	// A single file still works
+	cfg, err = loadFromConfig(nil, filepath.Join(dir, "10-base.yaml"))
+	if err != nil || len(cfg.Services) != 1 {
+		t.Errorf("Failed to load a single config file: %v %+v", err, cfg)
+	}
+}
+
+func TestLoadConfigDirectoryDuplicates(t *testing.T) {
+	for _, dup := range []string{
+		`{"services": [{"ID": "echo_service", "Type": "echo", "UserID": "@link:hyrule", "Config": {}}]}`,
+		`{"clients": [{"UserID": "@link:hyrule", "AccessToken": "x", "HomeserverURL": "http://hyrule.loz"}]}`,
+		`{"botoptions": [{"UserID": "@link:hyrule", "RoomID": "!r:hyrule", "Options": {}}, {"UserID": "@link:hyrule", "RoomID": "!r:hyrule", "Options": {}}]}`,
+	} {
+		dir := writeConfigFiles(t, map[string]string{
+			"10-base.yaml": baseConfigYAML,
+			"20-dup.json":  dup,
+		})
+		_, err := loadFromConfig(nil, dir)
+		if err == nil || !strings.Contains(err.Error(), "20-dup.json") || !strings.Contains(err.Error(), "Duplicate") {
+			t.Errorf("Expected a duplicate error naming the file for %s, got %v", dup, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
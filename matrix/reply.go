@@ -0,0 +1,182 @@
+package matrix
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// maxThreadMessages is the maximum number of thread messages returned by RepliedMessages.
+const maxThreadMessages = 50
+
+// relatesTo returns the m.relates_to content of an event, or nil if it has none.
+func relatesTo(event *gomatrix.Event) map[string]interface{} {
+	rel, _ := event.Content["m.relates_to"].(map[string]interface{})
+	return rel
+}
+
+// InReplyTo returns the ID of the event which an event replies to, or "" if it isn't a reply. The
+// fallback reply which clients add to thread messages for clients without thread support isn't a
+// reply.
+func InReplyTo(event *gomatrix.Event) string {
+	rel := relatesTo(event)
+	if rel == nil {
+		return ""
+	}
+	if falling, _ := rel["is_falling_back"].(bool); falling {
+		return ""
+	}
+	reply, _ := rel["m.in_reply_to"].(map[string]interface{})
+	eventID, _ := reply["event_id"].(string)
+	return eventID
+}
+
+// ThreadRoot returns the ID of the root of the thread which an event is in, or "" if it isn't in a
+// thread.
+func ThreadRoot(event *gomatrix.Event) string {
+	rel := relatesTo(event)
+	if rel == nil || rel["rel_type"] != "m.thread" {
+		return ""
+	}
+	eventID, _ := rel["event_id"].(string)
+	return eventID
+}
+
+// StripReplyFallback removes the quote of the replied to message which clients put at the start of
+// the body of replies.
+func StripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	return strings.TrimLeft(strings.Join(lines[i:], "\n"), "\n")
+}
+
+// Permalink returns a matrix.to link to an event.
+func Permalink(roomID, eventID string) string {
+	return "https://matrix.to/#/" + url.PathEscape(roomID) + "/" + url.PathEscape(eventID)
+}
+
+// FetchEvent fetches a single event from a room.
+func FetchEvent(cli *gomatrix.Client, roomID, eventID string) (*gomatrix.Event, error) {
+	var event gomatrix.Event
+	u := cli.BuildURL("rooms", roomID, "event", eventID)
+	if err := cli.MakeRequest("GET", u, nil, &event); err != nil {
+		return nil, err
+	}
+	if event.RoomID == "" {
+		event.RoomID = roomID
+	}
+	return &event, nil
+}
+
+// FetchThread fetches a thread's root event followed by up to limit of its messages, oldest first.
+func FetchThread(cli *gomatrix.Client, roomID, rootID string, limit int) ([]*gomatrix.Event, error) {
+	root, err := FetchEvent(cli, roomID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(cli.BuildBaseURL("_matrix/client/v1/rooms", roomID, "relations", rootID, "m.thread"))
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+	var res struct {
+		Chunk []*gomatrix.Event `json:"chunk"`
+	}
+	if err := cli.MakeRequest("GET", u.String(), nil, &res); err != nil {
+		return nil, err
+	}
+	events := []*gomatrix.Event{root}
+	// Relations are returned newest first
+	for i := len(res.Chunk) - 1; i >= 0; i-- {
+		events = append(events, res.Chunk[i])
+	}
+	return events, nil
+}
+
+// RepliedMessages fetches the message which a command event replies to, and the messages to quote
+// from it: either just that message, or the whole thread which it is in if thread is true. It
+// returns a nil message if the event isn't a reply.
+func RepliedMessages(cli *gomatrix.Client, event *gomatrix.Event, thread bool) (*gomatrix.Event, []*gomatrix.Event, error) {
+	eventID := InReplyTo(event)
+	if eventID == "" {
+		return nil, nil, nil
+	}
+	replied, err := FetchEvent(cli, event.RoomID, eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !thread {
+		return replied, []*gomatrix.Event{replied}, nil
+	}
+	rootID := ThreadRoot(replied)
+	if rootID == "" {
+		rootID = replied.ID
+	}
+	events, err := FetchThread(cli, event.RoomID, rootID, maxThreadMessages)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Don't quote the command itself if it was sent in the thread
+	for i, e := range events {
+		if e.ID == event.ID {
+			events = append(events[:i], events[i+1:]...)
+			break
+		}
+	}
+	return replied, events, nil
+}
+
+// ThreadArg removes a "--thread" argument from the arguments of a command, returning whether it was
+// there.
+func ThreadArg(args []string) ([]string, bool) {
+	var rest []string
+	thread := false
+	for _, arg := range args {
+		if arg == "--thread" {
+			thread = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, thread
+}
+
+// MessageBody returns the body of a message event without any reply fallback.
+func MessageBody(event *gomatrix.Event) string {
+	body, _ := event.Body()
+	return StripReplyFallback(body)
+}
+
+// ThreadedReply returns the content of a message which responds to a command event in a thread. The
+// thread is the one which the command was sent in, otherwise the thread of the message which the
+// command replied to, or a new thread from that message.
+func ThreadedReply(event *gomatrix.Event, replied *gomatrix.Event, msgType, body string) map[string]interface{} {
+	rootID := ThreadRoot(event)
+	replyID := event.ID
+	if rootID == "" {
+		rootID = ThreadRoot(replied)
+		replyID = replied.ID
+	}
+	if rootID == "" {
+		rootID = replied.ID
+	}
+	return map[string]interface{}{
+		"msgtype": msgType,
+		"body":    body,
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        rootID,
+			"is_falling_back": true,
+			"m.in_reply_to": map[string]interface{}{
+				"event_id": replyID,
+			},
+		},
+	}
+}
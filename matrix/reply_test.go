@@ -0,0 +1,94 @@
+package matrix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/gomatrix"
+)
+
+func TestStripReplyFallback(t *testing.T) {
+	for body, want := range map[string]string{
+		"!github create bug":                             "!github create bug",
+		"> <@a:b> broken\n> still\n\n!github create bug": "!github create bug",
+		"> <@a:b> broken\n!github create bug":            "!github create bug",
+		"quoting\n> <@a:b> broken":                       "quoting\n> <@a:b> broken",
+	} {
+		if got := StripReplyFallback(body); got != want {
+			t.Errorf("StripReplyFallback(%q) want %q got %q", body, want, got)
+		}
+	}
+}
+
+func TestRepliedMessages(t *testing.T) {
+	responses := map[string]string{
+		"/_matrix/client/r0/rooms/!room:hyrule/event/$reply": `{"event_id":"$reply","sender":"@link:hyrule","type":"m.room.message",
+			"content":{"body":"> <@zelda:hyrule> hi\n\nit's broken","msgtype":"m.text",
+			"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$root"}}}}`,
+		"/_matrix/client/r0/rooms/!room:hyrule/event/$root": `{"event_id":"$root","sender":"@zelda:hyrule","type":"m.room.message",
+			"content":{"body":"hi","msgtype":"m.text"}}`,
+		"/_matrix/client/v1/rooms/!room:hyrule/relations/$root/m.thread": `{"chunk":[
+			{"event_id":"$command","sender":"@navi:hyrule","content":{"body":"!github create bug"}},
+			{"event_id":"$reply","sender":"@link:hyrule","content":{"body":"it's broken"}}]}`,
+	}
+	var requests []string
+	cli, _ := gomatrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.URL.Path)
+		body, ok := responses[req.URL.Path]
+		if !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	command := &gomatrix.Event{
+		ID:     "$command",
+		RoomID: "!room:hyrule",
+		Content: map[string]interface{}{
+			"body": "!github create bug",
+			"m.relates_to": map[string]interface{}{
+				"rel_type":      "m.thread",
+				"event_id":      "$root",
+				"m.in_reply_to": map[string]interface{}{"event_id": "$reply"},
+			},
+		},
+	}
+
+	replied, messages, err := RepliedMessages(cli, command, false)
+	if err != nil || replied.ID != "$reply" || len(messages) != 1 || MessageBody(messages[0]) != "it's broken" {
+		t.Fatalf("Expected the replied to message, got %v %v %v", replied, messages, err)
+	}
+	_, messages, err = RepliedMessages(cli, command, true)
+	if err != nil {
+		t.Fatalf("Failed to fetch thread: %s", err)
+	}
+	var ids []string
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"$root", "$reply"}) {
+		t.Errorf("Expected the thread without the command, got %v", ids)
+	}
+
+	reply := ThreadedReply(command, replied, "m.notice", "Created issue")
+	rel := reply["m.relates_to"].(map[string]interface{})
+	if rel["event_id"] != "$root" || rel["m.in_reply_to"].(map[string]interface{})["event_id"] != "$command" {
+		t.Errorf("Expected a reply to the command in its thread, got %v", rel)
+	}
+
+	// A thread message which doesn't reply to anything only has a fallback reply
+	command.Content["m.relates_to"].(map[string]interface{})["is_falling_back"] = true
+	if replied, _, _ := RepliedMessages(cli, command, false); replied != nil {
+		t.Errorf("Expected a fallback reply not to be a reply, got %v", replied)
+	}
+}
+
+func TestPermalink(t *testing.T) {
+	if link := Permalink("!room:hyrule", "$abc/def"); link != "https://matrix.to/#/%21room:hyrule/$abc%2Fdef" {
+		t.Errorf("Unexpected permalink %s", link)
+	}
+}
@@ -30,6 +30,18 @@ var (
 		Name: "goneb_auth_session_total",
 		Help: "The total number of successful /requestAuthSession requests",
 	}, []string{"realm_type"})
+	apiRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_api_requests_total",
+		Help: "The total number of requests to external APIs by cache result (hit, revalidated, miss)",
+	}, []string{"api", "result"})
+	apiRateLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goneb_api_ratelimit_remaining",
+		Help: "The number of requests remaining in the current rate limit window of an external API",
+	}, []string{"api", "client"})
+	apiRateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_api_rate_limited_total",
+		Help: "The total number of requests to external APIs which were refused due to rate limiting",
+	}, []string{"api"})
 )
 
 // IncrementCommand increments the pling command counter
@@ -52,9 +64,27 @@ func IncrementAuthSession(realmType string) {
 	authSessionCounter.With(prometheus.Labels{"realm_type": realmType}).Inc()
 }
 
+// IncrementAPIRequest increments the external API request counter
+func IncrementAPIRequest(api, result string) {
+	apiRequestCounter.With(prometheus.Labels{"api": api, "result": result}).Inc()
+}
+
+// SetAPIRateLimitRemaining sets the number of requests a client has left in an external API's rate limit
+func SetAPIRateLimitRemaining(api, client string, remaining int) {
+	apiRateLimitGauge.With(prometheus.Labels{"api": api, "client": client}).Set(float64(remaining))
+}
+
+// IncrementAPIRateLimited increments the rate limited external API request counter
+func IncrementAPIRateLimited(api string) {
+	apiRateLimitedCounter.With(prometheus.Labels{"api": api}).Inc()
+}
+
 func init() {
 	prometheus.MustRegister(cmdCounter)
 	prometheus.MustRegister(configureServicesCounter)
 	prometheus.MustRegister(webhookCounter)
 	prometheus.MustRegister(authSessionCounter)
+	prometheus.MustRegister(apiRequestCounter)
+	prometheus.MustRegister(apiRateLimitGauge)
+	prometheus.MustRegister(apiRateLimitedCounter)
 }
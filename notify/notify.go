@@ -0,0 +1,316 @@
+// Package notify delivers notifications from services into Matrix rooms.
+//
+// Services which send messages into rooms on their own accord (e.g. in response to a webhook or a
+// poll) should use Send rather than sending the message event themselves. This allows rooms to
+// control when they receive notifications.
+//
+// Quiet hours
+//
+// A room can declare quiet hours by sending a `m.room.bot.options` state event for the bot user
+// which has the following `content`:
+//
+//  {
+//    "quiet_hours": {
+//      "start": "22:00",
+//      "end": "07:00",
+//      "timezone": "Europe/London"
+//    }
+//  }
+//
+// The timezone is an IANA time zone name and defaults to UTC. During quiet hours, non-urgent
+// notifications are held back and delivered as a single summary message once quiet hours end.
+// Urgent notifications (e.g. critical alerts) are always delivered immediately.
+package notify
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/email"
+	"github.com/matrix-org/go-neb/eventstream"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often to check whether held back notifications can be delivered.
+const flushInterval = 1 * time.Minute
+
+var clientPool *clients.Clients
+
+// SetClients sets a pool of clients for delivering held back notifications.
+func SetClients(clis *clients.Clients) {
+	clientPool = clis
+}
+
+// QuietHours represents the "quiet_hours" section of a room's bot options.
+type QuietHours struct {
+	// The time of day quiet hours start, as "HH:MM".
+	Start string `json:"start"`
+	// The time of day quiet hours end, as "HH:MM". This may be earlier than Start, in which
+	// case quiet hours span midnight.
+	End string `json:"end"`
+	// Optional. The IANA time zone name which Start and End are in. Defaults to UTC.
+	Timezone string `json:"timezone"`
+}
+
+// Active returns true if the given time falls within these quiet hours.
+func (q *QuietHours) Active(now time.Time) (bool, error) {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false, fmt.Errorf("quiet_hours.start: %s", err)
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false, fmt.Errorf("quiet_hours.end: %s", err)
+	}
+	loc := time.UTC
+	if q.Timezone != "" {
+		if loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return false, fmt.Errorf("quiet_hours.timezone: %s", err)
+		}
+	}
+	local := now.In(loc)
+	mins := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return mins >= start && mins < end, nil
+	}
+	// spans midnight e.g. 22:00 -> 07:00
+	return mins >= start || mins < end, nil
+}
+
+// parseClock parses "HH:MM" into minutes past midnight.
+func parseClock(clock string) (int, error) {
+	segs := strings.Split(clock, ":")
+	if len(segs) != 2 {
+		return 0, fmt.Errorf("'%s' is not of the form HH:MM", clock)
+	}
+	h, err := strconv.Atoi(segs[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("'%s' has an invalid hour", clock)
+	}
+	m, err := strconv.Atoi(segs[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("'%s' has an invalid minute", clock)
+	}
+	return h*60 + m, nil
+}
+
+// quietHoursFor returns the quiet hours for the given bot user in the given room, or nil
+// if there are none.
+func quietHoursFor(userID, roomID string) *QuietHours {
+	logger := log.WithFields(log.Fields{
+		"room_id":     roomID,
+		"bot_user_id": userID,
+	})
+	opts, err := database.GetServiceDB().LoadBotOptions(userID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.WithError(err).Error("Failed to load bot options")
+		}
+		return nil
+	}
+	qhOpts, ok := opts.Options["quiet_hours"]
+	if !ok {
+		return nil
+	}
+	// Round-trip through JSON to get at the typed fields.
+	b, err := json.Marshal(qhOpts)
+	if err != nil {
+		return nil
+	}
+	var qh QuietHours
+	if err := json.Unmarshal(b, &qh); err != nil {
+		logger.WithError(err).WithField("quiet_hours", qhOpts).Error("Failed to parse quiet hours")
+		return nil
+	}
+	return &qh
+}
+
+// inQuietHours returns true if the room is currently in quiet hours for the given bot user.
+func inQuietHours(userID, roomID string, now time.Time) bool {
+	qh := quietHoursFor(userID, roomID)
+	if qh == nil {
+		return false
+	}
+	active, err := qh.Active(now)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:  err,
+			"room_id":     roomID,
+			"bot_user_id": userID,
+		}).Warn("Ignoring malformed quiet hours")
+		return false
+	}
+	return active
+}
+
+// SenderClient returns the client which should send messages into the given room: the client for
+// the room's user in senders if it has one, otherwise cli.
+func SenderClient(cli *gomatrix.Client, senders types.Senders, roomID string) (*gomatrix.Client, error) {
+	userID := senders[roomID]
+	if userID == "" || userID == cli.UserID {
+		return cli, nil
+	}
+	if clientPool == nil {
+		return nil, fmt.Errorf("no client for sender %s", userID)
+	}
+	return clientPool.Client(userID)
+}
+
+// Send sends a m.room.message notification into the given room as the given client.
+//
+// If the room is currently in quiet hours and the notification is not urgent, it is queued
+// and delivered as part of a summary when quiet hours end. Once the notification or summary has
+// been sent into the room, it is also emailed to the room's email recipients, if it has any, in the
+// background.
+func Send(cli *gomatrix.Client, roomID string, content interface{}, urgent bool) error {
+	_, err := SendEvent(cli, roomID, content, urgent)
+	return err
+}
+
+// SendEvent is like Send, but also returns the ID of the event which was sent so that services can
+// edit it later. The event ID is empty if the notification was held back.
+func SendEvent(cli *gomatrix.Client, roomID string, content interface{}, urgent bool) (string, error) {
+	eventID, err := sendEvent(cli, roomID, content, urgent)
+	if err == nil && eventID != "" {
+		// Sending email can be slow, so it mustn't hold up the caller.
+		go email.Deliver(cli.UserID, roomID, content)
+	}
+	return eventID, err
+}
+
+func sendEvent(cli *gomatrix.Client, roomID string, content interface{}, urgent bool) (string, error) {
+	now := time.Now()
+	if !urgent && inQuietHours(cli.UserID, roomID, now) {
+		contentJSON, err := json.Marshal(content)
+		if err != nil {
+			return "", err
+		}
+		log.WithFields(log.Fields{
+			"room_id": roomID,
+			"user_id": cli.UserID,
+		}).Info("Holding back notification during quiet hours")
+		return "", database.GetServiceDB().StoreQueuedNotification(types.QueuedNotification{
+			UserID:    cli.UserID,
+			RoomID:    roomID,
+			Content:   contentJSON,
+			Timestamp: now.UnixNano() / 1000000,
+		})
+	}
+	resp, err := cli.SendMessageEvent(roomID, "m.room.message", content)
+	if err != nil {
+		eventstream.Publish(eventstream.Event{
+			Type:   eventstream.TypeSendFailure,
+			RoomID: roomID,
+			UserID: cli.UserID,
+			Data:   map[string]interface{}{"error": err.Error()},
+		})
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// Start periodically delivering held back notifications.
+func Start() error {
+	go func() {
+		for {
+			flush(time.Now())
+			time.Sleep(flushInterval)
+		}
+	}()
+	return nil
+}
+
+// flush sends a summary of held back notifications into each room whose quiet hours have ended.
+func flush(now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Errorf("notify flush panicked!\n%s", debug.Stack())
+		}
+	}()
+	notifs, err := database.GetServiceDB().LoadQueuedNotifications()
+	if err != nil {
+		log.WithError(err).Error("Failed to load queued notifications")
+		return
+	}
+
+	type roomKey struct{ userID, roomID string }
+	var order []roomKey
+	byRoom := make(map[roomKey][]types.QueuedNotification)
+	for _, n := range notifs {
+		k := roomKey{n.UserID, n.RoomID}
+		if _, ok := byRoom[k]; !ok {
+			order = append(order, k)
+		}
+		byRoom[k] = append(byRoom[k], n)
+	}
+
+	for _, k := range order {
+		if inQuietHours(k.userID, k.roomID, now) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"room_id": k.roomID,
+			"user_id": k.userID,
+		})
+		cli, err := clientPool.Client(k.userID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load client for queued notifications")
+			continue
+		}
+		held := byRoom[k]
+		summary := summaryMessage(held)
+		if _, err := cli.SendMessageEvent(k.roomID, "m.room.message", summary); err != nil {
+			logger.WithError(err).Error("Failed to send quiet hours summary")
+			continue
+		}
+		go email.Deliver(k.userID, k.roomID, summary)
+		logger.WithField("count", len(held)).Info("Delivered quiet hours summary")
+		upTo := held[len(held)-1].Timestamp
+		if err := database.GetServiceDB().DeleteQueuedNotifications(k.userID, k.roomID, upTo); err != nil {
+			logger.WithError(err).Error("Failed to delete queued notifications")
+		}
+	}
+}
+
+// summaryMessage combines held back notifications into a single message.
+func summaryMessage(notifs []types.QueuedNotification) gomatrix.HTMLMessage {
+	var htmlBuffer bytes.Buffer
+	var plainBuffer bytes.Buffer
+	heading := fmt.Sprintf("%d notification(s) were held during quiet hours:", len(notifs))
+	htmlBuffer.WriteString(fmt.Sprintf("<strong>%s</strong><ul>", html.EscapeString(heading)))
+	plainBuffer.WriteString(heading + "\n")
+	for _, n := range notifs {
+		var content struct {
+			Body          string `json:"body"`
+			Format        string `json:"format"`
+			FormattedBody string `json:"formatted_body"`
+		}
+		if err := json.Unmarshal(n.Content, &content); err != nil {
+			continue
+		}
+		formatted := html.EscapeString(content.Body)
+		if content.Format == "org.matrix.custom.html" && content.FormattedBody != "" {
+			formatted = content.FormattedBody
+		}
+		htmlBuffer.WriteString(fmt.Sprintf("<li>%s</li>", formatted))
+		plainBuffer.WriteString(fmt.Sprintf(" - %s\n", content.Body))
+	}
+	htmlBuffer.WriteString("</ul>")
+	return gomatrix.HTMLMessage{
+		Body:          plainBuffer.String(),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBuffer.String(),
+	}
+}
@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+var quietHoursTests = []struct {
+	qh     QuietHours
+	now    string
+	expect bool
+}{
+	{QuietHours{Start: "22:00", End: "07:00"}, "2020-01-01T23:30:00Z", true},
+	{QuietHours{Start: "22:00", End: "07:00"}, "2020-01-01T03:00:00Z", true},
+	{QuietHours{Start: "22:00", End: "07:00"}, "2020-01-01T07:00:00Z", false},
+	{QuietHours{Start: "22:00", End: "07:00"}, "2020-01-01T12:00:00Z", false},
+	{QuietHours{Start: "12:00", End: "13:00"}, "2020-01-01T12:30:00Z", true},
+	{QuietHours{Start: "12:00", End: "13:00"}, "2020-01-01T13:30:00Z", false},
+	// 22:30 UTC is 07:30 the following morning in Tokyo
+	{QuietHours{Start: "22:00", End: "07:00", Timezone: "Asia/Tokyo"}, "2020-01-01T22:30:00Z", false},
+	{QuietHours{Start: "22:00", End: "07:00", Timezone: "Asia/Tokyo"}, "2020-01-01T14:30:00Z", true},
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	for _, test := range quietHoursTests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		active, err := test.qh.Active(now)
+		if err != nil {
+			t.Errorf("TestQuietHoursActive %+v: unexpected error %s", test.qh, err)
+			continue
+		}
+		if active != test.expect {
+			t.Errorf("TestQuietHoursActive %+v at %s: want %v got %v", test.qh, test.now, test.expect, active)
+		}
+	}
+	bad := QuietHours{Start: "25:00", End: "07:00"}
+	if _, err := bad.Active(time.Now()); err == nil {
+		t.Errorf("TestQuietHoursActive: expected error for malformed start time")
+	}
+}
+
+type mockStore struct {
+	database.NopStorage
+	quietHours map[string]interface{}
+	queued     []types.QueuedNotification
+	deleted    int
+}
+
+func (s *mockStore) LoadBotOptions(userID, roomID string) (types.BotOptions, error) {
+	return types.BotOptions{
+		UserID:  userID,
+		RoomID:  roomID,
+		Options: map[string]interface{}{"quiet_hours": s.quietHours},
+	}, nil
+}
+
+func (s *mockStore) StoreQueuedNotification(n types.QueuedNotification) error {
+	s.queued = append(s.queued, n)
+	return nil
+}
+
+func (s *mockStore) LoadQueuedNotifications() ([]types.QueuedNotification, error) {
+	return s.queued, nil
+}
+
+func (s *mockStore) DeleteQueuedNotifications(userID, roomID string, upToMs int64) error {
+	s.deleted++
+	return nil
+}
+
+func (s *mockStore) LoadMatrixClientConfig(userID string) (api.ClientConfig, error) {
+	return api.ClientConfig{
+		UserID:        userID,
+		HomeserverURL: "https://hyrule",
+		AccessToken:   "its_a_secret",
+	}, nil
+}
+
+func TestQuietHoursQueueAndFlush(t *testing.T) {
+	// Quiet hours covering the current time
+	now := time.Now().UTC()
+	store := &mockStore{
+		quietHours: map[string]interface{}{
+			"start": now.Add(-1 * time.Hour).Format("15:04"),
+			"end":   now.Add(1 * time.Hour).Format("15:04"),
+		},
+	}
+	database.SetServiceDB(store)
+
+	var sent []gomatrix.HTMLMessage
+	httpCli := &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:hyrule"}`)),
+		}, nil
+	})}
+	SetClients(clients.New(store, httpCli))
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = httpCli
+
+	if err := Send(cli, "!room:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "build passed"}, false); err != nil {
+		t.Fatalf("Send returned error: %s", err)
+	}
+	if err := Send(cli, "!room:hyrule", gomatrix.TextMessage{MsgType: "m.notice", Body: "prod is on fire"}, true); err != nil {
+		t.Fatalf("Send returned error: %s", err)
+	}
+	if len(sent) != 1 || sent[0].Body != "prod is on fire" {
+		t.Fatalf("Expected only the urgent notification to be sent, got %v", sent)
+	}
+	if len(store.queued) != 1 {
+		t.Fatalf("Expected 1 queued notification, got %d", len(store.queued))
+	}
+
+	// Still in quiet hours: nothing should be flushed
+	flush(now)
+	if len(sent) != 1 {
+		t.Fatalf("Expected no summary during quiet hours, got %v", sent)
+	}
+
+	// Quiet hours over
+	flush(now.Add(2 * time.Hour))
+	if len(sent) != 2 {
+		t.Fatalf("Expected a summary after quiet hours, got %v", sent)
+	}
+	if !strings.Contains(sent[1].Body, "build passed") {
+		t.Errorf("Expected summary to contain held notification, got %s", sent[1].Body)
+	}
+	if store.deleted != 1 {
+		t.Errorf("Expected queued notifications to be deleted, got %d deletes", store.deleted)
+	}
+}
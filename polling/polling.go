@@ -7,6 +7,7 @@ import (
 
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/eventstream"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 )
@@ -97,7 +98,17 @@ func pollLoop(service types.Service, ts int64) {
 	}
 	for {
 		logger.Info("OnPoll")
+		start := time.Now()
 		nextTime := poller.OnPoll(cli)
+		eventstream.Publish(eventstream.Event{
+			Type:        eventstream.TypePoll,
+			ServiceID:   service.ServiceID(),
+			ServiceType: service.ServiceType(),
+			Data: map[string]interface{}{
+				"duration_ms":  time.Since(start).Nanoseconds() / int64(time.Millisecond),
+				"next_poll_ts": nextTime.Unix(),
+			},
+		})
 		if pollTimeChanged(service, ts) {
 			logger.Info("Terminating poll.")
 			break
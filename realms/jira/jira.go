@@ -14,6 +14,7 @@ import (
 
 	jira "github.com/andygrunwald/go-jira"
 	"github.com/dghubble/oauth1"
+	"github.com/matrix-org/go-neb/apicache"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
 	"github.com/matrix-org/go-neb/types"
@@ -351,7 +352,7 @@ func (r *Realm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error
 		if err == sql.ErrNoRows {
 			if allowUnauth {
 				// make an unauthenticated client
-				return jira.NewClient(nil, r.JIRAEndpoint)
+				return r.unauthenticatedClient()
 			}
 		}
 		return nil, err
@@ -365,7 +366,7 @@ func (r *Realm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error
 	if jsession.AccessSecret == "" || jsession.AccessToken == "" {
 		if allowUnauth {
 			// make an unauthenticated client
-			return jira.NewClient(nil, r.JIRAEndpoint)
+			return r.unauthenticatedClient()
 		}
 		return nil, errors.New("No authenticated session found for " + userID)
 	}
@@ -375,9 +376,17 @@ func (r *Realm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error
 		context.TODO(),
 		oauth1.NewToken(jsession.AccessToken, jsession.AccessSecret),
 	)
+	httpClient.Transport = apicache.Transport("jira", jsession.AccessToken, httpClient.Transport)
 	return jira.NewClient(httpClient, r.JIRAEndpoint)
 }
 
+// unauthenticatedClient returns a jira.Client which caches responses to unauthenticated requests.
+func (r *Realm) unauthenticatedClient() (*jira.Client, error) {
+	return jira.NewClient(&http.Client{
+		Transport: apicache.Transport("jira", "", http.DefaultTransport),
+	}, r.JIRAEndpoint)
+}
+
 func (r *Realm) parsePrivateKey() error {
 	if r.privateKey != nil {
 		return nil
@@ -0,0 +1,191 @@
+// Package roomstate lets webhook services set room state from the requests they receive, such as
+// setting the topic to the version which was just deployed.
+//
+// Services have a list of Updates, each of which renders the content of a state event with a Go
+// template (https://golang.org/pkg/text/template/) executed with the service's webhook data. The
+// "json" function formats a value as JSON, for use inside content templates.
+//
+// Services only send state event types which are in their allowlist, and the bot user also needs
+// a high enough power level in the room to send them.
+//
+// m.room.pinned_events is handled specially: the template renders the text of a message, which is
+// sent and pinned in place of the message which the service pinned last time.
+package roomstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/gomatrix"
+)
+
+// The content key which marks messages pinned by a service, with the service ID as its value.
+const pinnedKey = "org.matrix.neb.pinned_by"
+
+// Update is a templated state event.
+type Update struct {
+	// The type of state event, e.g. "m.room.topic". This must be in the service's allowlist.
+	Type string `json:"type"`
+	// Optional. A template for the state key. Defaults to the empty state key.
+	StateKey string `json:"state_key"`
+	// A template which renders the content of the event as a JSON object. For m.room.topic and
+	// m.room.name it can render the topic or name instead. For m.room.pinned_events it renders
+	// the text of the message to pin.
+	Content string `json:"content"`
+	// Optional. Merge the content into the room's current state instead of replacing it. Keys
+	// which are set to null are removed. This is useful for changing a user's level in
+	// m.room.power_levels without touching the rest of it.
+	Merge bool `json:"merge"`
+}
+
+// A Compiled update has its templates parsed.
+type Compiled struct {
+	*Update
+	stateKey *template.Template
+	content  *template.Template
+}
+
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Compile checks that the updates are allowed and parses their templates.
+func Compile(updates []Update, allowedTypes []string) ([]*Compiled, error) {
+	allowed := make(map[string]bool)
+	for _, t := range allowedTypes {
+		allowed[t] = true
+	}
+	var compiled []*Compiled
+	for i := range updates {
+		u := &updates[i]
+		if u.Type == "" {
+			return nil, fmt.Errorf("state update %d has no type", i)
+		}
+		if !allowed[u.Type] {
+			return nil, fmt.Errorf("state update %d: %s is not in allowed_state_types", i, u.Type)
+		}
+		c := Compiled{Update: u}
+		var err error
+		if c.stateKey, err = template.New("state_key").Option("missingkey=zero").Funcs(templateFuncs).Parse(u.StateKey); err != nil {
+			return nil, fmt.Errorf("state update %d: state_key template is invalid: %s", i, err)
+		}
+		if c.content, err = template.New("content").Option("missingkey=zero").Funcs(templateFuncs).Parse(u.Content); err != nil {
+			return nil, fmt.Errorf("state update %d: content template is invalid: %s", i, err)
+		}
+		compiled = append(compiled, &c)
+	}
+	return compiled, nil
+}
+
+// render executes the templates, returning the state key and the raw content.
+func (c *Compiled) render(data interface{}) (string, string, error) {
+	var stateKey, content bytes.Buffer
+	if err := c.stateKey.Execute(&stateKey, data); err != nil {
+		return "", "", err
+	}
+	if err := c.content.Execute(&content, data); err != nil {
+		return "", "", err
+	}
+	return stateKey.String(), strings.TrimSpace(content.String()), nil
+}
+
+// Send renders the update with the data and sends it into the room, as the given service.
+func (c *Compiled) Send(cli *gomatrix.Client, serviceID, roomID string, data interface{}) error {
+	stateKey, raw, err := c.render(data)
+	if err != nil {
+		return err
+	}
+	if c.Type == "m.room.pinned_events" {
+		return pinMessage(cli, serviceID, roomID, raw)
+	}
+	var content map[string]interface{}
+	switch {
+	case c.Type == "m.room.topic" && !strings.HasPrefix(raw, "{"):
+		content = map[string]interface{}{"topic": raw}
+	case c.Type == "m.room.name" && !strings.HasPrefix(raw, "{"):
+		content = map[string]interface{}{"name": raw}
+	default:
+		if err := json.Unmarshal([]byte(raw), &content); err != nil {
+			return fmt.Errorf("content template did not render a JSON object: %s", err)
+		}
+	}
+	if c.Merge {
+		current := make(map[string]interface{})
+		if err := currentState(cli, roomID, c.Type, stateKey, &current); err != nil {
+			return err
+		}
+		content = merge(current, content)
+	}
+	_, err = cli.SendStateEvent(roomID, c.Type, stateKey, content)
+	return err
+}
+
+// currentState fetches the content of a state event. The room may not have the state event yet,
+// in which case content is left empty, but any other error is returned so that the state isn't
+// replaced by mistake.
+func currentState(cli *gomatrix.Client, roomID, eventType, stateKey string, content interface{}) error {
+	err := cli.StateEvent(roomID, eventType, stateKey, content)
+	if httpErr, ok := err.(gomatrix.HTTPError); ok {
+		if respErr, ok := httpErr.WrappedError.(gomatrix.RespError); ok && respErr.ErrCode == "M_NOT_FOUND" {
+			return nil
+		}
+	}
+	return err
+}
+
+// merge merges src into dst, recursing into objects. Keys which are null in src are removed.
+func merge(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			dst[k] = merge(dstMap, srcMap)
+		} else {
+			dst[k] = v
+		}
+	}
+	return dst
+}
+
+// pinMessage sends a message and pins it instead of the messages which the service pinned before.
+func pinMessage(cli *gomatrix.Client, serviceID, roomID, text string) error {
+	if text == "" {
+		return errors.New("content template rendered an empty message")
+	}
+	var pinned struct {
+		Pinned []string `json:"pinned"`
+	}
+	if err := currentState(cli, roomID, "m.room.pinned_events", "", &pinned); err != nil {
+		return err
+	}
+	resp, err := cli.SendMessageEvent(roomID, "m.room.message", map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    text,
+		pinnedKey: serviceID,
+	})
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, id := range pinned.Pinned {
+		if ev, err := matrix.FetchEvent(cli, roomID, id); err == nil && ev.Sender == cli.UserID && ev.Content[pinnedKey] == serviceID {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	ids = append(ids, resp.EventID)
+	_, err = cli.SendStateEvent(roomID, "m.room.pinned_events", "", map[string]interface{}{"pinned": ids})
+	return err
+}
@@ -0,0 +1,164 @@
+package roomstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/gomatrix"
+)
+
+// room stands in for a homeserver with a single room, recording the state events sent to it.
+type room struct {
+	state map[string]string // type/state_key => content JSON
+	sent  map[string]map[string]interface{}
+	msgs  int
+	// Fail requests for state with a 500
+	broken bool
+}
+
+func (r *room) client() *gomatrix.Client {
+	cli, _ := gomatrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		path := strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!room:hs/")
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		switch {
+		case strings.HasPrefix(path, "state/") && req.Method == "GET":
+			if r.broken {
+				return respond(500, `{"errcode":"M_UNKNOWN","error":"Internal server error"}`)
+			}
+			if content, ok := r.state[strings.TrimPrefix(path, "state/")]; ok {
+				return respond(200, content)
+			}
+			return respond(404, `{"errcode":"M_NOT_FOUND"}`)
+		case strings.HasPrefix(path, "state/"):
+			var content map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&content)
+			r.sent[strings.TrimPrefix(path, "state/")] = content
+			return respond(200, `{"event_id":"$state"}`)
+		case strings.HasPrefix(path, "send/m.room.message/"):
+			r.msgs++
+			return respond(200, `{"event_id":"$new"}`)
+		case path == "event/$old":
+			return respond(200, `{"event_id":"$old","sender":"@neb:hs","content":{"body":"On call: link","org.matrix.neb.pinned_by":"oncall"}}`)
+		case path == "event/$other":
+			return respond(200, `{"event_id":"$other","sender":"@zelda:hs","content":{"body":"Rules"}}`)
+		}
+		return respond(404, `{"errcode":"M_NOT_FOUND"}`)
+	})}
+	return cli
+}
+
+func compileOne(t *testing.T, u Update) *Compiled {
+	compiled, err := Compile([]Update{u}, []string{u.Type})
+	if err != nil {
+		t.Fatalf("Failed to compile %+v: %s", u, err)
+	}
+	return compiled[0]
+}
+
+func TestTopic(t *testing.T) {
+	r := &room{sent: make(map[string]map[string]interface{})}
+	data := map[string]string{"version": "v1.2.3"}
+	u := compileOne(t, Update{Type: "m.room.topic", Content: "Production: {{.version}}"})
+	if err := u.Send(r.client(), "deploys", "!room:hs", data); err != nil {
+		t.Fatal(err)
+	}
+	if r.sent["m.room.topic"]["topic"] != "Production: v1.2.3" {
+		t.Errorf("Unexpected topic: %v", r.sent)
+	}
+
+	u = compileOne(t, Update{Type: "com.example.release", StateKey: "{{.version}}", Content: `{"version": {{json .version}}}`})
+	if err := u.Send(r.client(), "deploys", "!room:hs", data); err != nil {
+		t.Fatal(err)
+	}
+	if r.sent["com.example.release/v1.2.3"]["version"] != "v1.2.3" {
+		t.Errorf("Unexpected custom state: %v", r.sent)
+	}
+}
+
+func TestMergePowerLevels(t *testing.T) {
+	r := &room{
+		state: map[string]string{"m.room.power_levels": `{"users":{"@zelda:hs":100,"@ganon:hs":50},"state_default":50}`},
+		sent:  make(map[string]map[string]interface{}),
+	}
+	u := compileOne(t, Update{
+		Type:    "m.room.power_levels",
+		Content: `{"users": {"{{.incoming}}": 50, "{{.outgoing}}": null}}`,
+		Merge:   true,
+	})
+	if err := u.Send(r.client(), "oncall", "!room:hs", map[string]string{"incoming": "@link:hs", "outgoing": "@ganon:hs"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"users":         map[string]interface{}{"@zelda:hs": float64(100), "@link:hs": float64(50)},
+		"state_default": float64(50),
+	}
+	if !reflect.DeepEqual(r.sent["m.room.power_levels"], want) {
+		t.Errorf("want power levels %v got %v", want, r.sent["m.room.power_levels"])
+	}
+}
+
+func TestPinnedMessage(t *testing.T) {
+	r := &room{
+		state: map[string]string{"m.room.pinned_events": `{"pinned":["$other","$old"]}`},
+		sent:  make(map[string]map[string]interface{}),
+	}
+	u := compileOne(t, Update{Type: "m.room.pinned_events", Content: "On call: {{.}}"})
+	if err := u.Send(r.client(), "oncall", "!room:hs", "zelda"); err != nil {
+		t.Fatal(err)
+	}
+	pinned := r.sent["m.room.pinned_events"]["pinned"]
+	if r.msgs != 1 || !reflect.DeepEqual(pinned, []interface{}{"$other", "$new"}) {
+		t.Errorf("Expected the service's old message to be replaced by the new one, got %v", pinned)
+	}
+}
+
+func TestStateFetchFailure(t *testing.T) {
+	merged := compileOne(t, Update{Type: "m.room.power_levels", Content: `{"users": {"{{.}}": 50}}`, Merge: true})
+	pinned := compileOne(t, Update{Type: "m.room.pinned_events", Content: "On call: {{.}}"})
+
+	// A room without the state yet is merged into and pinned in as normal
+	r := &room{state: map[string]string{}, sent: make(map[string]map[string]interface{})}
+	if err := merged.Send(r.client(), "oncall", "!room:hs", "@link:hs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinned.Send(r.client(), "oncall", "!room:hs", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.sent) != 2 {
+		t.Errorf("Expected the state to be sent when the room has none, got %v", r.sent)
+	}
+
+	// The state can't be replaced when the current state can't be fetched
+	r = &room{
+		state:  map[string]string{"m.room.power_levels": `{"users":{"@zelda:hs":100}}`},
+		sent:   make(map[string]map[string]interface{}),
+		broken: true,
+	}
+	if err := merged.Send(r.client(), "oncall", "!room:hs", "@link:hs"); err == nil {
+		t.Errorf("Expected an error merging into state which can't be fetched")
+	}
+	if err := pinned.Send(r.client(), "oncall", "!room:hs", "link"); err == nil {
+		t.Errorf("Expected an error pinning a message when the pinned events can't be fetched")
+	}
+	if len(r.sent) != 0 || r.msgs != 0 {
+		t.Errorf("Expected nothing to be sent, got %v and %d messages", r.sent, r.msgs)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	if _, err := Compile([]Update{{Type: "m.room.power_levels", Content: "{}"}}, []string{"m.room.topic"}); err == nil {
+		t.Errorf("Expected a state type which isn't allowed to be refused")
+	}
+	if _, err := Compile([]Update{{Type: "m.room.topic", Content: "{{.oops"}}, []string{"m.room.topic"}); err == nil {
+		t.Errorf("Expected an invalid template to be refused")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/roomstate"
+	"github.com/matrix-org/go-neb/statusboard"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	log "github.com/sirupsen/logrus"
@@ -22,7 +25,8 @@ const ServiceType = "alertmanager"
 //
 // This service will send notifications into a Matrix room when Alertmanager sends
 // webhook events to it. It requires a public domain which Alertmanager can reach.
-// Notices will be sent as the service user ID.
+// Notices will be sent as the service user ID, unless the room has a different sender in
+// "senders". Each sender must be a configured client.
 //
 // For the template strings, take a look at https://golang.org/pkg/text/template/
 // and the html variant https://golang.org/pkg/html/template/.
@@ -30,14 +34,29 @@ const ServiceType = "alertmanager"
 //
 // You can set msg_type to either m.text or m.notice
 //
+// Notifications which contain a firing alert with a "severity" label of "critical" are
+// considered urgent and will be delivered even if the room is in quiet hours.
+//
+// Rooms can also have state templates, e.g. to pin a message with the current on-call person or
+// change their power level, which are executed with the webhookNotification. Only state event
+// types listed in allowed_state_types can be set. See package roomstate.
+//
 // Example JSON request:
 //    {
 //        rooms: {
 //            "!ewfug483gsfe:localhost": {
 //                "text_template": "your plain text template goes here",
 //                "html_template": "your html template goes here",
-//                "msg_type": "m.text"
+//                "msg_type": "m.text",
+//                "status_entry": "alerts",
+//                "state": [
+//                    {"type": "m.room.pinned_events", "content": "On call: {{.CommonLabels.oncall}}"}
+//                ]
 //            },
+//        },
+//        allowed_state_types: ["m.room.pinned_events"],
+//        senders: {
+//            "!ewfug483gsfe:localhost": "@prod-alerts:localhost"
 //        }
 //    }
 type Service struct {
@@ -50,7 +69,16 @@ type Service struct {
 		TextTemplate string `json:"text_template"`
 		HTMLTemplate string `json:"html_template"`
 		MsgType      string `json:"msg_type"`
+		// Optional. The name of an entry on the room's status board which will be updated with
+		// the number of firing alerts. See package statusboard.
+		StatusEntry string `json:"status_entry"`
+		// Optional. State events to set in the room for each notification.
+		State []roomstate.Update `json:"state"`
 	} `json:"rooms"`
+	// Optional. A map of matrix rooms to the user ID to send notifications into that room as.
+	Senders types.Senders `json:"senders"`
+	// Optional. The state event types which rooms may set.
+	AllowedStateTypes []string `json:"allowed_state_types"`
 }
 
 // WebhookNotification is the payload from Alertmanager
@@ -95,6 +123,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		}
 		alert.SilenceURL = fmt.Sprintf("%s#silences/new?filter={%s}", notif.ExternalURL, strings.Join(filters, ","))
 	}
+	urgent := isUrgent(&notif)
 
 	for roomID, templates := range s.Rooms {
 		var msg interface{}
@@ -128,18 +157,63 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			}
 		}
 
+		sender, err := notify.SenderClient(cli, s.Senders, roomID)
+		if err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load sender for room")
+			continue
+		}
 		log.WithFields(log.Fields{
 			"message": msg,
 			"room_id": roomID,
+			"user_id": sender.UserID,
 		}).Print("Sending Alertmanager notification to room")
-		if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+		if e := notify.Send(sender, roomID, msg, urgent); e != nil {
 			log.WithError(e).WithField("room_id", roomID).Print(
 				"Failed to send Alertmanager notification to room.")
 		}
+		if templates.StatusEntry != "" {
+			if e := statusboard.Publish(sender, roomID, templates.StatusEntry, firingSummary(&notif)); e != nil {
+				log.WithError(e).WithField("room_id", roomID).Print("Failed to update status board.")
+			}
+		}
+		// we don't check whether the state templates compile because we already did when storing them in the db
+		updates, _ := roomstate.Compile(templates.State, s.AllowedStateTypes)
+		for _, u := range updates {
+			if e := u.Send(sender, s.ServiceID(), roomID, notif); e != nil {
+				log.WithError(e).WithFields(log.Fields{
+					"room_id": roomID,
+					"type":    u.Type,
+				}).Print("Failed to set room state.")
+			}
+		}
 	}
 	w.WriteHeader(200)
 }
 
+// isUrgent returns true if the notification contains a firing critical alert.
+func isUrgent(notif *WebhookNotification) bool {
+	for _, alert := range notif.Alerts {
+		if alert.Status == "firing" && alert.Labels["severity"] == "critical" {
+			return true
+		}
+	}
+	return false
+}
+
+// firingSummary returns a short description of how many alerts are firing.
+func firingSummary(notif *WebhookNotification) string {
+	firing := 0
+	for _, alert := range notif.Alerts {
+		if alert.Status == "firing" {
+			firing++
+		}
+	}
+	if firing == 0 {
+		return "all resolved"
+	}
+	return fmt.Sprintf("%d firing", firing)
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	s.WebhookURL = s.webhookEndpointURL
@@ -166,9 +240,22 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 		if templates.MsgType != "m.notice" && templates.MsgType != "m.text" {
 			return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
 		}
+		// validate that the state updates are allowed and their templates are valid
+		if _, err := roomstate.Compile(templates.State, s.AllowedStateTypes); err != nil {
+			return err
+		}
 	}
-	s.joinRooms(client)
-	return nil
+	for roomID := range s.Senders {
+		if _, ok := s.Rooms[roomID]; !ok {
+			return fmt.Errorf("sender configured for unknown room %s", roomID)
+		}
+	}
+	return s.joinRooms(client)
+}
+
+// SenderUserIDs returns the users which notifications are sent as, other than the service user.
+func (s *Service) SenderUserIDs() []string {
+	return s.Senders.UserIDs()
 }
 
 // PostRegister deletes this service if there are no registered repos.
@@ -188,16 +275,21 @@ func (s *Service) PostRegister(oldService types.Service) {
 	}
 }
 
-func (s *Service) joinRooms(client *gomatrix.Client) {
+func (s *Service) joinRooms(client *gomatrix.Client) error {
 	for roomID := range s.Rooms {
-		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+		sender, err := notify.SenderClient(client, s.Senders, roomID)
+		if err != nil {
+			return fmt.Errorf("sender for room %s: %s", roomID, err)
+		}
+		if _, err := sender.JoinRoom(roomID, "", nil); err != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
 				"room_id":    roomID,
-				"user_id":    client.UserID,
+				"user_id":    sender.UserID,
 			}).Error("Failed to join room")
 		}
 	}
+	return nil
 }
 
 func init() {
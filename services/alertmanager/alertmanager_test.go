@@ -2,9 +2,13 @@ package alertmanager
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
@@ -181,3 +185,78 @@ func checkSilenceLine(t *testing.T, line string, expectedKeys map[string]string)
 		t.Errorf("number of filter fields got %d, want %d", matched, len(expectedKeys))
 	}
 }
+
+type senderStore struct {
+	database.NopStorage
+}
+
+func (s *senderStore) LoadMatrixClientConfig(userID string) (api.ClientConfig, error) {
+	if userID != "@prod-alerts:hs" {
+		return api.ClientConfig{}, sql.ErrNoRows
+	}
+	return api.ClientConfig{
+		UserID:        userID,
+		HomeserverURL: "https://hs",
+		AccessToken:   "prod_secret",
+	}, nil
+}
+
+func TestSenders(t *testing.T) {
+	store := &senderStore{}
+	database.SetServiceDB(store)
+
+	// Record which access token each message was sent with
+	sentBy := make(map[string]string)
+	httpCli := &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		roomID := strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"), "/")[0]
+		token := req.URL.Query().Get("access_token")
+		if token == "" {
+			token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		}
+		if strings.Contains(req.URL.Path, "/send/m.room.message") {
+			sentBy[roomID] = token
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event","room_id":"` + roomID + `"}`)),
+		}, nil
+	})}
+	notify.SetClients(clients.New(store, httpCli))
+	defer notify.SetClients(nil)
+	matrixCli, _ := gomatrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = httpCli
+
+	config := `{
+		"rooms": {
+			"!team:hs": {"text_template": "{{.Status}}", "msg_type": "m.text"},
+			"!prod:hs": {"text_template": "{{.Status}}", "msg_type": "m.text"}
+		},
+		"senders": {"!prod:hs": "@prod-alerts:hs"}
+	}`
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(nil, matrixCli); err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+	if ids := srv.(types.MultiSender).SenderUserIDs(); len(ids) != 1 || ids[0] != "@prod-alerts:hs" {
+		t.Errorf("Unexpected sender user IDs: %v", ids)
+	}
+
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{"status":"firing"}`))
+	srv.OnReceiveWebhook(httptest.NewRecorder(), req, matrixCli)
+	if sentBy["!team:hs"] != "its_a_secret" || sentBy["!prod:hs"] != "prod_secret" {
+		t.Errorf("Expected each room to be sent to by its sender, got %v", sentBy)
+	}
+
+	for _, bad := range []string{
+		`{"rooms": {"!team:hs": {"text_template": "x", "msg_type": "m.text"}}, "senders": {"!team:hs": "@unknown:hs"}}`,
+		`{"rooms": {"!team:hs": {"text_template": "x", "msg_type": "m.text"}}, "senders": {"!other:hs": "@prod-alerts:hs"}}`,
+	} {
+		srv, _ := types.CreateService("id", ServiceType, "@neb:hs", []byte(bad))
+		if err := srv.Register(nil, matrixCli); err == nil {
+			t.Errorf("Expected config %s to be refused", bad)
+		}
+	}
+}
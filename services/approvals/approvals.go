@@ -0,0 +1,724 @@
+// Package approvals implements a Service which lets people approve deployments and changes from a room.
+package approvals
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Approvals service
+const ServiceType = "approvals"
+
+// Approval request statuses
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusTimedOut = "timed_out"
+)
+
+const (
+	defaultTimeoutMins = 60
+	pollInterval       = 1 * time.Minute
+)
+
+// Reaction keys which approve and reject requests. Variation selectors and skin tones are ignored.
+var (
+	approveKeys = map[string]bool{"👍": true, "✅": true}
+	rejectKeys  = map[string]bool{"👎": true, "❌": true}
+)
+
+// votesMutex serialises votes, so that two approvals arriving at once can't both miss the decision.
+var votesMutex sync.Mutex
+
+// Service contains the Config fields for the Approvals service.
+//
+// Pipelines request approval by POSTing to the service's webhook URL with the header
+// "Authorization: Bearer <secret>":
+//   {
+//       "title": "Deploy payments v1.2.3 to production",
+//       "description": "3 commits since v1.2.2",
+//       "url": "https://ci.example.com/pipelines/1234",
+//       "room_id": "!ops:localhost",
+//       "required_approvals": 2,
+//       "timeout_mins": 30,
+//       "callback_url": "https://ci.example.com/hooks/approvals/1234"
+//   }
+// Only "title" is required. The request is posted into the room, or the first of the service's
+// rooms, and the response contains its ID:
+//   HTTP/1.1 201 Created
+//   {"id": 42, "status": "pending", "poll_url": "https://neb.example.com/services/hooks/YXBwcm92YWxz?id=42"}
+//
+// Approvers approve or reject it by reacting with 👍 or 👎 (or ✅ and ❌), or with the commands
+// below. It is approved once enough different approvers approve it, and rejected as soon as one of
+// them rejects it. If nobody decides in time it times out.
+//
+// The decision is POSTed to the callback URL, if there is one, and can be polled for with a GET
+// of the poll URL with the same Authorization header. Both have the same JSON body, which includes
+// the request's audit trail:
+//   {
+//       "id": 42,
+//       "title": "Deploy payments v1.2.3 to production",
+//       "status": "approved",
+//       "required_approvals": 2,
+//       "approved_by": ["@alice:localhost", "@bob:localhost"],
+//       "created_at": 1603900000000,
+//       "expires_at": 1603901800000,
+//       "decided_at": 1603900600000,
+//       "audit": [{"user_id": "@alice:localhost", "action": "approved", "detail": "", "ts": 1603900300000}, ...]
+//   }
+// The status is one of "pending", "approved", "rejected" or "timed_out". A rejection also has
+// "rejected_by" and "reason". Callbacks are signed with the secret: the "X-Signature" header is
+// "sha256=" followed by the hex HMAC-SHA256 of the body. Callbacks which fail are retried every
+// minute, up to 5 times.
+//
+// Every request, vote, decision and callback is recorded in the database.
+//
+// Commands supported:
+//    !approvals
+//    !approve <request> [comment]
+//    !reject <request> [reason]
+//
+// Example JSON request:
+//   {
+//       "secret": "hunter2",
+//       "rooms": ["!ops:localhost"],
+//       "approvers": ["@alice:localhost", "@bob:localhost", "@carol:localhost"],
+//       "required_approvals": 1,
+//       "timeout_mins": 60
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which pipelines should POST approval requests to. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The secret which pipelines authenticate with, and which callbacks are signed with.
+	Secret string `json:"secret"`
+	// The rooms which approval requests can be posted into. Requests which don't name a room are
+	// posted into the first one.
+	Rooms []string `json:"rooms"`
+	// The users who can approve and reject requests.
+	Approvers []string `json:"approvers"`
+	// Optional. The minimum number of approvals a request needs. Requests can ask for more.
+	// Defaults to 1.
+	RequiredApprovals int `json:"required_approvals"`
+	// Optional. How long requests wait for a decision before timing out, unless the request says
+	// otherwise. Defaults to 60.
+	TimeoutMins int `json:"timeout_mins"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Secret == "" {
+		return errors.New("secret must be specified")
+	}
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room must be specified")
+	}
+	if len(s.Approvers) == 0 {
+		return errors.New("At least one approver must be specified")
+	}
+	if s.RequiredApprovals < 0 || s.TimeoutMins < 0 {
+		return errors.New("required_approvals and timeout_mins cannot be negative")
+	}
+	if s.requiredApprovals() > len(s.Approvers) {
+		return errors.New("required_approvals cannot be more than the number of approvers")
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (s *Service) requiredApprovals() int {
+	if s.RequiredApprovals == 0 {
+		return 1
+	}
+	return s.RequiredApprovals
+}
+
+func (s *Service) timeout() time.Duration {
+	if s.TimeoutMins == 0 {
+		return defaultTimeoutMins * time.Minute
+	}
+	return time.Duration(s.TimeoutMins) * time.Minute
+}
+
+func (s *Service) isApprover(userID string) bool {
+	for _, u := range s.Approvers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) hasRoom(roomID string) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (s *Service) audit(requestID int64, userID, action, detail string) {
+	err := database.GetServiceDB().InsertApprovalAudit(types.ApprovalAuditEntry{
+		ServiceID: s.ServiceID(),
+		RequestID: requestID,
+		UserID:    userID,
+		Action:    action,
+		Detail:    detail,
+		Timestamp: nowMs(),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"request":    requestID,
+			"action":     action,
+		}).Error("Failed to record approval audit entry")
+	}
+}
+
+// incomingRequest is the body of a request for approval.
+type incomingRequest struct {
+	Title             string `json:"title"`
+	Description       string `json:"description"`
+	URL               string `json:"url"`
+	RoomID            string `json:"room_id"`
+	RequiredApprovals int    `json:"required_approvals"`
+	TimeoutMins       int    `json:"timeout_mins"`
+	CallbackURL       string `json:"callback_url"`
+}
+
+// OnReceiveWebhook creates approval requests from POSTs and returns their status for GETs.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Secret)) != 1 {
+		w.WriteHeader(401)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		s.onPoll(w, req)
+	case "POST":
+		s.onRequest(w, req, cli)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (s *Service) onPoll(w http.ResponseWriter, req *http.Request) {
+	requestID, err := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, 400, errors.New("id must be a request number"))
+		return
+	}
+	r, err := database.GetServiceDB().LoadApprovalRequest(s.ServiceID(), requestID)
+	if err == sql.ErrNoRows {
+		writeError(w, 404, fmt.Errorf("Approval request %d doesn't exist", requestID))
+		return
+	} else if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to load approval request")
+		writeError(w, 500, errors.New("Failed to load approval request"))
+		return
+	}
+	status, err := s.status(r)
+	if err != nil {
+		writeError(w, 500, errors.New("Failed to load approval audit trail"))
+		return
+	}
+	writeJSON(w, 200, status)
+}
+
+func (s *Service) onRequest(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	var in incomingRequest
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		writeError(w, 400, fmt.Errorf("Failed to parse request: %s", err))
+		return
+	}
+	if err := s.checkRequest(&in); err != nil {
+		writeError(w, 400, err)
+		return
+	}
+	now := time.Now()
+	timeout := s.timeout()
+	if in.TimeoutMins > 0 {
+		timeout = time.Duration(in.TimeoutMins) * time.Minute
+	}
+	r := types.ApprovalRequest{
+		ServiceID:         s.ServiceID(),
+		RoomID:            in.RoomID,
+		Title:             in.Title,
+		Description:       in.Description,
+		URL:               in.URL,
+		RequiredApprovals: in.RequiredApprovals,
+		Status:            StatusPending,
+		CallbackURL:       in.CallbackURL,
+		CreatedTimestamp:  now.UnixNano() / int64(time.Millisecond),
+		ExpiresTimestamp:  now.Add(timeout).UnixNano() / int64(time.Millisecond),
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    r.RoomID,
+	})
+	db := database.GetServiceDB()
+	if err := db.InsertApprovalRequest(&r); err != nil {
+		logger.WithError(err).Error("Failed to insert approval request")
+		writeError(w, 500, errors.New("Failed to store approval request"))
+		return
+	}
+	s.audit(r.RequestID, "", "requested", r.Title)
+	resp, err := cli.SendMessageEvent(r.RoomID, "m.room.message", s.message(r, nil, nil))
+	if err != nil {
+		logger.WithError(err).Error("Failed to post approval request")
+		writeError(w, 502, errors.New("Failed to post approval request into the room"))
+		return
+	}
+	r.EventID = resp.EventID
+	if err := db.UpdateApprovalRequest(r); err != nil {
+		logger.WithError(err).Error("Failed to update approval request")
+	}
+	logger.WithField("request", r.RequestID).Info("Posted approval request")
+	writeJSON(w, 201, map[string]interface{}{
+		"id":       r.RequestID,
+		"status":   r.Status,
+		"poll_url": s.WebhookURL + "?id=" + strconv.FormatInt(r.RequestID, 10),
+	})
+}
+
+// checkRequest validates a request for approval and fills in its defaults.
+func (s *Service) checkRequest(in *incomingRequest) error {
+	if strings.TrimSpace(in.Title) == "" {
+		return errors.New("title must be specified")
+	}
+	if in.RoomID == "" {
+		in.RoomID = s.Rooms[0]
+	} else if !s.hasRoom(in.RoomID) {
+		return fmt.Errorf("Room %s isn't one of the service's rooms", in.RoomID)
+	}
+	if in.RequiredApprovals < s.requiredApprovals() {
+		in.RequiredApprovals = s.requiredApprovals()
+	}
+	if in.RequiredApprovals > len(s.Approvers) {
+		return fmt.Errorf("required_approvals cannot be more than the %d approvers", len(s.Approvers))
+	}
+	if in.TimeoutMins < 0 {
+		return errors.New("timeout_mins cannot be negative")
+	}
+	if in.CallbackURL != "" && !strings.HasPrefix(in.CallbackURL, "http://") && !strings.HasPrefix(in.CallbackURL, "https://") {
+		return errors.New("callback_url must start with http[s]://")
+	}
+	return nil
+}
+
+// votes returns the approvers who approved the request, in order, and the rejection if there is one.
+func votes(audit []types.ApprovalAuditEntry) (approvedBy []string, rejection *types.ApprovalAuditEntry) {
+	seen := make(map[string]bool)
+	for i, e := range audit {
+		switch e.Action {
+		case StatusApproved:
+			if !seen[e.UserID] {
+				seen[e.UserID] = true
+				approvedBy = append(approvedBy, e.UserID)
+			}
+		case StatusRejected:
+			if rejection == nil {
+				rejection = &audit[i]
+			}
+		}
+	}
+	return
+}
+
+// summary describes the state of a request, e.g. "approved by @alice:localhost and @bob:localhost".
+func summary(r types.ApprovalRequest, approvedBy []string, rejection *types.ApprovalAuditEntry) string {
+	switch r.Status {
+	case StatusApproved:
+		return "approved by " + strings.Join(approvedBy, ", ")
+	case StatusRejected:
+		text := "rejected by " + rejection.UserID
+		if rejection.Detail != "" {
+			text += ": " + rejection.Detail
+		}
+		return text
+	case StatusTimedOut:
+		return fmt.Sprintf("timed out with %d of %d approvals", len(approvedBy), r.RequiredApprovals)
+	}
+	text := fmt.Sprintf("waiting for approval (%d of %d)", len(approvedBy), r.RequiredApprovals)
+	if len(approvedBy) > 0 {
+		text += ", approved by " + strings.Join(approvedBy, ", ")
+	}
+	return text
+}
+
+// message renders the message which represents a request in the room.
+func (s *Service) message(r types.ApprovalRequest, approvedBy []string, rejection *types.ApprovalAuditEntry) gomatrix.HTMLMessage {
+	var plain, formatted []string
+	plain = append(plain, fmt.Sprintf("Approval #%d: %s", r.RequestID, r.Title))
+	formatted = append(formatted, fmt.Sprintf("<strong>Approval #%d: %s</strong>", r.RequestID, html.EscapeString(r.Title)))
+	if r.Description != "" {
+		plain = append(plain, r.Description)
+		formatted = append(formatted, html.EscapeString(r.Description))
+	}
+	if r.URL != "" {
+		plain = append(plain, r.URL)
+		formatted = append(formatted, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(r.URL), html.EscapeString(r.URL)))
+	}
+	status := "Status: " + summary(r, approvedBy, rejection)
+	plain = append(plain, status)
+	formatted = append(formatted, "<em>"+html.EscapeString(status)+"</em>")
+	if r.Status == StatusPending {
+		expires := time.Unix(0, r.ExpiresTimestamp*int64(time.Millisecond)).UTC().Format("15:04 MST")
+		help := fmt.Sprintf("React with 👍 to approve or 👎 to reject, or use !approve %d or !reject %d <reason>, before %s.",
+			r.RequestID, r.RequestID, expires)
+		plain = append(plain, help)
+		formatted = append(formatted, html.EscapeString(help))
+	}
+	return gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Body:          strings.Join(plain, "\n"),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(formatted, "<br>"),
+	}
+}
+
+// updateMessage edits the request's message to show its current state.
+func (s *Service) updateMessage(cli *gomatrix.Client, r types.ApprovalRequest, approvedBy []string, rejection *types.ApprovalAuditEntry) {
+	if r.EventID == "" {
+		return
+	}
+	msg := s.message(r, approvedBy, rejection)
+	_, err := cli.SendMessageEvent(r.RoomID, "m.room.message", map[string]interface{}{
+		"msgtype":        msg.MsgType,
+		"body":           "* " + msg.Body,
+		"format":         msg.Format,
+		"formatted_body": "* " + msg.FormattedBody,
+		"m.new_content":  msg,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": r.EventID,
+		},
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"request":    r.RequestID,
+		}).Error("Failed to update approval request message")
+	}
+}
+
+// reply sends a notice into the room in reply to the request's message.
+func (s *Service) reply(cli *gomatrix.Client, r types.ApprovalRequest, text string) {
+	content := map[string]interface{}{"msgtype": "m.notice", "body": text}
+	if r.EventID != "" {
+		content["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": r.EventID},
+		}
+	}
+	if _, err := cli.SendMessageEvent(r.RoomID, "m.room.message", content); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"request":    r.RequestID,
+		}).Error("Failed to send approval notice")
+	}
+}
+
+// vote records an approval or rejection of a request by a user, deciding the request if it has
+// enough approvals or was rejected. It returns a description of the request's new state.
+func (s *Service) vote(cli *gomatrix.Client, requestID int64, userID string, approve bool, detail string) (string, error) {
+	r, approvedBy, rejection, err := s.recordVote(requestID, userID, approve, detail)
+	if err != nil {
+		return "", err
+	}
+	// The callback can take a while, so it mustn't hold up the sync loop or other votes.
+	if r.CallbackStatus == "pending" {
+		callback := r
+		go s.deliverCallback(&callback)
+	}
+	s.updateMessage(cli, r, approvedBy, rejection)
+	return fmt.Sprintf("Approval #%d %s", r.RequestID, summary(r, approvedBy, rejection)), nil
+}
+
+// recordVote stores a vote and decides the request if need be, returning the request and its votes.
+func (s *Service) recordVote(requestID int64, userID string, approve bool, detail string) (r types.ApprovalRequest, approvedBy []string, rejection *types.ApprovalAuditEntry, err error) {
+	votesMutex.Lock()
+	defer votesMutex.Unlock()
+	db := database.GetServiceDB()
+	r, err = db.LoadApprovalRequest(s.ServiceID(), requestID)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("Approval request #%d doesn't exist", requestID)
+		return
+	} else if err != nil {
+		return
+	}
+	if r.Status != StatusPending {
+		err = fmt.Errorf("Approval request #%d has already been %s", requestID, strings.Replace(r.Status, "_", " ", -1))
+		return
+	}
+	// It will be timed out on the next poll.
+	if nowMs() >= r.ExpiresTimestamp {
+		err = fmt.Errorf("Approval request #%d has expired", requestID)
+		return
+	}
+	audit, err := db.LoadApprovalAudit(s.ServiceID(), requestID)
+	if err != nil {
+		return
+	}
+	approvedBy, _ = votes(audit)
+	if approve {
+		for _, u := range approvedBy {
+			if u == userID {
+				err = fmt.Errorf("You have already approved #%d", requestID)
+				return
+			}
+		}
+	}
+
+	action := StatusRejected
+	if approve {
+		action = StatusApproved
+	}
+	entry := types.ApprovalAuditEntry{
+		ServiceID: s.ServiceID(),
+		RequestID: requestID,
+		UserID:    userID,
+		Action:    action,
+		Detail:    detail,
+		Timestamp: nowMs(),
+	}
+	if err = db.InsertApprovalAudit(entry); err != nil {
+		return
+	}
+	audit = append(audit, entry)
+	approvedBy, rejection = votes(audit)
+	if rejection != nil {
+		r.Status = StatusRejected
+	} else if len(approvedBy) >= r.RequiredApprovals {
+		r.Status = StatusApproved
+	}
+	if r.Status != StatusPending {
+		s.decide(&r)
+	}
+	return
+}
+
+// decide stores the decision on a request. If it has a callback URL, the callback is left pending
+// for the caller to deliver once it has released votesMutex.
+func (s *Service) decide(r *types.ApprovalRequest) {
+	r.DecidedTimestamp = nowMs()
+	if r.CallbackURL != "" {
+		r.CallbackStatus = "pending"
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"request":    r.RequestID,
+		"status":     r.Status,
+	})
+	if err := database.GetServiceDB().UpdateApprovalRequest(*r); err != nil {
+		logger.WithError(err).Error("Failed to update approval request")
+	}
+	logger.Info("Approval request decided")
+}
+
+// OnReceiveEvent approves and rejects requests from reactions to their messages.
+func (s *Service) OnReceiveEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if event.Type != "m.reaction" || event.Sender == cli.UserID || !s.hasRoom(event.RoomID) {
+		return
+	}
+	rel, _ := event.Content["m.relates_to"].(map[string]interface{})
+	if relType, _ := rel["rel_type"].(string); relType != "m.annotation" {
+		return
+	}
+	eventID, _ := rel["event_id"].(string)
+	key, _ := rel["key"].(string)
+	key = strings.TrimRight(key, "\ufe0f\U0001F3FB\U0001F3FC\U0001F3FD\U0001F3FE\U0001F3FF")
+	if !approveKeys[key] && !rejectKeys[key] {
+		return
+	}
+	r, err := database.GetServiceDB().LoadApprovalRequestByEvent(s.ServiceID(), eventID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to load approval request")
+		}
+		return
+	}
+	if r.Status != StatusPending || !s.isApprover(event.Sender) {
+		return
+	}
+	text, err := s.vote(cli, r.RequestID, event.Sender, approveKeys[key], "")
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Failed to vote on approval request")
+		return
+	}
+	s.reply(cli, r, text)
+}
+
+// OnPoll times out requests which have waited too long, and retries callbacks which failed.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	s.expire(cli, time.Now())
+	return time.Now().Add(pollInterval)
+}
+
+func (s *Service) expire(cli *gomatrix.Client, now time.Time) {
+	logger := log.WithField("service_id", s.ServiceID())
+	db := database.GetServiceDB()
+	reqs, err := db.LoadOutstandingApprovalRequests(s.ServiceID())
+	if err != nil {
+		logger.WithError(err).Error("Failed to load outstanding approval requests")
+		return
+	}
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	for _, r := range reqs {
+		if r.Status != StatusPending {
+			s.deliverCallback(&r)
+			continue
+		}
+		if nowMs < r.ExpiresTimestamp {
+			continue
+		}
+		votesMutex.Lock()
+		// A vote may have decided it since it was loaded.
+		current, err := db.LoadApprovalRequest(s.ServiceID(), r.RequestID)
+		if err != nil || current.Status != StatusPending {
+			votesMutex.Unlock()
+			continue
+		}
+		audit, err := db.LoadApprovalAudit(s.ServiceID(), r.RequestID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load approval audit trail")
+			votesMutex.Unlock()
+			continue
+		}
+		approvedBy, _ := votes(audit)
+		s.audit(r.RequestID, "", StatusTimedOut, "")
+		r.Status = StatusTimedOut
+		s.decide(&r)
+		votesMutex.Unlock()
+		s.updateMessage(cli, r, approvedBy, nil)
+		s.reply(cli, r, fmt.Sprintf("Approval #%d %s", r.RequestID, summary(r, approvedBy, nil)))
+		if r.CallbackStatus == "pending" {
+			s.deliverCallback(&r)
+		}
+	}
+}
+
+// Commands supported:
+//    !approvals
+//    !approve <request> [comment]
+//    !reject <request> [reason]
+// Commands are only accepted in the service's rooms, and !approve and !reject only from approvers.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"approvals"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if !s.hasRoom(roomID) {
+					return nil, errors.New("Approvals can only be listed in the approval rooms")
+				}
+				return s.cmdApprovals(roomID)
+			},
+		},
+		s.voteCommand(cli, "approve", true),
+		s.voteCommand(cli, "reject", false),
+	}
+}
+
+func (s *Service) cmdApprovals(roomID string) (interface{}, error) {
+	reqs, err := database.GetServiceDB().LoadOutstandingApprovalRequests(s.ServiceID())
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, r := range reqs {
+		if r.Status != StatusPending || r.RoomID != roomID {
+			continue
+		}
+		audit, err := database.GetServiceDB().LoadApprovalAudit(s.ServiceID(), r.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		approvedBy, _ := votes(audit)
+		lines = append(lines, fmt.Sprintf("#%d %s: %d of %d approvals", r.RequestID, r.Title, len(approvedBy), r.RequiredApprovals))
+	}
+	if len(lines) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "There are no pending approval requests."}, nil
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+}
+
+func (s *Service) voteCommand(cli *gomatrix.Client, name string, approve bool) types.Command {
+	return types.Command{
+		Path: []string{name},
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("Usage: !%s <request> [comment]", name)
+			}
+			if !s.isApprover(userID) {
+				return nil, errors.New("You aren't allowed to approve or reject requests")
+			}
+			requestID, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not an approval request number", args[0])
+			}
+			r, err := database.GetServiceDB().LoadApprovalRequest(s.ServiceID(), requestID)
+			if err == sql.ErrNoRows || (err == nil && r.RoomID != roomID) {
+				return nil, fmt.Errorf("Approval request #%d doesn't exist in this room", requestID)
+			} else if err != nil {
+				return nil, err
+			}
+			text, err := s.vote(cli, requestID, userID, approve, strings.Join(args[1:], " "))
+			if err != nil {
+				return nil, err
+			}
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: text}, nil
+		},
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
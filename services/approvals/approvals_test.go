@@ -0,0 +1,279 @@
+package approvals
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// mockStore is safe for concurrent use, as callbacks are delivered in the background.
+type mockStore struct {
+	database.NopStorage
+	mu    sync.Mutex
+	reqs  []types.ApprovalRequest
+	audit []types.ApprovalAuditEntry
+}
+
+// request returns a copy of a stored request.
+func (s *mockStore) request(requestID int64) types.ApprovalRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs[requestID-1]
+}
+
+func (s *mockStore) InsertApprovalRequest(r *types.ApprovalRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.RequestID = int64(len(s.reqs) + 1)
+	s.reqs = append(s.reqs, *r)
+	return nil
+}
+
+func (s *mockStore) UpdateApprovalRequest(r types.ApprovalRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs[r.RequestID-1] = r
+	return nil
+}
+
+func (s *mockStore) LoadApprovalRequest(serviceID string, requestID int64) (types.ApprovalRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if requestID < 1 || int(requestID) > len(s.reqs) {
+		return types.ApprovalRequest{}, sql.ErrNoRows
+	}
+	return s.reqs[requestID-1], nil
+}
+
+func (s *mockStore) LoadApprovalRequestByEvent(serviceID, eventID string) (types.ApprovalRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.reqs {
+		if r.EventID == eventID {
+			return r, nil
+		}
+	}
+	return types.ApprovalRequest{}, sql.ErrNoRows
+}
+
+func (s *mockStore) LoadOutstandingApprovalRequests(serviceID string) (reqs []types.ApprovalRequest, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.reqs {
+		if r.Status == StatusPending || r.CallbackStatus == "pending" {
+			reqs = append(reqs, r)
+		}
+	}
+	return
+}
+
+func (s *mockStore) InsertApprovalAudit(e types.ApprovalAuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *mockStore) LoadApprovalAudit(serviceID string, requestID int64) (entries []types.ApprovalAuditEntry, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.audit {
+		if e.RequestID == requestID {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// callbacks stands in for a pipeline, recording the callbacks it receives.
+type callbacks struct {
+	fail   bool
+	bodies []requestStatus
+}
+
+func (c *callbacks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if c.fail || r.Header.Get("X-Signature") != sign("hunter2", body) {
+		w.WriteHeader(500)
+		return
+	}
+	var status requestStatus
+	json.Unmarshal(body, &status)
+	c.bodies = append(c.bodies, status)
+}
+
+func newService(t *testing.T) (*Service, *mockStore, *[]testutils.SentMessage, *gomatrix.Client) {
+	store := &mockStore{}
+	database.SetServiceDB(store)
+	var sent []testutils.SentMessage
+	cli := testutils.NewMatrixClient(&sent, "$request:hyrule")
+	s := testutils.NewService(t, ServiceType, `{
+		"secret": "hunter2",
+		"rooms": ["!ops:hyrule"],
+		"approvers": ["@zelda:hyrule", "@impa:hyrule", "@rauru:hyrule"],
+		"required_approvals": 2
+	}`, cli).(*Service)
+	return s, store, &sent, cli
+}
+
+func request(s *Service, cli *gomatrix.Client, method, query, body string) (int, map[string]interface{}) {
+	req, _ := http.NewRequest(method, "https://neb/services/hooks/id"+query, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer hunter2")
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	var res map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func reaction(userID, key string) *gomatrix.Event {
+	return &gomatrix.Event{
+		Type:   "m.reaction",
+		Sender: userID,
+		RoomID: "!ops:hyrule",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": "$request:hyrule",
+				"key":      key,
+			},
+		},
+	}
+}
+
+// waitForCallback waits for a callback for a request to be attempted in the background.
+func waitForCallback(store *mockStore, requestID int64, attempts int) types.ApprovalRequest {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := store.request(requestID)
+		deliveringMutex.Lock()
+		inFlight := delivering[deliveryKey{"id", requestID}]
+		deliveringMutex.Unlock()
+		if (r.CallbackAttempts >= attempts && !inFlight) || time.Now().After(deadline) {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	s, store, sent, cli := newService(t)
+	cb := &callbacks{}
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(`{"title":"Deploy"}`))
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	if w.Code != 401 {
+		t.Errorf("Expected an unauthenticated request to return 401, got %d", w.Code)
+	}
+	if code, _ := request(s, cli, "POST", "", `{"title":"Deploy", "required_approvals": 4}`); code != 400 {
+		t.Errorf("Expected a request needing more approvals than approvers to return 400, got %d", code)
+	}
+
+	code, res := request(s, cli, "POST", "", `{"title":"Deploy payments v1.2.3","url":"https://ci/1234","callback_url":"`+srv.URL+`"}`)
+	if code != 201 || res["id"] != float64(1) || res["poll_url"] != s.WebhookURL+"?id=1" {
+		t.Fatalf("Unexpected response to approval request: %d %v", code, res)
+	}
+	if len(*sent) != 1 || !strings.HasPrefix((*sent)[0].Body(), "Approval #1: Deploy payments v1.2.3\nhttps://ci/1234\nStatus: waiting for approval (0 of 2)") {
+		t.Fatalf("Expected the request to be posted into the room, got %v", *sent)
+	}
+
+	// Reactions from people who aren't approvers are ignored
+	s.OnReceiveEvent(cli, reaction("@link:hyrule", "👍"))
+	s.OnReceiveEvent(cli, reaction("@zelda:hyrule", "👍🏽"))
+	if len(*sent) != 3 {
+		t.Fatalf("Expected an edit and a reply to the approval, got %v", *sent)
+	}
+	if (*sent)[2].Body() != "Approval #1 waiting for approval (1 of 2), approved by @zelda:hyrule" {
+		t.Errorf("Unexpected reply to approval: %v", (*sent)[2].Body())
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@zelda:hyrule", "approve 1"); err == nil {
+		t.Errorf("Expected a second approval from the same user to be rejected")
+	}
+	body, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@impa:hyrule", "approve #1 ship it")
+	if err != nil {
+		t.Fatalf("approve returned error: %s", err)
+	}
+	if body != "Approval #1 approved by @zelda:hyrule, @impa:hyrule" {
+		t.Errorf("Unexpected approve response: %s", body)
+	}
+	r := waitForCallback(store, 1, 1)
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@rauru:hyrule", "reject 1"); err == nil || err.Error() != "Approval request #1 has already been approved" {
+		t.Errorf("Expected a decided request to be closed, got %v", err)
+	}
+
+	if len(cb.bodies) != 1 || cb.bodies[0].Status != StatusApproved || len(cb.bodies[0].ApprovedBy) != 2 {
+		t.Fatalf("Expected a signed callback with the decision, got %+v", cb.bodies)
+	}
+	if r.CallbackStatus != "delivered" {
+		t.Errorf("Expected the callback to be marked as delivered, got %s", r.CallbackStatus)
+	}
+	code, res = request(s, cli, "GET", "?id=1", "")
+	if code != 200 || res["status"] != StatusApproved {
+		t.Fatalf("Unexpected poll response: %d %v", code, res)
+	}
+	var actions []string
+	for _, e := range res["audit"].([]interface{}) {
+		actions = append(actions, e.(map[string]interface{})["action"].(string))
+	}
+	if strings.Join(actions, ",") != "requested,approved,approved,callback_delivered" {
+		t.Errorf("Unexpected audit trail: %v", actions)
+	}
+}
+
+func TestRejectAndTimeout(t *testing.T) {
+	s, store, sent, cli := newService(t)
+	cb := &callbacks{fail: true}
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	request(s, cli, "POST", "", `{"title":"Drop the users table","callback_url":"`+srv.URL+`"}`)
+	request(s, cli, "POST", "", `{"title":"Deploy","timeout_mins":5}`)
+	body, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@rauru:hyrule", "reject 1 not on a Friday")
+	if err != nil {
+		t.Fatalf("reject returned error: %s", err)
+	}
+	if body != "Approval #1 rejected by @rauru:hyrule: not on a Friday" {
+		t.Errorf("Unexpected reject response: %s", body)
+	}
+	if r := waitForCallback(store, 1, 1); r.CallbackStatus != "pending" || r.CallbackAttempts != 1 {
+		t.Errorf("Expected the failed callback to be retried, got %+v", r)
+	}
+
+	// Votes aren't accepted once a request has expired, even before it has been timed out
+	store.mu.Lock()
+	store.reqs[1].ExpiresTimestamp = nowMs() - 1
+	store.mu.Unlock()
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@zelda:hyrule", "approve 2"); err == nil || err.Error() != "Approval request #2 has expired" {
+		t.Errorf("Expected a vote on an expired request to be rejected, got %v", err)
+	}
+
+	*sent = nil
+	cb.fail = false
+	s.expire(cli, time.Now().Add(10*time.Minute))
+	if r := store.request(2); r.Status != StatusTimedOut {
+		t.Errorf("Expected the request to time out, got %s", r.Status)
+	}
+	if len(*sent) != 2 || (*sent)[1].Body() != "Approval #2 timed out with 0 of 2 approvals" {
+		t.Errorf("Expected the timeout to be announced, got %v", *sent)
+	}
+	if len(cb.bodies) != 1 || cb.bodies[0].RejectedBy != "@rauru:hyrule" || cb.bodies[0].Reason != "not on a Friday" {
+		t.Errorf("Expected the callback to be retried, got %+v", cb.bodies)
+	}
+	if r := store.request(1); r.CallbackStatus != "delivered" {
+		t.Errorf("Expected the retried callback to be delivered, got %s", r.CallbackStatus)
+	}
+}
@@ -0,0 +1,167 @@
+package approvals
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The number of times to try delivering a callback before giving up.
+const maxCallbackAttempts = 5
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	// delivering holds the callbacks being delivered, so that a retry from OnPoll can't send a
+	// callback which is already on its way.
+	deliveringMutex sync.Mutex
+	delivering      = make(map[deliveryKey]bool)
+)
+
+type deliveryKey struct {
+	serviceID string
+	requestID int64
+}
+
+type auditEntry struct {
+	UserID    string `json:"user_id"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail"`
+	Timestamp int64  `json:"ts"`
+}
+
+// requestStatus is the body of callbacks and of responses to polls.
+type requestStatus struct {
+	ID                int64        `json:"id"`
+	Title             string       `json:"title"`
+	Status            string       `json:"status"`
+	RequiredApprovals int          `json:"required_approvals"`
+	ApprovedBy        []string     `json:"approved_by"`
+	RejectedBy        string       `json:"rejected_by,omitempty"`
+	Reason            string       `json:"reason,omitempty"`
+	CreatedAt         int64        `json:"created_at"`
+	ExpiresAt         int64        `json:"expires_at"`
+	DecidedAt         int64        `json:"decided_at,omitempty"`
+	Audit             []auditEntry `json:"audit"`
+}
+
+func (s *Service) status(r types.ApprovalRequest) (*requestStatus, error) {
+	audit, err := database.GetServiceDB().LoadApprovalAudit(s.ServiceID(), r.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	approvedBy, rejection := votes(audit)
+	status := requestStatus{
+		ID:                r.RequestID,
+		Title:             r.Title,
+		Status:            r.Status,
+		RequiredApprovals: r.RequiredApprovals,
+		ApprovedBy:        approvedBy,
+		CreatedAt:         r.CreatedTimestamp,
+		ExpiresAt:         r.ExpiresTimestamp,
+		DecidedAt:         r.DecidedTimestamp,
+		Audit:             []auditEntry{},
+	}
+	if status.ApprovedBy == nil {
+		status.ApprovedBy = []string{}
+	}
+	if r.Status == StatusRejected && rejection != nil {
+		status.RejectedBy = rejection.UserID
+		status.Reason = rejection.Detail
+	}
+	for _, e := range audit {
+		status.Audit = append(status.Audit, auditEntry{e.UserID, e.Action, e.Detail, e.Timestamp})
+	}
+	return &status, nil
+}
+
+// sign returns the X-Signature header for a callback body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback POSTs the decision on a request to its callback URL, recording the attempt in
+// the request and its audit trail.
+func (s *Service) deliverCallback(r *types.ApprovalRequest) {
+	key := deliveryKey{s.ServiceID(), r.RequestID}
+	deliveringMutex.Lock()
+	if delivering[key] {
+		deliveringMutex.Unlock()
+		return
+	}
+	delivering[key] = true
+	deliveringMutex.Unlock()
+	defer func() {
+		deliveringMutex.Lock()
+		delete(delivering, key)
+		deliveringMutex.Unlock()
+	}()
+
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"request":    r.RequestID,
+	})
+	// It may have been delivered since r was loaded.
+	current, err := database.GetServiceDB().LoadApprovalRequest(s.ServiceID(), r.RequestID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load approval request")
+		return
+	} else if current.CallbackStatus != "pending" {
+		return
+	}
+	*r = current
+	status, err := s.status(*r)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load approval audit trail")
+		return
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	r.CallbackAttempts++
+	err = postCallback(r.CallbackURL, s.Secret, body)
+	if err == nil {
+		r.CallbackStatus = "delivered"
+		s.audit(r.RequestID, "", "callback_delivered", r.CallbackURL)
+	} else {
+		logger.WithError(err).WithField("attempt", r.CallbackAttempts).Warn("Failed to deliver approval callback")
+		s.audit(r.RequestID, "", "callback_failed", err.Error())
+		if r.CallbackAttempts >= maxCallbackAttempts {
+			r.CallbackStatus = "failed"
+		}
+	}
+	if err := database.GetServiceDB().UpdateApprovalRequest(*r); err != nil {
+		logger.WithError(err).Error("Failed to update approval request")
+	}
+}
+
+func postCallback(url, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", sign(secret, body))
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", res.StatusCode)
+	}
+	return nil
+}
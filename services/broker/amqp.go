@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+type amqpConnection struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	exchange string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func dialAMQP(s *Service, queues []string, onMessage func(topic, source string, payload []byte)) (connection, error) {
+	conn, err := amqp.Dial(s.AMQPURL)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &amqpConnection{
+		conn:     conn,
+		channel:  ch,
+		exchange: s.AMQPExchange,
+	}
+	c.watch(s.ServiceID(), conn.NotifyClose(make(chan *amqp.Error, 1)), ch.NotifyClose(make(chan *amqp.Error, 1)))
+	for _, queue := range queues {
+		deliveries, err := ch.Consume(queue, "", true, false, false, false, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		queue := queue
+		go func() {
+			// The deliveries channel is closed when the connection goes away.
+			for d := range deliveries {
+				onMessage(d.RoutingKey, queue, d.Body)
+			}
+		}()
+	}
+	return c, nil
+}
+
+// watch marks the connection as closed when either it or its channel closes, so that it is redialled.
+// A channel exception, e.g. from publishing to an exchange which doesn't exist, closes the channel
+// but leaves the connection open.
+func (c *amqpConnection) watch(serviceID string, connClosed, chClosed <-chan *amqp.Error) {
+	go func() {
+		var err *amqp.Error
+		msg := "Lost connection to AMQP broker"
+		select {
+		case err = <-connClosed:
+		case err = <-chClosed:
+			msg = "AMQP channel closed"
+		}
+		if err != nil {
+			log.WithError(err).WithField("service_id", serviceID).Warn(msg)
+		}
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+	}()
+}
+
+func (c *amqpConnection) Publish(routingKey string, payload []byte) error {
+	return c.channel.Publish(c.exchange, routingKey, false, false, amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        payload,
+	})
+}
+
+func (c *amqpConnection) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed
+}
+
+func (c *amqpConnection) Close() {
+	c.conn.Close()
+}
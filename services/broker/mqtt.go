@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait for the broker to acknowledge a connect, subscribe or publish.
+const mqttTimeout = 10 * time.Second
+
+type mqttConnection struct {
+	client mqtt.Client
+}
+
+func dialMQTT(s *Service, topics []string, onMessage func(topic, source string, payload []byte)) (connection, error) {
+	clientID := s.MQTTClientID
+	if clientID == "" {
+		clientID = "go-neb-" + s.ServiceID()
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.MQTTURL).
+		SetClientID(clientID).
+		SetUsername(s.MQTTUsername).
+		SetPassword(s.MQTTPassword).
+		SetConnectTimeout(mqttTimeout).
+		// Reconnection is handled by OnPoll so we can back off and resubscribe in one place.
+		SetAutoReconnect(false).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Lost connection to MQTT broker")
+		})
+	client := mqtt.NewClient(opts)
+	if err := waitFor(client.Connect()); err != nil {
+		return nil, err
+	}
+	for _, topic := range topics {
+		token := client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
+			onMessage(m.Topic(), m.Topic(), m.Payload())
+		})
+		if err := waitFor(token); err != nil {
+			client.Disconnect(0)
+			return nil, err
+		}
+	}
+	return &mqttConnection{client}, nil
+}
+
+func (c *mqttConnection) Publish(topic string, payload []byte) error {
+	return waitFor(c.client.Publish(topic, 1, false, payload))
+}
+
+func (c *mqttConnection) Connected() bool {
+	return c.client.IsConnected()
+}
+
+func (c *mqttConnection) Close() {
+	c.client.Disconnect(250)
+}
+
+func waitFor(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out waiting for MQTT broker")
+	}
+	return token.Error()
+}
@@ -0,0 +1,209 @@
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Content types of the structured and batched content modes.
+const (
+	structuredContentType = "application/cloudevents+json"
+	batchContentType      = "application/cloudevents-batch+json"
+)
+
+// Event is a CloudEvent. This is the data which templates are executed with.
+type Event struct {
+	SpecVersion     string
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            string
+	DataContentType string
+	DataSchema      string
+	// The event data. JSON data is decoded, so fields can be used in templates e.g. {{.Data.name}}.
+	// Other data is a string.
+	Data interface{}
+	// Extension attributes e.g. {{.Extensions.partitionkey}}
+	Extensions map[string]string
+}
+
+// validate checks the event has the required attributes.
+func (e *Event) validate() error {
+	if e.SpecVersion == "" {
+		return errors.New("event has no specversion")
+	}
+	if !strings.HasPrefix(e.SpecVersion, "1.") && e.SpecVersion != "0.3" {
+		return fmt.Errorf("unsupported specversion %s", e.SpecVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return errors.New("event must have an id, source and type")
+	}
+	return nil
+}
+
+// isJSON returns true if data with the content type should be decoded as JSON. Data with no
+// content type is JSON, as the spec says.
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// parseStructured parses an event in the structured content mode, where the whole event including
+// its attributes is a JSON object.
+func parseStructured(raw map[string]json.RawMessage) (*Event, error) {
+	e := Event{Extensions: make(map[string]string)}
+	var dataBase64 string
+	for name, value := range raw {
+		if name == "data" {
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			// Extensions may be numbers or booleans, so keep their JSON form
+			str = string(value)
+		}
+		switch name {
+		case "specversion":
+			e.SpecVersion = str
+		case "id":
+			e.ID = str
+		case "source":
+			e.Source = str
+		case "type":
+			e.Type = str
+		case "subject":
+			e.Subject = str
+		case "time":
+			e.Time = str
+		case "datacontenttype":
+			e.DataContentType = str
+		case "dataschema":
+			e.DataSchema = str
+		case "data_base64":
+			dataBase64 = str
+		default:
+			e.Extensions[name] = str
+		}
+	}
+	if value, ok := raw["data"]; ok {
+		if isJSON(e.DataContentType) {
+			if err := json.Unmarshal(value, &e.Data); err != nil {
+				return nil, err
+			}
+		} else {
+			// Non-JSON data is a JSON string in the structured mode
+			var str string
+			if err := json.Unmarshal(value, &str); err != nil {
+				return nil, fmt.Errorf("data with content type %s must be a string", e.DataContentType)
+			}
+			e.Data = str
+		}
+	} else if dataBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(dataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data_base64: %s", err)
+		}
+		e.Data = string(data)
+	}
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// parseBinary parses an event in the binary content mode, where the attributes are ce- headers and
+// the body is the data.
+func parseBinary(header http.Header, body []byte) (*Event, error) {
+	e := Event{
+		Extensions:      make(map[string]string),
+		DataContentType: header.Get("Content-Type"),
+	}
+	for key, values := range header {
+		lower := strings.ToLower(key)
+		if !strings.HasPrefix(lower, "ce-") || len(values) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(lower, "ce-")
+		value := values[0]
+		switch name {
+		case "specversion":
+			e.SpecVersion = value
+		case "id":
+			e.ID = value
+		case "source":
+			e.Source = value
+		case "type":
+			e.Type = value
+		case "subject":
+			e.Subject = value
+		case "time":
+			e.Time = value
+		case "dataschema":
+			e.DataSchema = value
+		default:
+			e.Extensions[name] = value
+		}
+	}
+	if len(body) > 0 {
+		if isJSON(e.DataContentType) {
+			if err := json.Unmarshal(body, &e.Data); err != nil {
+				return nil, err
+			}
+		} else {
+			e.Data = string(body)
+		}
+	}
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// parseEvents parses the events in a request in any of the HTTP content modes.
+func parseEvents(header http.Header, body []byte) ([]*Event, error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch mediaType {
+	case structuredContentType:
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+		e, err := parseStructured(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []*Event{e}, nil
+	case batchContentType:
+		var raws []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return nil, err
+		}
+		var events []*Event
+		for i, raw := range raws {
+			e, err := parseStructured(raw)
+			if err != nil {
+				return nil, fmt.Errorf("event %d: %s", i, err)
+			}
+			events = append(events, e)
+		}
+		return events, nil
+	default:
+		e, err := parseBinary(header, body)
+		if err != nil {
+			return nil, err
+		}
+		return []*Event{e}, nil
+	}
+}
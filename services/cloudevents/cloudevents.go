@@ -0,0 +1,466 @@
+// Package cloudevents implements a Service which sends CloudEvents into Matrix rooms.
+package cloudevents
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	html "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	text "text/template"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/roomstate"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the CloudEvents service.
+const ServiceType = "cloudevents"
+
+const (
+	defaultTextTemplate    = "{{.Type}} from {{.Source}}{{with .Subject}} ({{.}}){{end}}"
+	defaultSignatureHeader = "X-Signature"
+	maxBodyBytes           = 5 * 1024 * 1024
+)
+
+// Route sends events which match its patterns into rooms.
+type Route struct {
+	// Optional. Patterns which the event's type, source and subject must match. "*" matches any
+	// characters. An empty pattern matches everything.
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	Subject string `json:"subject"`
+	// The rooms to send matching events into. This cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. The template for the plain text body, which is executed with an Event. Defaults to
+	// the event's type, source and subject.
+	TextTemplate string `json:"text_template"`
+	// Optional. The template for the HTML body.
+	HTMLTemplate string `json:"html_template"`
+	// Optional. Either m.text or m.notice. Defaults to m.notice.
+	MsgType string `json:"msg_type"`
+	// Optional. Deliver events even during the room's quiet hours.
+	Urgent bool `json:"urgent"`
+	// Optional. State events to set in the rooms for each event, such as the topic. Their types
+	// must be in the service's allowed_state_types. See package roomstate.
+	State []roomstate.Update `json:"state"`
+	// Optional. Only set the state, without sending a message.
+	StateOnly bool `json:"state_only"`
+}
+
+// Service contains the Config fields for the CloudEvents service.
+//
+// This service accepts CloudEvents (https://cloudevents.io) over HTTP, from e.g. Knative, Argo
+// Events or a cloud event bus, and sends them into rooms. Events can be sent in the binary mode
+// (ce- headers), the structured mode (Content-Type: application/cloudevents+json) or the batched
+// mode (Content-Type: application/cloudevents-batch+json). Events from a batch which go to the same
+// room are sent as one message.
+//
+// Each event is sent by the first route whose type, source and subject patterns all match it.
+// Events which don't match any route are dropped. Templates are Go templates
+// (https://golang.org/pkg/text/template/) executed with an Event; JSON data can be used as
+// {{.Data.field}}, and the "json" function formats a value as JSON.
+//
+// If a secret is set, requests must have a header (X-Signature by default) containing the hex
+// HMAC-SHA256 of the body, optionally prefixed with "sha256=".
+//
+// Events are sent as the service user ID, unless the room has a different sender in "senders".
+// Each sender must be a configured client.
+//
+// Routes can also set room state, e.g. to put the latest release in the topic, from state templates
+// which are executed with an Event. Only state event types listed in allowed_state_types can be set.
+//
+// Example JSON request:
+//    {
+//        "secret": "optional shared secret",
+//        "routes": [
+//            {
+//                "type": "dev.knative.apiserver.*",
+//                "source": "https://kubernetes.default.svc",
+//                "rooms": ["!ewfug483gsfe:localhost"],
+//                "text_template": "{{.Type}}: {{.Data.metadata.name}}"
+//            },
+//            {
+//                "type": "com.example.deploy.failed",
+//                "rooms": ["!ewfug483gsfe:localhost"],
+//                "urgent": true
+//            },
+//            {
+//                "type": "com.example.deploy.succeeded",
+//                "rooms": ["!ewfug483gsfe:localhost"],
+//                "state": [
+//                    {"type": "m.room.topic", "content": "Production: {{.Data.version}}"}
+//                ],
+//                "state_only": true
+//            }
+//        ],
+//        "allowed_state_types": ["m.room.topic"],
+//        "senders": {
+//            "!ewfug483gsfe:localhost": "@prod-alerts:localhost"
+//        }
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which events should be sent to. This is populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The routes to match events against, in order.
+	Routes []Route `json:"routes"`
+	// Optional. A shared secret which requests must be signed with.
+	Secret string `json:"secret"`
+	// Optional. The header which contains the signature. Defaults to X-Signature.
+	SignatureHeader string `json:"signature_header"`
+	// Optional. A map of matrix rooms to the user ID to send events into that room as.
+	Senders types.Senders `json:"senders"`
+	// Optional. The state event types which routes may set.
+	AllowedStateTypes []string `json:"allowed_state_types"`
+}
+
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// globToRegexp compiles a pattern in which "*" matches any characters.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	quoted := regexp.QuoteMeta(pattern)
+	return regexp.Compile("^" + strings.Replace(quoted, `\*`, ".*", -1) + "$")
+}
+
+// A compiledRoute is a route with its patterns and templates parsed.
+type compiledRoute struct {
+	*Route
+	patterns     [3]*regexp.Regexp // type, source, subject. nil matches everything.
+	textTemplate *text.Template
+	htmlTemplate *html.Template
+	state        []*roomstate.Compiled
+}
+
+func compileRoute(r *Route, allowedStateTypes []string) (*compiledRoute, error) {
+	c := compiledRoute{Route: r}
+	for i, pattern := range []string{r.Type, r.Source, r.Subject} {
+		if pattern == "" {
+			continue
+		}
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.patterns[i] = re
+	}
+	textTemplate := r.TextTemplate
+	if textTemplate == "" {
+		textTemplate = defaultTextTemplate
+	}
+	var err error
+	if c.textTemplate, err = text.New("text").Option("missingkey=zero").Funcs(templateFuncs).Parse(textTemplate); err != nil {
+		return nil, fmt.Errorf("text template is invalid: %s", err)
+	}
+	if r.HTMLTemplate != "" {
+		if c.htmlTemplate, err = html.New("html").Option("missingkey=zero").Funcs(templateFuncs).Parse(r.HTMLTemplate); err != nil {
+			return nil, fmt.Errorf("html template is invalid: %s", err)
+		}
+	}
+	if c.state, err = roomstate.Compile(r.State, allowedStateTypes); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *compiledRoute) matches(e *Event) bool {
+	for i, value := range []string{e.Type, e.Source, e.Subject} {
+		if c.patterns[i] != nil && !c.patterns[i].MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) compileRoutes() ([]*compiledRoute, error) {
+	var routes []*compiledRoute
+	for i := range s.Routes {
+		c, err := compileRoute(&s.Routes[i], s.AllowedStateTypes)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %s", i, err)
+		}
+		routes = append(routes, c)
+	}
+	return routes, nil
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Routes) == 0 {
+		// this is an error UNLESS the old service had some routes in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Routes) == 0 {
+			return errors.New("At least one route must be specified")
+		}
+		return nil
+	}
+	if _, err := s.compileRoutes(); err != nil {
+		return err
+	}
+	for i, r := range s.Routes {
+		if len(r.Rooms) == 0 {
+			return fmt.Errorf("route %d has no rooms", i)
+		}
+		if r.MsgType != "" && r.MsgType != "m.notice" && r.MsgType != "m.text" {
+			return fmt.Errorf("route %d: msg_type is neither 'm.notice' nor 'm.text'", i)
+		}
+	}
+	roomSet := s.roomSet()
+	for roomID := range s.Senders {
+		if !roomSet[roomID] {
+			return fmt.Errorf("sender configured for unknown room %s", roomID)
+		}
+	}
+	return s.joinRooms(client, roomSet)
+}
+
+// SenderUserIDs returns the users which events are sent as, other than the service user.
+func (s *Service) SenderUserIDs() []string {
+	return s.Senders.UserIDs()
+}
+
+func (s *Service) roomSet() map[string]bool {
+	roomSet := make(map[string]bool)
+	for _, r := range s.Routes {
+		for _, roomID := range r.Rooms {
+			roomSet[roomID] = true
+		}
+	}
+	return roomSet
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client, roomSet map[string]bool) error {
+	for roomID := range roomSet {
+		sender, err := notify.SenderClient(client, s.Senders, roomID)
+		if err != nil {
+			return fmt.Errorf("sender for room %s: %s", roomID, err)
+		}
+		if _, err := sender.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    sender.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// PostRegister deletes this service if there are no routes remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Routes) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Deleting service: No routes remaining.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+func (s *Service) verifySignature(header http.Header, body []byte) bool {
+	if s.Secret == "" {
+		return true
+	}
+	name := s.SignatureHeader
+	if name == "" {
+		name = defaultSignatureHeader
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(header.Get(name), "sha256="))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// A delivery is the messages for one room from one route.
+type delivery struct {
+	route  *compiledRoute
+	roomID string
+	texts  []string
+	htmls  []string
+}
+
+// OnReceiveWebhook receives CloudEvents and sends them to the rooms of the routes they match.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	logger := log.WithField("service_id", s.ServiceID())
+	if req.Method == "OPTIONS" {
+		// Abuse protection handshake from the CloudEvents HTTP webhook spec
+		origin := req.Header.Get("WebHook-Request-Origin")
+		if origin == "" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header().Set("WebHook-Allowed-Origin", origin)
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(200)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if !s.verifySignature(req.Header, body) {
+		logger.Warn("CloudEvents webhook received a request with a bad signature")
+		w.WriteHeader(401)
+		return
+	}
+	events, err := parseEvents(req.Header, body)
+	if err != nil {
+		logger.WithError(err).Warn("CloudEvents webhook received an invalid event")
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	routes, err := s.compileRoutes()
+	if err != nil {
+		logger.WithError(err).Error("Failed to compile routes")
+		w.WriteHeader(500)
+		return
+	}
+
+	// Group the messages by route and room, so a batch is sent as one message per room
+	var deliveries []*delivery
+	byKey := make(map[string]*delivery)
+	for _, e := range events {
+		var route *compiledRoute
+		for _, r := range routes {
+			if r.matches(e) {
+				route = r
+				break
+			}
+		}
+		if route == nil {
+			logger.WithFields(log.Fields{
+				"type":   e.Type,
+				"source": e.Source,
+			}).Debug("Dropping CloudEvent which matches no route")
+			continue
+		}
+		for _, roomID := range route.Rooms {
+			s.sendState(cli, route, roomID, e)
+		}
+		if route.StateOnly {
+			continue
+		}
+		plain, formatted, err := route.render(e)
+		if err != nil {
+			logger.WithError(err).WithField("type", e.Type).Error("Failed to render CloudEvent")
+			continue
+		}
+		for _, roomID := range route.Rooms {
+			key := fmt.Sprintf("%p %s", route, roomID)
+			d := byKey[key]
+			if d == nil {
+				d = &delivery{route: route, roomID: roomID}
+				byKey[key] = d
+				deliveries = append(deliveries, d)
+			}
+			d.texts = append(d.texts, plain)
+			d.htmls = append(d.htmls, formatted)
+		}
+	}
+
+	for _, d := range deliveries {
+		sender, err := notify.SenderClient(cli, s.Senders, d.roomID)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", d.roomID).Error("Failed to load sender for room")
+			continue
+		}
+		if err := notify.Send(sender, d.roomID, d.message(), d.route.Urgent); err != nil {
+			logger.WithError(err).WithField("room_id", d.roomID).Error("Failed to send CloudEvent to room")
+		}
+	}
+	w.WriteHeader(202)
+}
+
+// sendState sets the room state for the event from the route's state updates.
+func (s *Service) sendState(cli *gomatrix.Client, route *compiledRoute, roomID string, e *Event) {
+	if len(route.state) == 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    roomID,
+	})
+	sender, err := notify.SenderClient(cli, s.Senders, roomID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load sender for room")
+		return
+	}
+	for _, u := range route.state {
+		if err := u.Send(sender, s.ServiceID(), roomID, e); err != nil {
+			logger.WithError(err).WithField("type", u.Type).Error("Failed to set room state")
+		}
+	}
+}
+
+// render executes the route's templates for the event. The HTML is empty if there is no HTML template.
+func (c *compiledRoute) render(e *Event) (string, string, error) {
+	var plain bytes.Buffer
+	if err := c.textTemplate.Execute(&plain, e); err != nil {
+		return "", "", err
+	}
+	if c.htmlTemplate == nil {
+		return plain.String(), "", nil
+	}
+	var formatted bytes.Buffer
+	if err := c.htmlTemplate.Execute(&formatted, e); err != nil {
+		return "", "", err
+	}
+	return plain.String(), formatted.String(), nil
+}
+
+func (d *delivery) message() interface{} {
+	msgType := d.route.MsgType
+	if msgType == "" {
+		msgType = "m.notice"
+	}
+	body := strings.Join(d.texts, "\n")
+	if d.route.htmlTemplate == nil {
+		return gomatrix.TextMessage{MsgType: msgType, Body: body}
+	}
+	return gomatrix.HTMLMessage{
+		Body:          body,
+		MsgType:       msgType,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(d.htmls, "<br>"),
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package cloudevents
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type sentMessage struct {
+	roomID string
+	msg    gomatrix.HTMLMessage
+}
+
+func buildTestClient(msgs *[]sentMessage) *gomatrix.Client {
+	matrixCli, _ := gomatrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		roomID := strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"), "/")[0]
+		*msgs = append(*msgs, sentMessage{roomID, msg})
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	})}
+	return matrixCli
+}
+
+func buildTestService(t *testing.T, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv.(*Service)
+}
+
+const testConfig = `{
+	"routes": [
+		{
+			"type": "com.example.deploy.*",
+			"source": "/ci/*",
+			"rooms": ["!deploys:hs"],
+			"text_template": "{{.Data.app}} {{.Extensions.environment}}",
+			"html_template": "<b>{{.Data.app}}</b>"
+		},
+		{
+			"subject": "alerts/*",
+			"rooms": ["!alerts:hs"],
+			"urgent": true
+		}
+	]
+}`
+
+func TestBindings(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv := buildTestService(t, testConfig)
+
+	testCases := []struct {
+		name      string
+		header    map[string]string
+		body      string
+		wantCode  int
+		wantRooms []string
+		wantBody  string
+	}{
+		{
+			name: "binary",
+			header: map[string]string{
+				"Content-Type":   "application/json",
+				"Ce-Specversion": "1.0",
+				"Ce-Id":          "1",
+				"Ce-Source":      "/ci/builds",
+				"Ce-Type":        "com.example.deploy.finished",
+				"Ce-Environment": "prod",
+			},
+			body:      `{"app":"hyrule"}`,
+			wantCode:  202,
+			wantRooms: []string{"!deploys:hs"},
+			wantBody:  "hyrule prod",
+		},
+		{
+			name:      "structured",
+			header:    map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+			body:      `{"specversion":"1.0","id":"2","source":"/ci/builds","type":"com.example.deploy.started","environment":"dev","data":{"app":"termina"}}`,
+			wantCode:  202,
+			wantRooms: []string{"!deploys:hs"},
+			wantBody:  "termina dev",
+		},
+		{
+			name:      "structured text data",
+			header:    map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:      `{"specversion":"1.0","id":"3","source":"monitor","type":"com.example.alert","subject":"alerts/disk","datacontenttype":"text/plain","data":"disk full"}`,
+			wantCode:  202,
+			wantRooms: []string{"!alerts:hs"},
+			wantBody:  "com.example.alert from monitor (alerts/disk)",
+		},
+		{
+			name:     "no route",
+			header:   map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:     `{"specversion":"1.0","id":"4","source":"/other","type":"com.example.deploy.started"}`,
+			wantCode: 202,
+		},
+		{
+			name:     "missing attributes",
+			header:   map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:     `{"specversion":"1.0","id":"5","source":"/ci/builds"}`,
+			wantCode: 400,
+		},
+		{
+			name:     "binary without headers",
+			header:   map[string]string{"Content-Type": "application/json"},
+			body:     `{}`,
+			wantCode: 400,
+		},
+	}
+
+	for _, tc := range testCases {
+		var msgs []sentMessage
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(tc.body))
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, buildTestClient(&msgs))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: want code %d, got %d", tc.name, tc.wantCode, w.Code)
+		}
+		if len(msgs) != len(tc.wantRooms) {
+			t.Errorf("%s: want %d messages, got %v", tc.name, len(tc.wantRooms), msgs)
+			continue
+		}
+		for i, roomID := range tc.wantRooms {
+			if msgs[i].roomID != roomID || msgs[i].msg.Body != tc.wantBody {
+				t.Errorf("%s: want %q in %s, got %q in %s", tc.name, tc.wantBody, roomID, msgs[i].msg.Body, msgs[i].roomID)
+			}
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv := buildTestService(t, testConfig)
+
+	var msgs []sentMessage
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`[
+		{"specversion":"1.0","id":"1","source":"/ci/a","type":"com.example.deploy.started","data":{"app":"a"}},
+		{"specversion":"1.0","id":"2","source":"monitor","type":"com.example.alert","subject":"alerts/cpu"},
+		{"specversion":"1.0","id":"3","source":"/ci/b","type":"com.example.deploy.started","data":{"app":"b"}}
+	]`))
+	req.Header.Set("Content-Type", "application/cloudevents-batch+json")
+	w := httptest.NewRecorder()
+	srv.OnReceiveWebhook(w, req, buildTestClient(&msgs))
+	if w.Code != 202 {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected one message per room, got %v", msgs)
+	}
+	deploys := msgs[0].msg
+	if msgs[0].roomID != "!deploys:hs" || deploys.Body != "a \nb " || deploys.FormattedBody != "<b>a</b><br><b>b</b>" {
+		t.Errorf("Unexpected batched message: %+v", deploys)
+	}
+	if msgs[1].roomID != "!alerts:hs" || msgs[1].msg.MsgType != "m.notice" {
+		t.Errorf("Unexpected alert message: %+v", msgs[1])
+	}
+}
+
+func TestSignature(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv := buildTestService(t, `{"secret":"s3cr3t","routes":[{"rooms":["!room:hs"]}]}`)
+	body := `{"specversion":"1.0","id":"1","source":"/s","type":"t"}`
+
+	send := func(sig string) (int, int) {
+		var msgs []sentMessage
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+		if sig != "" {
+			req.Header.Set("X-Signature", sig)
+		}
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, buildTestClient(&msgs))
+		return w.Code, len(msgs)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(body))
+	sig := hex.EncodeToString(mac.Sum(nil))
+	for _, good := range []string{sig, "sha256=" + sig} {
+		if code, n := send(good); code != 202 || n != 1 {
+			t.Errorf("Expected signature %q to be accepted, got %d with %d messages", good, code, n)
+		}
+	}
+	for _, bad := range []string{"", "sha256=", sig[2:], "nothex"} {
+		if code, n := send(bad); code != 401 || n != 0 {
+			t.Errorf("Expected signature %q to be refused, got %d with %d messages", bad, code, n)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	matrixCli, _ := gomatrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!room:hs"}`)),
+		}, nil
+	})}
+	for _, config := range []string{
+		`{"routes":[]}`,
+		`{"routes":[{"type":"t"}]}`,
+		`{"routes":[{"rooms":["!room:hs"],"text_template":"{{.Type"}]}`,
+		`{"routes":[{"rooms":["!room:hs"],"msg_type":"m.emote"}]}`,
+		`{"routes":[{"rooms":["!room:hs"],"state":[{"type":"m.room.power_levels","content":"{}"}]}],"allowed_state_types":["m.room.topic"]}`,
+	} {
+		srv := buildTestService(t, config)
+		if err := srv.Register(nil, matrixCli); err == nil {
+			t.Errorf("Expected config %s to be refused", config)
+		}
+	}
+	srv := buildTestService(t, `{"routes":[{"rooms":["!room:hs"]}]}`)
+	srv.webhookEndpointURL = "https://neb/services/hooks/aWQ"
+	if err := srv.Register(nil, matrixCli); err != nil {
+		t.Fatal(err)
+	}
+	if srv.WebhookURL != "https://neb/services/hooks/aWQ" {
+		t.Errorf("Expected the webhook URL to be populated, got %s", srv.WebhookURL)
+	}
+}
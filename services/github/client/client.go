@@ -1,7 +1,10 @@
 package client
 
 import (
+	"net/http"
+
 	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/apicache"
 	"golang.org/x/oauth2"
 )
 
@@ -39,13 +42,17 @@ func TrimRepository(repo *github.Repository) TrimmedRepository {
 // New returns a github Client which can perform Github API operations.
 // If `token` is empty, a non-authenticated client will be created. This should be
 // used sparingly where possible as you only get 60 requests/hour like that (IP locked).
+// Responses are cached per token and revalidated with conditional requests, which don't
+// count against the rate limit.
 func New(token string) *github.Client {
-	var tokenSource oauth2.TokenSource
+	var transport http.RoundTripper = http.DefaultTransport
 	if token != "" {
-		tokenSource = oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: token},
-		)
+		transport = &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+			Base:   http.DefaultTransport,
+		}
 	}
-	httpCli := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	return github.NewClient(httpCli)
+	return github.NewClient(&http.Client{
+		Transport: apicache.Transport("github", token, transport),
+	})
 }
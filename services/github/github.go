@@ -202,6 +202,69 @@ func (s *Service) cmdGithubCreate(roomID, userID string, args []string) (interfa
 	return gomatrix.TextMessage{"m.notice", fmt.Sprintf("Created issue: %s", *issue.HTMLURL)}, nil
 }
 
+const cmdGithubCreateReplyUsage = `!github create [owner/repo] "issue title" [--thread] (as a reply to a message)`
+
+// cmdGithubCreateFromReply creates an issue from the message which the command replies to, or its
+// whole thread with --thread, and responds in a thread on that message.
+func (s *Service) cmdGithubCreateFromReply(mxCli *gomatrix.Client, event *gomatrix.Event, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(event.Sender)
+	if cli == nil {
+		return resp, err
+	}
+	args, thread := matrix.ThreadArg(args)
+	if len(args) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Usage: " + cmdGithubCreateReplyUsage}, nil
+	}
+	// The repo is optional if there is a default one set, so it is only the first arg if there is
+	// a title after it
+	ownerRepo := s.defaultRepo(event.RoomID)
+	if len(args) > 1 && ownerRepoRegex.MatchString(args[0]) {
+		ownerRepo = args[0]
+		args = args[1:]
+	}
+	if ownerRepo == "" {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Need to specify repo. Usage: " + cmdGithubCreateReplyUsage}, nil
+	}
+	ownerRepoGroups := ownerRepoRegex.FindStringSubmatch(ownerRepo)
+	if len(ownerRepoGroups) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Malformed default repo. Usage: " + cmdGithubCreateReplyUsage}, nil
+	}
+	title := strings.Join(args, " ")
+
+	replied, messages, err := matrix.RepliedMessages(mxCli, event, thread)
+	if err != nil {
+		log.WithError(err).WithField("room_id", event.RoomID).Print("Failed to fetch replied to message")
+		return nil, fmt.Errorf("Failed to fetch the message to create an issue from")
+	}
+	if replied == nil {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Usage: " + cmdGithubCreateReplyUsage}, nil
+	}
+	var body bytes.Buffer
+	for _, m := range messages {
+		fmt.Fprintf(&body, "%s [wrote](%s):\n", m.Sender, matrix.Permalink(event.RoomID, m.ID))
+		for _, line := range strings.Split(matrix.MessageBody(m), "\n") {
+			body.WriteString("> " + line + "\n")
+		}
+		body.WriteString("\n")
+	}
+	fmt.Fprintf(&body, "Reported from Matrix by %s.", event.Sender)
+	desc := body.String()
+
+	issue, res, err := cli.Issues.Create(ownerRepoGroups[1], ownerRepoGroups[2], &gogithub.IssueRequest{
+		Title: &title,
+		Body:  &desc,
+	})
+	if err != nil {
+		log.WithField("err", err).Print("Failed to create issue")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to create issue. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to create issue. HTTP %d", res.StatusCode)
+	}
+
+	return matrix.ThreadedReply(event, replied, "m.notice", fmt.Sprintf("Created issue: %s", *issue.HTMLURL)), nil
+}
+
 var cmdGithubReactAliases = map[string]string{
 	"+1":   "+1",
 	":+1:": "+1",
@@ -500,6 +563,10 @@ func (s *Service) expandCommit(roomID, userID, owner, repo, sha string) interfac
 // Responds with the outcome of the issue creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
+//    !github create [owner/repo] "issue title" [--thread]
+// When sent as a reply, the issue description quotes the replied to message, or its whole
+// thread with --thread, linking to each message. The outcome is sent in a thread on the
+// replied to message.
 //    !github comment [owner/repo]#issue "comment"
 // Responds with the outcome of the issue comment creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
@@ -514,8 +581,11 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 		},
 		types.Command{
 			Path: []string{"github", "create"},
-			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubCreate(roomID, userID, args)
+			EventCommand: func(event *gomatrix.Event, args []string) (interface{}, error) {
+				if matrix.InReplyTo(event) != "" {
+					return s.cmdGithubCreateFromReply(cli, event, args)
+				}
+				return s.cmdGithubCreate(event.RoomID, event.Sender, args)
 			},
 		},
 		types.Command{
@@ -555,6 +625,7 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 					"m.notice",
 					strings.Join([]string{
 						cmdGithubCreateUsage,
+						cmdGithubCreateReplyUsage,
 						cmdGithubReactUsage,
 						cmdGithubCommentUsage,
 						cmdGithubAssignUsage,
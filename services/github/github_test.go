@@ -0,0 +1,123 @@
+package github
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/github"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// authStore has a github realm which @link:hyrule has logged into.
+type authStore struct {
+	database.NopStorage
+	realm types.AuthRealm
+}
+
+func (s *authStore) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *authStore) LoadAuthSessionByUser(realmID, userID string) (types.AuthSession, error) {
+	if userID != "@link:hyrule" {
+		return nil, sql.ErrNoRows
+	}
+	session := s.realm.AuthSession("session", userID, realmID).(*github.Session)
+	session.AccessToken = "gh_token"
+	return session, nil
+}
+
+func TestCreateFromReply(t *testing.T) {
+	realm, err := types.CreateAuthRealm("ghrealm", "github", []byte(`{"ClientSecret":"secret","ClientID":"id"}`))
+	if err != nil {
+		t.Fatal("Failed to create github realm: ", err)
+	}
+	database.SetServiceDB(&authStore{realm: realm})
+
+	// Stub the GitHub API, which the github client reaches through the default transport
+	var issues []map[string]string
+	defaultTransport := http.DefaultTransport
+	defer func() { http.DefaultTransport = defaultTransport }()
+	http.DefaultTransport = testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/repos/hyrule/castle/issues" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		var issue map[string]string
+		json.NewDecoder(req.Body).Decode(&issue)
+		issues = append(issues, issue)
+		return &http.Response{
+			StatusCode: 201,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"number":1,"html_url":"https://github.com/hyrule/castle/issues/1"}`)),
+		}, nil
+	})
+
+	// Stub the homeserver, which has the message being replied to
+	var fetched []string
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.Path)
+		if req.URL.Path != "/_matrix/client/r0/rooms/!room:hyrule/event/$broken" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$broken","sender":"@zelda:hyrule",
+				"type":"m.room.message","content":{"msgtype":"m.text","body":"> <@ganon:hyrule> hah\n\nthe door is stuck\nagain"}}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{"RealmID":"ghrealm"}`))
+	if err != nil {
+		t.Fatal("Failed to create github service: ", err)
+	}
+	cmd := srv.Commands(cli)[1]
+	command := func(relatesTo map[string]interface{}) *gomatrix.Event {
+		content := map[string]interface{}{"msgtype": "m.text", "body": "!github create hyrule/castle Door stuck"}
+		if relatesTo != nil {
+			content["m.relates_to"] = relatesTo
+		}
+		return &gomatrix.Event{ID: "$command", RoomID: "!room:hyrule", Sender: "@link:hyrule", Content: content}
+	}
+
+	reply := command(map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$broken"}})
+	res, err := cmd.EventCommand(reply, []string{"hyrule/castle", "Door", "stuck"})
+	if err != nil {
+		t.Fatal("Failed to create issue from reply: ", err)
+	}
+	if len(fetched) != 1 {
+		t.Errorf("Expected the replied to message to be fetched, got %v", fetched)
+	}
+	wantBody := "@zelda:hyrule [wrote](https://matrix.to/#/%21room:hyrule/$broken):\n" +
+		"> the door is stuck\n> again\n\nReported from Matrix by @link:hyrule."
+	if len(issues) != 1 || issues[0]["title"] != "Door stuck" || issues[0]["body"] != wantBody {
+		t.Fatalf("Expected an issue quoting the replied to message, got %v", issues)
+	}
+	content := res.(map[string]interface{})
+	relatesTo := content["m.relates_to"].(map[string]interface{})
+	if content["body"] != "Created issue: https://github.com/hyrule/castle/issues/1" ||
+		relatesTo["rel_type"] != "m.thread" || relatesTo["event_id"] != "$broken" {
+		t.Errorf("Expected the issue link in a thread on the replied to message, got %v", content)
+	}
+
+	// Without m.relates_to the command isn't a reply, so nothing is fetched or quoted
+	fetched, issues = nil, nil
+	if _, err := cmd.EventCommand(command(nil), []string{"hyrule/castle", "Door stuck"}); err != nil {
+		t.Fatal("Failed to create issue: ", err)
+	}
+	if len(fetched) != 0 || len(issues) != 1 || issues[0]["body"] != "" {
+		t.Errorf("Expected an issue without a quote, got %v (fetched %v)", issues, fetched)
+	}
+	issues = nil
+	res, err = srv.(*Service).cmdGithubCreateFromReply(cli, command(nil), []string{"hyrule/castle", "Door stuck"})
+	if msg, ok := res.(*gomatrix.TextMessage); err != nil || !ok || !strings.HasPrefix(msg.Body, "Usage: ") || len(issues) != 0 {
+		t.Errorf("Expected usage for a command which isn't a reply, got %v %v", res, err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	gogithub "github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/types"
@@ -108,7 +109,7 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 					"message": msg,
 					"room_id": roomID,
 				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+				if e := notify.Send(cli, roomID, msg, false); e != nil {
 					logger.WithError(e).WithField("room_id", roomID).Print(
 						"Failed to send notification to room.")
 				}
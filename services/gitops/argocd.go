@@ -0,0 +1,204 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// application is the part of an Argo CD Application which is used.
+type application struct {
+	Status struct {
+		Sync struct {
+			Status   string `json:"status"`
+			Revision string `json:"revision"`
+		} `json:"sync"`
+		Health struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"health"`
+		OperationState *struct {
+			Phase   string `json:"phase"`
+			Message string `json:"message"`
+		} `json:"operationState"`
+		History []struct {
+			ID       int64  `json:"id"`
+			Revision string `json:"revision"`
+		} `json:"history"`
+	} `json:"status"`
+}
+
+// argoError is the body of an error response from the Argo CD API.
+type argoError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// argoRequest makes a request to the Argo CD API and decodes the JSON response into result.
+func (s *Service) argoRequest(method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.ArgoCDURL+"/api/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.ArgoCDToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e argoError
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || (e.Message == "" && e.Error == "") {
+			return fmt.Errorf("Argo CD returned %d", res.StatusCode)
+		}
+		if e.Message == "" {
+			e.Message = e.Error
+		}
+		return fmt.Errorf("Argo CD returned %d: %s", res.StatusCode, e.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func appPath(app string) string {
+	return "applications/" + url.PathEscape(app)
+}
+
+// checkApp returns an error unless the app is routed to the room.
+func (s *Service) checkApp(roomID, app string) error {
+	for _, r := range s.Routes {
+		if r.hasRoom(roomID) && r.matchesApp(app) {
+			return nil
+		}
+	}
+	return fmt.Errorf("App %s is not configured for this room", app)
+}
+
+func (s *Service) isAllowed(userID string) bool {
+	if len(s.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range s.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) cmdStatus(roomID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !argocd status <app>")
+	}
+	name := args[0]
+	if err := s.checkApp(roomID, name); err != nil {
+		return nil, err
+	}
+	var app application
+	if err := s.argoRequest("GET", appPath(name), nil, &app); err != nil {
+		return nil, fmt.Errorf("Failed to get status of %s: %s", name, err)
+	}
+	st := app.Status
+	lines := []string{
+		fmt.Sprintf("%s: %s, %s at %s", name, st.Sync.Status, st.Health.Status, shortRevision(st.Sync.Revision)),
+	}
+	if st.Health.Message != "" {
+		lines = append(lines, "Health: "+st.Health.Message)
+	}
+	if op := st.OperationState; op != nil {
+		lines = append(lines, fmt.Sprintf("Last operation: %s %s", op.Phase, op.Message))
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.TrimSpace(strings.Join(lines, "\n"))}, nil
+}
+
+func (s *Service) cmdSync(roomID, userID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !argocd sync <app>")
+	}
+	name := args[0]
+	if err := s.checkApp(roomID, name); err != nil {
+		return nil, err
+	}
+	if !s.isAllowed(userID) {
+		return nil, errors.New("You are not allowed to sync apps")
+	}
+	if err := s.argoRequest("POST", appPath(name)+"/sync", map[string]interface{}{}, nil); err != nil {
+		return nil, fmt.Errorf("Failed to sync %s: %s", name, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"app":        name,
+	}).Info("Started Argo CD sync")
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Syncing " + name}, nil
+}
+
+func (s *Service) cmdRollback(roomID, userID string, args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("Usage: !argocd rollback <app> [history ID]")
+	}
+	name := args[0]
+	if err := s.checkApp(roomID, name); err != nil {
+		return nil, err
+	}
+	if !s.isAllowed(userID) {
+		return nil, errors.New("You are not allowed to roll back apps")
+	}
+	var id int64
+	var revision string
+	if len(args) == 2 {
+		var err error
+		if id, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, errors.New("Usage: !argocd rollback <app> [history ID]")
+		}
+	} else {
+		// Roll back to the deployment before the current one
+		var app application
+		if err := s.argoRequest("GET", appPath(name), nil, &app); err != nil {
+			return nil, fmt.Errorf("Failed to get history of %s: %s", name, err)
+		}
+		history := app.Status.History
+		if len(history) < 2 {
+			return nil, fmt.Errorf("%s has no previous deployment to roll back to", name)
+		}
+		id = history[len(history)-2].ID
+		revision = history[len(history)-2].Revision
+	}
+	if err := s.argoRequest("POST", appPath(name)+"/rollback", map[string]interface{}{"id": id}, nil); err != nil {
+		return nil, fmt.Errorf("Failed to roll back %s: %s", name, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"app":        name,
+		"history_id": id,
+	}).Info("Started Argo CD rollback")
+	msg := fmt.Sprintf("Rolling back %s to deployment %d", name, id)
+	if revision != "" {
+		msg += " (" + shortRevision(revision) + ")"
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: msg}, nil
+}
@@ -0,0 +1,161 @@
+package gitops
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// The kinds of deployment event which are sent into rooms.
+const (
+	EventSyncStarted    = "sync-started"
+	EventSyncSucceeded  = "sync-succeeded"
+	EventSyncFailed     = "sync-failed"
+	EventHealthDegraded = "health-degraded"
+)
+
+var eventDescriptions = map[string]string{
+	EventSyncStarted:    "sync started",
+	EventSyncSucceeded:  "sync succeeded",
+	EventSyncFailed:     "sync failed",
+	EventHealthDegraded: "health degraded",
+}
+
+// An Event is a deployment event from either Argo CD or Flux.
+type Event struct {
+	Source   string // "Argo CD" or "Flux"
+	App      string
+	Kind     string // One of the Event constants
+	Revision string
+	Message  string
+	URL      string
+}
+
+// argoNotification is the webhook body which the Argo CD notifications template should produce.
+type argoNotification struct {
+	App      string `json:"app"`
+	Event    string `json:"event"`
+	Phase    string `json:"phase"`
+	Health   string `json:"health"`
+	Revision string `json:"revision"`
+	Message  string `json:"message"`
+	URL      string `json:"url"`
+}
+
+// kind returns the event kind named in the notification, or works it out from the application's
+// operation phase and health.
+func (n *argoNotification) kind() string {
+	if _, ok := eventDescriptions[n.Event]; ok {
+		return n.Event
+	}
+	switch {
+	case n.Health == "Degraded":
+		return EventHealthDegraded
+	case n.Phase == "Running":
+		return EventSyncStarted
+	case n.Phase == "Succeeded":
+		return EventSyncSucceeded
+	case n.Phase == "Failed" || n.Phase == "Error":
+		return EventSyncFailed
+	}
+	return ""
+}
+
+// fluxEvent is the body sent by the Flux notification-controller's generic webhook provider.
+type fluxEvent struct {
+	InvolvedObject struct {
+		Kind      string `json:"kind"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"involvedObject"`
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Reason   string            `json:"reason"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (e *fluxEvent) kind() string {
+	switch {
+	case e.Severity == "error" && e.Reason == "HealthCheckFailed":
+		return EventHealthDegraded
+	case e.Severity == "error":
+		return EventSyncFailed
+	case e.Reason == "Progressing":
+		return EventSyncStarted
+	case strings.HasSuffix(e.Reason, "Succeeded"):
+		return EventSyncSucceeded
+	}
+	return ""
+}
+
+func (e *fluxEvent) revision() string {
+	if rev, ok := e.Metadata["revision"]; ok {
+		return rev
+	}
+	// Newer controllers prefix metadata keys with their API group
+	for key, value := range e.Metadata {
+		if strings.HasSuffix(key, "/revision") {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseEvent parses an Argo CD or Flux webhook body. It returns a nil Event for notifications which
+// aren't one of the event kinds, such as Flux's informational events.
+func parseEvent(body []byte) (*Event, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if _, ok := raw["involvedObject"]; ok {
+		var fe fluxEvent
+		if err := json.Unmarshal(body, &fe); err != nil {
+			return nil, err
+		}
+		if fe.InvolvedObject.Name == "" {
+			return nil, errors.New("Flux event has no involvedObject name")
+		}
+		kind := fe.kind()
+		if kind == "" {
+			return nil, nil
+		}
+		return &Event{
+			Source:   "Flux",
+			App:      fe.InvolvedObject.Name,
+			Kind:     kind,
+			Revision: fe.revision(),
+			Message:  fe.Message,
+		}, nil
+	}
+	var an argoNotification
+	if err := json.Unmarshal(body, &an); err != nil {
+		return nil, err
+	}
+	if an.App == "" {
+		return nil, errors.New("Argo CD notification has no app")
+	}
+	kind := an.kind()
+	if kind == "" {
+		return nil, nil
+	}
+	return &Event{
+		Source:   "Argo CD",
+		App:      an.App,
+		Kind:     kind,
+		Revision: an.Revision,
+		Message:  an.Message,
+		URL:      an.URL,
+	}, nil
+}
+
+var commitHash = regexp.MustCompile(`[0-9a-f]{40}$`)
+
+// shortRevision shortens a commit hash at the end of a revision such as "main@sha1:<hash>".
+func shortRevision(rev string) string {
+	if loc := commitHash.FindStringIndex(rev); loc != nil {
+		return rev[:loc[0]+7]
+	}
+	return rev
+}
@@ -0,0 +1,386 @@
+// Package gitops implements a Service which sends Argo CD and Flux deployment events into Matrix
+// rooms and controls Argo CD applications.
+package gitops
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the GitOps service.
+const ServiceType = "gitops"
+
+const maxBodyBytes = 1024 * 1024
+
+// Route sends events for matching apps into rooms.
+type Route struct {
+	// The apps to send events for. "*" matches any characters.
+	Apps []string `json:"apps"`
+	// The rooms to send events into. This cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. The kinds of event to send: "sync-started", "sync-succeeded", "sync-failed" and
+	// "health-degraded". Defaults to all of them.
+	Events []string `json:"events"`
+	// Optional. Send failures and degraded health even during the room's quiet hours.
+	Urgent bool `json:"urgent"`
+
+	apps []*regexp.Regexp
+}
+
+func (r *Route) compile() error {
+	if len(r.Apps) == 0 {
+		return errors.New("no apps")
+	}
+	if len(r.Rooms) == 0 {
+		return errors.New("no rooms")
+	}
+	for _, e := range r.Events {
+		if _, ok := eventDescriptions[e]; !ok {
+			return fmt.Errorf("unknown event %s", e)
+		}
+	}
+	r.apps = nil
+	for _, pattern := range r.Apps {
+		quoted := regexp.QuoteMeta(pattern)
+		re, err := regexp.Compile("^" + strings.Replace(quoted, `\*`, ".*", -1) + "$")
+		if err != nil {
+			return err
+		}
+		r.apps = append(r.apps, re)
+	}
+	return nil
+}
+
+func (r *Route) matchesApp(app string) bool {
+	for _, re := range r.apps {
+		if re.MatchString(app) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) matchesEvent(kind string) bool {
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, e := range r.Events {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) hasRoom(roomID string) bool {
+	for _, id := range r.Rooms {
+		if id == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// Service contains the Config fields for the GitOps service.
+//
+// This service sends deployment events from Argo CD (https://argo-cd.readthedocs.io) and Flux
+// (https://fluxcd.io) into rooms: syncs starting, succeeding and failing, and apps becoming
+// degraded. Events are routed to rooms by the name of the app, which is the Flux object's name for
+// Flux events. An event is sent into the rooms of every route which matches it.
+//
+// Argo CD should be configured with a webhook service for the webhook_url of this service, which is
+// populated by Go-NEB after Service registration, and a template which sends:
+//    {
+//        "app": "{{.app.metadata.name}}",
+//        "phase": "{{.app.status.operationState.phase}}",
+//        "health": "{{.app.status.health.status}}",
+//        "revision": "{{.app.status.sync.revision}}",
+//        "message": "{{.app.status.operationState.message}}",
+//        "url": "{{.context.argocdUrl}}/applications/{{.app.metadata.name}}"
+//    }
+// The kind of event is worked out from the phase and health, or can be given as "event" in
+// templates for specific triggers. Flux should be configured with a notification-controller
+// Provider of type "generic" or "generic-hmac" for the webhook_url.
+//
+// If a secret is set, requests must either have an "Authorization: Bearer <secret>" header, which
+// can be set in the Argo CD webhook service, or an X-Signature header with the HMAC-SHA256 of the
+// body, as sent by Flux's generic-hmac provider.
+//
+// If argocd_url and argocd_token are set, Argo CD apps can be controlled from the rooms they are
+// routed to. The token should belong to an Argo CD account with permission to get, sync and
+// roll back the apps.
+//
+// Commands supported:
+//    !argocd status <app>
+//    !argocd sync <app>
+//    !argocd rollback <app> [history ID]
+// Rollback defaults to the deployment before the current one.
+//
+// Example JSON request:
+//    {
+//        "secret": "optional shared secret",
+//        "argocd_url": "https://argocd.example.com",
+//        "argocd_token": "eyJhbGciOi...",
+//        "allowed_users": ["@alice:example.com"],
+//        "routes": [
+//            {
+//                "apps": ["payments-*"],
+//                "rooms": ["!ewfug483gsfe:localhost"]
+//            },
+//            {
+//                "apps": ["*"],
+//                "rooms": ["!oncall:localhost"],
+//                "events": ["sync-failed", "health-degraded"],
+//                "urgent": true
+//            }
+//        ]
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which Argo CD and Flux should send notifications to. Populated by Go-NEB after
+	// Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The routes which send events into rooms.
+	Routes []Route `json:"routes"`
+	// Optional. A shared secret which requests must be authenticated with.
+	Secret string `json:"secret"`
+	// Optional. The base URL of Argo CD, which enables the !argocd commands.
+	ArgoCDURL string `json:"argocd_url"`
+	// Optional. The Argo CD API token for the !argocd commands.
+	ArgoCDToken string `json:"argocd_token"`
+	// Optional. The users who can sync and roll back apps. Anyone in a room can if this is empty.
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+func (s *Service) compileRoutes() error {
+	for i := range s.Routes {
+		if err := s.Routes[i].compile(); err != nil {
+			return fmt.Errorf("route %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Routes) == 0 {
+		// this is an error UNLESS the old service had some routes in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Routes) == 0 {
+			return errors.New("At least one route must be specified")
+		}
+		return nil
+	}
+	if err := s.compileRoutes(); err != nil {
+		return err
+	}
+	if s.ArgoCDURL != "" {
+		u, err := url.Parse(s.ArgoCDURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("argocd_url must be an absolute URL")
+		}
+		if s.ArgoCDToken == "" {
+			return errors.New("argocd_token must be specified with argocd_url")
+		}
+		s.ArgoCDURL = strings.TrimSuffix(s.ArgoCDURL, "/")
+	}
+	joined := make(map[string]bool)
+	for _, r := range s.Routes {
+		for _, roomID := range r.Rooms {
+			if joined[roomID] {
+				continue
+			}
+			joined[roomID] = true
+			if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+				log.WithFields(log.Fields{
+					log.ErrorKey: err,
+					"room_id":    roomID,
+					"user_id":    client.UserID,
+				}).Error("Failed to join room")
+			}
+		}
+	}
+	return nil
+}
+
+// PostRegister deletes this service if there are no routes remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Routes) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Deleting service: No routes remaining.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// Commands supported:
+//    !argocd status <app>
+//    !argocd sync <app>
+//    !argocd rollback <app> [history ID]
+// There are no commands unless argocd_url is set.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	if s.ArgoCDURL == "" {
+		return nil
+	}
+	// Services loaded from the database haven't been registered
+	if err := s.compileRoutes(); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to compile routes")
+		return nil
+	}
+	return []types.Command{
+		{
+			Path: []string{"argocd", "status"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdStatus(roomID, args)
+			},
+		},
+		{
+			Path: []string{"argocd", "sync"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdSync(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"argocd", "rollback"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdRollback(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) authenticate(header http.Header, body []byte) bool {
+	if s.Secret == "" {
+		return true
+	}
+	if auth := header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Secret)) == 1
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(header.Get("X-Signature"), "sha256="))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func (e *Event) message() gomatrix.HTMLMessage {
+	desc := eventDescriptions[e.Kind]
+	var text, htmlText strings.Builder
+	fmt.Fprintf(&text, "[%s] %s: %s", e.Source, e.App, desc)
+	if e.URL != "" {
+		fmt.Fprintf(&htmlText, `[%s] <a href="%s"><b>%s</b></a>: %s`, html.EscapeString(e.Source), html.EscapeString(e.URL), html.EscapeString(e.App), desc)
+	} else {
+		fmt.Fprintf(&htmlText, "[%s] <b>%s</b>: %s", html.EscapeString(e.Source), html.EscapeString(e.App), desc)
+	}
+	if e.Revision != "" {
+		rev := shortRevision(e.Revision)
+		fmt.Fprintf(&text, " (%s)", rev)
+		fmt.Fprintf(&htmlText, " (<code>%s</code>)", html.EscapeString(rev))
+	}
+	if e.Message != "" {
+		text.WriteString(" - " + e.Message)
+		htmlText.WriteString(" - " + html.EscapeString(e.Message))
+	}
+	if e.URL != "" {
+		text.WriteString(" " + e.URL)
+	}
+	return gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		Body:          text.String(),
+		FormattedBody: htmlText.String(),
+	}
+}
+
+// OnReceiveWebhook receives Argo CD and Flux notifications and sends them to the rooms of the
+// routes they match.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	logger := log.WithField("service_id", s.ServiceID())
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if !s.authenticate(req.Header, body) {
+		logger.Warn("GitOps webhook failed authentication")
+		w.WriteHeader(401)
+		return
+	}
+	event, err := parseEvent(body)
+	if err != nil {
+		logger.WithError(err).Error("GitOps webhook received an invalid payload")
+		w.WriteHeader(400)
+		return
+	}
+	if event == nil {
+		w.WriteHeader(200)
+		return
+	}
+	if err := s.compileRoutes(); err != nil {
+		logger.WithError(err).Error("Failed to compile routes")
+		w.WriteHeader(500)
+		return
+	}
+	msg := event.message()
+	urgent := event.Kind == EventSyncFailed || event.Kind == EventHealthDegraded
+	// A room may be in several matching routes, and is sent the event once. It is urgent if any
+	// of those routes is.
+	var rooms []string
+	urgentRooms := make(map[string]bool)
+	for _, r := range s.Routes {
+		if !r.matchesApp(event.App) || !r.matchesEvent(event.Kind) {
+			continue
+		}
+		for _, roomID := range r.Rooms {
+			if _, ok := urgentRooms[roomID]; !ok {
+				rooms = append(rooms, roomID)
+			}
+			urgentRooms[roomID] = urgentRooms[roomID] || (r.Urgent && urgent)
+		}
+	}
+	for _, roomID := range rooms {
+		if err := notify.Send(cli, roomID, msg, urgentRooms[roomID]); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send GitOps event to room")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package gitops
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+const argoSucceeded = `{"app":"payments-api","phase":"Succeeded","health":"Healthy",
+	"revision":"3a092c3a6032ebb50384c99b445f947e9ce86e2a","message":"successfully synced (all tasks run)",
+	"url":"https://argocd/applications/payments-api"}`
+
+const fluxFailed = `{"involvedObject":{"kind":"Kustomization","namespace":"flux-system","name":"payments-api"},
+	"severity":"error","reason":"ReconciliationFailed","message":"kustomize build failed",
+	"metadata":{"kustomize.toolkit.fluxcd.io/revision":"main@sha1:3a092c3a6032ebb50384c99b445f947e9ce86e2a"},
+	"reportingController":"kustomize-controller"}`
+
+func newService(t *testing.T, argoURL string) (*Service, *[]testutils.SentMessage, *gomatrix.Client) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []testutils.SentMessage
+	cli := testutils.NewMatrixClient(&sent, "")
+	s := testutils.NewService(t, ServiceType, `{
+		"secret": "hunter2",
+		"argocd_url": "`+argoURL+`",
+		"argocd_token": "argo_token",
+		"allowed_users": ["@zelda:hyrule"],
+		"routes": [
+			{"apps": ["payments-*"], "rooms": ["!payments:hyrule"]},
+			{"apps": ["*"], "rooms": ["!oncall:hyrule"], "events": ["sync-failed", "health-degraded"]}
+		]
+	}`, cli).(*Service)
+	return s, &sent, cli
+}
+
+func TestWebhook(t *testing.T) {
+	s, sent, cli := newService(t, "https://argocd")
+
+	post := func(body string, header http.Header) int {
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, cli)
+		return w.Code
+	}
+
+	if code := post(argoSucceeded, nil); code != 401 {
+		t.Errorf("Expected an unauthenticated request to return 401, got %d", code)
+	}
+	if code := post(argoSucceeded, http.Header{"Authorization": {"Bearer hunter2"}}); code != 200 {
+		t.Fatalf("Argo CD notification returned %d", code)
+	}
+	want := "!payments:hyrule [Argo CD] payments-api: sync succeeded (3a092c3) - successfully synced (all tasks run) https://argocd/applications/payments-api"
+	if len(*sent) != 1 || (*sent)[0].String() != want {
+		t.Errorf("Expected only the payments room to be told about a successful sync, got %v", *sent)
+	}
+
+	*sent = nil
+	mac := hmac.New(sha256.New, []byte("hunter2"))
+	mac.Write([]byte(fluxFailed))
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if code := post(fluxFailed, http.Header{"X-Signature": {sig}}); code != 200 {
+		t.Fatalf("Flux event returned %d", code)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("Expected a failed sync to go to both rooms, got %v", *sent)
+	}
+	for _, msg := range *sent {
+		if !strings.HasSuffix(msg.String(), " [Flux] payments-api: sync failed (main@sha1:3a092c3) - kustomize build failed") {
+			t.Errorf("Unexpected message: %s", msg)
+		}
+	}
+
+	*sent = nil
+	info := `{"involvedObject":{"name":"payments-api"},"severity":"info","reason":"DependencyNotReady"}`
+	if code := post(info, http.Header{"Authorization": {"Bearer hunter2"}}); code != 200 || len(*sent) != 0 {
+		t.Errorf("Expected informational events to be ignored, got %d %v", code, *sent)
+	}
+}
+
+// quietStore puts every room in quiet hours.
+type quietStore struct {
+	database.NopStorage
+	queued []types.QueuedNotification
+}
+
+func (s *quietStore) LoadBotOptions(userID, roomID string) (types.BotOptions, error) {
+	now := time.Now().UTC()
+	return types.BotOptions{
+		UserID: userID,
+		RoomID: roomID,
+		Options: map[string]interface{}{"quiet_hours": map[string]interface{}{
+			"start": now.Add(-time.Hour).Format("15:04"),
+			"end":   now.Add(time.Hour).Format("15:04"),
+		}},
+	}, nil
+}
+
+func (s *quietStore) StoreQueuedNotification(n types.QueuedNotification) error {
+	s.queued = append(s.queued, n)
+	return nil
+}
+
+func TestWebhookUrgentRoute(t *testing.T) {
+	s, sent, cli := newService(t, "https://argocd")
+	store := &quietStore{}
+	database.SetServiceDB(store)
+	s.Routes = []Route{
+		{Apps: []string{"*"}, Rooms: []string{"!oncall:hyrule", "!payments:hyrule"}},
+		{Apps: []string{"payments-*"}, Rooms: []string{"!oncall:hyrule"}, Urgent: true},
+	}
+
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(fluxFailed))
+	req.Header.Set("Authorization", "Bearer hunter2")
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	if w.Code != 200 {
+		t.Fatalf("Flux event returned %d", w.Code)
+	}
+	// The on-call room is in a non-urgent route too, but is still sent the event during quiet hours
+	if len(*sent) != 1 || !strings.HasPrefix((*sent)[0].String(), "!oncall:hyrule ") {
+		t.Errorf("Expected the event to be sent to the on-call room once, got %v", *sent)
+	}
+	if len(store.queued) != 1 || store.queued[0].RoomID != "!payments:hyrule" {
+		t.Errorf("Expected the event to be held back in the payments room, got %+v", store.queued)
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"app":"a","phase":"Running"}`:                                                   EventSyncStarted,
+		`{"app":"a","phase":"Error"}`:                                                     EventSyncFailed,
+		`{"app":"a","phase":"Succeeded","health":"Degraded"}`:                             EventHealthDegraded,
+		`{"app":"a","event":"sync-failed","phase":"Succeeded"}`:                           EventSyncFailed,
+		`{"involvedObject":{"name":"a"},"reason":"Progressing"}`:                          EventSyncStarted,
+		`{"involvedObject":{"name":"a"},"reason":"UpgradeSucceeded"}`:                     EventSyncSucceeded,
+		`{"involvedObject":{"name":"a"},"severity":"error","reason":"HealthCheckFailed"}`: EventHealthDegraded,
+	} {
+		e, err := parseEvent([]byte(body))
+		if err != nil || e == nil || e.Kind != want {
+			t.Errorf("%s: want %s got %+v %v", body, want, e, err)
+		}
+	}
+	if _, err := parseEvent([]byte(`{"phase":"Running"}`)); err == nil {
+		t.Errorf("Expected a notification without an app to be rejected")
+	}
+}
+
+// argocd stands in for the Argo CD API, recording the requests it receives.
+type argocd struct {
+	requests []string
+}
+
+func (a *argocd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer argo_token" {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error":"invalid session","code":16,"message":"invalid session"}`))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	a.requests = append(a.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+	switch r.URL.Path {
+	case "/api/v1/applications/payments-api":
+		w.Write([]byte(`{"status":{"sync":{"status":"Synced","revision":"3a092c3a6032ebb50384c99b445f947e9ce86e2a"},
+			"health":{"status":"Healthy"},"operationState":{"phase":"Succeeded","message":"successfully synced"},
+			"history":[{"id":4,"revision":"9f9d459ba0820000000000000000000000000000"},{"id":5,"revision":"3a092c3a6032ebb50384c99b445f947e9ce86e2a"}]}}`))
+	case "/api/v1/applications/payments-api/sync", "/api/v1/applications/payments-api/rollback":
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(403)
+		w.Write([]byte(`{"error":"permission denied","code":7,"message":"permission denied"}`))
+	}
+}
+
+func TestCommands(t *testing.T) {
+	a := &argocd{}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	s, _, cli := newService(t, srv.URL)
+	cmds := s.Commands(cli)
+
+	body, err := testutils.RunTextCommand(cmds, "!payments:hyrule", "@link:hyrule", "argocd status payments-api")
+	if err != nil {
+		t.Fatalf("status returned error: %s", err)
+	}
+	if body != "payments-api: Synced, Healthy at 3a092c3\nLast operation: Succeeded successfully synced" {
+		t.Errorf("Unexpected status response: %s", body)
+	}
+
+	if _, err := testutils.RunTextCommand(cmds, "!payments:hyrule", "@link:hyrule", "argocd sync payments-api"); err == nil {
+		t.Errorf("Expected a user who isn't allowed to be rejected")
+	}
+	if _, err := testutils.RunTextCommand(cmds, "!lobby:hyrule", "@zelda:hyrule", "argocd sync web"); err == nil ||
+		err.Error() != "App web is not configured for this room" {
+		t.Errorf("Expected an app which isn't routed to the room to be rejected, got %v", err)
+	}
+	if _, err := testutils.RunTextCommand(cmds, "!payments:hyrule", "@zelda:hyrule", "argocd sync payments-api"); err != nil {
+		t.Fatalf("sync returned error: %s", err)
+	}
+	body, err = testutils.RunTextCommand(cmds, "!payments:hyrule", "@zelda:hyrule", "argocd rollback payments-api")
+	if err != nil {
+		t.Fatalf("rollback returned error: %s", err)
+	}
+	if body != "Rolling back payments-api to deployment 4 (9f9d459)" {
+		t.Errorf("Unexpected rollback response: %s", body)
+	}
+	want := []string{
+		"GET /api/v1/applications/payments-api",
+		"POST /api/v1/applications/payments-api/sync {}",
+		"GET /api/v1/applications/payments-api",
+		"POST /api/v1/applications/payments-api/rollback {\"id\":4}",
+	}
+	if strings.Join(a.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected requests:\n%s", strings.Join(a.requests, "\n"))
+	}
+
+	_, err = testutils.RunTextCommand(cmds, "!payments:hyrule", "@zelda:hyrule", "argocd sync payments-web")
+	if err == nil || err.Error() != "Failed to sync payments-web: Argo CD returned 403: permission denied" {
+		t.Errorf("Expected the Argo CD error to be returned, got %v", err)
+	}
+}
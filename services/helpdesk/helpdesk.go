@@ -0,0 +1,514 @@
+// Package helpdesk implements a Service which turns DMs to the bot into support tickets.
+package helpdesk
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Helpdesk service
+const ServiceType = "helpdesk"
+
+// Ticket statuses
+const (
+	StatusOpen     = "open"
+	StatusClaimed  = "claimed"
+	StatusResolved = "resolved"
+)
+
+const (
+	defaultSLAMins   = 60
+	pollInterval     = 1 * time.Minute
+	dmCacheLifetime  = 10 * time.Minute
+	defaultGreeting  = "Thanks for getting in touch! Someone will reply here as soon as they can."
+	resolvedFarewell = "This request has been marked as resolved. Send another message if you need more help."
+)
+
+// Service contains the Config fields for the Helpdesk service.
+//
+// A DM to the bot opens a ticket, which is posted into the triage room as the root of a thread.
+// Further messages from the user are added to the thread, and replies from staff in the thread
+// are relayed back to the user's DM. Messages in the thread which start with "!" are not relayed.
+// DM invites to the bot are accepted automatically. Once a ticket is resolved, the next DM from
+// the user opens a new ticket.
+//
+// If a ticket has been waiting for a reply from staff for longer than the SLA, a reminder is
+// posted in its thread, and again every SLA period until staff reply.
+//
+// Commands supported (in the triage room):
+//    !tickets
+//    !claim <ticket>
+//    !resolve <ticket>
+//    !reopen <ticket>
+//
+// Example JSON request:
+//   {
+//       "triage_room_id": "!triage:localhost",
+//       "staff": ["@alice:localhost", "@bob:localhost"],
+//       "greeting": "Thanks! We usually reply within an hour.",
+//       "sla_mins": 60
+//   }
+type Service struct {
+	types.DefaultService
+	// The room which tickets are posted into.
+	TriageRoomID string `json:"triage_room_id"`
+	// Optional. The users whose replies are relayed and who can run commands. Defaults to everyone
+	// in the triage room.
+	Staff []string `json:"staff"`
+	// Optional. The message sent to users when they open a ticket.
+	Greeting string `json:"greeting"`
+	// Optional. How long a ticket can wait for a reply from staff before a reminder is posted.
+	// Defaults to 60.
+	SLAMins int `json:"sla_mins"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the triage room.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if s.TriageRoomID == "" {
+		return errors.New("triage_room_id must be specified")
+	}
+	if s.SLAMins < 0 {
+		return errors.New("sla_mins cannot be negative")
+	}
+	if _, err := client.JoinRoom(s.TriageRoomID, "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    s.TriageRoomID,
+			"user_id":    client.UserID,
+		}).Error("Failed to join room")
+	}
+	return nil
+}
+
+func (s *Service) isStaff(userID string) bool {
+	if len(s.Staff) == 0 {
+		return true
+	}
+	for _, u := range s.Staff {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) sla() time.Duration {
+	if s.SLAMins == 0 {
+		return defaultSLAMins * time.Minute
+	}
+	return time.Duration(s.SLAMins) * time.Minute
+}
+
+type dmCacheEntry struct {
+	isDM    bool
+	expires time.Time
+}
+
+var (
+	dmCacheMutex sync.Mutex
+	dmCache      = make(map[string]dmCacheEntry) // bot user ID + room ID => entry
+)
+
+// isDM returns true if the room only has the bot and one other member in it.
+func (s *Service) isDM(cli *gomatrix.Client, roomID string) bool {
+	if roomID == s.TriageRoomID {
+		return false
+	}
+	key := cli.UserID + roomID
+	dmCacheMutex.Lock()
+	entry, ok := dmCache[key]
+	dmCacheMutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.isDM
+	}
+	members, err := cli.JoinedMembers(roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to get joined members")
+		return false
+	}
+	entry = dmCacheEntry{
+		isDM:    len(members.Joined) == 2,
+		expires: time.Now().Add(dmCacheLifetime),
+	}
+	dmCacheMutex.Lock()
+	dmCache[key] = entry
+	dmCacheMutex.Unlock()
+	return entry.isDM
+}
+
+// OnReceiveEvent accepts DM invites, opens and updates tickets from DMs, and relays staff replies.
+func (s *Service) OnReceiveEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if event.Type == "m.room.member" {
+		s.onMemberEvent(cli, event)
+		return
+	}
+	if event.Type != "m.room.message" || event.Sender == cli.UserID {
+		return
+	}
+	if msgtype, _ := event.MessageType(); msgtype == "m.notice" {
+		return // don't talk to other bots
+	}
+	if event.RoomID == s.TriageRoomID {
+		s.onStaffMessage(cli, event)
+	} else if s.isDM(cli, event.RoomID) {
+		s.onUserMessage(cli, event)
+	}
+}
+
+func (s *Service) onMemberEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if event.StateKey == nil || *event.StateKey != cli.UserID {
+		return
+	}
+	membership, _ := event.Content["membership"].(string)
+	isDirect, _ := event.Content["is_direct"].(bool)
+	if membership != "invite" || !isDirect {
+		return
+	}
+	if _, err := cli.JoinRoom(event.RoomID, "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    event.RoomID,
+			"inviter":    event.Sender,
+		}).Error("Failed to accept DM invite")
+	}
+}
+
+// onUserMessage opens a new ticket, or adds the message to the thread of the user's open ticket.
+func (s *Service) onUserMessage(cli *gomatrix.Client, event *gomatrix.Event) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    event.RoomID,
+		"user_id":    event.Sender,
+	})
+	db := database.GetServiceDB()
+	ticket, err := db.LoadLatestTicketForRoom(s.ServiceID(), event.RoomID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.WithError(err).Error("Failed to load ticket")
+		return
+	}
+	if err == sql.ErrNoRows || ticket.Status == StatusResolved {
+		s.openTicket(cli, event)
+		return
+	}
+	ticket.LastUserTimestamp = event.Timestamp
+	content := threaded(relayContent(event, event.Sender+": ", "m.notice"), ticket.ThreadEventID)
+	if _, err := cli.SendMessageEvent(s.TriageRoomID, "m.room.message", content); err != nil {
+		logger.WithError(err).Error("Failed to add message to ticket thread")
+		return
+	}
+	if err := db.UpdateTicket(ticket); err != nil {
+		logger.WithError(err).Error("Failed to update ticket")
+	}
+}
+
+func (s *Service) openTicket(cli *gomatrix.Client, event *gomatrix.Event) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"room_id":    event.RoomID,
+		"user_id":    event.Sender,
+	})
+	ticket := types.Ticket{
+		ServiceID:         s.ServiceID(),
+		UserID:            event.Sender,
+		DMRoomID:          event.RoomID,
+		Status:            StatusOpen,
+		OpenedTimestamp:   event.Timestamp,
+		LastUserTimestamp: event.Timestamp,
+	}
+	db := database.GetServiceDB()
+	if err := db.InsertTicket(&ticket); err != nil {
+		logger.WithError(err).Error("Failed to insert ticket")
+		return
+	}
+	root := relayContent(event, fmt.Sprintf("Ticket #%d from %s: ", ticket.TicketID, event.Sender), "m.notice")
+	res, err := cli.SendMessageEvent(s.TriageRoomID, "m.room.message", root)
+	if err != nil {
+		logger.WithError(err).Error("Failed to post ticket into triage room")
+		return
+	}
+	ticket.ThreadEventID = res.EventID
+	if err := db.UpdateTicket(ticket); err != nil {
+		logger.WithError(err).Error("Failed to update ticket")
+		return
+	}
+	logger.WithField("ticket", ticket.TicketID).Info("Opened ticket")
+	greeting := s.Greeting
+	if greeting == "" {
+		greeting = defaultGreeting
+	}
+	s.tellUser(cli, ticket, greeting)
+}
+
+// onStaffMessage relays replies in ticket threads to the ticket's DM room.
+func (s *Service) onStaffMessage(cli *gomatrix.Client, event *gomatrix.Event) {
+	rootID := matrix.ThreadRoot(event)
+	if rootID == "" {
+		// A reply to the root event is treated as being in the thread, for clients which don't
+		// support threads
+		rootID = matrix.InReplyTo(event)
+	}
+	if rootID == "" || !s.isStaff(event.Sender) {
+		return
+	}
+	if body, _ := event.Body(); strings.HasPrefix(body, "!") {
+		return // commands aren't for the user
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    event.Sender,
+		"thread_id":  rootID,
+	})
+	db := database.GetServiceDB()
+	ticket, err := db.LoadTicketByThread(s.ServiceID(), rootID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.WithError(err).Error("Failed to load ticket")
+		}
+		return
+	}
+	if ticket.Status == StatusResolved {
+		return
+	}
+	if _, err := cli.SendMessageEvent(ticket.DMRoomID, "m.room.message", relayContent(event, "", "m.text")); err != nil {
+		logger.WithError(err).Error("Failed to relay reply to user")
+		return
+	}
+	ticket.LastStaffTimestamp = event.Timestamp
+	if err := db.UpdateTicket(ticket); err != nil {
+		logger.WithError(err).Error("Failed to update ticket")
+	}
+}
+
+func (s *Service) tellUser(cli *gomatrix.Client, ticket types.Ticket, text string) {
+	if _, err := cli.SendText(ticket.DMRoomID, text); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    ticket.DMRoomID,
+			"ticket":     ticket.TicketID,
+		}).Error("Failed to send message to user")
+	}
+}
+
+// relayContent copies the content of a message so it can be sent elsewhere. Text messages have
+// their reply fallback removed and the prefix added, and are sent with the given msgtype; other
+// messages (images, files) are copied as they are. Any relations are dropped.
+func relayContent(event *gomatrix.Event, prefix, textType string) map[string]interface{} {
+	content := make(map[string]interface{})
+	msgtype, _ := event.MessageType()
+	if msgtype == "m.text" || msgtype == "m.emote" || msgtype == "" {
+		content["msgtype"] = textType
+		content["body"] = prefix + matrix.MessageBody(event)
+		return content
+	}
+	for k, v := range event.Content {
+		if k != "m.relates_to" {
+			content[k] = v
+		}
+	}
+	return content
+}
+
+// threaded adds a thread relation to the content so it is sent into the thread with the given root.
+func threaded(content map[string]interface{}, rootID string) map[string]interface{} {
+	content["m.relates_to"] = map[string]interface{}{
+		"rel_type":        "m.thread",
+		"event_id":        rootID,
+		"is_falling_back": true,
+		"m.in_reply_to": map[string]interface{}{
+			"event_id": rootID,
+		},
+	}
+	return content
+}
+
+// OnPoll posts reminders for tickets which have been waiting for a reply for longer than the SLA.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	s.remind(cli, time.Now())
+	return time.Now().Add(pollInterval)
+}
+
+func (s *Service) remind(cli *gomatrix.Client, now time.Time) {
+	logger := log.WithField("service_id", s.ServiceID())
+	db := database.GetServiceDB()
+	tickets, err := db.LoadUnresolvedTickets(s.ServiceID())
+	if err != nil {
+		logger.WithError(err).Error("Failed to load unresolved tickets")
+		return
+	}
+	slaMs := int64(s.sla() / time.Millisecond)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	for _, t := range tickets {
+		if t.ThreadEventID == "" || t.LastStaffTimestamp >= t.LastUserTimestamp {
+			continue // not waiting for staff
+		}
+		due := t.LastUserTimestamp
+		if t.RemindedTimestamp > due {
+			due = t.RemindedTimestamp
+		}
+		if nowMs < due+slaMs {
+			continue
+		}
+		waiting := time.Duration(nowMs-t.LastUserTimestamp) * time.Millisecond
+		text := fmt.Sprintf("Ticket #%d from %s has been waiting for a reply for %s.", t.TicketID, t.UserID, formatWait(waiting))
+		if t.Status == StatusClaimed {
+			text = t.Assignee + ": " + text
+		} else {
+			text += " Nobody has claimed it yet."
+		}
+		content := threaded(map[string]interface{}{"msgtype": "m.notice", "body": text}, t.ThreadEventID)
+		if err := notify.Send(cli, s.TriageRoomID, content, false); err != nil {
+			logger.WithError(err).WithField("ticket", t.TicketID).Error("Failed to send SLA reminder")
+			continue
+		}
+		t.RemindedTimestamp = nowMs
+		if err := db.UpdateTicket(t); err != nil {
+			logger.WithError(err).WithField("ticket", t.TicketID).Error("Failed to update ticket")
+		}
+	}
+}
+
+func formatWait(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%d minutes", int(d/time.Minute))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+// Commands supported:
+//    !tickets
+//    !claim <ticket>
+//    !resolve <ticket>
+//    !reopen <ticket>
+// Commands are only accepted in the triage room, from staff.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"tickets"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if err := s.checkStaffCommand(roomID, userID); err != nil {
+					return nil, err
+				}
+				return s.cmdTickets()
+			},
+		},
+		s.stateCommand(cli, "claim"),
+		s.stateCommand(cli, "resolve"),
+		s.stateCommand(cli, "reopen"),
+	}
+}
+
+func (s *Service) checkStaffCommand(roomID, userID string) error {
+	if roomID != s.TriageRoomID {
+		return errors.New("Ticket commands can only be used in the triage room")
+	}
+	if !s.isStaff(userID) {
+		return errors.New("Only staff can manage tickets")
+	}
+	return nil
+}
+
+func (s *Service) cmdTickets() (interface{}, error) {
+	tickets, err := database.GetServiceDB().LoadUnresolvedTickets(s.ServiceID())
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "There are no unresolved tickets."}, nil
+	}
+	var lines []string
+	for _, t := range tickets {
+		line := fmt.Sprintf("#%d from %s: %s", t.TicketID, t.UserID, t.Status)
+		if t.Status == StatusClaimed {
+			line += " by " + t.Assignee
+		}
+		if t.LastUserTimestamp > t.LastStaffTimestamp {
+			line += " (waiting for staff)"
+		}
+		lines = append(lines, line)
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+}
+
+func (s *Service) stateCommand(cli *gomatrix.Client, name string) types.Command {
+	return types.Command{
+		Path: []string{name},
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			if err := s.checkStaffCommand(roomID, userID); err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, fmt.Errorf("Usage: !%s <ticket>", name)
+			}
+			ticketID, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a ticket number", args[0])
+			}
+			db := database.GetServiceDB()
+			ticket, err := db.LoadTicket(s.ServiceID(), ticketID)
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("Ticket #%d doesn't exist", ticketID)
+			} else if err != nil {
+				return nil, err
+			}
+
+			var reply, userText string
+			switch name {
+			case "claim":
+				if ticket.Status == StatusResolved {
+					return nil, fmt.Errorf("Ticket #%d is resolved. Reopen it first", ticketID)
+				}
+				ticket.Status = StatusClaimed
+				ticket.Assignee = userID
+				reply = fmt.Sprintf("%s claimed ticket #%d", userID, ticketID)
+				userText = userID + " is looking at your request."
+			case "resolve":
+				if ticket.Status == StatusResolved {
+					return nil, fmt.Errorf("Ticket #%d is already resolved", ticketID)
+				}
+				ticket.Status = StatusResolved
+				reply = fmt.Sprintf("%s resolved ticket #%d", userID, ticketID)
+				userText = resolvedFarewell
+			case "reopen":
+				if ticket.Status != StatusResolved {
+					return nil, fmt.Errorf("Ticket #%d isn't resolved", ticketID)
+				}
+				latest, err := db.LoadLatestTicketForRoom(s.ServiceID(), ticket.DMRoomID)
+				if err != nil {
+					return nil, err
+				}
+				if latest.TicketID != ticket.TicketID && latest.Status != StatusResolved {
+					return nil, fmt.Errorf("%s has a newer open ticket #%d", ticket.UserID, latest.TicketID)
+				}
+				ticket.Status = StatusOpen
+				ticket.Assignee = ""
+				reply = fmt.Sprintf("%s reopened ticket #%d", userID, ticketID)
+				userText = "Your request has been reopened."
+			}
+			if err := db.UpdateTicket(ticket); err != nil {
+				return nil, err
+			}
+			s.tellUser(cli, ticket, userText)
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: reply}, nil
+		},
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package helpdesk
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// ticketStore keeps tickets in memory.
+type ticketStore struct {
+	database.NopStorage
+	tickets []types.Ticket
+}
+
+func (s *ticketStore) InsertTicket(t *types.Ticket) error {
+	t.TicketID = int64(len(s.tickets) + 1)
+	s.tickets = append(s.tickets, *t)
+	return nil
+}
+
+func (s *ticketStore) UpdateTicket(t types.Ticket) error {
+	s.tickets[t.TicketID-1] = t
+	return nil
+}
+
+func (s *ticketStore) LoadTicket(serviceID string, ticketID int64) (types.Ticket, error) {
+	if ticketID < 1 || ticketID > int64(len(s.tickets)) {
+		return types.Ticket{}, sql.ErrNoRows
+	}
+	return s.tickets[ticketID-1], nil
+}
+
+func (s *ticketStore) LoadTicketByThread(serviceID, threadEventID string) (types.Ticket, error) {
+	for _, t := range s.tickets {
+		if t.ThreadEventID == threadEventID {
+			return t, nil
+		}
+	}
+	return types.Ticket{}, sql.ErrNoRows
+}
+
+func (s *ticketStore) LoadLatestTicketForRoom(serviceID, dmRoomID string) (types.Ticket, error) {
+	for i := len(s.tickets) - 1; i >= 0; i-- {
+		if s.tickets[i].DMRoomID == dmRoomID {
+			return s.tickets[i], nil
+		}
+	}
+	return types.Ticket{}, sql.ErrNoRows
+}
+
+func (s *ticketStore) LoadUnresolvedTickets(serviceID string) (tickets []types.Ticket, err error) {
+	for _, t := range s.tickets {
+		if t.Status != StatusResolved {
+			tickets = append(tickets, t)
+		}
+	}
+	return
+}
+
+type sentMessage struct {
+	roomID  string
+	content map[string]interface{}
+}
+
+func (m sentMessage) threadRoot() string {
+	rel, _ := m.content["m.relates_to"].(map[string]interface{})
+	root, _ := rel["event_id"].(string)
+	return root
+}
+
+func newTestService(t *testing.T) (*Service, *gomatrix.Client, *[]sentMessage) {
+	var sent []sentMessage
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/joined_members"):
+			body = `{"joined":{"@navi:hyrule":{},"@link:hyrule":{}}}`
+			if strings.Contains(req.URL.Path, "!group:hyrule") {
+				body = `{"joined":{"@navi:hyrule":{},"@link:hyrule":{},"@zelda:hyrule":{}}}`
+			}
+		case strings.Contains(req.URL.Path, "/send/m.room.message"):
+			segs := strings.Split(req.URL.Path, "/")
+			var content map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			sent = append(sent, sentMessage{segs[len(segs)-4], content})
+			body = fmt.Sprintf(`{"event_id":"$%d:hyrule"}`, len(sent))
+		case strings.Contains(req.URL.Path, "/join/"):
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	srvc, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{
+		"triage_room_id": "!triage:hyrule",
+		"staff": ["@zelda:hyrule"],
+		"sla_mins": 30
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create helpdesk service: ", err)
+	}
+	s := srvc.(*Service)
+	if err := s.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register helpdesk service: ", err)
+	}
+	return s, cli, &sent
+}
+
+func message(roomID, sender, body string, ts int64, relatesTo map[string]interface{}) *gomatrix.Event {
+	content := map[string]interface{}{"msgtype": "m.text", "body": body}
+	if relatesTo != nil {
+		content["m.relates_to"] = relatesTo
+	}
+	return &gomatrix.Event{
+		Type:      "m.room.message",
+		Sender:    sender,
+		RoomID:    roomID,
+		Timestamp: ts,
+		Content:   content,
+	}
+}
+
+func inThread(rootID string) map[string]interface{} {
+	return map[string]interface{}{"rel_type": "m.thread", "event_id": rootID}
+}
+
+func TestTicketFlow(t *testing.T) {
+	store := &ticketStore{}
+	database.SetServiceDB(store)
+	s, cli, sent := newTestService(t)
+
+	s.OnReceiveEvent(cli, message("!dm:hyrule", "@link:hyrule", "I can't log in", 1000, nil))
+	if len(store.tickets) != 1 {
+		t.Fatalf("Expected a ticket to be opened, got %v", store.tickets)
+	}
+	ticket := store.tickets[0]
+	if ticket.ThreadEventID != "$1:hyrule" || ticket.Status != StatusOpen || ticket.UserID != "@link:hyrule" {
+		t.Fatalf("Unexpected ticket: %+v", ticket)
+	}
+	if len(*sent) != 2 || (*sent)[0].roomID != "!triage:hyrule" || (*sent)[1].roomID != "!dm:hyrule" {
+		t.Fatalf("Expected the ticket to be posted and the user greeted, got %v", *sent)
+	}
+	if body := (*sent)[0].content["body"]; body != "Ticket #1 from @link:hyrule: I can't log in" {
+		t.Errorf("Unexpected ticket message: %v", body)
+	}
+
+	// Follow ups go into the thread
+	*sent = nil
+	s.OnReceiveEvent(cli, message("!dm:hyrule", "@link:hyrule", "It says wrong password", 2000, nil))
+	if len(*sent) != 1 || (*sent)[0].roomID != "!triage:hyrule" || (*sent)[0].threadRoot() != "$1:hyrule" {
+		t.Fatalf("Expected the message to be added to the thread, got %v", *sent)
+	}
+	if len(store.tickets) != 1 {
+		t.Fatalf("Expected no new ticket, got %v", store.tickets)
+	}
+
+	// Staff replies are relayed, but not commands or replies from non-staff
+	*sent = nil
+	s.OnReceiveEvent(cli, message("!triage:hyrule", "@ganon:hyrule", "ha", 3000, inThread("$1:hyrule")))
+	s.OnReceiveEvent(cli, message("!triage:hyrule", "@zelda:hyrule", "!claim 1", 3000, inThread("$1:hyrule")))
+	s.OnReceiveEvent(cli, message("!triage:hyrule", "@zelda:hyrule", "> <@link:hyrule> It says wrong password\n\nTry resetting it", 3000, inThread("$1:hyrule")))
+	if len(*sent) != 1 || (*sent)[0].roomID != "!dm:hyrule" || (*sent)[0].content["body"] != "Try resetting it" {
+		t.Fatalf("Expected the staff reply to be relayed, got %v", *sent)
+	}
+	if store.tickets[0].LastStaffTimestamp != 3000 {
+		t.Errorf("Expected the staff reply time to be recorded, got %+v", store.tickets[0])
+	}
+
+	// Group rooms aren't DMs
+	s.OnReceiveEvent(cli, message("!group:hyrule", "@link:hyrule", "hello", 4000, nil))
+	if len(store.tickets) != 1 {
+		t.Fatalf("Expected no ticket from a group room, got %v", store.tickets)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	store := &ticketStore{}
+	database.SetServiceDB(store)
+	s, cli, sent := newTestService(t)
+	s.OnReceiveEvent(cli, message("!dm:hyrule", "@link:hyrule", "help", 1000, nil))
+	cmds := s.Commands(cli)
+	run := func(roomID, userID, name string, args ...string) (string, error) {
+		for _, c := range cmds {
+			if c.Path[0] == name {
+				res, err := c.Command(roomID, userID, args)
+				if err != nil {
+					return "", err
+				}
+				return res.(*gomatrix.TextMessage).Body, nil
+			}
+		}
+		t.Fatalf("No command %s", name)
+		return "", nil
+	}
+
+	if _, err := run("!dm:hyrule", "@zelda:hyrule", "claim", "1"); err == nil {
+		t.Errorf("Expected commands outside the triage room to be rejected")
+	}
+	if _, err := run("!triage:hyrule", "@ganon:hyrule", "claim", "1"); err == nil {
+		t.Errorf("Expected commands from non-staff to be rejected")
+	}
+	if _, err := run("!triage:hyrule", "@zelda:hyrule", "claim", "2"); err == nil {
+		t.Errorf("Expected an unknown ticket to be rejected")
+	}
+	*sent = nil
+	if res, err := run("!triage:hyrule", "@zelda:hyrule", "claim", "#1"); err != nil || res != "@zelda:hyrule claimed ticket #1" {
+		t.Fatalf("claim: unexpected response %q (%v)", res, err)
+	}
+	if store.tickets[0].Status != StatusClaimed || store.tickets[0].Assignee != "@zelda:hyrule" {
+		t.Errorf("Expected the ticket to be claimed, got %+v", store.tickets[0])
+	}
+	if len(*sent) != 1 || (*sent)[0].roomID != "!dm:hyrule" {
+		t.Errorf("Expected the user to be told, got %v", *sent)
+	}
+	if res, _ := run("!triage:hyrule", "@zelda:hyrule", "tickets"); res != "#1 from @link:hyrule: claimed by @zelda:hyrule (waiting for staff)" {
+		t.Errorf("tickets: unexpected response %q", res)
+	}
+	if _, err := run("!triage:hyrule", "@zelda:hyrule", "reopen", "1"); err == nil {
+		t.Errorf("Expected reopening an unresolved ticket to fail")
+	}
+	if _, err := run("!triage:hyrule", "@zelda:hyrule", "resolve", "1"); err != nil {
+		t.Fatalf("resolve returned error: %s", err)
+	}
+	if store.tickets[0].Status != StatusResolved {
+		t.Errorf("Expected the ticket to be resolved, got %+v", store.tickets[0])
+	}
+
+	// The next DM opens a new ticket, so the old one can't be reopened until that is resolved
+	s.OnReceiveEvent(cli, message("!dm:hyrule", "@link:hyrule", "another thing", 5000, nil))
+	if len(store.tickets) != 2 {
+		t.Fatalf("Expected a new ticket, got %v", store.tickets)
+	}
+	if _, err := run("!triage:hyrule", "@zelda:hyrule", "reopen", "1"); err == nil {
+		t.Errorf("Expected reopening to fail while there is a newer open ticket")
+	}
+	run("!triage:hyrule", "@zelda:hyrule", "resolve", "2")
+	if _, err := run("!triage:hyrule", "@zelda:hyrule", "reopen", "1"); err != nil {
+		t.Errorf("reopen returned error: %s", err)
+	}
+	if store.tickets[0].Status != StatusOpen || store.tickets[0].Assignee != "" {
+		t.Errorf("Expected the ticket to be reopened, got %+v", store.tickets[0])
+	}
+}
+
+func TestSLAReminders(t *testing.T) {
+	store := &ticketStore{}
+	database.SetServiceDB(store)
+	s, cli, sent := newTestService(t)
+	opened := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	openedMs := opened.UnixNano() / int64(time.Millisecond)
+	s.OnReceiveEvent(cli, message("!dm:hyrule", "@link:hyrule", "help", openedMs, nil))
+
+	*sent = nil
+	s.remind(cli, opened.Add(29*time.Minute))
+	if len(*sent) != 0 {
+		t.Fatalf("Expected no reminder before the SLA, got %v", *sent)
+	}
+	s.remind(cli, opened.Add(31*time.Minute))
+	if len(*sent) != 1 || (*sent)[0].threadRoot() != "$1:hyrule" {
+		t.Fatalf("Expected a reminder in the thread, got %v", *sent)
+	}
+	if body := (*sent)[0].content["body"]; body != "Ticket #1 from @link:hyrule has been waiting for a reply for 31 minutes. Nobody has claimed it yet." {
+		t.Errorf("Unexpected reminder: %v", body)
+	}
+	// Reminders repeat every SLA period
+	s.remind(cli, opened.Add(45*time.Minute))
+	if len(*sent) != 1 {
+		t.Fatalf("Expected no repeat reminder yet, got %v", *sent)
+	}
+	s.remind(cli, opened.Add(62*time.Minute))
+	if len(*sent) != 2 {
+		t.Fatalf("Expected a repeat reminder, got %v", *sent)
+	}
+	// No reminders once staff have replied
+	s.OnReceiveEvent(cli, message("!triage:hyrule", "@zelda:hyrule", "on it", openedMs+63*60000, inThread("$1:hyrule")))
+	*sent = nil
+	s.remind(cli, opened.Add(200*time.Minute))
+	if len(*sent) != 0 {
+		t.Errorf("Expected no reminder after a staff reply, got %v", *sent)
+	}
+}
@@ -0,0 +1,154 @@
+package jenkins
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// The longest line of a console log which is kept.
+const maxLineBytes = 4096
+
+// A crumb protects POST requests against CSRF when Jenkins requires it.
+type crumb struct {
+	Crumb             string `json:"crumb"`
+	CrumbRequestField string `json:"crumbRequestField"`
+}
+
+// jobPath returns the URL path of a job, which may be inside folders e.g. "team/deploy".
+func jobPath(job string) string {
+	var segments []string
+	for _, name := range strings.Split(job, "/") {
+		segments = append(segments, "job/"+url.PathEscape(name))
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *Service) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.URL+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.APIToken)
+	}
+	return req, nil
+}
+
+func (s *Service) do(req *http.Request) (*http.Response, error) {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		switch res.StatusCode {
+		case 401, 403:
+			return nil, fmt.Errorf("Jenkins refused the request (%d): check the API token and permissions", res.StatusCode)
+		case 404:
+			return nil, fmt.Errorf("Jenkins returned 404: no such job or build")
+		}
+		return nil, fmt.Errorf("Jenkins returned %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+// get makes a GET request and decodes the JSON response into result.
+func (s *Service) get(path string, result interface{}) error {
+	req, err := s.newRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// getTail makes a GET request and returns the last lines of the plain text response. Console logs
+// can be huge, so only those lines are kept while reading, and long lines are truncated.
+func (s *Service) getTail(path string, maxLines int) ([]string, error) {
+	req, err := s.newRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var lines []string
+	r := bufio.NewReaderSize(res.Body, maxLineBytes)
+	truncated := false
+	for {
+		line, isPrefix, err := r.ReadLine()
+		if err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// The rest of a long line is skipped
+		if !truncated {
+			lines = append(lines, string(line))
+			if len(lines) > maxLines {
+				lines = lines[1:]
+			}
+		}
+		truncated = isPrefix
+	}
+}
+
+// fetchCrumb returns a CSRF crumb, or nil if Jenkins doesn't have CSRF protection enabled.
+func (s *Service) fetchCrumb() (*crumb, error) {
+	req, err := s.newRequest("GET", "crumbIssuer/api/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to get a CSRF crumb: Jenkins returned %d", res.StatusCode)
+	}
+	var c crumb
+	if err := json.NewDecoder(res.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// post makes a POST request with a CSRF crumb and form parameters. It returns the response headers.
+func (s *Service) post(path string, params url.Values) (http.Header, error) {
+	c, err := s.fetchCrumb()
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest("POST", path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c != nil {
+		req.Header.Set(c.CrumbRequestField, c.Crumb)
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
@@ -0,0 +1,436 @@
+// Package jenkins implements a Service which controls Jenkins jobs and sends build notifications.
+package jenkins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Jenkins service
+const ServiceType = "jenkins"
+
+const defaultLogLines = 30
+
+// Service contains the Config fields for the Jenkins service.
+//
+// This service runs Jenkins jobs from Matrix rooms and sends a notification into rooms when their
+// builds finish. Each room lists the jobs it can control and be notified about; jobs inside
+// folders are named "folder/job". Requests are authenticated with a user's API token, and a
+// CSRF crumb is fetched for each request which changes something.
+//
+// Commands supported:
+//    !jenkins build <job> [PARAM=value...]
+//    !jenkins status <job>
+//    !jenkins abort <job> <build number>
+//    !jenkins log <job> <build number>
+//
+// Build notifications come from the Jenkins Notification plugin
+// (https://plugins.jenkins.io/notification/). Add an HTTP JSON endpoint for each job with the
+// webhook_url of this service, which is populated by Go-NEB after Service registration.
+// Notifications are sent when builds are finalized.
+//
+// Example JSON request:
+//   {
+//       "url": "https://jenkins.example.com",
+//       "username": "go-neb",
+//       "api_token": "11a2b3c4d5e6f7...",
+//       "allowed_users": ["@alice:example.com"],
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "jobs": ["go-neb", "deploy/production"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which the Jenkins Notification plugin should send to. Populated by Go-NEB after
+	// Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The base URL of Jenkins.
+	URL string `json:"url"`
+	// Optional. The Jenkins user to make requests as. Anonymous requests are made if this is empty.
+	Username string `json:"username"`
+	// Optional. The API token of the Jenkins user.
+	APIToken string `json:"api_token"`
+	// Optional. The users who can start and abort builds. Anyone in a room can if this is empty.
+	AllowedUsers []string `json:"allowed_users"`
+	// Optional. The number of lines from the end of a build log to show. Defaults to 30.
+	LogLines int `json:"log_lines"`
+	// A map of Matrix room ID to the jobs which can be controlled from that room.
+	Rooms map[string]struct {
+		// The names of the jobs. "*" allows every job.
+		Jobs []string `json:"jobs"`
+	} `json:"rooms"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Rooms) == 0 {
+		// this is an error UNLESS the old service had some rooms in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Rooms) == 0 {
+			return errors.New("At least one room must be specified")
+		}
+		return nil
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("url must be an absolute URL")
+	}
+	s.URL = strings.TrimSuffix(s.URL, "/")
+	if (s.Username == "") != (s.APIToken == "") {
+		return errors.New("username and api_token must be specified together")
+	}
+	if s.LogLines < 0 {
+		return errors.New("log_lines cannot be negative")
+	}
+	for roomID, room := range s.Rooms {
+		if len(room.Jobs) == 0 {
+			return fmt.Errorf("Room %s has no jobs", roomID)
+		}
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are configured.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// roomHasJob returns true if the job can be controlled from, and is notified to, the room.
+func (s *Service) roomHasJob(roomID, job string) bool {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return false
+	}
+	for _, j := range room.Jobs {
+		if j == "*" || j == job {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) isAllowed(userID string) bool {
+	if len(s.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range s.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands supported:
+//    !jenkins build <job> [PARAM=value...]
+//    !jenkins status <job>
+//    !jenkins abort <job> <build number>
+//    !jenkins log <job> <build number>
+// Commands for jobs which aren't configured for the room are rejected.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"jenkins", "build"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdBuild(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"jenkins", "status"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdStatus(roomID, args)
+			},
+		},
+		{
+			Path: []string{"jenkins", "abort"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdAbort(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"jenkins", "log"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdLog(roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) checkJob(roomID, job string) error {
+	if !s.roomHasJob(roomID, job) {
+		return fmt.Errorf("Job %s is not configured for this room", job)
+	}
+	return nil
+}
+
+// parseBuildArgs returns the job and build number from "<job> <n>" arguments.
+func parseBuildArgs(args []string, usage string) (string, int, error) {
+	if len(args) != 2 {
+		return "", 0, errors.New(usage)
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		return "", 0, errors.New(usage)
+	}
+	return args[0], n, nil
+}
+
+func (s *Service) cmdBuild(roomID, userID string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Usage: !jenkins build <job> [PARAM=value...]")
+	}
+	job := args[0]
+	if err := s.checkJob(roomID, job); err != nil {
+		return nil, err
+	}
+	if !s.isAllowed(userID) {
+		return nil, errors.New("You are not allowed to start builds")
+	}
+	params := url.Values{}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Parameters must be PARAM=value, got %s", arg)
+		}
+		params.Add(kv[0], kv[1])
+	}
+	path := jobPath(job) + "/build"
+	if len(params) > 0 {
+		path = jobPath(job) + "/buildWithParameters"
+	}
+	header, err := s.post(path, params)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start build of %s: %s", job, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"job":        job,
+	}).Info("Started Jenkins build")
+	msg := "Queued a build of " + job
+	if queueURL := header.Get("Location"); queueURL != "" {
+		msg += " (" + queueURL + ")"
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: msg}, nil
+}
+
+// build is the part of the Jenkins build API which is shown.
+type build struct {
+	Number    int    `json:"number"`
+	Result    string `json:"result"`
+	Building  bool   `json:"building"`
+	URL       string `json:"url"`
+	Duration  int64  `json:"duration"`  // ms
+	Timestamp int64  `json:"timestamp"` // ms
+}
+
+func (s *Service) cmdStatus(roomID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !jenkins status <job>")
+	}
+	job := args[0]
+	if err := s.checkJob(roomID, job); err != nil {
+		return nil, err
+	}
+	var b build
+	if err := s.get(jobPath(job)+"/lastBuild/api/json?tree=number,result,building,url,duration,timestamp", &b); err != nil {
+		return nil, fmt.Errorf("Failed to get status of %s: %s", job, err)
+	}
+	var status string
+	if b.Building {
+		elapsed := time.Since(time.Unix(0, b.Timestamp*int64(time.Millisecond))).Round(time.Second)
+		status = fmt.Sprintf("building for %s", elapsed)
+	} else {
+		status = fmt.Sprintf("%s in %s", b.Result, (time.Duration(b.Duration) * time.Millisecond).Round(time.Second))
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("%s #%d: %s %s", job, b.Number, status, b.URL),
+	}, nil
+}
+
+func (s *Service) cmdAbort(roomID, userID string, args []string) (interface{}, error) {
+	job, n, err := parseBuildArgs(args, "Usage: !jenkins abort <job> <build number>")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkJob(roomID, job); err != nil {
+		return nil, err
+	}
+	if !s.isAllowed(userID) {
+		return nil, errors.New("You are not allowed to abort builds")
+	}
+	if _, err := s.post(fmt.Sprintf("%s/%d/stop", jobPath(job), n), nil); err != nil {
+		return nil, fmt.Errorf("Failed to abort %s #%d: %s", job, n, err)
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"job":        job,
+		"build":      n,
+	}).Info("Aborted Jenkins build")
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: fmt.Sprintf("Aborting %s #%d", job, n)}, nil
+}
+
+func (s *Service) cmdLog(roomID string, args []string) (interface{}, error) {
+	job, n, err := parseBuildArgs(args, "Usage: !jenkins log <job> <build number>")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkJob(roomID, job); err != nil {
+		return nil, err
+	}
+	maxLines := s.LogLines
+	if maxLines == 0 {
+		maxLines = defaultLogLines
+	}
+	lines, err := s.getTail(fmt.Sprintf("%s/%d/consoleText", jobPath(job), n), maxLines)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the log of %s #%d: %s", job, n, err)
+	}
+	tail := strings.Join(lines, "\n")
+	return &gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		Body:          fmt.Sprintf("Last %d lines of %s #%d:\n```\n%s\n```", len(lines), job, n, tail),
+		FormattedBody: fmt.Sprintf("Last %d lines of %s #%d:<pre><code>%s</code></pre>", len(lines), html.EscapeString(job), n, html.EscapeString(tail)),
+	}, nil
+}
+
+// The payload from the Jenkins Notification plugin.
+type notification struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Build struct {
+		FullURL string `json:"full_url"`
+		Number  int    `json:"number"`
+		Phase   string `json:"phase"`
+		Status  string `json:"status"`
+		SCM     struct {
+			Branch string `json:"branch"`
+			Commit string `json:"commit"`
+		} `json:"scm"`
+	} `json:"build"`
+}
+
+// job returns the full name of the job, including any folders e.g. "team/deploy". The name in the
+// notification doesn't include folders, so it is taken from the job's URL e.g. "job/team/job/deploy/".
+func (n *notification) job() string {
+	segs := strings.Split(strings.Trim(n.URL, "/"), "/")
+	if len(segs)%2 != 0 {
+		return n.Name
+	}
+	var names []string
+	for i := 0; i < len(segs); i += 2 {
+		name, err := url.PathUnescape(segs[i+1])
+		if segs[i] != "job" || err != nil {
+			return n.Name
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "/")
+}
+
+func (n *notification) message() gomatrix.HTMLMessage {
+	var details []string
+	if n.Build.SCM.Branch != "" {
+		details = append(details, n.Build.SCM.Branch)
+	}
+	if commit := n.Build.SCM.Commit; commit != "" {
+		if len(commit) > 10 {
+			commit = commit[:10]
+		}
+		details = append(details, commit)
+	}
+	suffix := ""
+	if len(details) > 0 {
+		suffix = " (" + strings.Join(details, " ") + ")"
+	}
+	job := n.job()
+	return gomatrix.HTMLMessage{
+		MsgType: "m.notice",
+		Format:  "org.matrix.custom.html",
+		Body:    fmt.Sprintf("%s #%d %s%s %s", job, n.Build.Number, n.Build.Status, suffix, n.Build.FullURL),
+		FormattedBody: fmt.Sprintf(
+			`<b>%s</b> <a href="%s">#%d</a> %s%s`,
+			html.EscapeString(job), html.EscapeString(n.Build.FullURL), n.Build.Number,
+			html.EscapeString(n.Build.Status), html.EscapeString(suffix),
+		),
+	}
+}
+
+// OnReceiveWebhook receives build notifications from the Jenkins Notification plugin and sends
+// them to the rooms which have the job.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	var n notification
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil || n.Name == "" {
+		log.WithError(err).Error("Jenkins webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	job := n.job()
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"job":        job,
+		"build":      n.Build.Number,
+		"phase":      n.Build.Phase,
+	})
+	// Each build sends QUEUED, STARTED, COMPLETED and FINALIZED notifications
+	if n.Build.Phase != "FINALIZED" {
+		w.WriteHeader(200)
+		return
+	}
+	msg := n.message()
+	for roomID := range s.Rooms {
+		if !s.roomHasJob(roomID, job) {
+			continue
+		}
+		if err := notify.Send(cli, roomID, msg, false); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send Jenkins notification to room")
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
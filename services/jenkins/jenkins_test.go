@@ -0,0 +1,211 @@
+package jenkins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// jenkins stands in for a Jenkins server with CSRF protection, recording the requests it receives.
+type jenkins struct {
+	requests []string
+	forms    []string
+}
+
+func (j *jenkins) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, token, ok := r.BasicAuth(); !ok || user != "navi" || token != "api_token" {
+		w.WriteHeader(401)
+		return
+	}
+	if r.URL.Path == "/crumbIssuer/api/json" {
+		w.Write([]byte(`{"crumb":"c0ffee","crumbRequestField":"Jenkins-Crumb"}`))
+		return
+	}
+	if r.Method == "POST" && r.Header.Get("Jenkins-Crumb") != "c0ffee" {
+		w.WriteHeader(403)
+		return
+	}
+	r.ParseForm()
+	j.requests = append(j.requests, r.Method+" "+r.URL.EscapedPath())
+	j.forms = append(j.forms, r.PostForm.Encode())
+	switch r.URL.EscapedPath() {
+	case "/job/go-neb/build", "/job/deploy/job/production/buildWithParameters":
+		w.Header().Set("Location", "http://jenkins/queue/item/42/")
+		w.WriteHeader(201)
+	case "/job/go-neb/lastBuild/api/json":
+		w.Write([]byte(`{"number":18,"result":"FAILURE","building":false,"duration":95000,
+			"url":"http://jenkins/job/go-neb/18/"}`))
+	case "/job/go-neb/17/stop":
+		w.WriteHeader(200)
+	case "/job/go-neb/17/consoleText":
+		for i := 1; i <= 50; i++ {
+			fmt.Fprintf(w, "line %d <b>\n", i)
+		}
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func newService(t *testing.T, url string) (*Service, []types.Command) {
+	cli := testutils.NewMatrixClient(nil, "")
+	s := testutils.NewService(t, ServiceType, `{
+		"url": "`+url+`/",
+		"username": "navi",
+		"api_token": "api_token",
+		"allowed_users": ["@zelda:hyrule"],
+		"log_lines": 5,
+		"rooms": {
+			"!castle:hyrule": {"jobs": ["go-neb", "deploy/production"]},
+			"!village:hyrule": {"jobs": ["*"]}
+		}
+	}`, cli).(*Service)
+	return s, s.Commands(cli)
+}
+
+func TestCommands(t *testing.T) {
+	j := &jenkins{}
+	srv := httptest.NewServer(j)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+
+	res, err := testutils.RunCommand(cmds, "!castle:hyrule", "@zelda:hyrule", "jenkins build go-neb")
+	if err != nil {
+		t.Fatalf("build returned error: %s", err)
+	}
+	if body := res.(*gomatrix.TextMessage).Body; body != "Queued a build of go-neb (http://jenkins/queue/item/42/)" {
+		t.Errorf("Unexpected build response: %s", body)
+	}
+	_, err = testutils.RunCommand(cmds, "!castle:hyrule", "@zelda:hyrule", "jenkins build deploy/production VERSION=1.2 ENV=prod")
+	if err != nil {
+		t.Fatalf("build with parameters returned error: %s", err)
+	}
+	if len(j.requests) != 2 || j.requests[1] != "POST /job/deploy/job/production/buildWithParameters" ||
+		j.forms[1] != "ENV=prod&VERSION=1.2" {
+		t.Errorf("Unexpected requests: %v %v", j.requests, j.forms)
+	}
+
+	res, err = testutils.RunCommand(cmds, "!castle:hyrule", "@link:hyrule", "jenkins status go-neb")
+	if err != nil {
+		t.Fatalf("status returned error: %s", err)
+	}
+	if body := res.(*gomatrix.TextMessage).Body; body != "go-neb #18: FAILURE in 1m35s http://jenkins/job/go-neb/18/" {
+		t.Errorf("Unexpected status response: %s", body)
+	}
+
+	if _, err = testutils.RunCommand(cmds, "!castle:hyrule", "@zelda:hyrule", "jenkins abort go-neb 17"); err != nil {
+		t.Fatalf("abort returned error: %s", err)
+	}
+	if j.requests[len(j.requests)-1] != "POST /job/go-neb/17/stop" {
+		t.Errorf("Unexpected abort request: %v", j.requests)
+	}
+
+	res, err = testutils.RunCommand(cmds, "!castle:hyrule", "@link:hyrule", "jenkins log go-neb 17")
+	if err != nil {
+		t.Fatalf("log returned error: %s", err)
+	}
+	msg := res.(*gomatrix.HTMLMessage)
+	if !strings.HasSuffix(msg.Body, "```\nline 46 <b>\nline 47 <b>\nline 48 <b>\nline 49 <b>\nline 50 <b>\n```") {
+		t.Errorf("Expected the log tail as a code block, got:\n%s", msg.Body)
+	}
+	if !strings.Contains(msg.FormattedBody, "<pre><code>line 46 &lt;b&gt;\n") {
+		t.Errorf("Expected the escaped log tail in a code block, got:\n%s", msg.FormattedBody)
+	}
+
+	if _, err = testutils.RunCommand(cmds, "!castle:hyrule", "@zelda:hyrule", "jenkins status missing"); err == nil {
+		t.Errorf("Expected a job which isn't configured for the room to be rejected")
+	}
+	if _, err = testutils.RunCommand(cmds, "!village:hyrule", "@zelda:hyrule", "jenkins status missing"); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected Jenkins' 404 to be returned, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	j := &jenkins{}
+	srv := httptest.NewServer(j)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+
+	for _, text := range []string{"jenkins build go-neb", "jenkins abort go-neb 17"} {
+		if _, err := testutils.RunCommand(cmds, "!castle:hyrule", "@ganon:hyrule", text); err == nil {
+			t.Errorf("%s: expected a user who isn't allowed to be rejected", text)
+		}
+	}
+	if _, err := testutils.RunCommand(cmds, "!castle:hyrule", "@zelda:hyrule", "jenkins abort go-neb last"); err == nil {
+		t.Errorf("Expected an invalid build number to be rejected")
+	}
+	if len(j.requests) != 0 {
+		t.Errorf("Expected no Jenkins requests, got %v", j.requests)
+	}
+}
+
+func TestNotification(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []string
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			var msg gomatrix.HTMLMessage
+			json.NewDecoder(req.Body).Decode(&msg)
+			sent = append(sent, strings.Split(req.URL.Path, "/")[5]+" "+msg.Body)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	s, _ := newService(t, "http://jenkins")
+
+	for _, phase := range []string{"STARTED", "COMPLETED", "FINALIZED"} {
+		body := `{"name":"go-neb","url":"job/go-neb/","build":{"full_url":"http://jenkins/job/go-neb/19/",
+			"number":19,"phase":"` + phase + `","status":"SUCCESS",
+			"scm":{"branch":"origin/master","commit":"3a092c3a6032ebb50384c99b445f947e9ce86e2a"}}}`
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, cli)
+		if w.Code != 200 {
+			t.Fatalf("%s: webhook returned %d", phase, w.Code)
+		}
+	}
+	want := "go-neb #19 SUCCESS (origin/master 3a092c3a60) http://jenkins/job/go-neb/19/"
+	if len(sent) != 2 {
+		t.Fatalf("Expected a notification to both rooms for the finalized build, got %v", sent)
+	}
+	for _, s := range sent {
+		if !strings.HasSuffix(s, " "+want) {
+			t.Errorf("Unexpected notification: %s", s)
+		}
+	}
+
+	// Jobs in folders are named by their URL, as the name doesn't include the folders
+	sent = nil
+	for _, job := range []string{"production", "staging"} {
+		body := `{"name":"` + job + `","url":"job/deploy/job/` + job + `/","build":{
+			"full_url":"http://jenkins/job/deploy/job/` + job + `/7/","number":7,"phase":"FINALIZED","status":"SUCCESS"}}`
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(body))
+		s.OnReceiveWebhook(httptest.NewRecorder(), req, cli)
+	}
+	want = "deploy/production #7 SUCCESS http://jenkins/job/deploy/job/production/7/"
+	if len(sent) != 3 || !strings.HasSuffix(sent[0], " "+want) || !strings.HasSuffix(sent[1], " "+want) ||
+		!strings.HasPrefix(sent[2], "!village:hyrule deploy/staging #7") {
+		t.Errorf("Expected deploy/production to be sent to both rooms and deploy/staging to one, got %v", sent)
+	}
+
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader("not json"))
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	if w.Code != 400 {
+		t.Errorf("Expected an invalid payload to return 400, got %d", w.Code)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	gojira "github.com/andygrunwald/go-jira"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/realms/jira"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
 	"github.com/matrix-org/go-neb/services/jira/webhook"
@@ -115,13 +116,26 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 		title = joinedTitle
 	}
 
+	issueURL, resp, err := s.createIssue(userID, pkey, title, desc)
+	if issueURL == "" {
+		return resp, err
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("Created issue: %s", issueURL),
+	}, nil
+}
+
+// createIssue creates an issue as the user and returns its URL. If it can't, it returns either a
+// response to send instead, such as a Starter Link, or an error.
+func (s *Service) createIssue(userID, pkey, title, desc string) (issueURL string, resp interface{}, err error) {
 	r, err := s.projectToRealm(userID, pkey)
 	if err != nil {
 		log.WithError(err).Print("Failed to map project key to realm")
-		return nil, errors.New("Failed to map project key to a JIRA endpoint")
+		return "", nil, errors.New("Failed to map project key to a JIRA endpoint")
 	}
 	if r == nil {
-		return nil, errors.New("No known project exists with that project key")
+		return "", nil, errors.New("No known project exists with that project key")
 	}
 
 	iss := gojira.Issue{
@@ -140,7 +154,7 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 	cli, err := r.JIRAClient(userID, false)
 	if err != nil {
 		if err == sql.ErrNoRows { // no client found
-			return matrix.StarterLinkMessage{
+			return "", matrix.StarterLinkMessage{
 				Body: fmt.Sprintf(
 					"You need to OAuth with JIRA on %s before you can create issues.",
 					r.JIRAEndpoint,
@@ -148,7 +162,7 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 				Link: r.StarterLink,
 			}, nil
 		}
-		return nil, err
+		return "", nil, err
 	}
 	i, res, err := cli.Issue.Create(&iss)
 	if err != nil {
@@ -158,16 +172,49 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 			"project":    pkey,
 			"realm_id":   r.ID(),
 		}).Print("Failed to create issue")
-		return nil, errors.New("Failed to create issue")
+		return "", nil, errors.New("Failed to create issue")
 	}
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, fmt.Errorf("Failed to create issue: JIRA returned %d", res.StatusCode)
+		return "", nil, fmt.Errorf("Failed to create issue: JIRA returned %d", res.StatusCode)
 	}
 
-	return &gomatrix.TextMessage{
-		"m.notice",
-		fmt.Sprintf("Created issue: %sbrowse/%s", r.JIRAEndpoint, i.Key),
-	}, nil
+	return fmt.Sprintf("%sbrowse/%s", r.JIRAEndpoint, i.Key), nil, nil
+}
+
+// cmdJiraCreateFromReply creates an issue from the message which the command replies to, or its
+// whole thread with --thread, and responds in a thread on that message.
+func (s *Service) cmdJiraCreateFromReply(mxCli *gomatrix.Client, event *gomatrix.Event, args []string) (interface{}, error) {
+	// E.g jira create PROJ "Issue title" --thread
+	args, thread := matrix.ThreadArg(args)
+	if len(args) <= 1 {
+		return nil, errors.New("Missing project key (e.g 'ABC') and/or title")
+	}
+	if !projectKeyRegex.MatchString(args[0]) {
+		return nil, errors.New("Project key must only contain A-Z")
+	}
+	pkey := strings.ToUpper(args[0])
+	title := strings.Join(args[1:], " ")
+
+	replied, messages, err := matrix.RepliedMessages(mxCli, event, thread)
+	if err != nil {
+		log.WithError(err).WithField("room_id", event.RoomID).Print("Failed to fetch replied to message")
+		return nil, errors.New("Failed to fetch the message to create an issue from")
+	}
+	if replied == nil {
+		return nil, errors.New("The command must be sent as a reply to a message")
+	}
+	// JIRA descriptions use its wiki markup rather than markdown
+	var desc strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&desc, "%s [wrote|%s]:\n{quote}%s{quote}\n\n", m.Sender, matrix.Permalink(event.RoomID, m.ID), matrix.MessageBody(m))
+	}
+	fmt.Fprintf(&desc, "Reported from Matrix by %s.", event.Sender)
+
+	issueURL, resp, err := s.createIssue(event.Sender, pkey, title, desc.String())
+	if issueURL == "" {
+		return resp, err
+	}
+	return matrix.ThreadedReply(event, replied, "m.notice", fmt.Sprintf("Created issue: %s", issueURL)), nil
 }
 
 func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) interface{} {
@@ -239,12 +286,19 @@ func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) in
 // same project key, which project is chosen is undefined. If there
 // is no JIRA account linked to the Matrix user ID, it will return a Starter Link
 // if there is a known public project with that project key.
+//    !jira create KEY "issue title" [--thread]
+// When sent as a reply, the issue description quotes the replied to message, or its whole
+// thread with --thread, linking to each message. The outcome is sent in a thread on the
+// replied to message.
 func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 	return []types.Command{
 		types.Command{
 			Path: []string{"jira", "create"},
-			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdJiraCreate(roomID, userID, args)
+			EventCommand: func(event *gomatrix.Event, args []string) (interface{}, error) {
+				if matrix.InReplyTo(event) != "" {
+					return s.cmdJiraCreateFromReply(cli, event, args)
+				}
+				return s.cmdJiraCreate(event.RoomID, event.Sender, args)
 			},
 		},
 	}
@@ -296,8 +350,8 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				if pkey != eventProjectKey || !projectConfig.Track {
 					continue
 				}
-				_, msgErr := cli.SendMessageEvent(
-					roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", htmlText),
+				msgErr := notify.Send(
+					cli, roomID, gomatrix.GetHTMLMessage("m.notice", htmlText), false,
 				)
 				if msgErr != nil {
 					log.WithFields(log.Fields{
@@ -0,0 +1,151 @@
+package jira
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// authStore has a jira realm which @link:hyrule has logged into.
+type authStore struct {
+	database.NopStorage
+	realm types.AuthRealm
+}
+
+func (s *authStore) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *authStore) LoadAuthRealmsByType(realmType string) ([]types.AuthRealm, error) {
+	return []types.AuthRealm{s.realm}, nil
+}
+
+func (s *authStore) LoadAuthSessionByUser(realmID, userID string) (types.AuthSession, error) {
+	if userID != "@link:hyrule" {
+		return nil, sql.ErrNoRows
+	}
+	session := s.realm.AuthSession("session", userID, realmID).(*jira.Session)
+	session.AccessToken = "jira_token"
+	session.AccessSecret = "jira_secret"
+	return session, nil
+}
+
+func TestCreateFromReply(t *testing.T) {
+	// Stub the JIRA API
+	var issues []map[string]interface{}
+	jiraServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /rest/api/2/project":
+			w.Write([]byte(`[{"key":"CASTLE"}]`))
+		case "POST /rest/api/2/issue":
+			var issue struct {
+				Fields map[string]interface{} `json:"fields"`
+			}
+			json.NewDecoder(r.Body).Decode(&issue)
+			issues = append(issues, issue.Fields)
+			w.WriteHeader(201)
+			w.Write([]byte(`{"id":"1","key":"CASTLE-1"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer jiraServer.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	realmJSON, _ := json.Marshal(map[string]string{
+		"JIRAEndpoint":   jiraServer.URL,
+		"ConsumerName":   "navi",
+		"ConsumerKey":    "navi",
+		"ConsumerSecret": "hey_listen",
+		"PrivateKeyPEM":  string(keyPEM),
+	})
+	realm, err := types.CreateAuthRealm("jirarealm", "jira", realmJSON)
+	if err != nil {
+		t.Fatal("Failed to create jira realm: ", err)
+	}
+	if err := realm.Init(); err != nil {
+		t.Fatal("Failed to init jira realm: ", err)
+	}
+	database.SetServiceDB(&authStore{realm: realm})
+
+	// Stub the homeserver, which has the message being replied to
+	var fetched []string
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.Path)
+		if req.URL.Path != "/_matrix/client/r0/rooms/!room:hyrule/event/$broken" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$broken","sender":"@zelda:hyrule",
+				"type":"m.room.message","content":{"msgtype":"m.text","body":"> <@ganon:hyrule> hah\n\nthe door is stuck"}}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{"ClientUserID":"@link:hyrule"}`))
+	if err != nil {
+		t.Fatal("Failed to create jira service: ", err)
+	}
+	cmd := srv.Commands(cli)[0]
+	command := func(relatesTo map[string]interface{}) *gomatrix.Event {
+		content := map[string]interface{}{"msgtype": "m.text", "body": "!jira create CASTLE Door stuck"}
+		if relatesTo != nil {
+			content["m.relates_to"] = relatesTo
+		}
+		return &gomatrix.Event{ID: "$command", RoomID: "!room:hyrule", Sender: "@link:hyrule", Content: content}
+	}
+
+	reply := command(map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$broken"}})
+	res, err := cmd.EventCommand(reply, []string{"CASTLE", "Door", "stuck"})
+	if err != nil {
+		t.Fatal("Failed to create issue from reply: ", err)
+	}
+	if len(fetched) != 1 {
+		t.Errorf("Expected the replied to message to be fetched, got %v", fetched)
+	}
+	wantDesc := "@zelda:hyrule [wrote|https://matrix.to/#/%21room:hyrule/$broken]:\n" +
+		"{quote}the door is stuck{quote}\n\nReported from Matrix by @link:hyrule."
+	if len(issues) != 1 || issues[0]["summary"] != "Door stuck" || issues[0]["description"] != wantDesc {
+		t.Fatalf("Expected an issue quoting the replied to message, got %v", issues)
+	}
+	content := res.(map[string]interface{})
+	relatesTo := content["m.relates_to"].(map[string]interface{})
+	if content["body"] != "Created issue: "+jiraServer.URL+"/browse/CASTLE-1" ||
+		relatesTo["rel_type"] != "m.thread" || relatesTo["event_id"] != "$broken" {
+		t.Errorf("Expected the issue link in a thread on the replied to message, got %v", content)
+	}
+
+	// Without m.relates_to the command isn't a reply, so nothing is fetched or quoted
+	fetched, issues = nil, nil
+	if _, err := cmd.EventCommand(command(nil), []string{"CASTLE", "Door stuck"}); err != nil {
+		t.Fatal("Failed to create issue: ", err)
+	}
+	if len(fetched) != 0 || len(issues) != 1 || issues[0]["description"] != nil {
+		t.Errorf("Expected an issue without a quote, got %v (fetched %v)", issues, fetched)
+	}
+	issues = nil
+	if _, err := srv.(*Service).cmdJiraCreateFromReply(cli, command(nil), []string{"CASTLE", "Door stuck"}); err == nil ||
+		!strings.Contains(err.Error(), "reply") || len(issues) != 0 {
+		t.Errorf("Expected an error for a command which isn't a reply, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// esResponse is the response from the Elasticsearch/OpenSearch _search API.
+type esResponse struct {
+	Hits struct {
+		Hits []struct {
+			Source map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// queryElasticsearch returns the newest documents matching the query_string query between start
+// and end, whose fields match the given labels.
+func queryElasticsearch(ds *Datasource, query string, labels map[string]string, start, end time.Time, limit int) ([]logLine, error) {
+	tsField := ds.TimestampField
+	if tsField == "" {
+		tsField = "@timestamp"
+	}
+	msgField := ds.MessageField
+	if msgField == "" {
+		msgField = "message"
+	}
+
+	filters := []interface{}{
+		map[string]interface{}{
+			"range": map[string]interface{}{
+				tsField: map[string]interface{}{
+					"gte":    start.UTC().Format(time.RFC3339Nano),
+					"lte":    end.UTC().Format(time.RFC3339Nano),
+					"format": "strict_date_optional_time",
+				},
+			},
+		},
+	}
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		filters = append(filters, map[string]interface{}{
+			"match_phrase": map[string]interface{}{k: labels[k]},
+		})
+	}
+	search := map[string]interface{}{
+		"size": limit,
+		"sort": []interface{}{
+			map[string]interface{}{tsField: map[string]interface{}{"order": "desc"}},
+		},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"query_string": map[string]interface{}{"query": query},
+				},
+				"filter": filters,
+			},
+		},
+	}
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(ds.URL, "/") + "/" + url.PathEscape(ds.Index) + "/_search"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ds.setAuth(req)
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		errBody, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("%d: %s", res.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+	var resp esResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	var lines []logLine
+	for _, hit := range resp.Hits.Hits {
+		var l logLine
+		if ts, ok := hit.Source[tsField].(string); ok {
+			l.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+		}
+		switch msg := hit.Source[msgField].(type) {
+		case string:
+			l.Line = msg
+		case nil:
+			// show the whole document rather than nothing at all
+			doc, _ := json.Marshal(hit.Source)
+			l.Line = string(doc)
+		default:
+			l.Line = fmt.Sprintf("%v", msg)
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
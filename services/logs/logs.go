@@ -0,0 +1,358 @@
+// Package logs implements a Service which queries Loki or Elasticsearch for recent log lines.
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	text "text/template"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Logs service
+const ServiceType = "logs"
+
+// Datasource types
+const (
+	TypeLoki          = "loki"
+	TypeElasticsearch = "elasticsearch"
+)
+
+const (
+	defaultSince    = 15 * time.Minute
+	defaultMaxLines = 20
+	// The maximum number of characters of log output to put into the room.
+	maxOutputLength = 4000
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Datasource is a single Loki or Elasticsearch/OpenSearch server.
+type Datasource struct {
+	// Either "loki" or "elasticsearch". OpenSearch uses "elasticsearch".
+	Type string `json:"type"`
+	// The base URL of the server e.g. "http://loki:3100" or "https://es.example.com:9200".
+	URL string `json:"url"`
+	// Optional. Basic auth credentials.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Optional. A bearer token to send with requests. For Loki, this can be used for Grafana Cloud.
+	Token string `json:"token"`
+	// Optional. For Loki, the tenant to send as X-Scope-OrgID.
+	OrgID string `json:"org_id"`
+	// Elasticsearch only. The index or index pattern to search e.g. "logs-*".
+	Index string `json:"index"`
+	// Elasticsearch only. The document field holding the timestamp. Defaults to "@timestamp".
+	TimestampField string `json:"timestamp_field"`
+	// Elasticsearch only. The document field holding the log line. Defaults to "message".
+	MessageField string `json:"message_field"`
+	// Optional. A text/template for a link to the full results, e.g. in Grafana Explore or Kibana.
+	// The data is a LinkData.
+	LinkTemplate string `json:"link_template"`
+}
+
+// LinkData is the data given to a datasource's link template.
+type LinkData struct {
+	// The query which was run, including any room labels.
+	Query string
+	// The start and end of the query, in milliseconds since the epoch.
+	StartMs int64
+	EndMs   int64
+}
+
+// A logLine is a single result from a datasource.
+type logLine struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// Service contains the Config fields for the Logs service.
+//
+// This service lets rooms pull recent log lines into the room with:
+//    !logs <query> [since]
+// where "since" is a duration such as "30m", "2h" or "1d" which defaults to 15 minutes. The query is
+// LogQL for Loki, and Lucene query_string syntax for Elasticsearch/OpenSearch. For Loki, a query which
+// isn't a LogQL stream selector is treated as a line filter over the room's labels. To use one of the
+// room's other allowed datasources, start the query with "source:<name>".
+//
+// The newest lines are shown first, as a code block which is truncated if it is too long, with a link
+// to the full results if the datasource has a link template.
+//
+// Example JSON request:
+//   {
+//       "datasources": {
+//           "loki": {
+//               "type": "loki",
+//               "url": "http://loki:3100",
+//               "link_template": "https://grafana.example.com/explore?left={{urlquery .Query}}"
+//           },
+//           "es": {
+//               "type": "elasticsearch",
+//               "url": "http://elasticsearch:9200",
+//               "index": "logs-*"
+//           }
+//       },
+//       "rooms": {
+//           "!ewfug483gsfe:localhost": {
+//               "datasource": "loki",
+//               "allowed_datasources": ["es"],
+//               "labels": { "env": "prod", "app": "api" },
+//               "max_lines": 30
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map of datasource name to datasource.
+	Datasources map[string]Datasource `json:"datasources"`
+	// A map of room ID to room defaults. Rooms which aren't listed can't use !logs.
+	Rooms map[string]struct {
+		// The name of the datasource to query by default.
+		Datasource string `json:"datasource"`
+		// Optional. The other datasources which can be queried from this room with "source:<name>".
+		AllowedDatasources []string `json:"allowed_datasources"`
+		// Optional. Labels (Loki) or field values (Elasticsearch) which every query in this
+		// room is restricted to.
+		Labels map[string]string `json:"labels"`
+		// Optional. The maximum number of lines to show. Defaults to 20.
+		MaxLines int `json:"max_lines"`
+	} `json:"rooms"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Datasources) == 0 {
+		return errors.New("At least one datasource must be specified")
+	}
+	for name, ds := range s.Datasources {
+		if ds.URL == "" {
+			return fmt.Errorf("datasources[%s]: url is required", name)
+		}
+		switch ds.Type {
+		case TypeLoki:
+		case TypeElasticsearch:
+			if ds.Index == "" {
+				return fmt.Errorf("datasources[%s]: index is required for elasticsearch", name)
+			}
+		default:
+			return fmt.Errorf("datasources[%s]: unknown type '%s'", name, ds.Type)
+		}
+		if ds.LinkTemplate != "" {
+			if _, err := text.New("link").Parse(ds.LinkTemplate); err != nil {
+				return fmt.Errorf("datasources[%s]: link template is invalid: %s", name, err)
+			}
+		}
+	}
+	for roomID, room := range s.Rooms {
+		if _, ok := s.Datasources[room.Datasource]; !ok {
+			return fmt.Errorf("rooms[%s]: unknown datasource '%s'", roomID, room.Datasource)
+		}
+		for _, name := range room.AllowedDatasources {
+			if _, ok := s.Datasources[name]; !ok {
+				return fmt.Errorf("rooms[%s]: unknown datasource '%s'", roomID, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Commands supported:
+//    !logs <query> [since]
+// Responds with the most recent matching log lines.
+func (s *Service) Commands(client *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"logs"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdLogs(roomID, userID, args, time.Now())
+			},
+		},
+	}
+}
+
+const cmdLogsUsage = "!logs [source:<name>] <query> [since]"
+
+func (s *Service) cmdLogs(roomID, userID string, args []string, now time.Time) (interface{}, error) {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return nil, errors.New("This room is not configured to query logs")
+	}
+	dsName := room.Datasource
+	if len(args) > 0 && strings.HasPrefix(args[0], "source:") {
+		dsName = strings.TrimPrefix(args[0], "source:")
+		args = args[1:]
+		if !roomAllowsDatasource(room.Datasource, room.AllowedDatasources, dsName) {
+			return nil, fmt.Errorf("This room can't query datasource '%s'", dsName)
+		}
+	}
+	ds, ok := s.Datasources[dsName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown datasource '%s'", dsName)
+	}
+	since := defaultSince
+	if len(args) > 1 {
+		if d, err := parseSince(args[len(args)-1]); err == nil {
+			since = d
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Usage: " + cmdLogsUsage}, nil
+	}
+	query := strings.Join(args, " ")
+	maxLines := room.MaxLines
+	if maxLines <= 0 {
+		maxLines = defaultMaxLines
+	}
+
+	start := now.Add(-since)
+	var lines []logLine
+	var err error
+	switch ds.Type {
+	case TypeLoki:
+		query = lokiQuery(query, room.Labels)
+		lines, err = queryLoki(&ds, query, start, now, maxLines+1)
+	case TypeElasticsearch:
+		lines, err = queryElasticsearch(&ds, query, room.Labels, start, now, maxLines+1)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"datasource": dsName,
+			"query":      query,
+			"room_id":    roomID,
+			"user_id":    userID,
+		}).Error("Failed to query logs")
+		return nil, fmt.Errorf("Failed to query %s: %s", dsName, err)
+	}
+
+	link := ""
+	if ds.LinkTemplate != "" {
+		var b bytes.Buffer
+		t, err := text.New("link").Parse(ds.LinkTemplate)
+		if err == nil {
+			err = t.Execute(&b, LinkData{query, start.UnixNano() / 1000000, now.UnixNano() / 1000000})
+		}
+		if err != nil {
+			log.WithError(err).WithField("datasource", dsName).Error("Failed to render link template")
+		} else {
+			link = b.String()
+		}
+	}
+	return renderLines(query, since, lines, maxLines, link), nil
+}
+
+// roomAllowsDatasource returns true if the datasource is the room's default or one of its allowed
+// datasources.
+func roomAllowsDatasource(defaultName string, allowed []string, name string) bool {
+	if name == defaultName {
+		return true
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSince parses a duration such as "90s", "30m", "2h" or "7d".
+func parseSince(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return d, nil
+}
+
+// renderLines renders log lines as a code block, truncated to maxLines and maxOutputLength.
+func renderLines(query string, since time.Duration, lines []logLine, maxLines int, link string) *gomatrix.HTMLMessage {
+	if len(lines) == 0 {
+		body := fmt.Sprintf("No logs matching %s in the last %s", query, since)
+		if link != "" {
+			body += "\n" + link
+		}
+		return &gomatrix.HTMLMessage{
+			Body:          body,
+			MsgType:       "m.notice",
+			Format:        "org.matrix.custom.html",
+			FormattedBody: linkify(html.EscapeString(body), link),
+		}
+	}
+	truncated := false
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		truncated = true
+	}
+	var out bytes.Buffer
+	for _, l := range lines {
+		line := fmt.Sprintf("%s %s\n", l.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"), strings.TrimRight(l.Line, "\n"))
+		if out.Len()+len(line) > maxOutputLength {
+			truncated = true
+			break
+		}
+		out.WriteString(line)
+	}
+	heading := fmt.Sprintf("Logs matching %s in the last %s", query, since)
+	footer := ""
+	if truncated {
+		footer = "Output truncated."
+		if link != "" {
+			footer += " Full results: " + link
+		}
+	} else if link != "" {
+		footer = "Full results: " + link
+	}
+	plain := heading + "\n" + out.String() + footer
+	formatted := fmt.Sprintf(
+		"%s<pre><code>%s</code></pre>%s",
+		html.EscapeString(heading), html.EscapeString(out.String()), linkify(html.EscapeString(footer), link),
+	)
+	return &gomatrix.HTMLMessage{
+		Body:          strings.TrimSpace(plain),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+}
+
+// linkify replaces the escaped link in s with an anchor.
+func linkify(s, link string) string {
+	if link == "" {
+		return s
+	}
+	escaped := html.EscapeString(link)
+	return strings.Replace(s, escaped, fmt.Sprintf(`<a href="%s">%s</a>`, escaped, escaped), 1)
+}
+
+// setAuth adds the datasource's credentials to the request.
+func (ds *Datasource) setAuth(req *http.Request) {
+	if ds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ds.Token)
+	} else if ds.Username != "" {
+		req.SetBasicAuth(ds.Username, ds.Password)
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+var lokiQueryTests = []struct {
+	query  string
+	labels map[string]string
+	expect string
+}{
+	{"timeout", map[string]string{"env": "prod", "app": "api"}, `{app="api", env="prod"} |= "timeout"`},
+	{`say "hi"`, nil, `{job=~".+"} |= "say \"hi\""`},
+	{`{app="web"} |= "500"`, map[string]string{"env": "prod", "app": "api"}, `{app="api", env="prod", app="web"} |= "500"`},
+	{`{app="web"}`, nil, `{app="web"}`},
+	{`{}`, map[string]string{"env": "prod"}, `{env="prod"}`},
+	// The room's labels can't be overridden
+	{`{env=~".*"}`, map[string]string{"env": "prod"}, `{env="prod", env=~".*"}`},
+	{`{env!="prod", app="api"}`, map[string]string{"env": "prod"}, `{env="prod", env!="prod", app="api"}`},
+	{`{app="x}", env=~".*"}`, map[string]string{"env": "prod"}, `{env="prod", app="x}", env=~".*"}`},
+}
+
+func TestLokiQuery(t *testing.T) {
+	for _, test := range lokiQueryTests {
+		if got := lokiQuery(test.query, test.labels); got != test.expect {
+			t.Errorf("lokiQuery(%q, %v): want %s got %s", test.query, test.labels, test.expect, got)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	for in, want := range map[string]time.Duration{"30m": 30 * time.Minute, "2h": 2 * time.Hour, "1d": 24 * time.Hour} {
+		got, err := parseSince(in)
+		if err != nil || got != want {
+			t.Errorf("parseSince(%q): want %s got %s (%v)", in, want, got, err)
+		}
+	}
+	for _, bad := range []string{"timeout", "-5m", "xd"} {
+		if _, err := parseSince(bad); err == nil {
+			t.Errorf("parseSince(%q): expected error", bad)
+		}
+	}
+}
+
+func createService(t *testing.T, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(config))
+	if err != nil {
+		t.Fatal("Failed to create logs service: ", err)
+	}
+	s := srv.(*Service)
+	if err := s.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register logs service: ", err)
+	}
+	return s
+}
+
+func TestLoki(t *testing.T) {
+	now := time.Date(2020, 5, 6, 12, 0, 0, 0, time.UTC)
+	var gotQuery, gotStart, gotOrg string
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/query_range" {
+			w.WriteHeader(404)
+			return
+		}
+		gotQuery = r.URL.Query().Get("query")
+		gotStart = r.URL.Query().Get("start")
+		gotOrg = r.Header.Get("X-Scope-OrgID")
+		ts := func(d time.Duration) string {
+			return fmt.Sprintf("%d", now.Add(-d).UnixNano())
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"streams","result":[
+			{"stream":{"app":"api","pod":"a"},"values":[["%s","request timeout <a>"],["%s","request timeout 2"]]},
+			{"stream":{"app":"api","pod":"b"},"values":[["%s","request timeout 3"]]}
+		]}}`, ts(1*time.Minute), ts(3*time.Minute), ts(2*time.Minute))
+	}))
+	defer loki.Close()
+
+	s := createService(t, `{
+		"datasources": {
+			"loki": {
+				"type": "loki",
+				"url": "`+loki.URL+`",
+				"org_id": "ops",
+				"link_template": "https://grafana/explore?q={{urlquery .Query}}&from={{.StartMs}}"
+			}
+		},
+		"rooms": {
+			"!ops:hyrule": {
+				"datasource": "loki",
+				"labels": { "app": "api" },
+				"max_lines": 2
+			}
+		}
+	}`)
+
+	res, err := s.cmdLogs("!ops:hyrule", "@link:hyrule", []string{"timeout", "1h"}, now)
+	if err != nil {
+		t.Fatalf("!logs returned error: %s", err)
+	}
+	if gotQuery != `{app="api"} |= "timeout"` {
+		t.Errorf("Unexpected LogQL: %s", gotQuery)
+	}
+	if gotStart != fmt.Sprintf("%d", now.Add(-1*time.Hour).UnixNano()) {
+		t.Errorf("Unexpected start: %s", gotStart)
+	}
+	if gotOrg != "ops" {
+		t.Errorf("Expected X-Scope-OrgID to be sent, got %q", gotOrg)
+	}
+	msg := res.(*gomatrix.HTMLMessage)
+	wantBody := `Logs matching {app="api"} |= "timeout" in the last 1h0m0s
+2020-05-06T11:59:00.000Z request timeout <a>
+2020-05-06T11:58:00.000Z request timeout 3
+Output truncated. Full results: https://grafana/explore?q=%7Bapp%3D%22api%22%7D+%7C%3D+%22timeout%22&from=1588762800000`
+	if msg.Body != wantBody {
+		t.Errorf("Unexpected body:\nwant %s\ngot  %s", wantBody, msg.Body)
+	}
+	if !strings.Contains(msg.FormattedBody, "<pre><code>2020-05-06T11:59:00.000Z request timeout &lt;a&gt;") ||
+		!strings.Contains(msg.FormattedBody, `<a href="https://grafana/explore?q=`) {
+		t.Errorf("Unexpected formatted body: %s", msg.FormattedBody)
+	}
+
+	if _, err := s.cmdLogs("!other:hyrule", "@link:hyrule", []string{"timeout"}, now); err == nil {
+		t.Errorf("Expected !logs in an unconfigured room to fail")
+	}
+}
+
+func TestElasticsearch(t *testing.T) {
+	now := time.Date(2020, 5, 6, 12, 0, 0, 0, time.UTC)
+	var search map[string]interface{}
+	var gotAuth string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/logs-*/_search" {
+			w.WriteHeader(404)
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&search)
+		w.Write([]byte(`{"hits":{"hits":[
+			{"_source":{"@timestamp":"2020-05-06T11:59:00Z","message":"disk full"}},
+			{"_source":{"@timestamp":"2020-05-06T11:58:00Z","level":"error"}}
+		]}}`))
+	}))
+	defer es.Close()
+
+	s := createService(t, `{
+		"datasources": {
+			"loki": { "type": "loki", "url": "http://unused" },
+			"es": { "type": "elasticsearch", "url": "`+es.URL+`", "index": "logs-*", "token": "sekrit" }
+		},
+		"rooms": {
+			"!ops:hyrule": { "datasource": "loki", "allowed_datasources": ["es"], "labels": { "service": "db" } },
+			"!dev:hyrule": { "datasource": "loki" }
+		}
+	}`)
+
+	if _, err := s.cmdLogs("!dev:hyrule", "@link:hyrule", []string{"source:es", "disk"}, now); err == nil {
+		t.Errorf("Expected a datasource which the room isn't allowed to use to be rejected")
+	}
+
+	res, err := s.cmdLogs("!ops:hyrule", "@link:hyrule", []string{"source:es", "level:error", "AND", "disk"}, now)
+	if err != nil {
+		t.Fatalf("!logs returned error: %s", err)
+	}
+	if gotAuth != "Bearer sekrit" {
+		t.Errorf("Expected bearer token, got %q", gotAuth)
+	}
+	searchJSON, _ := json.Marshal(search)
+	for _, want := range []string{
+		`"query_string":{"query":"level:error AND disk"}`,
+		`"match_phrase":{"service":"db"}`,
+		`"gte":"2020-05-06T11:45:00Z"`,
+		`"size":21`,
+	} {
+		if !strings.Contains(string(searchJSON), want) {
+			t.Errorf("Expected search to contain %s, got %s", want, searchJSON)
+		}
+	}
+	msg := res.(*gomatrix.HTMLMessage)
+	wantBody := `Logs matching level:error AND disk in the last 15m0s
+2020-05-06T11:59:00.000Z disk full
+2020-05-06T11:58:00.000Z {"@timestamp":"2020-05-06T11:58:00Z","level":"error"}`
+	if msg.Body != wantBody {
+		t.Errorf("Unexpected body:\nwant %s\ngot  %s", wantBody, msg.Body)
+	}
+}
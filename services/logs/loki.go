@@ -0,0 +1,119 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lokiResponse is the response from /loki/api/v1/query_range for a log query.
+type lokiResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"` // [ nanosecond timestamp, line ]
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// lokiQuery turns a query into LogQL restricted to the given labels. Queries which start with a
+// stream selector have the labels added to the selector. All the matchers in a selector must match,
+// so the query can't loosen the restriction by matching on the same labels. Other queries are used
+// as a line filter.
+func lokiQuery(query string, labels map[string]string) string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var matchers []string
+	for _, k := range keys {
+		matchers = append(matchers, fmt.Sprintf("%s=%s", k, strconv.Quote(labels[k])))
+	}
+
+	if strings.HasPrefix(query, "{") {
+		if len(matchers) == 0 {
+			return query
+		}
+		// Add the labels at the start of the selector, which doesn't depend on finding its end
+		rest := query[1:]
+		if strings.HasPrefix(strings.TrimSpace(rest), "}") {
+			return "{" + strings.Join(matchers, ", ") + strings.TrimSpace(rest)
+		}
+		return "{" + strings.Join(matchers, ", ") + ", " + rest
+	}
+
+	if len(matchers) == 0 {
+		// Loki needs at least one non-empty matcher
+		matchers = append(matchers, `job=~".+"`)
+	}
+	return fmt.Sprintf("{%s} |= %s", strings.Join(matchers, ", "), strconv.Quote(query))
+}
+
+// queryLoki returns the newest lines matching the LogQL query between start and end.
+func queryLoki(ds *Datasource, query string, start, end time.Time, limit int) ([]logLine, error) {
+	u, err := url.Parse(strings.TrimSuffix(ds.URL, "/") + "/loki/api/v1/query_range")
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("query", query)
+	q.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	q.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("direction", "backward")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ds.setAuth(req)
+	if ds.OrgID != "" {
+		req.Header.Set("X-Scope-OrgID", ds.OrgID)
+	}
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("%d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var resp lokiResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("expected a log query but got a %s result", resp.Data.ResultType)
+	}
+	var lines []logLine
+	for _, stream := range resp.Data.Result {
+		for _, v := range stream.Values {
+			ns, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp '%s'", v[0])
+			}
+			lines = append(lines, logLine{time.Unix(0, ns), v[1]})
+		}
+	}
+	// Each stream is sorted, but the streams are interleaved
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Timestamp.After(lines[j].Timestamp)
+	})
+	if len(lines) > limit {
+		lines = lines[:limit]
+	}
+	return lines, nil
+}
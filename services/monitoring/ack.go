@@ -0,0 +1,144 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// acknowledge acknowledges a problem in the monitoring system which reported it.
+func (s *Service) acknowledge(p types.MonitoringProblem, userID, comment string) error {
+	message := "Acknowledged by " + userID + " from Matrix"
+	if comment != "" {
+		message += ": " + comment
+	}
+	switch p.Source {
+	case SourceZabbix:
+		if s.ZabbixURL == "" {
+			return errors.New("The Zabbix API isn't configured")
+		}
+		return s.acknowledgeZabbix(p.ExternalID, message)
+	case SourceIcinga:
+		if s.IcingaURL == "" {
+			return errors.New("The Icinga2 API isn't configured")
+		}
+		return s.acknowledgeIcinga(p, userID, message)
+	}
+	return fmt.Errorf("%s problems can't be acknowledged from Matrix", sourceNames[p.Source])
+}
+
+// acknowledgeZabbix acknowledges a problem event and adds a message to it with the Zabbix API.
+// See https://www.zabbix.com/documentation/current/en/manual/api/reference/event/acknowledge
+func (s *Service) acknowledgeZabbix(eventID, message string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "event.acknowledge",
+		"params": map[string]interface{}{
+			"eventids": []string{eventID},
+			// 2 = acknowledge, 4 = add message
+			"action":  6,
+			"message": message,
+		},
+		"id": 1,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.ZabbixURL, "/")+"/api_jsonrpc.php", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+	req.Header.Set("Authorization", "Bearer "+s.ZabbixToken)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Zabbix API returned %d", res.StatusCode)
+	}
+	var rpcRes struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+			Data    string `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		return fmt.Errorf("Failed to parse Zabbix API response: %s", err)
+	}
+	if rpcRes.Error != nil {
+		return fmt.Errorf("Zabbix API error: %s %s", rpcRes.Error.Message, rpcRes.Error.Data)
+	}
+	return nil
+}
+
+// acknowledgeIcinga acknowledges a host or service problem with the Icinga2 API.
+// See https://icinga.com/docs/icinga-2/latest/doc/12-icinga2-api/#acknowledge-problem
+func (s *Service) acknowledgeIcinga(p types.MonitoringProblem, userID, comment string) error {
+	params := map[string]interface{}{
+		"author":  userID,
+		"comment": comment,
+		"notify":  true,
+	}
+	if p.Service == "" {
+		params["type"] = "Host"
+		params["filter"] = "host.name == h"
+		params["filter_vars"] = map[string]string{"h": p.Host}
+	} else {
+		params["type"] = "Service"
+		params["filter"] = "host.name == h && service.name == s"
+		params["filter_vars"] = map[string]string{"h": p.Host, "s": p.Service}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.IcingaURL, "/")+"/v1/actions/acknowledge-problem", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.IcingaUser, s.IcingaPassword)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var icingaRes struct {
+		Results []struct {
+			Code   float64 `json:"code"`
+			Status string  `json:"status"`
+		} `json:"results"`
+		Status string `json:"status"`
+	}
+	// Errors have a body too, e.g. {"error": 404, "status": "No objects found."}
+	if err := json.NewDecoder(res.Body).Decode(&icingaRes); err != nil && res.StatusCode == 200 {
+		return fmt.Errorf("Failed to parse Icinga2 API response: %s", err)
+	}
+	if res.StatusCode != 200 {
+		if icingaRes.Status != "" {
+			return fmt.Errorf("Icinga2 API returned %d: %s", res.StatusCode, icingaRes.Status)
+		}
+		return fmt.Errorf("Icinga2 API returned %d", res.StatusCode)
+	}
+	if len(icingaRes.Results) == 0 {
+		return errors.New("Icinga2 didn't find the problem")
+	}
+	for _, r := range icingaRes.Results {
+		if r.Code != 200 {
+			return fmt.Errorf("Icinga2 API: %s", r.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,548 @@
+// Package monitoring implements a Service which sends problems from Zabbix, Icinga2 and Nagios into rooms.
+package monitoring
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Monitoring service
+const ServiceType = "monitoring"
+
+// Problem statuses
+const (
+	StatusProblem      = "problem"
+	StatusAcknowledged = "acknowledged"
+	StatusRecovered    = "recovered"
+)
+
+var sourceNames = map[string]string{
+	SourceZabbix: "Zabbix",
+	SourceIcinga: "Icinga2",
+	SourceNagios: "Nagios",
+}
+
+// problemsMutex serialises notifications, so that a recovery can't overtake the problem it recovers.
+var problemsMutex sync.Mutex
+
+// Route sends problems which match it into rooms.
+type Route struct {
+	// Optional. The monitoring systems to match: "zabbix", "icinga" or "nagios". Empty matches all.
+	Sources []string `json:"sources"`
+	// Optional. Shell patterns, e.g. "db*.example.com", which the host and service must match one
+	// of. Empty matches all. Host problems have an empty service.
+	Hosts    []string `json:"hosts"`
+	Services []string `json:"services"`
+	// Optional. The severities to match: "critical", "warning" or "info". Empty matches all.
+	Severities []string `json:"severities"`
+	// The rooms to send matching problems into. This cannot be empty.
+	Rooms []string `json:"rooms"`
+}
+
+// Service contains the Config fields for the Monitoring service.
+//
+// This service accepts notifications about problems from Zabbix, Icinga2 and Nagios, which are
+// POSTed to the webhook URL as JSON, and sends them into the rooms of every route which matches
+// them. Zabbix sends them with a webhook media type, e.g. with the parameters:
+//   {
+//       "source": "zabbix",
+//       "event_id": "{EVENT.ID}",
+//       "event_value": "{EVENT.VALUE}",
+//       "event_update_status": "{EVENT.UPDATE.STATUS}",
+//       "event_update_action": "{EVENT.UPDATE.ACTION}",
+//       "event_update_user": "{USER.FULLNAME}",
+//       "event_update_message": "{EVENT.UPDATE.MESSAGE}",
+//       "host": "{HOST.NAME}",
+//       "trigger_name": "{EVENT.NAME}",
+//       "severity": "{EVENT.SEVERITY}",
+//       "url": "{$ZABBIX.URL}/tr_events.php?triggerid={TRIGGER.ID}&eventid={EVENT.ID}"
+//   }
+// Icinga2 and Nagios send them with a notification command which POSTs e.g.:
+//   {
+//       "source": "icinga",
+//       "notification_type": "$notification.type$",
+//       "host": "$host.name$",
+//       "service": "$service.name$",
+//       "state": "$service.state$",
+//       "output": "$service.output$",
+//       "author": "$notification.author$",
+//       "comment": "$notification.comment$"
+//   }
+// Host notifications leave out the service and use the host's state and output. Notification
+// types other than PROBLEM, RECOVERY and ACKNOWLEDGEMENT are ignored. If a secret is set,
+// requests must have the header "Authorization: Bearer <secret>".
+//
+// Each problem is posted once into each room, and the message is edited as the problem is
+// re-notified, acknowledged and recovers. Zabbix problems are correlated by event ID, and Icinga2
+// and Nagios problems by host and service. Critical problems are delivered even during the room's
+// quiet hours.
+//
+// Problems from Zabbix and Icinga2 can be acknowledged from the rooms they were posted into with
+// !ack, if the service has credentials for their API. The acknowledgement comment says who
+// acknowledged it.
+//
+// Commands supported:
+//    !ack <problem> [comment]
+//
+// Example JSON request:
+//   {
+//       "secret": "hunter2",
+//       "routes": [
+//           {
+//               "hosts": ["db*.example.com"],
+//               "rooms": ["!dba:localhost"]
+//           },
+//           {
+//               "severities": ["critical"],
+//               "rooms": ["!ops:localhost"]
+//           }
+//       ],
+//       "zabbix_url": "https://zabbix.example.com",
+//       "zabbix_token": "b5b1ea1c...",
+//       "icinga_url": "https://icinga.example.com:5665",
+//       "icinga_user": "neb",
+//       "icinga_password": "hunter2",
+//       "allowed_users": ["@alice:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which notifications should be POSTed to. Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// Optional. The secret which requests must have as a bearer token.
+	Secret string `json:"secret"`
+	// The routes to match problems against. A problem is sent by every route which matches it.
+	Routes []Route `json:"routes"`
+	// Optional. The URL of the Zabbix frontend and an API token, for acknowledging Zabbix problems.
+	ZabbixURL   string `json:"zabbix_url"`
+	ZabbixToken string `json:"zabbix_token"`
+	// Optional. The URL of the Icinga2 API and an API user, for acknowledging Icinga2 problems. The
+	// user needs the "actions/acknowledge-problem" permission.
+	IcingaURL      string `json:"icinga_url"`
+	IcingaUser     string `json:"icinga_user"`
+	IcingaPassword string `json:"icinga_password"`
+	// Optional. The users who can acknowledge problems. Defaults to everyone in the rooms.
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if len(s.Routes) == 0 {
+		return errors.New("At least one route must be specified")
+	}
+	for i, r := range s.Routes {
+		if err := r.check(); err != nil {
+			return fmt.Errorf("route %d: %s", i, err)
+		}
+	}
+	if s.ZabbixURL != "" && s.ZabbixToken == "" {
+		return errors.New("zabbix_token must be specified with zabbix_url")
+	}
+	if s.IcingaURL != "" && (s.IcingaUser == "" || s.IcingaPassword == "") {
+		return errors.New("icinga_user and icinga_password must be specified with icinga_url")
+	}
+	for _, u := range []string{s.ZabbixURL, s.IcingaURL} {
+		if u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return errors.New("zabbix_url and icinga_url must start with http[s]://")
+		}
+	}
+	for _, roomID := range s.rooms() {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (r *Route) check() error {
+	if len(r.Rooms) == 0 {
+		return errors.New("At least one room must be specified")
+	}
+	for _, source := range r.Sources {
+		if sourceNames[source] == "" {
+			return fmt.Errorf("Unknown source '%s'", source)
+		}
+	}
+	for _, severity := range r.Severities {
+		if severity != SeverityCritical && severity != SeverityWarning && severity != SeverityInfo {
+			return fmt.Errorf("Unknown severity '%s'", severity)
+		}
+	}
+	for _, pattern := range append(append([]string{}, r.Hosts...), r.Services...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad pattern '%s': %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (r *Route) matches(n *notification) bool {
+	return matchesAny(r.Sources, n.source, false) && matchesAny(r.Severities, n.severity, false) &&
+		matchesAny(r.Hosts, n.host, true) && matchesAny(r.Services, n.service, true)
+}
+
+// matchesAny returns true if the value is one of the values, or matches one of the patterns.
+// An empty list matches everything.
+func matchesAny(list []string, value string, patterns bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+		if patterns {
+			if ok, _ := path.Match(v, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rooms returns the rooms of every route, without duplicates.
+func (s *Service) rooms() []string {
+	var rooms []string
+	seen := make(map[string]bool)
+	for _, r := range s.Routes {
+		for _, roomID := range r.Rooms {
+			if !seen[roomID] {
+				seen[roomID] = true
+				rooms = append(rooms, roomID)
+			}
+		}
+	}
+	return rooms
+}
+
+func (s *Service) isAllowed(userID string) bool {
+	if len(s.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range s.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// OnReceiveWebhook receives notifications from monitoring systems.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if s.Secret != "" {
+		auth := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Secret)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+	}
+	var p payload
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		log.WithError(err).Error("Monitoring webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	n, err := p.parse()
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if n == nil {
+		w.WriteHeader(200)
+		return
+	}
+	if err := s.onNotification(cli, n); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"key":        n.key,
+		}).Error("Failed to process monitoring notification")
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// onNotification opens, updates, acknowledges or recovers the problem which the notification is
+// about, and posts or edits its messages.
+func (s *Service) onNotification(cli *gomatrix.Client, n *notification) error {
+	problemsMutex.Lock()
+	defer problemsMutex.Unlock()
+	db := database.GetServiceDB()
+	p, err := db.LoadOpenMonitoringProblem(s.ServiceID(), n.key)
+	if err == sql.ErrNoRows {
+		if n.kind != kindProblem {
+			// We never saw the problem, or it has already recovered.
+			return nil
+		}
+		p = types.MonitoringProblem{
+			ServiceID:       s.ServiceID(),
+			Key:             n.key,
+			Source:          n.source,
+			Host:            n.host,
+			Service:         n.service,
+			ExternalID:      n.externalID,
+			Status:          StatusProblem,
+			OpenedTimestamp: nowMs(),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	switch n.kind {
+	case kindProblem:
+		p.Severity = n.severity
+		p.State = n.state
+		p.Summary = n.summary
+		if n.url != "" {
+			p.URL = n.url
+		}
+	case kindRecovery:
+		p.Status = StatusRecovered
+		p.State = n.state
+		if n.summary != "" {
+			p.Summary = n.summary
+		}
+	case kindAcknowledgement:
+		// Acknowledging from Matrix is echoed back by the monitoring system, which shouldn't
+		// replace who acknowledged it.
+		if p.Status != StatusAcknowledged {
+			p.Status = StatusAcknowledged
+			p.AckedBy = n.author
+			p.AckComment = n.comment
+		}
+	}
+	p.UpdatedTimestamp = nowMs()
+	if p.ProblemID == 0 {
+		err = db.InsertMonitoringProblem(&p)
+	} else {
+		err = db.UpdateMonitoringProblem(p)
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"problem":    p.ProblemID,
+		"status":     p.Status,
+	}).Info("Received monitoring notification")
+
+	// Recoveries and acknowledgements go wherever the problem went.
+	n.severity = p.Severity
+	var rooms []string
+	for _, r := range s.Routes {
+		if r.matches(n) {
+			rooms = append(rooms, r.Rooms...)
+		}
+	}
+	s.post(cli, p, rooms, n.kind == kindProblem && p.Severity == SeverityCritical)
+	return nil
+}
+
+// post edits the messages about a problem, and sends a message into any of the rooms which
+// don't have one yet.
+func (s *Service) post(cli *gomatrix.Client, p types.MonitoringProblem, rooms []string, urgent bool) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"problem":    p.ProblemID,
+	})
+	db := database.GetServiceDB()
+	messages, err := db.LoadMonitoringMessages(s.ServiceID(), p.ProblemID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load monitoring messages")
+		return
+	}
+	msg := s.message(p)
+	for roomID, eventID := range messages {
+		if err := edit(cli, roomID, eventID, msg); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to edit monitoring message")
+		}
+	}
+	for _, roomID := range rooms {
+		if _, ok := messages[roomID]; ok {
+			continue
+		}
+		// Several routes may send into the same room
+		messages[roomID] = ""
+		eventID, err := notify.SendEvent(cli, roomID, msg, urgent)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send monitoring message")
+			continue
+		}
+		// The message is held back during quiet hours, in which case there is nothing to edit.
+		if eventID == "" {
+			continue
+		}
+		if err := db.StoreMonitoringMessage(s.ServiceID(), p.ProblemID, roomID, eventID); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to store monitoring message")
+		}
+	}
+}
+
+// message renders the message which represents a problem in a room, e.g.
+// "[#12] PROBLEM (critical) db1/postgres: connection refused".
+func (s *Service) message(p types.MonitoringProblem) gomatrix.HTMLMessage {
+	subject := p.Host
+	if p.Service != "" {
+		subject += "/" + p.Service
+	}
+	label := strings.ToUpper(p.Status)
+	if p.Status == StatusProblem || p.Status == StatusAcknowledged {
+		label += " (" + p.Severity + ")"
+	}
+	plain := []string{fmt.Sprintf("[#%d] %s %s: %s", p.ProblemID, label, subject, p.Summary)}
+	formatted := []string{fmt.Sprintf("<strong>[#%d] %s</strong> %s: %s",
+		p.ProblemID, html.EscapeString(label), html.EscapeString(subject), html.EscapeString(p.Summary))}
+	if p.AckedBy != "" {
+		ack := "Acknowledged by " + p.AckedBy
+		if p.AckComment != "" {
+			ack += ": " + p.AckComment
+		}
+		plain = append(plain, ack)
+		formatted = append(formatted, "<em>"+html.EscapeString(ack)+"</em>")
+	}
+	if p.URL != "" {
+		plain = append(plain, p.URL)
+		formatted = append(formatted, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(p.URL), html.EscapeString(p.URL)))
+	}
+	if p.Status == StatusProblem && s.canAcknowledge(p.Source) {
+		help := fmt.Sprintf("Acknowledge with !ack %d [comment]", p.ProblemID)
+		plain = append(plain, help)
+		formatted = append(formatted, html.EscapeString(help))
+	}
+	return gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Body:          strings.Join(plain, "\n"),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(formatted, "<br>"),
+	}
+}
+
+func (s *Service) canAcknowledge(source string) bool {
+	return (source == SourceZabbix && s.ZabbixURL != "") || (source == SourceIcinga && s.IcingaURL != "")
+}
+
+// edit replaces the content of a message.
+func edit(cli *gomatrix.Client, roomID, eventID string, msg gomatrix.HTMLMessage) error {
+	_, err := cli.SendMessageEvent(roomID, "m.room.message", map[string]interface{}{
+		"msgtype":        msg.MsgType,
+		"body":           "* " + msg.Body,
+		"format":         msg.Format,
+		"formatted_body": "* " + msg.FormattedBody,
+		"m.new_content":  msg,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		},
+	})
+	return err
+}
+
+// Commands supported:
+//    !ack <problem> [comment]
+// Problems can only be acknowledged in the rooms they were posted into.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"ack"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdAck(cli, roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdAck(cli *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, errors.New("Usage: !ack <problem> [comment]")
+	}
+	if !s.isAllowed(userID) {
+		return nil, errors.New("You aren't allowed to acknowledge problems")
+	}
+	problemID, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a problem number", args[0])
+	}
+	db := database.GetServiceDB()
+	p, err := db.LoadMonitoringProblem(s.ServiceID(), problemID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	messages, err := db.LoadMonitoringMessages(s.ServiceID(), problemID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := messages[roomID]; !ok {
+		return nil, fmt.Errorf("Problem #%d doesn't exist in this room", problemID)
+	}
+	if p.Status != StatusProblem {
+		return nil, fmt.Errorf("Problem #%d is already %s", problemID, p.Status)
+	}
+	comment := strings.Join(args[1:], " ")
+	if err := s.acknowledge(p, userID, comment); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"problem":    problemID,
+		}).Warn("Failed to acknowledge problem")
+		return nil, fmt.Errorf("Failed to acknowledge #%d: %s", problemID, err)
+	}
+
+	problemsMutex.Lock()
+	defer problemsMutex.Unlock()
+	// The monitoring system may have already told us about the acknowledgement.
+	if current, err := db.LoadMonitoringProblem(s.ServiceID(), problemID); err == nil {
+		p = current
+	}
+	p.Status = StatusAcknowledged
+	p.AckedBy = userID
+	p.AckComment = comment
+	p.UpdatedTimestamp = nowMs()
+	if err := db.UpdateMonitoringProblem(p); err != nil {
+		return nil, err
+	}
+	s.post(cli, p, nil, false)
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("Acknowledged #%d in %s", problemID, sourceNames[p.Source]),
+	}, nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package monitoring
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type mockStore struct {
+	database.NopStorage
+	problems []types.MonitoringProblem
+	messages map[int64]map[string]string
+}
+
+func (s *mockStore) InsertMonitoringProblem(p *types.MonitoringProblem) error {
+	p.ProblemID = int64(len(s.problems) + 1)
+	s.problems = append(s.problems, *p)
+	return nil
+}
+
+func (s *mockStore) UpdateMonitoringProblem(p types.MonitoringProblem) error {
+	s.problems[p.ProblemID-1] = p
+	return nil
+}
+
+func (s *mockStore) LoadMonitoringProblem(serviceID string, problemID int64) (types.MonitoringProblem, error) {
+	if problemID < 1 || int(problemID) > len(s.problems) {
+		return types.MonitoringProblem{}, sql.ErrNoRows
+	}
+	return s.problems[problemID-1], nil
+}
+
+func (s *mockStore) LoadOpenMonitoringProblem(serviceID, key string) (types.MonitoringProblem, error) {
+	for i := len(s.problems) - 1; i >= 0; i-- {
+		if s.problems[i].Key == key && s.problems[i].Status != StatusRecovered {
+			return s.problems[i], nil
+		}
+	}
+	return types.MonitoringProblem{}, sql.ErrNoRows
+}
+
+func (s *mockStore) StoreMonitoringMessage(serviceID string, problemID int64, roomID, eventID string) error {
+	if s.messages[problemID] == nil {
+		s.messages[problemID] = make(map[string]string)
+	}
+	s.messages[problemID][roomID] = eventID
+	return nil
+}
+
+func (s *mockStore) LoadMonitoringMessages(serviceID string, problemID int64) (map[string]string, error) {
+	messages := make(map[string]string)
+	for roomID, eventID := range s.messages[problemID] {
+		messages[roomID] = eventID
+	}
+	return messages, nil
+}
+
+// apiStandIn records the requests it receives and responds with a fixed body.
+type apiStandIn struct {
+	response string
+	requests []map[string]interface{}
+	auth     []string
+}
+
+func (a *apiStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	a.requests = append(a.requests, body)
+	a.auth = append(a.auth, r.URL.Path+" "+r.Header.Get("Authorization"))
+	w.Write([]byte(a.response))
+}
+
+func newService(t *testing.T, config string) (*Service, *mockStore, *[]testutils.SentMessage, *gomatrix.Client) {
+	store := &mockStore{messages: make(map[int64]map[string]string)}
+	database.SetServiceDB(store)
+	var sent []testutils.SentMessage
+	cli := testutils.NewMatrixClient(&sent, "$problem:hyrule")
+	return testutils.NewService(t, ServiceType, config, cli).(*Service), store, &sent, cli
+}
+
+func post(s *Service, cli *gomatrix.Client, body string) int {
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer hunter2")
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	return w.Code
+}
+
+// edits returns the new bodies of the edits which were sent.
+func edits(sent []testutils.SentMessage) (bodies []string) {
+	for _, e := range sent {
+		if newContent, ok := e.Content["m.new_content"].(map[string]interface{}); ok {
+			bodies = append(bodies, newContent["body"].(string))
+		}
+	}
+	return
+}
+
+func TestZabbix(t *testing.T) {
+	zabbix := &apiStandIn{response: `{"jsonrpc":"2.0","result":{"eventids":["4242"]},"id":1}`}
+	srv := httptest.NewServer(zabbix)
+	defer srv.Close()
+	s, store, sent, cli := newService(t, `{
+		"secret": "hunter2",
+		"routes": [
+			{"hosts": ["db*.hyrule"], "rooms": ["!dba:hyrule"]},
+			{"severities": ["critical"], "rooms": ["!ops:hyrule"]}
+		],
+		"zabbix_url": "`+srv.URL+`",
+		"zabbix_token": "zabbix-token"
+	}`)
+
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
+	s.OnReceiveWebhook(w, req, cli)
+	if w.Code != 401 {
+		t.Errorf("Expected an unauthenticated request to return 401, got %d", w.Code)
+	}
+
+	problem := `{"source":"zabbix","event_id":"4242","event_value":"1","host":"db1.hyrule",
+		"trigger_name":"Replication lag is high","severity":"Average","url":"https://zabbix/tr_events.php?eventid=4242"}`
+	if code := post(s, cli, problem); code != 200 {
+		t.Fatalf("Expected problem to return 200, got %d", code)
+	}
+	if len(*sent) != 1 || (*sent)[0].RoomID != "!dba:hyrule" {
+		t.Fatalf("Expected an average problem to only be sent to the DBA room, got %v", *sent)
+	}
+	body := (*sent)[0].Body()
+	if !strings.HasPrefix(body, "[#1] PROBLEM (warning) db1.hyrule: Replication lag is high\nhttps://zabbix/tr_events.php?eventid=4242\nAcknowledge with !ack 1") {
+		t.Errorf("Unexpected problem message: %s", body)
+	}
+
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!ops:hyrule", "@link:hyrule", "ack 1"); err == nil {
+		t.Errorf("Expected !ack in a room without the problem to fail")
+	}
+	res, err := testutils.RunTextCommand(s.Commands(cli), "!dba:hyrule", "@link:hyrule", "ack #1 looking")
+	if err != nil {
+		t.Fatalf("!ack returned error: %s", err)
+	}
+	if res != "Acknowledged #1 in Zabbix" {
+		t.Errorf("Unexpected !ack response: %s", res)
+	}
+	if len(zabbix.requests) != 1 || zabbix.auth[0] != "/api_jsonrpc.php Bearer zabbix-token" {
+		t.Fatalf("Expected an authenticated Zabbix API request, got %v", zabbix.auth)
+	}
+	params := zabbix.requests[0]["params"].(map[string]interface{})
+	if zabbix.requests[0]["method"] != "event.acknowledge" || params["eventids"].([]interface{})[0] != "4242" ||
+		params["message"] != "Acknowledged by @link:hyrule from Matrix: looking" {
+		t.Errorf("Unexpected Zabbix API request: %v", zabbix.requests[0])
+	}
+
+	// Zabbix tells us about the acknowledgement, which shouldn't change who acknowledged it
+	ack := `{"event_id":"4242","event_value":"1","event_update_status":"1","event_update_action":"acknowledged, commented",
+		"event_update_user":"Go-NEB","host":"db1.hyrule","trigger_name":"Replication lag is high","severity":"Average"}`
+	post(s, cli, ack)
+	recovery := `{"event_id":"4242","event_value":"0","host":"db1.hyrule","trigger_name":"Replication lag is high","severity":"Average"}`
+	post(s, cli, recovery)
+	bodies := edits(*sent)
+	if len(bodies) != 3 || !strings.HasPrefix(bodies[0], "[#1] ACKNOWLEDGED (warning) db1.hyrule: Replication lag is high\nAcknowledged by @link:hyrule: looking") {
+		t.Fatalf("Expected the acknowledgement to edit the message, got %v", bodies)
+	}
+	if !strings.HasPrefix(bodies[2], "[#1] RECOVERED db1.hyrule: Replication lag is high\nAcknowledged by @link:hyrule: looking") {
+		t.Errorf("Expected the recovery to edit the message, got %s", bodies[2])
+	}
+	if store.problems[0].Status != StatusRecovered || len(*sent) != 4 {
+		t.Errorf("Expected the problem to recover without new messages, got %+v", store.problems[0])
+	}
+
+	// The same trigger firing again is a new problem
+	post(s, cli, strings.Replace(strings.Replace(problem, "4242", "4250", -1), "Average", "Disaster", 1))
+	if len(store.problems) != 2 || len(*sent) != 6 {
+		t.Errorf("Expected a disaster to be sent to both rooms, got %v", *sent)
+	}
+}
+
+func TestIcinga(t *testing.T) {
+	icinga := &apiStandIn{response: `{"results":[{"code":200.0,"status":"Successfully acknowledged problem"}]}`}
+	srv := httptest.NewServer(icinga)
+	defer srv.Close()
+	s, store, sent, cli := newService(t, `{
+		"routes": [{"sources": ["icinga", "nagios"], "services": ["http*"], "rooms": ["!web:hyrule"]}],
+		"icinga_url": "`+srv.URL+`",
+		"icinga_user": "neb",
+		"icinga_password": "hunter2",
+		"allowed_users": ["@zelda:hyrule"]
+	}`)
+
+	problem := `{"source":"icinga","notification_type":"PROBLEM","host":"web1","service":"https",
+		"state":"CRITICAL","output":"Connection refused"}`
+	post(s, cli, problem)
+	post(s, cli, `{"source":"icinga","notification_type":"PROBLEM","host":"web1","service":"disk",
+		"state":"WARNING","output":"10% free"}`)
+	post(s, cli, `{"source":"icinga","notification_type":"DOWNTIMESTART","host":"web1","service":"https"}`)
+	if len(*sent) != 1 || !strings.HasPrefix((*sent)[0].Body(), "[#1] PROBLEM (critical) web1/https: Connection refused") {
+		t.Fatalf("Expected only the https problem to be sent, got %v", *sent)
+	}
+	if code := post(s, cli, `{"source":"icinga","host":"web1"}`); code != 400 {
+		t.Errorf("Expected a notification without a type to return 400, got %d", code)
+	}
+
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!web:hyrule", "@link:hyrule", "ack 1"); err == nil {
+		t.Errorf("Expected !ack from someone who isn't allowed to fail")
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!web:hyrule", "@zelda:hyrule", "ack 1"); err != nil {
+		t.Fatalf("!ack returned error: %s", err)
+	}
+	if len(icinga.requests) != 1 || icinga.auth[0] != "/v1/actions/acknowledge-problem Basic bmViOmh1bnRlcjI=" {
+		t.Fatalf("Expected an authenticated Icinga2 API request, got %v", icinga.auth)
+	}
+	vars := icinga.requests[0]["filter_vars"].(map[string]interface{})
+	if icinga.requests[0]["type"] != "Service" || vars["h"] != "web1" || vars["s"] != "https" || icinga.requests[0]["author"] != "@zelda:hyrule" {
+		t.Errorf("Unexpected Icinga2 API request: %v", icinga.requests[0])
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!web:hyrule", "@zelda:hyrule", "ack 1"); err == nil || err.Error() != "Problem #1 is already acknowledged" {
+		t.Errorf("Expected a second !ack to fail, got %v", err)
+	}
+
+	post(s, cli, strings.Replace(strings.Replace(problem, "PROBLEM", "RECOVERY", 1), "CRITICAL", "OK", 1))
+	if store.problems[0].Status != StatusRecovered || store.problems[0].Severity != SeverityCritical {
+		t.Errorf("Expected the problem to recover, got %+v", store.problems[0])
+	}
+	bodies := edits(*sent)
+	if len(bodies) != 2 || !strings.HasPrefix(bodies[1], "[#1] RECOVERED web1/https: Connection refused") {
+		t.Errorf("Expected the recovery to edit the message, got %v", bodies)
+	}
+
+	// Nagios has no API to acknowledge problems with
+	post(s, cli, strings.Replace(problem, `"icinga"`, `"nagios"`, 1))
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!web:hyrule", "@zelda:hyrule", "ack 3"); err == nil || !strings.Contains(err.Error(), "Nagios problems can't be acknowledged") {
+		t.Errorf("Expected acknowledging a Nagios problem to fail, got %v", err)
+	}
+}
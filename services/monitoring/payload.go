@@ -0,0 +1,187 @@
+package monitoring
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Monitoring systems
+const (
+	SourceZabbix = "zabbix"
+	SourceIcinga = "icinga"
+	SourceNagios = "nagios"
+)
+
+// Kinds of notification
+const (
+	kindProblem         = "problem"
+	kindRecovery        = "recovery"
+	kindAcknowledgement = "acknowledgement"
+)
+
+// Normalised severities
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// payload is the JSON body of a notification. Zabbix webhook media types and Icinga2 or Nagios
+// notification commands fill in different fields.
+type payload struct {
+	// Optional. "zabbix", "icinga" or "nagios". Defaults to zabbix if there is an event_id and
+	// icinga otherwise.
+	Source string `json:"source"`
+	Host   string `json:"host"`
+	URL    string `json:"url"`
+
+	// Zabbix: {EVENT.ID}, {EVENT.VALUE}, {EVENT.UPDATE.STATUS}, {EVENT.UPDATE.ACTION},
+	// {USER.FULLNAME}, {EVENT.UPDATE.MESSAGE}, {EVENT.NAME} and {EVENT.SEVERITY}.
+	EventID            string `json:"event_id"`
+	EventValue         string `json:"event_value"`
+	EventUpdateStatus  string `json:"event_update_status"`
+	EventUpdateAction  string `json:"event_update_action"`
+	EventUpdateUser    string `json:"event_update_user"`
+	EventUpdateMessage string `json:"event_update_message"`
+	TriggerName        string `json:"trigger_name"`
+	Severity           string `json:"severity"`
+
+	// Icinga2 and Nagios: $notification.type$, $service.name$, $service.state$ (or $host.state$),
+	// $service.output$ (or $host.output$), $notification.author$ and $notification.comment$.
+	NotificationType string `json:"notification_type"`
+	Service          string `json:"service"`
+	State            string `json:"state"`
+	Output           string `json:"output"`
+	Author           string `json:"author"`
+	Comment          string `json:"comment"`
+}
+
+// notification is a payload from any monitoring system, in a common form.
+type notification struct {
+	kind   string
+	source string
+	// Correlates the problem, recovery and acknowledgements of a problem.
+	key string
+	// The ID of the problem in the monitoring system's API.
+	externalID string
+	host       string
+	service    string
+	severity   string
+	state      string
+	summary    string
+	url        string
+	author     string
+	comment    string
+}
+
+// parse converts a payload into a notification. It returns nil if the payload is a kind of
+// notification which the service ignores, such as a Zabbix comment or an Icinga downtime.
+func (p *payload) parse() (*notification, error) {
+	source := strings.ToLower(p.Source)
+	if source == "" {
+		source = SourceIcinga
+		if p.EventID != "" {
+			source = SourceZabbix
+		}
+	}
+	if p.Host == "" {
+		return nil, errors.New("host must be specified")
+	}
+	switch source {
+	case SourceZabbix:
+		return p.parseZabbix()
+	case SourceIcinga, SourceNagios:
+		return p.parseIcinga(source)
+	}
+	return nil, fmt.Errorf("Unknown source '%s'", p.Source)
+}
+
+func (p *payload) parseZabbix() (*notification, error) {
+	if p.EventID == "" {
+		return nil, errors.New("event_id must be specified")
+	}
+	n := notification{
+		source:     SourceZabbix,
+		key:        SourceZabbix + ":" + p.EventID,
+		externalID: p.EventID,
+		host:       p.Host,
+		severity:   zabbixSeverity(p.Severity),
+		state:      p.Severity,
+		summary:    p.TriggerName,
+		url:        p.URL,
+	}
+	switch {
+	case p.EventUpdateStatus == "1":
+		// Zabbix lists everything done in the update, e.g. "acknowledged, commented"
+		if !strings.Contains(p.EventUpdateAction, "acknowledged") || strings.Contains(p.EventUpdateAction, "unacknowledged") {
+			return nil, nil
+		}
+		n.kind = kindAcknowledgement
+		n.author = p.EventUpdateUser
+		n.comment = p.EventUpdateMessage
+	case p.EventValue == "1":
+		n.kind = kindProblem
+	case p.EventValue == "0":
+		n.kind = kindRecovery
+		n.state = "Resolved"
+	default:
+		return nil, fmt.Errorf("Unknown event_value '%s'", p.EventValue)
+	}
+	return &n, nil
+}
+
+func (p *payload) parseIcinga(source string) (*notification, error) {
+	n := notification{
+		source:   source,
+		host:     p.Host,
+		service:  p.Service,
+		severity: icingaSeverity(p.State),
+		state:    strings.ToUpper(p.State),
+		summary:  p.Output,
+		url:      p.URL,
+		author:   p.Author,
+		comment:  p.Comment,
+	}
+	n.externalID = p.Host
+	if p.Service != "" {
+		n.externalID += "!" + p.Service
+	}
+	n.key = source + ":" + n.externalID
+	switch strings.ToUpper(p.NotificationType) {
+	case "PROBLEM":
+		n.kind = kindProblem
+	case "RECOVERY":
+		n.kind = kindRecovery
+	case "ACKNOWLEDGEMENT":
+		n.kind = kindAcknowledgement
+	case "":
+		return nil, errors.New("notification_type must be specified")
+	default:
+		// CUSTOM, FLAPPINGSTART, DOWNTIMESTART etc.
+		return nil, nil
+	}
+	return &n, nil
+}
+
+// zabbixSeverity normalises a Zabbix trigger severity.
+func zabbixSeverity(severity string) string {
+	switch strings.ToLower(severity) {
+	case "disaster", "high":
+		return SeverityCritical
+	case "average", "warning":
+		return SeverityWarning
+	}
+	return SeverityInfo
+}
+
+// icingaSeverity normalises an Icinga2 or Nagios host or service state.
+func icingaSeverity(state string) string {
+	switch strings.ToUpper(state) {
+	case "CRITICAL", "DOWN", "UNREACHABLE":
+		return SeverityCritical
+	case "WARNING", "UNKNOWN":
+		return SeverityWarning
+	}
+	return SeverityInfo
+}
@@ -0,0 +1,261 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Supported registries
+const (
+	RegistryGo        = "go"
+	RegistryNPM       = "npm"
+	RegistryPyPI      = "pypi"
+	RegistryCrates    = "crates"
+	RegistryDockerHub = "dockerhub"
+	RegistryGHCR      = "ghcr"
+	RegistryGitHub    = "github"
+)
+
+// The base URLs of each registry's API. These are variables so tests can point them elsewhere.
+var (
+	goProxyURL   = "https://proxy.golang.org"
+	npmURL       = "https://registry.npmjs.org"
+	pypiURL      = "https://pypi.org"
+	cratesURL    = "https://crates.io"
+	dockerHubURL = "https://hub.docker.com"
+	ghcrURL      = "https://ghcr.io"
+	githubAPIURL = "https://api.github.com"
+)
+
+// A release is a single published version of a package.
+type release struct {
+	version version
+	// A link to the changelog or release notes, or failing that the registry page for the version.
+	link string
+}
+
+// A fetcher lists the releases of a package.
+type fetcher func(s *Service, name string) ([]release, error)
+
+var fetchers = map[string]fetcher{
+	RegistryGo:        fetchGo,
+	RegistryNPM:       fetchNPM,
+	RegistryPyPI:      fetchPyPI,
+	RegistryCrates:    fetchCrates,
+	RegistryDockerHub: fetchDockerHub,
+	RegistryGHCR:      fetchGHCR,
+	RegistryGitHub:    fetchGitHub,
+}
+
+// getJSON GETs the URL and decodes the JSON response into v.
+func getJSON(u string, headers map[string]string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// crates.io rejects requests without a User-Agent
+	req.Header.Set("User-Agent", "go-neb (https://github.com/matrix-org/go-neb)")
+	for k, val := range headers {
+		req.Header.Set(k, val)
+	}
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s returned %d: %s", u, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if s, ok := v.(*string); ok {
+		body, err := ioutil.ReadAll(res.Body)
+		*s = string(body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// parseReleases parses each version string, skipping those which aren't versions, using link
+// to make the changelog link for each.
+func parseReleases(versions []string, link func(v string) string) []release {
+	var releases []release
+	for _, raw := range versions {
+		v, ok := parseVersion(raw)
+		if !ok {
+			continue
+		}
+		releases = append(releases, release{v, link(raw)})
+	}
+	return releases
+}
+
+// escapeModulePath escapes a Go module path for the module proxy, which replaces upper case
+// letters with an exclamation mark followed by the lower case letter.
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			b.WriteRune('!')
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func fetchGo(s *Service, module string) ([]release, error) {
+	var list string
+	if err := getJSON(goProxyURL+"/"+escapeModulePath(module)+"/@v/list", nil, &list); err != nil {
+		return nil, err
+	}
+	return parseReleases(strings.Fields(list), func(v string) string {
+		return "https://pkg.go.dev/" + module + "@" + v
+	}), nil
+}
+
+func fetchNPM(s *Service, pkg string) ([]release, error) {
+	var doc struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	// scoped packages are requested as @scope%2fname
+	if err := getJSON(npmURL+"/"+strings.Replace(pkg, "/", "%2f", 1), nil, &doc); err != nil {
+		return nil, err
+	}
+	var versions []string
+	for v := range doc.Versions {
+		versions = append(versions, v)
+	}
+	return parseReleases(versions, func(v string) string {
+		return "https://www.npmjs.com/package/" + pkg + "/v/" + v
+	}), nil
+}
+
+func fetchPyPI(s *Service, project string) ([]release, error) {
+	var doc struct {
+		Releases map[string][]struct {
+			Yanked bool `json:"yanked"`
+		} `json:"releases"`
+	}
+	if err := getJSON(pypiURL+"/pypi/"+url.PathEscape(project)+"/json", nil, &doc); err != nil {
+		return nil, err
+	}
+	var versions []string
+	for v, files := range doc.Releases {
+		// releases with no files or only yanked files can't be installed
+		for _, f := range files {
+			if !f.Yanked {
+				versions = append(versions, v)
+				break
+			}
+		}
+	}
+	return parseReleases(versions, func(v string) string {
+		return "https://pypi.org/project/" + project + "/" + v + "/"
+	}), nil
+}
+
+func fetchCrates(s *Service, crate string) ([]release, error) {
+	var doc struct {
+		Versions []struct {
+			Num    string `json:"num"`
+			Yanked bool   `json:"yanked"`
+		} `json:"versions"`
+	}
+	if err := getJSON(cratesURL+"/api/v1/crates/"+url.PathEscape(crate), nil, &doc); err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, v := range doc.Versions {
+		if !v.Yanked {
+			versions = append(versions, v.Num)
+		}
+	}
+	return parseReleases(versions, func(v string) string {
+		return "https://crates.io/crates/" + crate + "/" + v
+	}), nil
+}
+
+func fetchDockerHub(s *Service, image string) ([]release, error) {
+	repo := image
+	page := "https://hub.docker.com/r/" + image
+	if !strings.Contains(image, "/") {
+		// official images live in the "library" namespace
+		repo = "library/" + image
+		page = "https://hub.docker.com/_/" + image
+	}
+	var doc struct {
+		Results []struct {
+			Name string `json:"name"`
+		} `json:"results"`
+	}
+	if err := getJSON(dockerHubURL+"/v2/repositories/"+repo+"/tags?page_size=100&ordering=last_updated", nil, &doc); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, t := range doc.Results {
+		tags = append(tags, t.Name)
+	}
+	return parseReleases(tags, func(tag string) string {
+		return page + "/tags?name=" + url.QueryEscape(tag)
+	}), nil
+}
+
+func fetchGHCR(s *Service, image string) ([]release, error) {
+	// Public images still need an anonymous pull token
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := getJSON(ghcrURL+"/token?scope="+url.QueryEscape("repository:"+image+":pull"), nil, &token); err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Tags []string `json:"tags"`
+	}
+	headers := map[string]string{"Authorization": "Bearer " + token.Token}
+	if err := getJSON(ghcrURL+"/v2/"+image+"/tags/list?n=1000", headers, &doc); err != nil {
+		return nil, err
+	}
+	return parseReleases(doc.Tags, func(tag string) string {
+		return "https://ghcr.io/" + image
+	}), nil
+}
+
+func fetchGitHub(s *Service, ownerRepo string) ([]release, error) {
+	var doc []struct {
+		TagName    string `json:"tag_name"`
+		HTMLURL    string `json:"html_url"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	}
+	headers := map[string]string{"Accept": "application/vnd.github.v3+json"}
+	if s.GitHubToken != "" {
+		headers["Authorization"] = "token " + s.GitHubToken
+	}
+	if err := getJSON(githubAPIURL+"/repos/"+ownerRepo+"/releases?per_page=100", headers, &doc); err != nil {
+		return nil, err
+	}
+	var releases []release
+	for _, r := range doc {
+		if r.Draft {
+			continue
+		}
+		v, ok := parseVersion(r.TagName)
+		if !ok {
+			continue
+		}
+		if r.Prerelease && v.prerelease == "" {
+			// GitHub knows better than the tag name
+			v.prerelease = "prerelease"
+		}
+		releases = append(releases, release{v, r.HTMLURL})
+	}
+	return releases, nil
+}
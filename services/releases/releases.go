@@ -0,0 +1,317 @@
+// Package releases implements a Service which announces new versions of packages.
+package releases
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Releases service
+const ServiceType = "releases"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+const (
+	minPollingIntervalMins     = 15
+	defaultPollingIntervalMins = 60
+	// The most releases to announce for a package in one go, in case a package publishes a flurry
+	// of versions or the service hasn't polled for a long time.
+	maxAnnouncements = 5
+)
+
+// Package is the configuration and state for a single tracked package.
+type Package struct {
+	// The list of rooms to announce new versions in. This cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. Only announce versions which change the major version. For 0.x versions, a change
+	// to the minor version counts as a major change.
+	MajorsOnly bool `json:"majors_only"`
+	// Optional. Also announce pre-releases such as "2.0.0-rc.1".
+	IncludePrereleases bool `json:"include_prereleases"`
+	// Optional. The time to wait between polls. Defaults to 60. The minimum is 15.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The newest version seen. This is populated by Go-NEB. Use /getService to retrieve this value.
+	LatestVersion string `json:"latest_version"`
+	// True if the registry couldn't be queried for this package. This is populated by Go-NEB.
+	// Use /getService to retrieve this value.
+	IsFailing bool `json:"is_failing"`
+	// Internal field. When we should poll again.
+	NextPollTimestampSecs int64
+}
+
+// Service contains the Config fields for the Releases service.
+//
+// This service polls package registries and announces new versions in rooms, with a link to the
+// release notes where the registry has them. Packages are keyed by "<registry>:<name>", where the
+// registry is one of:
+//   go         A Go module e.g. "go:github.com/matrix-org/gomatrix", via the Go module proxy.
+//   npm        An npm package e.g. "npm:react" or "npm:@babel/core".
+//   pypi       A PyPI project e.g. "pypi:requests".
+//   crates     A crates.io crate e.g. "crates:serde".
+//   dockerhub  A Docker Hub image e.g. "dockerhub:nginx" or "dockerhub:grafana/grafana".
+//   ghcr       A GitHub Container Registry image e.g. "ghcr:home-assistant/home-assistant".
+//   github     GitHub releases for a repository e.g. "github:matrix-org/synapse".
+// Tags and versions which don't look like version numbers (e.g. "latest") are ignored. The first
+// poll of a package only records the latest version, so adding a package doesn't announce its
+// entire history.
+//
+// Example JSON request:
+//   {
+//       "github_token": "optional personal access token for a higher rate limit",
+//       "packages": {
+//           "npm:react": {
+//               "rooms": ["!ewfug483gsfe:localhost"],
+//               "majors_only": true
+//           },
+//           "github:matrix-org/synapse": {
+//               "rooms": ["!ewfug483gsfe:localhost"],
+//               "include_prereleases": true,
+//               "poll_interval_mins": 30
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. A GitHub token to use for GitHub releases, to avoid the anonymous rate limit.
+	GitHubToken string `json:"github_token"`
+	// A map of "<registry>:<name>" to package config.
+	Packages map[string]Package `json:"packages"`
+}
+
+// splitKey splits "<registry>:<name>" into its parts.
+func splitKey(key string) (string, string, error) {
+	segs := strings.SplitN(key, ":", 2)
+	if len(segs) != 2 || segs[1] == "" {
+		return "", "", fmt.Errorf("package '%s' is not of the form <registry>:<name>", key)
+	}
+	if _, ok := fetchers[segs[0]]; !ok {
+		return "", "", fmt.Errorf("package '%s' has an unknown registry '%s'", key, segs[0])
+	}
+	return segs[0], segs[1], nil
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Packages) == 0 {
+		// this is an error UNLESS the old service had some packages in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Packages) == 0 {
+			return errors.New("At least one package must be specified")
+		}
+		return nil
+	}
+	old, _ := oldService.(*Service)
+	for key, pkg := range s.Packages {
+		if _, _, err := splitKey(key); err != nil {
+			return err
+		}
+		if len(pkg.Rooms) == 0 {
+			return fmt.Errorf("Package %s has no rooms to send updates to", key)
+		}
+		// Keep the state of packages which were already being tracked
+		if old != nil {
+			if oldPkg, ok := old.Packages[key]; ok {
+				pkg.LatestVersion = oldPkg.LatestVersion
+				pkg.NextPollTimestampSecs = oldPkg.NextPollTimestampSecs
+				pkg.IsFailing = oldPkg.IsFailing
+				s.Packages[key] = pkg
+			}
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client) {
+	roomSet := make(map[string]bool)
+	for _, pkg := range s.Packages {
+		for _, roomID := range pkg.Rooms {
+			roomSet[roomID] = true
+		}
+	}
+	for roomID := range roomSet {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// PostRegister deletes this service if there are no packages remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Packages) == 0 {
+		logger := log.WithFields(log.Fields{
+			"service_id":   s.ServiceID(),
+			"service_type": s.ServiceType(),
+		})
+		logger.Info("Deleting service: No packages remaining.")
+		polling.StopPolling(s)
+		if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+	}
+}
+
+// OnPoll checks the packages which are due to be polled, and announces new versions.
+//
+// Returns a timestamp representing when this Service should have OnPoll called again.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now().Unix()
+	polled := false
+	for key, pkg := range s.Packages {
+		if pkg.NextPollTimestampSecs != 0 && now < pkg.NextPollTimestampSecs {
+			continue
+		}
+		polled = true
+		interval := pkg.PollIntervalMins
+		if interval == 0 {
+			interval = defaultPollingIntervalMins
+		} else if interval < minPollingIntervalMins {
+			interval = minPollingIntervalMins
+		}
+		pkg.NextPollTimestampSecs = now + int64(interval*60)
+
+		newReleases, err := s.checkPackage(key, &pkg)
+		pkg.IsFailing = err != nil
+		s.Packages[key] = pkg
+		if err != nil {
+			logger.WithError(err).WithField("package", key).Error("Failed to check package for releases")
+			continue
+		}
+		for _, r := range newReleases {
+			s.announce(cli, key, &pkg, r)
+		}
+	}
+	if polled {
+		// Persist the service to save the versions seen and next poll times
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			logger.WithError(err).Error("Failed to persist package state for service")
+		}
+	}
+	return s.nextTimestamp()
+}
+
+func (s *Service) nextTimestamp() time.Time {
+	var earliest int64
+	for _, pkg := range s.Packages {
+		if earliest == 0 || pkg.NextPollTimestampSecs < earliest {
+			earliest = pkg.NextPollTimestampSecs
+		}
+	}
+	// Don't allow times in the past, so we don't tight-loop on registries which 500.
+	now := time.Now().Unix()
+	if earliest <= now {
+		earliest = now + 60
+	}
+	return time.Unix(earliest, 0)
+}
+
+// checkPackage fetches the releases for the package and returns the ones which should be
+// announced, oldest first. It updates the package's latest version.
+func (s *Service) checkPackage(key string, pkg *Package) ([]release, error) {
+	registry, name, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	all, err := fetchers[registry](s, name)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []release
+	for _, r := range all {
+		if r.version.isPrerelease() && !pkg.IncludePrereleases {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].version.compare(candidates[j].version) < 0
+	})
+	newest := candidates[len(candidates)-1]
+
+	if pkg.LatestVersion == "" {
+		// First poll: remember where we are without announcing anything
+		pkg.LatestVersion = newest.version.raw
+		return nil, nil
+	}
+	latest, ok := parseVersion(pkg.LatestVersion)
+	if !ok || newest.version.compare(latest) <= 0 {
+		return nil, nil
+	}
+	pkg.LatestVersion = newest.version.raw
+
+	if pkg.MajorsOnly {
+		if newest.version.isMajorBump(latest) {
+			return []release{newest}, nil
+		}
+		return nil, nil
+	}
+	var newReleases []release
+	for _, r := range candidates {
+		if r.version.compare(latest) > 0 {
+			newReleases = append(newReleases, r)
+		}
+	}
+	if len(newReleases) > maxAnnouncements {
+		newReleases = newReleases[len(newReleases)-maxAnnouncements:]
+	}
+	return newReleases, nil
+}
+
+func (s *Service) announce(cli *gomatrix.Client, key string, pkg *Package, r release) {
+	kind := "New release"
+	if r.version.isPrerelease() {
+		kind = "New pre-release"
+	}
+	plain := fmt.Sprintf("%s of %s: %s %s", kind, key, r.version.raw, r.link)
+	formatted := fmt.Sprintf(
+		"%s of <strong>%s</strong>: <a href=\"%s\">%s</a>",
+		kind, html.EscapeString(key), html.EscapeString(r.link), html.EscapeString(r.version.raw),
+	)
+	msg := gomatrix.HTMLMessage{
+		Body:          plain,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+	for _, roomID := range pkg.Rooms {
+		if err := notify.Send(cli, roomID, msg, false); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"package":    key,
+				"version":    r.version.raw,
+			}).Error("Failed to announce release")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
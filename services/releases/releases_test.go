@@ -0,0 +1,256 @@
+package releases
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+var compareTests = []struct {
+	a, b   string
+	expect int
+}{
+	{"1.2.3", "1.2.3", 0},
+	{"v1.2.3", "1.2.4", -1},
+	{"1.10.0", "1.9.0", 1},
+	{"2.0.0-rc.1", "2.0.0", -1},
+	{"2.0.0-rc.2", "2.0.0-rc.10", -1},
+	{"2.0.0-beta", "2.0.0-alpha", 1},
+	{"1.0", "1.0.0", 0},
+	{"1.0rc1", "1.0", -1},
+	{"1.0.0+build5", "1.0.0", 0},
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, test := range compareTests {
+		a, ok := parseVersion(test.a)
+		b, ok2 := parseVersion(test.b)
+		if !ok || !ok2 {
+			t.Errorf("Failed to parse %s or %s", test.a, test.b)
+			continue
+		}
+		if got := a.compare(b); got != test.expect {
+			t.Errorf("compare(%s, %s): want %d got %d", test.a, test.b, test.expect, got)
+		}
+	}
+	for _, bad := range []string{"latest", "alpine", ""} {
+		if _, ok := parseVersion(bad); ok {
+			t.Errorf("parseVersion(%q): expected not to be a version", bad)
+		}
+	}
+	old, _ := parseVersion("0.3.1")
+	for v, want := range map[string]bool{"0.3.2": false, "0.4.0": true, "1.0.0": true} {
+		newer, _ := parseVersion(v)
+		if got := newer.isMajorBump(old); got != want {
+			t.Errorf("isMajorBump(%s, 0.3.1): want %v got %v", v, want, got)
+		}
+	}
+}
+
+// registry serves every registry API with the given versions.
+type registry struct {
+	versions []string
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/github.com/!burnt!sushi/toml/@v/list":
+		w.Write([]byte(strings.Join(reg.versions, "\n")))
+	case p == "/@babel/core" || p == "/@babel%2fcore":
+		versions := make(map[string]interface{})
+		for _, v := range reg.versions {
+			versions[v] = struct{}{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"versions": versions})
+	case p == "/pypi/requests/json":
+		releases := make(map[string]interface{})
+		for _, v := range reg.versions {
+			releases[v] = []interface{}{map[string]bool{"yanked": false}}
+		}
+		releases["0.0.1"] = []interface{}{} // no files
+		json.NewEncoder(w).Encode(map[string]interface{}{"releases": releases})
+	case p == "/api/v1/crates/serde":
+		var versions []interface{}
+		for _, v := range reg.versions {
+			versions = append(versions, map[string]interface{}{"num": v, "yanked": false})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"versions": versions})
+	case p == "/v2/repositories/library/nginx/tags":
+		results := []interface{}{map[string]string{"name": "latest"}}
+		for _, v := range reg.versions {
+			results = append(results, map[string]string{"name": v})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case p == "/token":
+		w.Write([]byte(`{"token":"anon"}`))
+	case p == "/v2/owner/image/tags/list":
+		if r.Header.Get("Authorization") != "Bearer anon" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"tags": append([]string{"sha-abc123"}, reg.versions...)})
+	case p == "/repos/matrix-org/synapse/releases":
+		var releases []interface{}
+		for _, v := range reg.versions {
+			releases = append(releases, map[string]interface{}{
+				"tag_name": "v" + v,
+				"html_url": "https://github.com/matrix-org/synapse/releases/tag/v" + v,
+			})
+		}
+		json.NewEncoder(w).Encode(releases)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestFetchers(t *testing.T) {
+	reg := &registry{versions: []string{"1.0.0", "1.1.0", "2.0.0-rc.1"}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	goProxyURL, npmURL, pypiURL, cratesURL, dockerHubURL, ghcrURL, githubAPIURL =
+		srv.URL, srv.URL, srv.URL, srv.URL, srv.URL, srv.URL, srv.URL
+
+	for key, wantLink := range map[string]string{
+		"go:github.com/BurntSushi/toml": "https://pkg.go.dev/github.com/BurntSushi/toml@1.1.0",
+		"npm:@babel/core":               "https://www.npmjs.com/package/@babel/core/v/1.1.0",
+		"pypi:requests":                 "https://pypi.org/project/requests/1.1.0/",
+		"crates:serde":                  "https://crates.io/crates/serde/1.1.0",
+		"dockerhub:nginx":               "https://hub.docker.com/_/nginx/tags?name=1.1.0",
+		"ghcr:owner/image":              "https://ghcr.io/owner/image",
+		"github:matrix-org/synapse":     "https://github.com/matrix-org/synapse/releases/tag/v1.1.0",
+	} {
+		registry, name, err := splitKey(key)
+		if err != nil {
+			t.Fatalf("splitKey(%s): %s", key, err)
+		}
+		releases, err := fetchers[registry](&Service{}, name)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", key, err)
+			continue
+		}
+		var got []string
+		link := ""
+		for _, r := range releases {
+			got = append(got, strings.TrimPrefix(r.version.raw, "v"))
+			if r.version.compare(version{nums: [3]int{1, 1, 0}}) == 0 {
+				link = r.link
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != "1.0.0,1.1.0,2.0.0-rc.1" {
+			t.Errorf("%s: unexpected versions %v", key, got)
+		}
+		if link != wantLink {
+			t.Errorf("%s: want link %s got %s", key, wantLink, link)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	reg := &registry{versions: []string{"1.0.0", "1.1.0"}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	npmURL = srv.URL
+
+	var sent []gomatrix.HTMLMessage
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/join/") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:hyrule"}`)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	srvc, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{
+		"packages": {
+			"npm:@babel/core": { "rooms": ["!all:hyrule"] },
+			"npm:react": { "rooms": ["!majors:hyrule"], "majors_only": true }
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create releases service: ", err)
+	}
+	s := srvc.(*Service)
+	if err := s.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register releases service: ", err)
+	}
+	// react isn't served by the stand-in registry
+	s.OnPoll(cli)
+	if len(sent) != 0 {
+		t.Fatalf("Expected the first poll not to announce anything, got %v", sent)
+	}
+	if pkg := s.Packages["npm:@babel/core"]; pkg.LatestVersion != "1.1.0" || pkg.IsFailing {
+		t.Fatalf("Expected latest version to be recorded, got %+v", pkg)
+	}
+	if !s.Packages["npm:react"].IsFailing {
+		t.Errorf("Expected npm:react to be failing")
+	}
+
+	reg.versions = append(reg.versions, "1.2.0", "1.3.0-rc.1", "1.2.1")
+	pkg := s.Packages["npm:@babel/core"]
+	pkg.NextPollTimestampSecs = 0
+	s.Packages["npm:@babel/core"] = pkg
+	s.OnPoll(cli)
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 announcements, got %v", sent)
+	}
+	if sent[0].Body != "New release of npm:@babel/core: 1.2.0 https://www.npmjs.com/package/@babel/core/v/1.2.0" ||
+		!strings.HasPrefix(sent[1].Body, "New release of npm:@babel/core: 1.2.1") {
+		t.Errorf("Unexpected announcements: %v", sent)
+	}
+	if s.Packages["npm:@babel/core"].LatestVersion != "1.2.1" {
+		t.Errorf("Expected latest version 1.2.1, got %s", s.Packages["npm:@babel/core"].LatestVersion)
+	}
+}
+
+func TestMajorsOnly(t *testing.T) {
+	reg := &registry{versions: []string{"1.0.0", "1.1.0", "2.0.0", "2.1.0"}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	cratesURL = srv.URL
+
+	s := &Service{}
+	pkg := Package{MajorsOnly: true, LatestVersion: "1.0.0"}
+	releases, err := s.checkPackage("crates:serde", &pkg)
+	if err != nil {
+		t.Fatalf("checkPackage returned error: %s", err)
+	}
+	if len(releases) != 1 || releases[0].version.raw != "2.1.0" {
+		t.Errorf("Expected only the newest major to be announced, got %v", releases)
+	}
+	reg.versions = append(reg.versions, "2.2.0")
+	if releases, _ := s.checkPackage("crates:serde", &pkg); len(releases) != 0 {
+		t.Errorf("Expected minor release not to be announced, got %v", releases)
+	}
+	if pkg.LatestVersion != "2.2.0" {
+		t.Errorf("Expected latest version to still be tracked, got %s", pkg.LatestVersion)
+	}
+}
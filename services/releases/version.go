@@ -0,0 +1,116 @@
+package releases
+
+import (
+	"strconv"
+	"strings"
+)
+
+// version is a loosely parsed semantic version. As well as semver, it copes with the versions
+// used by Go modules ("v1.2.3"), PyPI ("1.2rc1", "1.2.post1") and most Docker tags.
+type version struct {
+	raw        string
+	nums       [3]int
+	prerelease string
+}
+
+// parseVersion returns the version, or false if s doesn't look like a version at all
+// e.g. the Docker tag "latest".
+func parseVersion(s string) (version, bool) {
+	v := version{raw: s}
+	rest := strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	// build metadata doesn't affect precedence
+	if plus := strings.IndexByte(rest, '+'); plus != -1 {
+		rest = rest[:plus]
+	}
+	for i := 0; i < 3; i++ {
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			if i == 0 {
+				return v, false
+			}
+			break
+		}
+		v.nums[i], _ = strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		if i < 2 && strings.HasPrefix(rest, ".") && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9' {
+			rest = rest[1:]
+		} else {
+			break
+		}
+	}
+	rest = strings.TrimLeft(rest, "-.")
+	// PyPI post releases are newer than the release they follow, not pre-releases of it
+	if rest != "" && !strings.HasPrefix(rest, "post") {
+		v.prerelease = rest
+	}
+	return v, true
+}
+
+// isPrerelease returns true for pre-releases such as "1.0.0-rc.1", "1.0b2" or "2.0.0.dev1".
+func (v version) isPrerelease() bool {
+	return v.prerelease != ""
+}
+
+// isMajorBump returns true if v has breaking changes compared to old.
+func (v version) isMajorBump(old version) bool {
+	if v.nums[0] != old.nums[0] {
+		return v.nums[0] > old.nums[0]
+	}
+	return v.nums[0] == 0 && v.nums[1] > old.nums[1]
+}
+
+// compare returns -1, 0 or 1 if v is older than, the same as or newer than other.
+func (v version) compare(other version) int {
+	for i := 0; i < 3; i++ {
+		if v.nums[i] != other.nums[i] {
+			if v.nums[i] < other.nums[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// a pre-release is older than the release itself
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	}
+	return comparePrerelease(v.prerelease, other.prerelease)
+}
+
+// comparePrerelease compares dot separated identifiers, numerically where both are numbers.
+func comparePrerelease(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package roomstats
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	chartWidth  = 320
+	chartHeight = 120
+	chartMargin = 8
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartAxis       = color.RGBA{0x99, 0x99, 0x99, 0xff}
+	chartBar        = color.RGBA{0x0d, 0xbd, 0x8b, 0xff}
+)
+
+// renderChart draws a bar chart of the values as a PNG. There are no labels: the message the chart
+// is sent with has the numbers.
+func renderChart(values []int64) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.ZP, draw.Src)
+
+	baseline := chartHeight - chartMargin
+	draw.Draw(img, image.Rect(chartMargin, baseline, chartWidth-chartMargin, baseline+1), &image.Uniform{chartAxis}, image.ZP, draw.Src)
+
+	var max int64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	if len(values) > 0 && max > 0 {
+		slot := (chartWidth - 2*chartMargin) / len(values)
+		gap := slot / 5
+		plotHeight := baseline - chartMargin
+		for i, v := range values {
+			height := int(int64(plotHeight) * v / max)
+			if v > 0 && height == 0 {
+				height = 1 // make sure non-zero days are visible
+			}
+			x := chartMargin + i*slot + gap/2
+			bar := image.Rect(x, baseline-height, x+slot-gap, baseline)
+			draw.Draw(img, bar, &image.Uniform{chartBar}, image.ZP, draw.Src)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,547 @@
+// Package roomstats implements a Service which reports on activity in Matrix rooms.
+package roomstats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Room Stats service
+const ServiceType = "roomstats"
+
+const (
+	dayLayout            = "2006-01-02"
+	flushInterval        = 1 * time.Minute
+	defaultRetentionDays = 90
+	defaultReportHour    = 9
+	topThreadsLimit      = 3
+)
+
+// Service contains the Config fields for the Room Stats service.
+//
+// This service counts activity in rooms from the bot's timeline: messages per day, the number of
+// members who sent a message each day, joins, leaves, and the threads with the most replies. Only
+// daily totals are stored; the IDs of the members who were active are held in memory only for the
+// current day so that they can be counted, and are never persisted. Because of this, if Go-NEB is
+// restarted, members who were active earlier in the day are counted again only if they send another
+// message.
+//
+// A weekly report, with a chart of messages per day, is sent every week. Users can also ask for a
+// report at any time with:
+//    !roomstats [period]
+// where "period" is a number of days or weeks e.g. "30d" or "2w", and defaults to 7 days.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!ewfug483gsfe:localhost", "!abvgt843sfd:localhost"],
+//       "report_room_id": "!modteam:localhost",
+//       "report_weekday": "monday",
+//       "report_hour": 9,
+//       "retention_days": 90
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms to count activity in. This cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. The room to send weekly reports into. Defaults to sending each room's report into
+	// the room itself.
+	ReportRoomID string `json:"report_room_id"`
+	// Optional. The day of the week to send reports on. Defaults to "monday".
+	ReportWeekday string `json:"report_weekday"`
+	// Optional. The hour of the day (UTC) to send reports at. Defaults to 9.
+	ReportHour *int `json:"report_hour"`
+	// Optional. How many days of stats to keep. Defaults to 90.
+	RetentionDays int `json:"retention_days"`
+	// Internal field. When the next weekly report is due.
+	NextReportTimestampSecs int64
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Rooms) == 0 {
+		// this is an error UNLESS the old service had some rooms in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Rooms) == 0 {
+			return errors.New("At least one room must be specified")
+		}
+		return nil
+	}
+	if _, err := s.reportWeekday(); err != nil {
+		return err
+	}
+	if s.ReportHour != nil && (*s.ReportHour < 0 || *s.ReportHour > 23) {
+		return errors.New("report_hour must be between 0 and 23")
+	}
+	if s.RetentionDays < 0 {
+		return errors.New("retention_days cannot be negative")
+	}
+	// A new schedule means a new report time
+	s.NextReportTimestampSecs = 0
+	s.joinRooms(client)
+	return nil
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client) {
+	roomIDs := s.Rooms
+	if s.ReportRoomID != "" {
+		roomIDs = append([]string{s.ReportRoomID}, roomIDs...)
+	}
+	for _, roomID := range roomIDs {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// PostRegister deletes this service if there are no rooms remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) == 0 {
+		logger := log.WithFields(log.Fields{
+			"service_id":   s.ServiceID(),
+			"service_type": s.ServiceType(),
+		})
+		logger.Info("Deleting service: No rooms remaining.")
+		polling.StopPolling(s)
+		if err := database.GetServiceDB().DeleteRoomStats(s.ServiceID(), "9999-12-31"); err != nil {
+			logger.WithError(err).Error("Failed to delete room stats")
+		}
+		if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+	}
+}
+
+func (s *Service) reportWeekday() (time.Weekday, error) {
+	if s.ReportWeekday == "" {
+		return time.Monday, nil
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s.ReportWeekday) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("report_weekday '%s' is not a day of the week", s.ReportWeekday)
+}
+
+func (s *Service) tracksRoom(roomID string) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// counters are the activity counts for a room on a day which haven't been stored yet.
+type counters struct {
+	messages int64
+	joins    int64
+	leaves   int64
+	threads  map[string]int64 // thread root event ID => replies
+	// The members who sent a message. This is never persisted, only counted.
+	active map[string]bool
+}
+
+type counterKey struct {
+	serviceID, roomID, day string
+}
+
+var (
+	countersMutex sync.Mutex
+	pending       = make(map[counterKey]*counters)
+)
+
+func countersFor(k counterKey) *counters {
+	c := pending[k]
+	if c == nil {
+		c = &counters{
+			threads: make(map[string]int64),
+			active:  make(map[string]bool),
+		}
+		pending[k] = c
+	}
+	return c
+}
+
+// OnReceiveEvent counts messages and membership changes in tracked rooms.
+func (s *Service) OnReceiveEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if event.Sender == cli.UserID || !s.tracksRoom(event.RoomID) {
+		return
+	}
+	ts := time.Now()
+	if event.Timestamp > 0 {
+		ts = time.Unix(0, event.Timestamp*int64(time.Millisecond))
+	}
+	k := counterKey{s.ServiceID(), event.RoomID, ts.UTC().Format(dayLayout)}
+
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+	switch event.Type {
+	case "m.room.message":
+		c := countersFor(k)
+		c.messages++
+		c.active[event.Sender] = true
+		if threadID := threadRoot(event); threadID != "" {
+			c.threads[threadID]++
+		}
+	case "m.room.member":
+		membership, _ := event.Content["membership"].(string)
+		prev := prevMembership(event)
+		if membership == "join" && prev != "join" {
+			countersFor(k).joins++
+		} else if (membership == "leave" || membership == "ban") && prev == "join" {
+			countersFor(k).leaves++
+		}
+	}
+}
+
+// threadRoot returns the event ID of the thread the message is in, if any.
+func threadRoot(event *gomatrix.Event) string {
+	relatesTo, ok := event.Content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if relType, _ := relatesTo["rel_type"].(string); relType != "m.thread" {
+		return ""
+	}
+	eventID, _ := relatesTo["event_id"].(string)
+	return eventID
+}
+
+// prevMembership returns the membership before this member event, so display name and avatar
+// changes aren't counted as joins.
+func prevMembership(event *gomatrix.Event) string {
+	prevContent := event.PrevContent
+	if prevContent == nil {
+		prevContent, _ = event.Unsigned["prev_content"].(map[string]interface{})
+	}
+	membership, _ := prevContent["membership"].(string)
+	return membership
+}
+
+// flush stores the pending counters for this service. Active members for today are remembered so
+// that they aren't counted twice.
+func (s *Service) flush(now time.Time) {
+	today := now.UTC().Format(dayLayout)
+	countersMutex.Lock()
+	var toStore []types.RoomStats
+	var threads []types.ThreadStats
+	for k, c := range pending {
+		if k.serviceID != s.ServiceID() {
+			continue
+		}
+		toStore = append(toStore, types.RoomStats{
+			ServiceID:     k.serviceID,
+			RoomID:        k.roomID,
+			Day:           k.day,
+			Messages:      c.messages,
+			Joins:         c.joins,
+			Leaves:        c.leaves,
+			ActiveMembers: int64(len(c.active)),
+		})
+		for threadID, replies := range c.threads {
+			threads = append(threads, types.ThreadStats{
+				ServiceID: k.serviceID,
+				RoomID:    k.roomID,
+				Day:       k.day,
+				ThreadID:  threadID,
+				Replies:   replies,
+			})
+		}
+		if k.day == today {
+			c.messages, c.joins, c.leaves = 0, 0, 0
+			c.threads = make(map[string]int64)
+		} else {
+			delete(pending, k)
+		}
+	}
+	countersMutex.Unlock()
+
+	db := database.GetServiceDB()
+	for _, st := range toStore {
+		if err := db.IncrementRoomStats(st); err != nil {
+			log.WithError(err).WithField("room_id", st.RoomID).Error("Failed to store room stats")
+		}
+	}
+	for _, st := range threads {
+		if err := db.IncrementThreadStats(st); err != nil {
+			log.WithError(err).WithField("room_id", st.RoomID).Error("Failed to store thread stats")
+		}
+	}
+}
+
+// OnPoll stores the activity counted since the last poll, and sends the weekly reports when due.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	s.flush(now)
+
+	retention := s.RetentionDays
+	if retention == 0 {
+		retention = defaultRetentionDays
+	}
+	cutoff := now.UTC().AddDate(0, 0, -retention).Format(dayLayout)
+	if err := database.GetServiceDB().DeleteRoomStats(s.ServiceID(), cutoff); err != nil {
+		logger.WithError(err).Error("Failed to delete old room stats")
+	}
+
+	if s.NextReportTimestampSecs == 0 {
+		s.NextReportTimestampSecs = s.nextReportTime(now).Unix()
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			logger.WithError(err).Error("Failed to persist next report time")
+		}
+	} else if now.Unix() >= s.NextReportTimestampSecs {
+		reportEnd := time.Unix(s.NextReportTimestampSecs, 0).UTC()
+		for _, roomID := range s.Rooms {
+			if err := s.sendWeeklyReport(cli, roomID, reportEnd); err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Failed to send weekly report")
+			}
+		}
+		s.NextReportTimestampSecs = s.nextReportTime(now).Unix()
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			logger.WithError(err).Error("Failed to persist next report time")
+		}
+	}
+	return now.Add(flushInterval)
+}
+
+// nextReportTime returns the first report time after now.
+func (s *Service) nextReportTime(now time.Time) time.Time {
+	weekday, _ := s.reportWeekday()
+	hour := defaultReportHour
+	if s.ReportHour != nil {
+		hour = *s.ReportHour
+	}
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	next = next.AddDate(0, 0, (int(weekday)-int(now.Weekday())+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// A report is the aggregate activity in a room over a number of days.
+type report struct {
+	roomID     string
+	days       []string
+	daily      []types.RoomStats // one per day, including days with no activity
+	topThreads []types.ThreadStats
+}
+
+// loadReport loads the stats for the given number of whole days ending on lastDay.
+func (s *Service) loadReport(roomID string, lastDay time.Time, numDays int) (*report, error) {
+	r := &report{roomID: roomID}
+	first := lastDay.AddDate(0, 0, -(numDays - 1))
+	fromDay, toDay := first.Format(dayLayout), lastDay.Format(dayLayout)
+	db := database.GetServiceDB()
+	stats, err := db.LoadRoomStats(s.ServiceID(), roomID, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	byDay := make(map[string]types.RoomStats)
+	for _, st := range stats {
+		byDay[st.Day] = st
+	}
+	for i := 0; i < numDays; i++ {
+		day := first.AddDate(0, 0, i).Format(dayLayout)
+		r.days = append(r.days, day)
+		st, ok := byDay[day]
+		if !ok {
+			st = types.RoomStats{Day: day}
+		}
+		r.daily = append(r.daily, st)
+	}
+	if r.topThreads, err = db.LoadTopThreads(s.ServiceID(), roomID, fromDay, toDay, topThreadsLimit); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// message renders the report as a HTML message.
+func (r *report) message(title string) gomatrix.HTMLMessage {
+	var messages, joins, leaves, activeTotal, activePeak int64
+	for _, st := range r.daily {
+		messages += st.Messages
+		joins += st.Joins
+		leaves += st.Leaves
+		activeTotal += st.ActiveMembers
+		if st.ActiveMembers > activePeak {
+			activePeak = st.ActiveMembers
+		}
+	}
+	avgActive := float64(activeTotal) / float64(len(r.daily))
+
+	var plain, formatted bytes.Buffer
+	heading := fmt.Sprintf("%s for %s (%s to %s)", title, r.roomID, r.days[0], r.days[len(r.days)-1])
+	summary := []string{
+		fmt.Sprintf("Messages: %d", messages),
+		fmt.Sprintf("Active members per day: %.1f average, %d peak", avgActive, activePeak),
+		fmt.Sprintf("Joins: %d, leaves: %d", joins, leaves),
+	}
+	plain.WriteString(heading + "\n")
+	formatted.WriteString(fmt.Sprintf("<strong>%s</strong><ul>", html.EscapeString(heading)))
+	for _, line := range summary {
+		plain.WriteString(line + "\n")
+		formatted.WriteString(fmt.Sprintf("<li>%s</li>", html.EscapeString(line)))
+	}
+	formatted.WriteString("</ul>")
+
+	if len(r.daily) <= 14 {
+		var perDay []string
+		for _, st := range r.daily {
+			perDay = append(perDay, fmt.Sprintf("%s: %d", st.Day[5:], st.Messages))
+		}
+		line := "Messages per day: " + strings.Join(perDay, ", ")
+		plain.WriteString(line + "\n")
+		formatted.WriteString(html.EscapeString(line) + "<br>")
+	}
+
+	if len(r.topThreads) > 0 {
+		plain.WriteString("Top threads:\n")
+		formatted.WriteString("Top threads:<ol>")
+		for _, t := range r.topThreads {
+			link := matrix.Permalink(r.roomID, t.ThreadID)
+			plain.WriteString(fmt.Sprintf(" - %s (%d replies)\n", link, t.Replies))
+			formatted.WriteString(fmt.Sprintf(
+				`<li><a href="%s">%s</a> (%d replies)</li>`,
+				html.EscapeString(link), html.EscapeString(t.ThreadID), t.Replies,
+			))
+		}
+		formatted.WriteString("</ol>")
+	}
+	return gomatrix.HTMLMessage{
+		Body:          strings.TrimSpace(plain.String()),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted.String(),
+	}
+}
+
+func (s *Service) sendWeeklyReport(cli *gomatrix.Client, roomID string, reportEnd time.Time) error {
+	// the report covers the 7 whole days before the report time
+	r, err := s.loadReport(roomID, reportEnd.AddDate(0, 0, -1), 7)
+	if err != nil {
+		return err
+	}
+	target := roomID
+	if s.ReportRoomID != "" {
+		target = s.ReportRoomID
+	}
+	if err := notify.Send(cli, target, r.message("Weekly activity"), false); err != nil {
+		return err
+	}
+
+	var values []int64
+	for _, st := range r.daily {
+		values = append(values, st.Messages)
+	}
+	chart, err := renderChart(values)
+	if err != nil {
+		return err
+	}
+	upload, err := cli.UploadToContentRepo(bytes.NewReader(chart), "image/png", int64(len(chart)))
+	if err != nil {
+		return err
+	}
+	return notify.Send(cli, target, gomatrix.ImageMessage{
+		MsgType: "m.image",
+		Body:    "messages-per-day.png",
+		URL:     upload.ContentURI,
+		Info: gomatrix.ImageInfo{
+			Height:   chartHeight,
+			Width:    chartWidth,
+			Mimetype: "image/png",
+			Size:     uint(len(chart)),
+		},
+	}, false)
+}
+
+// Commands supported:
+//    !roomstats [period]
+// Responds with the activity in the room over the period, which defaults to 7 days.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"roomstats"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdRoomStats(roomID, args, time.Now())
+			},
+		},
+	}
+}
+
+func (s *Service) cmdRoomStats(roomID string, args []string, now time.Time) (interface{}, error) {
+	if !s.tracksRoom(roomID) {
+		return nil, errors.New("Activity isn't being counted in this room")
+	}
+	numDays := 7
+	if len(args) > 0 {
+		var err error
+		if numDays, err = parsePeriod(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	retention := s.RetentionDays
+	if retention == 0 {
+		retention = defaultRetentionDays
+	}
+	if numDays > retention {
+		return nil, fmt.Errorf("Stats are only kept for %d days", retention)
+	}
+	// make sure the report includes the latest activity
+	s.flush(now)
+	r, err := s.loadReport(roomID, now.UTC(), numDays)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to load room stats")
+		return nil, errors.New("Failed to load room stats")
+	}
+	return r.message(fmt.Sprintf("Activity over %d days", numDays)), nil
+}
+
+// parsePeriod parses a period such as "30d" or "2w" into a number of days.
+func parsePeriod(period string) (int, error) {
+	multiplier := 1
+	numStr := period
+	switch {
+	case strings.HasSuffix(period, "w"):
+		multiplier = 7
+		numStr = strings.TrimSuffix(period, "w")
+	case strings.HasSuffix(period, "d"):
+		numStr = strings.TrimSuffix(period, "d")
+	}
+	n, err := strconv.Atoi(numStr)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("'%s' is not a period such as 7d or 2w", period)
+	}
+	return n * multiplier, nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package roomstats
+
+import (
+	"bytes"
+	"image/png"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// statsStore keeps room stats in memory.
+type statsStore struct {
+	database.NopStorage
+	stats   map[string]*types.RoomStats // keyed by room ID + day
+	threads map[string]int64            // keyed by thread ID
+}
+
+func (s *statsStore) IncrementRoomStats(st types.RoomStats) error {
+	existing := s.stats[st.RoomID+st.Day]
+	if existing == nil {
+		s.stats[st.RoomID+st.Day] = &st
+		return nil
+	}
+	existing.Messages += st.Messages
+	existing.Joins += st.Joins
+	existing.Leaves += st.Leaves
+	if st.ActiveMembers > existing.ActiveMembers {
+		existing.ActiveMembers = st.ActiveMembers
+	}
+	return nil
+}
+
+func (s *statsStore) IncrementThreadStats(st types.ThreadStats) error {
+	s.threads[st.ThreadID] += st.Replies
+	return nil
+}
+
+func (s *statsStore) LoadRoomStats(serviceID, roomID, fromDay, toDay string) ([]types.RoomStats, error) {
+	var stats []types.RoomStats
+	for _, st := range s.stats {
+		if st.RoomID == roomID && st.Day >= fromDay && st.Day <= toDay {
+			stats = append(stats, *st)
+		}
+	}
+	return stats, nil
+}
+
+func (s *statsStore) LoadTopThreads(serviceID, roomID, fromDay, toDay string, limit int) ([]types.ThreadStats, error) {
+	var threads []types.ThreadStats
+	for id, replies := range s.threads {
+		threads = append(threads, types.ThreadStats{ThreadID: id, Replies: replies})
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].Replies > threads[j].Replies })
+	if len(threads) > limit {
+		threads = threads[:limit]
+	}
+	return threads, nil
+}
+
+func msg(sender string, ts time.Time, content map[string]interface{}) *gomatrix.Event {
+	if content == nil {
+		content = map[string]interface{}{"msgtype": "m.text", "body": "hi"}
+	}
+	return &gomatrix.Event{
+		Type:      "m.room.message",
+		Sender:    sender,
+		RoomID:    "!room:hyrule",
+		Timestamp: ts.UnixNano() / int64(time.Millisecond),
+		Content:   content,
+	}
+}
+
+func member(sender, membership, prev string, ts time.Time) *gomatrix.Event {
+	ev := &gomatrix.Event{
+		Type:      "m.room.member",
+		Sender:    sender,
+		StateKey:  &sender,
+		RoomID:    "!room:hyrule",
+		Timestamp: ts.UnixNano() / int64(time.Millisecond),
+		Content:   map[string]interface{}{"membership": membership},
+	}
+	if prev != "" {
+		ev.Unsigned = map[string]interface{}{
+			"prev_content": map[string]interface{}{"membership": prev},
+		}
+	}
+	return ev
+}
+
+func TestCountAndReport(t *testing.T) {
+	store := &statsStore{stats: make(map[string]*types.RoomStats), threads: make(map[string]int64)}
+	database.SetServiceDB(store)
+
+	srvc, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{"rooms":["!room:hyrule"]}`))
+	if err != nil {
+		t.Fatal("Failed to create roomstats service: ", err)
+	}
+	s := srvc.(*Service)
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	thread := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "reply",
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": "$root:hyrule",
+		},
+	}
+	events := []*gomatrix.Event{
+		msg("@link:hyrule", yesterday, nil),
+		msg("@link:hyrule", now, nil),
+		msg("@zelda:hyrule", now, thread),
+		msg("@link:hyrule", now, thread),
+		msg("@navi:hyrule", now, nil), // the bot's own messages aren't counted
+		member("@ganon:hyrule", "join", "", now),
+		member("@ganon:hyrule", "join", "join", now), // display name change
+		member("@ganon:hyrule", "ban", "join", now),
+	}
+	for _, ev := range events {
+		s.OnReceiveEvent(cli, ev)
+	}
+	other := msg("@link:hyrule", now, nil)
+	other.RoomID = "!untracked:hyrule"
+	s.OnReceiveEvent(cli, other)
+
+	s.flush(now)
+	// Link is already counted as active today, so this shouldn't increase the active count
+	s.OnReceiveEvent(cli, msg("@link:hyrule", now, nil))
+	s.flush(now)
+
+	today := store.stats["!room:hyrule"+now.Format(dayLayout)]
+	if today == nil || today.Messages != 4 || today.ActiveMembers != 2 || today.Joins != 1 || today.Leaves != 1 {
+		t.Fatalf("Unexpected stats for today: %+v", today)
+	}
+	if prev := store.stats["!room:hyrule"+yesterday.Format(dayLayout)]; prev == nil || prev.Messages != 1 {
+		t.Fatalf("Unexpected stats for yesterday: %+v", prev)
+	}
+	if store.threads["$root:hyrule"] != 2 {
+		t.Fatalf("Expected 2 thread replies, got %d", store.threads["$root:hyrule"])
+	}
+
+	res, err := s.cmdRoomStats("!room:hyrule", []string{"2d"}, now)
+	if err != nil {
+		t.Fatalf("!roomstats returned error: %s", err)
+	}
+	body := res.(gomatrix.HTMLMessage).Body
+	for _, want := range []string{
+		"Activity over 2 days for !room:hyrule (2026-03-09 to 2026-03-10)",
+		"Messages: 5",
+		"Active members per day: 1.5 average, 2 peak",
+		"Joins: 1, leaves: 1",
+		"Messages per day: 03-09: 1, 03-10: 4",
+		"https://matrix.to/#/%21room:hyrule/$root:hyrule (2 replies)",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, body)
+		}
+	}
+	if _, err := s.cmdRoomStats("!untracked:hyrule", nil, now); err == nil {
+		t.Errorf("Expected an error for a room which isn't tracked")
+	}
+}
+
+func TestNextReportTime(t *testing.T) {
+	hour := 18
+	s := &Service{ReportWeekday: "Friday", ReportHour: &hour}
+	for now, want := range map[string]string{
+		"2026-03-10T12:00:00Z": "2026-03-13T18:00:00Z", // Tuesday
+		"2026-03-13T17:59:00Z": "2026-03-13T18:00:00Z",
+		"2026-03-13T18:00:00Z": "2026-03-20T18:00:00Z",
+	} {
+		n, _ := time.Parse(time.RFC3339, now)
+		if got := s.nextReportTime(n).Format(time.RFC3339); got != want {
+			t.Errorf("nextReportTime(%s): want %s got %s", now, want, got)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	for period, want := range map[string]int{"7": 7, "30d": 30, "2w": 14} {
+		if got, err := parsePeriod(period); err != nil || got != want {
+			t.Errorf("parsePeriod(%s): want %d got %d (%v)", period, want, got, err)
+		}
+	}
+	for _, bad := range []string{"w", "0d", "-3d", "week"} {
+		if _, err := parsePeriod(bad); err == nil {
+			t.Errorf("parsePeriod(%s): expected error", bad)
+		}
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	data, err := renderChart([]int64{0, 3, 10, 1, 0, 7, 2})
+	if err != nil {
+		t.Fatalf("renderChart returned error: %s", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Chart isn't a valid PNG: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+		t.Errorf("Unexpected chart size %v", b)
+	}
+}
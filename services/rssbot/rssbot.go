@@ -2,18 +2,22 @@
 package rssbot
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"html"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"github.com/die-net/lrucache"
 	"github.com/gregjones/httpcache"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/polling"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
@@ -62,6 +66,12 @@ type includeRules struct {
 
 // Service contains the Config fields for this service.
 //
+// If a feed advertises a WebSub hub (https://www.w3.org/TR/websub/), the service subscribes to it
+// using its webhook endpoint, and new items are sent as soon as the hub pushes them. Feeds which
+// are pushed are still polled every 6 hours in case a push is missed, and are polled as normal if
+// the hub fails or the subscription lapses. Subscriptions are renewed a day before they expire.
+// WebSub requires Go-NEB's BASE_URL to be reachable by the hub.
+//
 // Example request:
 //   {
 //       feeds: {
@@ -76,6 +86,9 @@ type includeRules struct {
 //   }
 type Service struct {
 	types.DefaultService
+	webhookEndpointURL string
+	// Optional. Don't subscribe to WebSub hubs, and only poll feeds.
+	DisableWebSub bool `json:"disable_websub"`
 	// Feeds is a map of feed URL to configuration options for this feed.
 	Feeds map[string]struct {
 		// Optional. The time to wait between polls. If this is less than minPollingIntervalSeconds, it is ignored.
@@ -96,6 +109,18 @@ type Service struct {
 		NextPollTimestampSecs int64
 		// Internal field. The most recently seen GUIDs. Sized to the number of items in the feed.
 		RecentGUIDs []string
+		// The WebSub hub the feed advertises, if any. This is populated by Go-NEB. Use /getService
+		// to retrieve this value.
+		WebSubHub string `json:"websub_hub"`
+		// When the WebSub subscription expires, or 0 if the feed isn't subscribed. This is populated
+		// by Go-NEB. Use /getService to retrieve this value.
+		WebSubLeaseExpiresTimestampSecs int64 `json:"websub_lease_expires_ts_secs"`
+		// Internal field. The topic URL to subscribe to.
+		WebSubTopic string
+		// Internal field. The secret which the hub signs pushed content with.
+		WebSubSecret string
+		// Internal field. When to try subscribing again after the hub failed.
+		WebSubRetryTimestampSecs int64
 	} `json:"feeds"`
 }
 
@@ -117,7 +142,7 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	}
 	// Make sure we can parse the feed
 	for feedURL, feedInfo := range s.Feeds {
-		if _, err := readFeed(feedURL); err != nil {
+		if _, _, err := readFeed(feedURL); err != nil {
 			return fmt.Errorf("Failed to read URL %s: %s", feedURL, err.Error())
 		}
 		if len(feedInfo.Rooms) == 0 {
@@ -148,8 +173,12 @@ func (s *Service) joinRooms(client *gomatrix.Client) {
 	}
 }
 
-// PostRegister deletes this service if there are no feeds remaining.
+// PostRegister unsubscribes from the WebSub hubs of removed feeds, and deletes this service if there
+// are no feeds remaining.
 func (s *Service) PostRegister(oldService types.Service) {
+	if old, ok := oldService.(*Service); ok {
+		s.unsubscribeRemoved(old)
+	}
 	if len(s.Feeds) == 0 { // bye-bye :(
 		logger := log.WithFields(log.Fields{
 			"service_id":   s.ServiceID(),
@@ -195,24 +224,43 @@ func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
 
 	// Query each feed and send new items to subscribed rooms
 	for _, u := range pollFeeds {
-		feed, items, err := s.queryFeed(u)
-		if err != nil {
-			logger.WithField("feed_url", u).WithError(err).Error("Failed to query feed")
-			incrementMetrics(u, err)
-			continue
-		}
-		incrementMetrics(u, nil)
+		s.pollFeed(cli, u, logger)
+	}
+
+	// Subscribe to any hubs the feeds advertise. This is done after the feeds are persisted so the
+	// secrets are known when the hubs verify the subscriptions.
+	s.renewSubscriptions()
+
+	return s.nextTimestamp()
+}
+
+// pollFeed queries a feed, sends its new items to the feed's rooms and persists the feed's state.
+func (s *Service) pollFeed(cli *gomatrix.Client, feedURL string, logger *log.Entry) {
+	feed, links, err := readFeed(feedURL)
+
+	// WebSub pushes update the feed too, so hold the lock and start from the stored state
+	lock := feedStateLock(s.ServiceID())
+	lock.Lock()
+	defer lock.Unlock()
+	s.reloadFeedState()
+
+	items, err := s.updateFeed(feedURL, feed, links, err)
+	if err != nil {
+		logger.WithField("feed_url", feedURL).WithError(err).Error("Failed to query feed")
+		incrementMetrics(feedURL, err)
+	} else {
+		incrementMetrics(feedURL, nil)
 		logger.WithFields(log.Fields{
-			"feed_url":   u,
+			"feed_url":   feedURL,
 			"feed_items": len(feed.Items),
 			"new_items":  len(items),
 		}).Info("Sending new items")
 		// Loop backwards since [0] is the most recent and we want to send in chronological order
 		for i := len(items) - 1; i >= 0; i-- {
 			item := items[i]
-			if err := s.sendToRooms(cli, u, feed, item); err != nil {
+			if err := s.sendToRooms(cli, feedURL, feed, item); err != nil {
 				logger.WithFields(log.Fields{
-					"feed_url":   u,
+					"feed_url":   feedURL,
 					log.ErrorKey: err,
 					"item":       item,
 				}).Error("Failed to send item to room")
@@ -220,12 +268,59 @@ func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
 		}
 	}
 
-	// Persist the service to save the next poll times
+	// Persist the service to save the next poll time and the GUIDs which have been sent
 	if _, err := database.GetServiceDB().StoreService(s); err != nil {
 		logger.WithError(err).Error("Failed to persist next poll times for service")
 	}
+}
 
-	return s.nextTimestamp()
+var (
+	feedStateLocksMutex sync.Mutex
+	feedStateLocks      = make(map[string]*sync.Mutex) // service ID => lock
+)
+
+// feedStateLock returns the lock which must be held while updating and persisting a service's feed
+// state. The poller and the WebSub webhook each update their own copy of the service.
+func feedStateLock(serviceID string) *sync.Mutex {
+	feedStateLocksMutex.Lock()
+	defer feedStateLocksMutex.Unlock()
+	lock := feedStateLocks[serviceID]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		feedStateLocks[serviceID] = lock
+	}
+	return lock
+}
+
+// reloadFeedState replaces the state which Go-NEB keeps for each feed with the stored state, so
+// that changes persisted by another copy of the service aren't overwritten. The feed config is
+// left alone. It must be called with the feed state lock held.
+func (s *Service) reloadFeedState() {
+	srv, err := database.GetServiceDB().LoadService(s.ServiceID())
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to reload feed state")
+		return
+	}
+	stored, ok := srv.(*Service)
+	if !ok {
+		return
+	}
+	for feedURL, f := range s.Feeds {
+		sf, ok := stored.Feeds[feedURL]
+		if !ok {
+			continue
+		}
+		f.IsFailing = sf.IsFailing
+		f.FeedUpdatedTimestampSecs = sf.FeedUpdatedTimestampSecs
+		f.NextPollTimestampSecs = sf.NextPollTimestampSecs
+		f.RecentGUIDs = sf.RecentGUIDs
+		f.WebSubHub = sf.WebSubHub
+		f.WebSubLeaseExpiresTimestampSecs = sf.WebSubLeaseExpiresTimestampSecs
+		f.WebSubTopic = sf.WebSubTopic
+		f.WebSubSecret = sf.WebSubSecret
+		f.WebSubRetryTimestampSecs = sf.WebSubRetryTimestampSecs
+		s.Feeds[feedURL] = f
+	}
 }
 
 func incrementMetrics(urlStr string, err error) {
@@ -260,11 +355,10 @@ func (s *Service) nextTimestamp() time.Time {
 	return time.Unix(earliestNextTs, 0)
 }
 
-// Query the given feed, update relevant timestamps and return NEW items
-func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error) {
-	log.WithField("feed_url", feedURL).Info("Querying feed")
+// updateFeed updates the feed's state and relevant timestamps from the result of reading it, and
+// returns the NEW items.
+func (s *Service) updateFeed(feedURL string, feed *gofeed.Feed, links hubLinks, err error) ([]gofeed.Item, error) {
 	var items []gofeed.Item
-	feed, err := readFeed(feedURL)
 	// check for no items in addition to any returned errors as it appears some RSS feeds
 	// do not consistently return items.
 	if err == nil && len(feed.Items) == 0 {
@@ -275,12 +369,16 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 		f := s.Feeds[feedURL]
 		f.IsFailing = true
 		s.Feeds[feedURL] = f
-		return nil, items, err
+		return items, err
 	}
 
 	// Patch up the item list: make sure each item has a GUID.
 	ensureItemsHaveGUIDs(feed)
 
+	if s.canUseWebSub() {
+		s.updateHub(feedURL, links)
+	}
+
 	// Work out which items are new, if any (based on the last updated TS we have)
 	// If the TS is 0 then this is the first ever poll, so let's not send 10s of events
 	// into the room and just do new ones from this point onwards.
@@ -297,7 +395,24 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 	}
 	// TODO: Handle the 'sy' Syndication extension to control update interval.
 	// See http://www.feedforall.com/syndication.htm and http://web.resource.org/rss/1.0/modules/syndication/
+	if s.isPushed(feedURL, now) && nextPollTsSec < now+websubFallbackPollSecs {
+		nextPollTsSec = now + websubFallbackPollSecs
+	}
+
+	s.rememberGUIDs(feedURL, feed)
 
+	// Update the service config to persist the new times
+	f := s.Feeds[feedURL]
+	f.NextPollTimestampSecs = nextPollTsSec
+	f.FeedUpdatedTimestampSecs = now
+	f.IsFailing = false
+	s.Feeds[feedURL] = f
+
+	return items, nil
+}
+
+// rememberGUIDs adds the GUIDs of the items in the feed to the feed's recent GUIDs.
+func (s *Service) rememberGUIDs(feedURL string, feed *gofeed.Feed) {
 	// Work out which GUIDs to remember. We don't want to remember every GUID ever as that leads to completely
 	// unbounded growth of data.
 	f := s.Feeds[feedURL]
@@ -322,14 +437,8 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 		guids = guids[0:maxGuids]
 	}
 
-	// Update the service config to persist the new times
-	f.NextPollTimestampSecs = nextPollTsSec
-	f.FeedUpdatedTimestampSecs = now
 	f.RecentGUIDs = guids
-	f.IsFailing = false
 	s.Feeds[feedURL] = f
-
-	return feed, items, nil
 }
 
 // containsAny takes a string and an array of words and returns whether any of the words
@@ -414,7 +523,7 @@ func (s *Service) sendToRooms(cli *gomatrix.Client, feedURL string, feed *gofeed
 	})
 	logger.Info("Sending new feed item")
 	for _, roomID := range s.Feeds[feedURL].Rooms {
-		if _, err := cli.SendMessageEvent(roomID, "m.room.message", itemToHTML(feed, item)); err != nil {
+		if err := notify.Send(cli, roomID, itemToHTML(feed, item), false); err != nil {
 			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send to room")
 		}
 	}
@@ -507,7 +616,8 @@ func (rt userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 	return rt.Transport.RoundTrip(req)
 }
 
-func readFeed(feedURL string) (*gofeed.Feed, error) {
+// readFeed fetches and parses the feed, and finds any WebSub links it advertises.
+func readFeed(feedURL string) (*gofeed.Feed, hubLinks, error) {
 	// Don't use fp.ParseURL because it leaks on non-2xx responses as of 2016/11/29 (cac19c6c27)
 	fp := gofeed.NewParser()
 	resp, err := cachingClient.Get(feedURL)
@@ -515,16 +625,24 @@ func readFeed(feedURL string) (*gofeed.Feed, error) {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, err
+		return nil, hubLinks{}, err
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, gofeed.HTTPError{
+		return nil, hubLinks{}, gofeed.HTTPError{
 			StatusCode: resp.StatusCode,
 			Status:     resp.Status,
 		}
 	}
-	return fp.Parse(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, hubLinks{}, err
+	}
+	feed, err := fp.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, hubLinks{}, err
+	}
+	return feed, discoverHub(resp.Header, body), nil
 }
 
 func init() {
@@ -534,7 +652,8 @@ func init() {
 	}
 	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
 		r := &Service{
-			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
 		}
 		return r
 	})
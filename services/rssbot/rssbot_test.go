@@ -124,7 +124,8 @@ func TestFeedItemFiltering(t *testing.T) {
 	feed.MustInclude.Title = []string{"Zelda"}
 	rssbot.Feeds[feedURL] = feed
 
-	_, items, _ := rssbot.queryFeed(feedURL)
+	parsed, links, err := readFeed(feedURL)
+	items, _ := rssbot.updateFeed(feedURL, parsed, links, err)
 	// Expect that we get no items if we filter for 'Zelda' in title
 	if len(items) != 0 {
 		t.Errorf("Expected 0 items, got %v", items)
@@ -137,7 +138,8 @@ func TestFeedItemFiltering(t *testing.T) {
 	feed.MustInclude.Title = []string{"Majora"}
 	rssbot.Feeds[feedURL] = feed
 
-	_, items, _ = rssbot.queryFeed(feedURL)
+	parsed, links, err = readFeed(feedURL)
+	items, _ = rssbot.updateFeed(feedURL, parsed, links, err)
 	// Expect one item if we filter for 'Majora' in title
 	if len(items) != 1 {
 		t.Errorf("Expected 1 item, got %d", len(items))
@@ -150,7 +152,8 @@ func TestFeedItemFiltering(t *testing.T) {
 	feed.MustNotInclude.Author = []string{"kid"}
 	rssbot.Feeds[feedURL] = feed
 
-	_, items, _ = rssbot.queryFeed(feedURL)
+	parsed, links, err = readFeed(feedURL)
+	items, _ = rssbot.updateFeed(feedURL, parsed, links, err)
 	// 'kid' does not match an entire word in the author name, so it's not filtered
 	if len(items) != 1 {
 		t.Errorf("Expected 1 item, got %d", len(items))
@@ -163,7 +166,8 @@ func TestFeedItemFiltering(t *testing.T) {
 	feed.MustNotInclude.Author = []string{"Skullkid"}
 	rssbot.Feeds[feedURL] = feed
 
-	_, items, _ = rssbot.queryFeed(feedURL)
+	parsed, links, err = readFeed(feedURL)
+	items, _ = rssbot.updateFeed(feedURL, parsed, links, err)
 	// Expect no items if we filter for 'Skullkid' not in author name
 	if len(items) != 0 {
 		t.Errorf("Expected 0 items, got %v", items)
@@ -0,0 +1,407 @@
+package rssbot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/gomatrix"
+	"github.com/mmcdole/gofeed"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The lease we ask hubs for. Hubs may grant a different lease.
+	websubLeaseSecs = 7 * 24 * 60 * 60
+	// How long before a lease expires to renew it.
+	websubRenewBeforeSecs = 24 * 60 * 60
+	// How long to wait before trying a hub again after it fails.
+	websubRetrySecs = 60 * 60
+	// How often to poll feeds which are pushed to us, in case a push is missed.
+	websubFallbackPollSecs = 6 * 60 * 60
+	// The largest pushed feed we will read.
+	maxPushBytes = 10 * 1024 * 1024
+)
+
+var websubClient = &http.Client{Timeout: 30 * time.Second}
+
+// hubLinks are the WebSub links a feed advertises.
+type hubLinks struct {
+	hub  string
+	self string
+}
+
+// discoverHub finds the WebSub hub and topic URLs of a feed from its Link headers or, failing
+// that, from <link rel="hub"> and <link rel="self"> elements in the feed.
+func discoverHub(header http.Header, body []byte) (links hubLinks) {
+	for _, value := range header["Link"] {
+		for _, part := range strings.Split(value, ",") {
+			segs := strings.Split(part, ";")
+			target := strings.TrimSpace(segs[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+			for _, param := range segs[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" {
+					continue
+				}
+				links.add(strings.Trim(kv[1], `"`), target)
+			}
+		}
+	}
+	if links.hub != "" && links.self != "" {
+		return
+	}
+
+	var fromBody hubLinks
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "link" {
+			continue
+		}
+		var rel, href string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "rel":
+				rel = attr.Value
+			case "href":
+				href = attr.Value
+			}
+		}
+		if href != "" {
+			fromBody.add(rel, href)
+		}
+	}
+	if links.hub == "" {
+		links.hub = fromBody.hub
+	}
+	if links.self == "" {
+		links.self = fromBody.self
+	}
+	return
+}
+
+func (links *hubLinks) add(rel, href string) {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == "hub" && links.hub == "" {
+			links.hub = href
+		} else if r == "self" && links.self == "" {
+			links.self = href
+		}
+	}
+}
+
+// callbackURL is the URL the hub sends verification requests and content for the feed to.
+func (s *Service) callbackURL(feedURL string) string {
+	return s.webhookEndpointURL + "?feed=" + url.QueryEscape(feedURL)
+}
+
+// canUseWebSub returns true if hubs can reach this service. Go-NEB's base URL must be absolute
+// for hubs to be able to call back.
+func (s *Service) canUseWebSub() bool {
+	if s.DisableWebSub {
+		return false
+	}
+	u, err := url.Parse(s.webhookEndpointURL)
+	return err == nil && u.IsAbs()
+}
+
+// isPushed returns true if the feed has a WebSub subscription which hasn't expired.
+func (s *Service) isPushed(feedURL string, now int64) bool {
+	f := s.Feeds[feedURL]
+	return f.WebSubHub != "" && f.WebSubLeaseExpiresTimestampSecs > now
+}
+
+// updateHub records the hub a feed advertises. A new hub means a new subscription.
+func (s *Service) updateHub(feedURL string, links hubLinks) {
+	f := s.Feeds[feedURL]
+	topic := links.self
+	if topic == "" {
+		topic = feedURL
+	}
+	if links.hub == f.WebSubHub && topic == f.WebSubTopic {
+		return
+	}
+	f.WebSubHub = links.hub
+	f.WebSubTopic = topic
+	f.WebSubLeaseExpiresTimestampSecs = 0
+	f.WebSubRetryTimestampSecs = 0
+	if links.hub != "" && f.WebSubSecret == "" {
+		// The secret is persisted with the rest of the feed before we subscribe, as hubs may verify
+		// the subscription before replying to the subscription request.
+		f.WebSubSecret = randomSecret()
+	}
+	s.Feeds[feedURL] = f
+}
+
+func randomSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// renewSubscriptions subscribes to the hubs of feeds which aren't subscribed yet or whose lease
+// is about to expire, and persists the updated feeds.
+func (s *Service) renewSubscriptions() {
+	if !s.canUseWebSub() {
+		return
+	}
+	now := time.Now().Unix()
+	lock := feedStateLock(s.ServiceID())
+
+	// Assume we'll be granted the lease we ask for. The hub tells us the real lease when it
+	// verifies the subscription, which may happen before it replies to the subscription request,
+	// so the lock isn't held while subscribing.
+	lock.Lock()
+	s.reloadFeedState()
+	leases := make(map[string]int64) // feed URL => lease before subscribing
+	for feedURL, f := range s.Feeds {
+		if f.WebSubHub == "" || f.WebSubSecret == "" || now < f.WebSubRetryTimestampSecs {
+			continue
+		}
+		if f.WebSubLeaseExpiresTimestampSecs-websubRenewBeforeSecs > now {
+			continue
+		}
+		leases[feedURL] = f.WebSubLeaseExpiresTimestampSecs
+		f.WebSubLeaseExpiresTimestampSecs = now + websubLeaseSecs
+		f.WebSubRetryTimestampSecs = 0
+		s.Feeds[feedURL] = f
+	}
+	if len(leases) > 0 {
+		s.storeFeeds("Failed to persist WebSub subscriptions")
+	}
+	lock.Unlock()
+
+	failed := make(map[string]bool)
+	for feedURL := range leases {
+		f := s.Feeds[feedURL]
+		logger := log.WithFields(log.Fields{
+			"feed_url": feedURL,
+			"hub":      f.WebSubHub,
+		})
+		if err := s.requestSubscription(f.WebSubHub, f.WebSubTopic, feedURL, "subscribe", f.WebSubSecret); err != nil {
+			logger.WithError(err).Warn("Failed to subscribe to WebSub hub")
+			failed[feedURL] = true
+		} else {
+			logger.Info("Subscribed to WebSub hub")
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	s.reloadFeedState()
+	for feedURL := range failed {
+		// Fall back to polling until we try again
+		f := s.Feeds[feedURL]
+		if f.WebSubLeaseExpiresTimestampSecs == now+websubLeaseSecs {
+			f.WebSubLeaseExpiresTimestampSecs = leases[feedURL]
+		}
+		f.WebSubRetryTimestampSecs = now + websubRetrySecs
+		s.Feeds[feedURL] = f
+	}
+	s.storeFeeds("Failed to persist WebSub subscription failures")
+}
+
+func (s *Service) storeFeeds(failureMsg string) {
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error(failureMsg)
+	}
+}
+
+// requestSubscription sends a subscribe or unsubscribe request to a hub.
+func (s *Service) requestSubscription(hub, topic, feedURL, mode, secret string) error {
+	form := url.Values{
+		"hub.mode":     {mode},
+		"hub.topic":    {topic},
+		"hub.callback": {s.callbackURL(feedURL)},
+	}
+	if mode == "subscribe" {
+		form.Set("hub.secret", secret)
+		form.Set("hub.lease_seconds", strconv.Itoa(websubLeaseSecs))
+	}
+	res, err := websubClient.PostForm(hub, form)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("hub returned %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// unsubscribeRemoved unsubscribes from the hubs of feeds which were in the old service but aren't
+// in this one.
+func (s *Service) unsubscribeRemoved(old *Service) {
+	now := time.Now().Unix()
+	for feedURL, f := range old.Feeds {
+		if _, ok := s.Feeds[feedURL]; ok || !old.isPushed(feedURL, now) {
+			continue
+		}
+		if err := s.requestSubscription(f.WebSubHub, f.WebSubTopic, feedURL, "unsubscribe", ""); err != nil {
+			log.WithError(err).WithField("feed_url", feedURL).Warn("Failed to unsubscribe from WebSub hub")
+		}
+	}
+}
+
+// OnReceiveWebhook handles WebSub verification requests and content pushed by hubs.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	feedURL := req.URL.Query().Get("feed")
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"feed_url":   feedURL,
+	})
+	// The poller updates the feeds too, so hold the lock and start from the stored state
+	lock := feedStateLock(s.ServiceID())
+	lock.Lock()
+	defer lock.Unlock()
+	s.reloadFeedState()
+
+	switch req.Method {
+	case "GET":
+		s.onVerification(w, req, feedURL, logger)
+	case "POST":
+		// Hubs retry if they don't get a 2xx, so acknowledge content even if we ignore it.
+		w.WriteHeader(200)
+		s.onPush(cli, req, feedURL, logger)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Service) onVerification(w http.ResponseWriter, req *http.Request, feedURL string, logger *log.Entry) {
+	query := req.URL.Query()
+	mode := query.Get("hub.mode")
+	f, ok := s.Feeds[feedURL]
+	switch mode {
+	case "subscribe":
+		if !ok || f.WebSubHub == "" || query.Get("hub.topic") != f.WebSubTopic {
+			logger.WithField("topic", query.Get("hub.topic")).Warn("Refusing unexpected WebSub subscription")
+			w.WriteHeader(404)
+			return
+		}
+		if lease, err := strconv.ParseInt(query.Get("hub.lease_seconds"), 10, 64); err == nil && lease > 0 {
+			f.WebSubLeaseExpiresTimestampSecs = time.Now().Unix() + lease
+			s.Feeds[feedURL] = f
+			if _, err := database.GetServiceDB().StoreService(s); err != nil {
+				logger.WithError(err).Error("Failed to persist WebSub lease")
+			}
+		}
+	case "unsubscribe":
+		// We only unsubscribe from feeds which have been removed
+		if ok {
+			w.WriteHeader(404)
+			return
+		}
+	case "denied":
+		logger.WithField("reason", query.Get("hub.reason")).Warn("WebSub hub denied subscription")
+		if ok {
+			f.WebSubLeaseExpiresTimestampSecs = 0
+			f.WebSubRetryTimestampSecs = time.Now().Unix() + websubRetrySecs
+			s.Feeds[feedURL] = f
+			if _, err := database.GetServiceDB().StoreService(s); err != nil {
+				logger.WithError(err).Error("Failed to persist WebSub denial")
+			}
+		}
+		w.WriteHeader(200)
+		return
+	default:
+		w.WriteHeader(400)
+		return
+	}
+	logger.WithField("mode", mode).Info("Verified WebSub request")
+	w.WriteHeader(200)
+	w.Write([]byte(query.Get("hub.challenge")))
+}
+
+func (s *Service) onPush(cli *gomatrix.Client, req *http.Request, feedURL string, logger *log.Entry) {
+	f, ok := s.Feeds[feedURL]
+	if !ok || f.WebSubSecret == "" {
+		logger.Warn("Ignoring WebSub content for a feed without a subscription")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxPushBytes))
+	if err != nil {
+		logger.WithError(err).Error("Failed to read WebSub content")
+		return
+	}
+	if !verifySignature(f.WebSubSecret, req.Header.Get("X-Hub-Signature"), body) {
+		logger.Warn("Ignoring WebSub content with a bad signature")
+		return
+	}
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to parse WebSub content")
+		return
+	}
+	ensureItemsHaveGUIDs(feed)
+	items := s.newItems(feedURL, feed.Items)
+	s.rememberGUIDs(feedURL, feed)
+	f = s.Feeds[feedURL]
+	f.FeedUpdatedTimestampSecs = time.Now().Unix()
+	s.Feeds[feedURL] = f
+	logger.WithField("new_items", len(items)).Info("Sending pushed items")
+	for i := len(items) - 1; i >= 0; i-- {
+		s.sendToRooms(cli, feedURL, feed, items[i])
+	}
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		logger.WithError(err).Error("Failed to persist pushed items for service")
+	}
+}
+
+// verifySignature checks an X-Hub-Signature header of the form "method=signature".
+func verifySignature(secret, header string, body []byte) bool {
+	segs := strings.SplitN(header, "=", 2)
+	if len(segs) != 2 {
+		return false
+	}
+	var h func() hash.Hash
+	switch segs[0] {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return false
+	}
+	sig, err := hex.DecodeString(segs[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
@@ -0,0 +1,346 @@
+package rssbot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+const atomFeedXML = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Mask Shop</title>
+	<link rel="hub" href="HUB_URL"/>
+	<link rel="self" href="https://thehappymaskshop.hyrule/atom"/>
+	<link href="https://thehappymaskshop.hyrule/"/>
+	<entry>
+		<title>ENTRY_TITLE</title>
+		<link href="https://thehappymaskshop.hyrule/ENTRY_ID"/>
+		<id>ENTRY_ID</id>
+		<updated>2026-03-10T12:00:00Z</updated>
+	</entry>
+</feed>`
+
+func atomFeed(hubURL, entryID, title string) string {
+	return strings.NewReplacer("HUB_URL", hubURL, "ENTRY_ID", entryID, "ENTRY_TITLE", title).Replace(atomFeedXML)
+}
+
+func TestDiscoverHub(t *testing.T) {
+	links := discoverHub(http.Header{}, []byte(atomFeed("https://hub.hyrule/", "1", "Mask")))
+	if links.hub != "https://hub.hyrule/" || links.self != "https://thehappymaskshop.hyrule/atom" {
+		t.Errorf("Unexpected links from feed: %+v", links)
+	}
+
+	header := http.Header{}
+	header.Add("Link", `<https://other-hub.hyrule/>; rel="hub", <https://thehappymaskshop.hyrule/feed>; rel="self"`)
+	links = discoverHub(header, []byte(atomFeed("https://hub.hyrule/", "1", "Mask")))
+	if links.hub != "https://other-hub.hyrule/" || links.self != "https://thehappymaskshop.hyrule/feed" {
+		t.Errorf("Expected Link headers to take precedence, got %+v", links)
+	}
+
+	// An RSS <link> has no href and must not be mistaken for a hub
+	if links := discoverHub(http.Header{}, []byte(rssFeedXML)); links.hub != "" {
+		t.Errorf("Expected no hub for an RSS feed without one, got %+v", links)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte("hello")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+	if !verifySignature("secret", "sha256="+sig, body) {
+		t.Errorf("Expected a valid signature to verify")
+	}
+	for _, header := range []string{"", "sha256=" + sig[2:], "md5=" + sig, "sha256=zz"} {
+		if verifySignature("secret", header, body) {
+			t.Errorf("Expected signature %q not to verify", header)
+		}
+	}
+	if verifySignature("other", "sha256="+sig, body) {
+		t.Errorf("Expected a signature with the wrong secret not to verify")
+	}
+}
+
+func TestWebSub(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	feedURL := "https://thehappymaskshop.hyrule/atom"
+
+	var subscriptions []url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		subscriptions = append(subscriptions, r.PostForm)
+		w.WriteHeader(202)
+	}))
+	defer hub.Close()
+
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != feedURL {
+			return nil, errors.New("Unknown test URL")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(atomFeed(hub.URL, "1", "Mask of Truth"))),
+		}, nil
+	})}
+
+	var sent []string
+	matrixClient, _ := gomatrix.NewClient("https://hyrule", "@happy_mask_salesman:hyrule", "its_a_secret")
+	matrixClient.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$123456:hyrule"}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", "rssbot", "@happy_mask_salesman:hyrule", []byte(
+		`{"feeds": {"`+feedURL+`":{"rooms":["!linksroom:hyrule"]}}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rssbot := srv.(*Service)
+	rssbot.webhookEndpointURL = "https://neb.hyrule/services/hooks/aWQ"
+
+	// The first poll discovers the hub and subscribes
+	rssbot.OnPoll(matrixClient)
+	if len(subscriptions) != 1 {
+		t.Fatalf("Expected 1 subscription request, got %v", subscriptions)
+	}
+	sub := subscriptions[0]
+	f := rssbot.Feeds[feedURL]
+	if sub.Get("hub.mode") != "subscribe" || sub.Get("hub.topic") != feedURL ||
+		sub.Get("hub.callback") != rssbot.callbackURL(feedURL) || sub.Get("hub.secret") != f.WebSubSecret {
+		t.Errorf("Unexpected subscription request: %v", sub)
+	}
+	if f.WebSubSecret == "" || !rssbot.isPushed(feedURL, time.Now().Unix()) {
+		t.Fatalf("Expected the feed to be subscribed, got %+v", f)
+	}
+
+	// Verification of our subscription
+	verify := func(topic string) *httptest.ResponseRecorder {
+		q := url.Values{
+			"feed":              {feedURL},
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {topic},
+			"hub.challenge":     {"c4ll3ng3"},
+			"hub.lease_seconds": {"3600"},
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "https://neb.hyrule/services/hooks/aWQ?"+q.Encode(), nil)
+		rssbot.OnReceiveWebhook(w, req, matrixClient)
+		return w
+	}
+	if w := verify(feedURL); w.Code != 200 || w.Body.String() != "c4ll3ng3" {
+		t.Errorf("Expected the challenge to be echoed, got %d %s", w.Code, w.Body.String())
+	}
+	if lease := rssbot.Feeds[feedURL].WebSubLeaseExpiresTimestampSecs - time.Now().Unix(); lease < 3590 || lease > 3600 {
+		t.Errorf("Expected the lease granted by the hub to be used, got %d", lease)
+	}
+	if w := verify("https://evil.hyrule/"); w.Code != 404 {
+		t.Errorf("Expected an unexpected topic to be refused, got %d", w.Code)
+	}
+
+	// The lease is due for renewal
+	rssbot.renewSubscriptions()
+	if len(subscriptions) != 2 {
+		t.Errorf("Expected the subscription to be renewed, got %v", subscriptions)
+	}
+
+	push := func(body string, secret string) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		req, _ := http.NewRequest("POST", rssbot.callbackURL(feedURL), strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		w := httptest.NewRecorder()
+		rssbot.OnReceiveWebhook(w, req, matrixClient)
+		if w.Code != 200 {
+			t.Errorf("Expected pushes to be acknowledged, got %d", w.Code)
+		}
+	}
+	push(atomFeed(hub.URL, "2", "Bunny Hood"), "wrong secret")
+	if len(sent) != 0 {
+		t.Fatalf("Expected content with a bad signature to be ignored, got %v", sent)
+	}
+	push(atomFeed(hub.URL, "2", "Bunny Hood"), f.WebSubSecret)
+	if len(sent) != 1 || !strings.Contains(sent[0], "Bunny Hood") {
+		t.Fatalf("Expected the pushed item to be sent, got %v", sent)
+	}
+	// Items are only sent once, whether they are pushed or polled
+	push(atomFeed(hub.URL, "2", "Bunny Hood"), f.WebSubSecret)
+	if len(sent) != 1 {
+		t.Errorf("Expected the pushed item not to be sent again, got %v", sent)
+	}
+}
+
+func TestWebSubFallback(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	feedURL := "https://thehappymaskshop.hyrule/atom"
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer hub.Close()
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(atomFeed(hub.URL, "1", "Mask of Truth"))),
+		}, nil
+	})}
+	srv, _ := types.CreateService("id", "rssbot", "@happy_mask_salesman:hyrule", []byte(
+		`{"feeds": {"`+feedURL+`":{"rooms":["!linksroom:hyrule"]}}}`,
+	))
+	rssbot := srv.(*Service)
+	rssbot.webhookEndpointURL = "https://neb.hyrule/services/hooks/aWQ"
+	matrixClient, _ := gomatrix.NewClient("https://hyrule", "@happy_mask_salesman:hyrule", "its_a_secret")
+
+	next := rssbot.OnPoll(matrixClient)
+	f := rssbot.Feeds[feedURL]
+	if rssbot.isPushed(feedURL, time.Now().Unix()) || f.WebSubRetryTimestampSecs == 0 {
+		t.Fatalf("Expected the failed subscription to be retried later, got %+v", f)
+	}
+	if next.Sub(time.Now()) > minPollingIntervalSeconds*time.Second {
+		t.Errorf("Expected the feed to be polled as normal, next poll at %v", next)
+	}
+}
+
+// serviceStore keeps services as JSON, like the real database.
+type serviceStore struct {
+	database.NopStorage
+	services map[string][]byte
+}
+
+func (s *serviceStore) StoreService(service types.Service) (types.Service, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+	s.services[service.ServiceID()] = b
+	return nil, nil
+}
+
+func (s *serviceStore) LoadService(serviceID string) (types.Service, error) {
+	b, ok := s.services[serviceID]
+	if !ok {
+		return nil, nil
+	}
+	return types.CreateService(serviceID, ServiceType, "@happy_mask_salesman:hyrule", b)
+}
+
+func TestWebSubPushThenPoll(t *testing.T) {
+	store := &serviceStore{services: make(map[string][]byte)}
+	database.SetServiceDB(store)
+	feedURL := "https://thehappymaskshop.hyrule/atom"
+
+	// Webhooks are handled by a copy of the service loaded from the database, not the poller's copy
+	webhook := func(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+		srv, err := store.LoadService("id")
+		if err != nil || srv == nil {
+			t.Fatalf("Failed to load service: %v", err)
+		}
+		srv.(*Service).OnReceiveWebhook(w, req, cli)
+	}
+
+	var matrixClient *gomatrix.Client
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify the subscription before replying, granting a shorter lease than we asked for
+		r.ParseForm()
+		q := url.Values{
+			"feed":              {feedURL},
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {r.PostForm.Get("hub.topic")},
+			"hub.challenge":     {"c4ll3ng3"},
+			"hub.lease_seconds": {"3600"},
+		}
+		req, _ := http.NewRequest("GET", "https://neb.hyrule/services/hooks/aWQ?"+q.Encode(), nil)
+		webhook(httptest.NewRecorder(), req, matrixClient)
+		w.WriteHeader(202)
+	}))
+	defer hub.Close()
+
+	entryID, entryTitle := "1", "Mask of Truth"
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(atomFeed(hub.URL, entryID, entryTitle))),
+		}, nil
+	})}
+
+	var sent []string
+	matrixClient, _ = gomatrix.NewClient("https://hyrule", "@happy_mask_salesman:hyrule", "its_a_secret")
+	matrixClient.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$123456:hyrule"}`)),
+		}, nil
+	})}
+
+	srv, err := types.CreateService("id", "rssbot", "@happy_mask_salesman:hyrule", []byte(
+		`{"feeds": {"`+feedURL+`":{"rooms":["!linksroom:hyrule"]}}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rssbot := srv.(*Service)
+	rssbot.webhookEndpointURL = "https://neb.hyrule/services/hooks/aWQ"
+	store.StoreService(rssbot)
+
+	// The first poll subscribes, and the hub verifies the subscription before replying
+	rssbot.OnPoll(matrixClient)
+	stored, _ := store.LoadService("id")
+	if lease := stored.(*Service).Feeds[feedURL].WebSubLeaseExpiresTimestampSecs - time.Now().Unix(); lease < 3590 || lease > 3600 {
+		t.Fatalf("Expected the lease granted by the hub to be stored, got %d", lease)
+	}
+
+	// A new item is pushed
+	entryID, entryTitle = "2", "Bunny Hood"
+	body := atomFeed(hub.URL, entryID, entryTitle)
+	mac := hmac.New(sha256.New, []byte(stored.(*Service).Feeds[feedURL].WebSubSecret))
+	mac.Write([]byte(body))
+	req, _ := http.NewRequest("POST", rssbot.callbackURL(feedURL), strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	webhook(httptest.NewRecorder(), req, matrixClient)
+	if len(sent) != 1 || !strings.Contains(sent[0], "Bunny Hood") {
+		t.Fatalf("Expected the pushed item to be sent, got %v", sent)
+	}
+
+	// The poller's copy of the service hasn't seen the push, and polls the fallback
+	f := rssbot.Feeds[feedURL]
+	f.NextPollTimestampSecs = 0
+	rssbot.Feeds[feedURL] = f
+	rssbot.OnPoll(matrixClient)
+	if len(sent) != 1 {
+		t.Errorf("Expected the pushed item not to be sent again, got %v", sent)
+	}
+	stored, _ = store.LoadService("id")
+	f = stored.(*Service).Feeds[feedURL]
+	if len(f.RecentGUIDs) != 2 || f.RecentGUIDs[0] != "2" {
+		t.Errorf("Expected the pushed item to be remembered, got %v", f.RecentGUIDs)
+	}
+	if lease := f.WebSubLeaseExpiresTimestampSecs - time.Now().Unix(); lease < 3590 || lease > 3600 {
+		t.Errorf("Expected the lease granted by the hub to be kept, got %d", lease)
+	}
+}
@@ -0,0 +1,379 @@
+// Package search implements a Service which lets users search the history of Matrix rooms.
+package search
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Search service
+const ServiceType = "search"
+
+const (
+	dateLayout           = "2006-01-02"
+	retentionInterval    = 1 * time.Hour
+	defaultRetentionDays = 90
+	maxResults           = 10
+	maxBodyLength        = 200
+)
+
+// Service contains the Config fields for the Search service.
+//
+// This service indexes the text messages it sees in rooms which have opted in, so that users can
+// search them with:
+//    !search <terms> [from:@user:server] [before:YYYY-MM-DD] [after:YYYY-MM-DD]
+// Only the room the command is sent in is searched. Messages must contain all of the terms, and the
+// newest matches are returned with links to them. Rooms whose history visibility is "invited" or
+// "joined" can't be searched, since the results would show members messages from before they
+// joined. Edits update the index, and messages which are redacted, or edited into ones which
+// wouldn't be indexed, are removed from it. Messages are only indexed from when the service is set
+// up: history from before then isn't back-filled.
+//
+// The index is kept in Go-NEB's database. With SQLite it uses FTS5 if go-sqlite3 was built with
+// the "sqlite_fts5" tag, and FTS4 otherwise. With PostgreSQL it uses a tsvector column.
+//
+// Example JSON request:
+//   {
+//       "rooms": ["!ewfug483gsfe:localhost", "!abvgt843sfd:localhost"],
+//       "retention_days": 90
+//   }
+type Service struct {
+	types.DefaultService
+	// The rooms to index messages in. Removing a room deletes its messages from the index. This
+	// cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. How many days of messages to keep in the index. Defaults to 90.
+	RetentionDays int `json:"retention_days"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Rooms) == 0 {
+		// this is an error UNLESS the old service had some rooms in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Rooms) == 0 {
+			return errors.New("At least one room must be specified")
+		}
+		return nil
+	}
+	if s.RetentionDays < 0 {
+		return errors.New("retention_days cannot be negative")
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// PostRegister deletes the index of rooms which have been removed, and deletes this service if
+// there are no rooms remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	db := database.GetServiceDB()
+	if len(s.Rooms) == 0 {
+		logger.Info("Deleting service: No rooms remaining.")
+		polling.StopPolling(s)
+		if err := db.DeleteSearchMessages(s.ServiceID(), "", math.MaxInt64); err != nil {
+			logger.WithError(err).Error("Failed to delete search index")
+		}
+		if err := db.DeleteService(s.ServiceID()); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+		return
+	}
+	old, ok := oldService.(*Service)
+	if !ok {
+		return
+	}
+	for _, roomID := range old.Rooms {
+		if s.indexesRoom(roomID) {
+			continue
+		}
+		if err := db.DeleteSearchMessages(s.ServiceID(), roomID, math.MaxInt64); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to delete search index")
+		}
+	}
+}
+
+func (s *Service) indexesRoom(roomID string) bool {
+	for _, r := range s.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) retentionDays() int {
+	if s.RetentionDays == 0 {
+		return defaultRetentionDays
+	}
+	return s.RetentionDays
+}
+
+// OnReceiveEvent adds messages in the indexed rooms to the search index, and updates the index
+// when they are edited or redacted.
+func (s *Service) OnReceiveEvent(cli *gomatrix.Client, event *gomatrix.Event) {
+	if event.Sender == cli.UserID || !s.indexesRoom(event.RoomID) {
+		return
+	}
+	db := database.GetServiceDB()
+	var err error
+	switch event.Type {
+	case "m.room.message":
+		if eventID, newContent := replacement(event); eventID != "" {
+			if body, ok := indexableBody(newContent); ok {
+				err = db.UpdateSearchMessage(s.ServiceID(), eventID, event.Sender, body)
+			} else {
+				// The edit turned the message into one which wouldn't have been indexed
+				err = db.DeleteSearchMessage(s.ServiceID(), eventID, event.Sender)
+			}
+		} else if body, ok := indexableBody(event.Content); ok {
+			err = db.StoreSearchMessage(types.SearchMessage{
+				ServiceID: s.ServiceID(),
+				RoomID:    event.RoomID,
+				EventID:   event.ID,
+				Sender:    event.Sender,
+				Body:      body,
+				Timestamp: event.Timestamp,
+			})
+		}
+	case "m.room.redaction":
+		redacts := event.Redacts
+		if redacts == "" {
+			// Room version 11 moved this into the content
+			redacts, _ = event.Content["redacts"].(string)
+		}
+		if redacts != "" {
+			err = db.DeleteSearchMessage(s.ServiceID(), redacts, "")
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"room_id":    event.RoomID,
+			"event_id":   event.ID,
+		}).Error("Failed to update search index")
+	}
+}
+
+// indexableBody returns the body of a text message's content, without the quote of the message it
+// replies to. Commands aren't indexed.
+func indexableBody(content map[string]interface{}) (string, bool) {
+	switch msgtype, _ := content["msgtype"].(string); msgtype {
+	case "m.text", "m.notice", "m.emote":
+	default:
+		return "", false
+	}
+	body, _ := content["body"].(string)
+	body = matrix.StripReplyFallback(body)
+	if strings.TrimSpace(body) == "" || strings.HasPrefix(body, "!") {
+		return "", false
+	}
+	return body, true
+}
+
+// replacement returns the ID of the message which this event edits, and its new content.
+func replacement(event *gomatrix.Event) (eventID string, newContent map[string]interface{}) {
+	relatesTo, _ := event.Content["m.relates_to"].(map[string]interface{})
+	if relType, _ := relatesTo["rel_type"].(string); relType != "m.replace" {
+		return "", nil
+	}
+	eventID, _ = relatesTo["event_id"].(string)
+	newContent, _ = event.Content["m.new_content"].(map[string]interface{})
+	return eventID, newContent
+}
+
+// OnPoll deletes messages older than the retention period from the index.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -s.retentionDays())
+	if err := database.GetServiceDB().DeleteSearchMessages(s.ServiceID(), "", toMillis(cutoff)); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:   err,
+			"service_id":   s.ServiceID(),
+			"service_type": s.ServiceType(),
+		}).Error("Failed to delete old messages from search index")
+	}
+	return now.Add(retentionInterval)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Commands supported:
+//    !search <terms> [from:@user:server] [before:YYYY-MM-DD] [after:YYYY-MM-DD]
+// Responds with the newest messages in the room which contain all of the terms.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		types.Command{
+			Path: []string{"search"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return s.cmdSearch(cli, roomID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSearch(cli *gomatrix.Client, roomID string, args []string) (interface{}, error) {
+	if !s.indexesRoom(roomID) {
+		return nil, errors.New("Messages aren't being indexed in this room")
+	}
+	shared, err := sharedHistory(cli, roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to get history visibility")
+		return nil, errors.New("Failed to check who can see this room's history")
+	}
+	if !shared {
+		return nil, errors.New("Members of this room can't see messages from before they joined, so it can't be searched")
+	}
+	q, err := parseQuery(args)
+	if err != nil {
+		return nil, err
+	}
+	q.ServiceID = s.ServiceID()
+	q.RoomID = roomID
+	q.Limit = maxResults
+	messages, err := database.GetServiceDB().SearchMessages(q)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to search messages")
+		return nil, errors.New("Failed to search messages")
+	}
+	if len(messages) == 0 {
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "No messages found"}, nil
+	}
+	return results(messages), nil
+}
+
+// sharedHistory returns whether the room's history visibility lets its members see messages from
+// before they joined. Rooms without a history visibility are shared.
+func sharedHistory(cli *gomatrix.Client, roomID string) (bool, error) {
+	var content struct {
+		HistoryVisibility string `json:"history_visibility"`
+	}
+	err := cli.StateEvent(roomID, "m.room.history_visibility", "", &content)
+	if httpErr, ok := err.(gomatrix.HTTPError); ok {
+		if respErr, ok := httpErr.WrappedError.(gomatrix.RespError); ok && respErr.ErrCode == "M_NOT_FOUND" {
+			return true, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	switch content.HistoryVisibility {
+	case "", "shared", "world_readable":
+		return true, nil
+	}
+	return false, nil
+}
+
+// parseQuery parses the arguments to !search.
+func parseQuery(args []string) (q types.SearchQuery, err error) {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "from:"):
+			q.Sender = strings.TrimPrefix(arg, "from:")
+			if !strings.HasPrefix(q.Sender, "@") {
+				return q, fmt.Errorf("'%s' is not a user ID such as @alice:example.com", q.Sender)
+			}
+		case strings.HasPrefix(arg, "before:"):
+			day, err := parseDate(strings.TrimPrefix(arg, "before:"))
+			if err != nil {
+				return q, err
+			}
+			q.Before = toMillis(day)
+		case strings.HasPrefix(arg, "after:"):
+			day, err := parseDate(strings.TrimPrefix(arg, "after:"))
+			if err != nil {
+				return q, err
+			}
+			// Like before:, the date itself isn't included
+			q.After = toMillis(day.AddDate(0, 0, 1))
+		default:
+			if term := strings.TrimSpace(strings.Replace(arg, `"`, "", -1)); term != "" {
+				q.Terms = append(q.Terms, term)
+			}
+		}
+	}
+	if len(q.Terms) == 0 {
+		return q, errors.New("Usage: !search <terms> [from:@user:server] [before:YYYY-MM-DD] [after:YYYY-MM-DD]")
+	}
+	return q, nil
+}
+
+func parseDate(date string) (time.Time, error) {
+	day, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return day, fmt.Errorf("'%s' is not a date such as 2024-01-31", date)
+	}
+	return day, nil
+}
+
+// results renders search results as a HTML message.
+func results(messages []types.SearchMessage) gomatrix.HTMLMessage {
+	var plain, formatted bytes.Buffer
+	heading := fmt.Sprintf("Found %d messages:", len(messages))
+	if len(messages) == 1 {
+		heading = "Found 1 message:"
+	} else if len(messages) == maxResults {
+		heading = fmt.Sprintf("The newest %d messages:", maxResults)
+	}
+	plain.WriteString(heading + "\n")
+	formatted.WriteString(html.EscapeString(heading) + "<ol>")
+	for _, m := range messages {
+		sent := time.Unix(0, m.Timestamp*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04")
+		body := truncate(strings.Join(strings.Fields(m.Body), " "))
+		link := matrix.Permalink(m.RoomID, m.EventID)
+		plain.WriteString(fmt.Sprintf(" - %s (%s): %s %s\n", m.Sender, sent, body, link))
+		formatted.WriteString(fmt.Sprintf(
+			`<li><strong>%s</strong> (<a href="%s">%s</a>): %s</li>`,
+			html.EscapeString(m.Sender), html.EscapeString(link), sent, html.EscapeString(body),
+		))
+	}
+	formatted.WriteString("</ol>")
+	return gomatrix.HTMLMessage{
+		Body:          strings.TrimSpace(plain.String()),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted.String(),
+	}
+}
+
+func truncate(body string) string {
+	runes := []rune(body)
+	if len(runes) <= maxBodyLength {
+		return body
+	}
+	return string(runes[:maxBodyLength]) + "..."
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package search
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// indexStore keeps the search index in memory.
+type indexStore struct {
+	database.NopStorage
+	messages map[string]types.SearchMessage // keyed by event ID
+}
+
+func (s *indexStore) StoreSearchMessage(m types.SearchMessage) error {
+	s.messages[m.EventID] = m
+	return nil
+}
+
+func (s *indexStore) UpdateSearchMessage(serviceID, eventID, sender, body string) error {
+	if m, ok := s.messages[eventID]; ok && m.Sender == sender {
+		m.Body = body
+		s.messages[eventID] = m
+	}
+	return nil
+}
+
+func (s *indexStore) DeleteSearchMessage(serviceID, eventID, sender string) error {
+	if m, ok := s.messages[eventID]; ok && (sender == "" || m.Sender == sender) {
+		delete(s.messages, eventID)
+	}
+	return nil
+}
+
+func (s *indexStore) DeleteSearchMessages(serviceID, roomID string, beforeMs int64) error {
+	for id, m := range s.messages {
+		if (roomID == "" || m.RoomID == roomID) && m.Timestamp < beforeMs {
+			delete(s.messages, id)
+		}
+	}
+	return nil
+}
+
+func (s *indexStore) SearchMessages(q types.SearchQuery) ([]types.SearchMessage, error) {
+	var res []types.SearchMessage
+	for _, m := range s.messages {
+		if m.RoomID != q.RoomID || (q.Sender != "" && m.Sender != q.Sender) || m.Timestamp < q.After ||
+			(q.Before != 0 && m.Timestamp >= q.Before) {
+			continue
+		}
+		matches := true
+		for _, t := range q.Terms {
+			matches = matches && strings.Contains(strings.ToLower(m.Body), strings.ToLower(t))
+		}
+		if matches {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Timestamp > res[j].Timestamp })
+	return res, nil
+}
+
+func msg(id, sender string, ts time.Time, content map[string]interface{}) *gomatrix.Event {
+	return &gomatrix.Event{
+		Type:      "m.room.message",
+		ID:        id,
+		Sender:    sender,
+		RoomID:    "!room:hyrule",
+		Timestamp: toMillis(ts),
+		Content:   content,
+	}
+}
+
+func text(body string) map[string]interface{} {
+	return map[string]interface{}{"msgtype": "m.text", "body": body}
+}
+
+func TestIndexAndSearch(t *testing.T) {
+	store := &indexStore{messages: make(map[string]types.SearchMessage)}
+	database.SetServiceDB(store)
+
+	srvc, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{"rooms":["!room:hyrule"]}`))
+	if err != nil {
+		t.Fatal("Failed to create search service: ", err)
+	}
+	s := srvc.(*Service)
+	// The room has no history visibility until it is set
+	visibility := ""
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/state/m.room.history_visibility") {
+			t.Fatalf("Unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+		if visibility == "" {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Event not found."}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"history_visibility":"` + visibility + `"}`)),
+		}, nil
+	})}
+
+	day1 := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	other := msg("$other", "@link:hyrule", day1, text("the master sword is in the lost woods"))
+	other.RoomID = "!untracked:hyrule"
+	events := []*gomatrix.Event{
+		msg("$1", "@link:hyrule", day1, text("the master sword is in the forest")),
+		msg("$2", "@zelda:hyrule", day2, text("I found the Master Sword")),
+		msg("$3", "@zelda:hyrule", day2, text("the sword is in the temple")),
+		msg("$4", "@navi:hyrule", day2, text("master sword")),  // the bot's own messages aren't indexed
+		msg("$5", "@link:hyrule", day2, text("!search sword")), // nor are commands
+		msg("$6", "@link:hyrule", day2, map[string]interface{}{ // nor images
+			"msgtype": "m.image", "body": "master-sword.png",
+		}),
+		other,
+		// Replies are indexed without the quote of the message they reply to
+		msg("$10", "@link:hyrule", day2, map[string]interface{}{
+			"msgtype":      "m.text",
+			"body":         "> <@ganon:hyrule> the temple is mine\n\nnever",
+			"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$0"}},
+		}),
+		// Link edits a message
+		msg("$7", "@link:hyrule", day2, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* the master sword is in the lost woods",
+			"m.new_content": text("the master sword is in the lost woods"),
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$1"},
+		}),
+		// Ganon can't edit Zelda's message
+		msg("$8", "@ganon:hyrule", day2, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* the master sword is mine",
+			"m.new_content": text("the master sword is mine"),
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$2"},
+		}),
+		// Link edits a message into a command, which removes it from the index
+		msg("$11", "@link:hyrule", day1, text("the sword is in the lake")),
+		msg("$12", "@link:hyrule", day2, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* !search lake",
+			"m.new_content": text("!search lake"),
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$11"},
+		}),
+		// Ganon can't remove Zelda's message by editing it into an image
+		msg("$13", "@ganon:hyrule", day2, map[string]interface{}{
+			"msgtype":       "m.image",
+			"body":          "* ganon.png",
+			"m.new_content": map[string]interface{}{"msgtype": "m.image", "body": "ganon.png"},
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": "$2"},
+		}),
+		// Zelda redacts a message
+		&gomatrix.Event{Type: "m.room.redaction", ID: "$9", Sender: "@zelda:hyrule", RoomID: "!room:hyrule", Redacts: "$3"},
+	}
+	for _, ev := range events {
+		s.OnReceiveEvent(cli, ev)
+	}
+	if len(store.messages) != 3 || store.messages["$10"].Body != "never" || store.messages["$1"].Body != "the master sword is in the lost woods" ||
+		store.messages["$2"].Body != "I found the Master Sword" {
+		t.Fatalf("Unexpected index: %+v", store.messages)
+	}
+
+	search := func(args ...string) string {
+		res, err := s.Commands(cli)[0].Command("!room:hyrule", "@link:hyrule", args)
+		if err != nil {
+			t.Fatalf("!search %s returned error: %s", strings.Join(args, " "), err)
+		}
+		if m, ok := res.(*gomatrix.TextMessage); ok {
+			return m.Body
+		}
+		return res.(gomatrix.HTMLMessage).Body
+	}
+	body := search("master", "sword")
+	for _, want := range []string{
+		"Found 2 messages:",
+		" - @zelda:hyrule (2026-03-10 12:00): I found the Master Sword https://matrix.to/#/%21room:hyrule/$2",
+		" - @link:hyrule (2026-03-09 12:00): the master sword is in the lost woods https://matrix.to/#/%21room:hyrule/$1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected results to contain %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Index(body, "$2") > strings.Index(body, "$1") {
+		t.Errorf("Expected the newest message first, got:\n%s", body)
+	}
+	if body = search("sword", "from:@link:hyrule"); !strings.Contains(body, "Found 1 message:") || !strings.Contains(body, "$1") {
+		t.Errorf("Expected only Link's message, got:\n%s", body)
+	}
+	if body = search("sword", "before:2026-03-10"); !strings.Contains(body, "Found 1 message:") || !strings.Contains(body, "$1") {
+		t.Errorf("Expected only the message before 2026-03-10, got:\n%s", body)
+	}
+	if body = search("sword", "after:2026-03-09"); !strings.Contains(body, "Found 1 message:") || !strings.Contains(body, "$2") {
+		t.Errorf("Expected only the message after 2026-03-09, got:\n%s", body)
+	}
+	if body = search("temple"); body != "No messages found" {
+		t.Errorf("Expected no results for a redacted message, got:\n%s", body)
+	}
+
+	for _, args := range [][]string{nil, {"from:@link:hyrule"}, {"sword", "from:link"}, {"sword", "before:yesterday"}} {
+		if _, err := s.Commands(cli)[0].Command("!room:hyrule", "@link:hyrule", args); err == nil {
+			t.Errorf("Expected an error for !search %s", strings.Join(args, " "))
+		}
+	}
+	if _, err := s.Commands(cli)[0].Command("!untracked:hyrule", "@link:hyrule", []string{"sword"}); err == nil {
+		t.Errorf("Expected an error for a room which isn't indexed")
+	}
+
+	// Rooms can only be searched if their members can see messages from before they joined
+	for _, v := range []string{"shared", "world_readable"} {
+		visibility = v
+		if body = search("sword"); !strings.Contains(body, "$1") {
+			t.Errorf("Expected a room with %s history to be searched, got:\n%s", v, body)
+		}
+	}
+	for _, v := range []string{"invited", "joined"} {
+		visibility = v
+		if _, err := s.Commands(cli)[0].Command("!room:hyrule", "@link:hyrule", []string{"sword"}); err == nil {
+			t.Errorf("Expected an error for a room with %s history", v)
+		}
+	}
+
+	// Opting a room out deletes its messages
+	store.messages["$other"] = types.SearchMessage{RoomID: "!other:hyrule", EventID: "$other", Timestamp: toMillis(day1)}
+	s.PostRegister(&Service{Rooms: []string{"!room:hyrule", "!other:hyrule"}})
+	if _, ok := store.messages["$other"]; ok || len(store.messages) != 3 {
+		t.Errorf("Expected messages in !other:hyrule to be deleted, got %+v", store.messages)
+	}
+}
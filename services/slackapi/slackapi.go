@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/matrix-org/go-neb/notify"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	log "github.com/sirupsen/logrus"
@@ -63,9 +64,9 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 	htmlMessage.MsgType = messageType
-	cli.SendMessageEvent(
-		roomID, "m.room.message", htmlMessage,
-	)
+	if err := notify.Send(cli, roomID, htmlMessage, false); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to send slack message to room")
+	}
 	w.WriteHeader(200)
 }
 
@@ -0,0 +1,358 @@
+package statuspage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// incident is an incident on a status page.
+type incident struct {
+	ID     string
+	Name   string
+	Status string
+	// "none", "minor", "major" or "critical". Cachet doesn't have impacts.
+	Impact string
+	// The latest update's message.
+	Message      string
+	URL          string
+	ComponentIDs []string
+}
+
+// component is a component on a status page.
+type component struct {
+	ID     string
+	Name   string
+	Status string
+}
+
+// change is a change to an incident.
+type change struct {
+	// Only used when creating an incident.
+	Name    string
+	Status  string
+	Message string
+	// All the components affected by the incident, and the new statuses of the ones which change.
+	ComponentIDs    []string
+	ComponentStatus map[string]string
+}
+
+// statusPageAPI is the API of a status page provider. Incident and component statuses are the ones
+// Statuspage uses.
+type statusPageAPI interface {
+	components() ([]component, error)
+	incident(id string) (*incident, error)
+	createIncident(c change) (*incident, error)
+	updateIncident(id string, c change) (*incident, error)
+}
+
+// request makes a request to a status page API and decodes the JSON response into result.
+func request(method, url string, header http.Header, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e struct {
+			Error  string `json:"error"`
+			Errors []struct {
+				Detail string `json:"detail"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		if e.Error == "" && len(e.Errors) > 0 {
+			e.Error = e.Errors[0].Detail
+		}
+		if e.Error != "" {
+			return fmt.Errorf("Status page API returned %d: %s", res.StatusCode, e.Error)
+		}
+		return fmt.Errorf("Status page API returned %d", res.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// atlassianAPI is the Statuspage REST API. See https://developer.statuspage.io
+type atlassianAPI struct {
+	url    string
+	pageID string
+	apiKey string
+}
+
+type atlassianIncident struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Status          string `json:"status"`
+	Impact          string `json:"impact"`
+	Shortlink       string `json:"shortlink"`
+	IncidentUpdates []struct {
+		Body string `json:"body"`
+	} `json:"incident_updates"`
+	Components []struct {
+		ID string `json:"id"`
+	} `json:"components"`
+}
+
+func (i *atlassianIncident) incident() *incident {
+	inc := incident{
+		ID:     i.ID,
+		Name:   i.Name,
+		Status: i.Status,
+		Impact: i.Impact,
+		URL:    i.Shortlink,
+	}
+	// Updates are newest first
+	if len(i.IncidentUpdates) > 0 {
+		inc.Message = i.IncidentUpdates[0].Body
+	}
+	for _, c := range i.Components {
+		inc.ComponentIDs = append(inc.ComponentIDs, c.ID)
+	}
+	return &inc
+}
+
+func (a *atlassianAPI) request(method, path string, body, result interface{}) error {
+	header := http.Header{}
+	header.Set("Authorization", "OAuth "+a.apiKey)
+	return request(method, a.url+"/pages/"+a.pageID+path, header, body, result)
+}
+
+func (a *atlassianAPI) components() ([]component, error) {
+	var res []component
+	var components []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Group  bool   `json:"group"`
+	}
+	if err := a.request("GET", "/components", nil, &components); err != nil {
+		return nil, err
+	}
+	for _, c := range components {
+		if !c.Group {
+			res = append(res, component{c.ID, c.Name, c.Status})
+		}
+	}
+	return res, nil
+}
+
+func (a *atlassianAPI) incident(id string) (*incident, error) {
+	var i atlassianIncident
+	if err := a.request("GET", "/incidents/"+id, nil, &i); err != nil {
+		return nil, err
+	}
+	return i.incident(), nil
+}
+
+func (c change) atlassianBody() map[string]interface{} {
+	body := map[string]interface{}{"body": c.Message}
+	if c.Name != "" {
+		body["name"] = c.Name
+	}
+	if c.Status != "" {
+		body["status"] = c.Status
+	}
+	if len(c.ComponentIDs) > 0 {
+		body["component_ids"] = c.ComponentIDs
+	}
+	if len(c.ComponentStatus) > 0 {
+		body["components"] = c.ComponentStatus
+	}
+	return map[string]interface{}{"incident": body}
+}
+
+func (a *atlassianAPI) createIncident(c change) (*incident, error) {
+	var i atlassianIncident
+	if err := a.request("POST", "/incidents", c.atlassianBody(), &i); err != nil {
+		return nil, err
+	}
+	return i.incident(), nil
+}
+
+func (a *atlassianAPI) updateIncident(id string, c change) (*incident, error) {
+	var i atlassianIncident
+	if err := a.request("PATCH", "/incidents/"+id, c.atlassianBody(), &i); err != nil {
+		return nil, err
+	}
+	return i.incident(), nil
+}
+
+// cachetAPI is the Cachet API. See https://docs.cachethq.io
+type cachetAPI struct {
+	url    string
+	apiKey string
+}
+
+// Cachet uses numbers for statuses. The Statuspage status for each number is at its index.
+var (
+	cachetIncidentStatuses  = []string{"scheduled", "investigating", "identified", "monitoring", "resolved"}
+	cachetComponentStatuses = []string{"", "operational", "degraded_performance", "partial_outage", "major_outage"}
+)
+
+func cachetStatus(statuses []string, status string) int {
+	for i, s := range statuses {
+		if s == status {
+			return i
+		}
+	}
+	return 0
+}
+
+func cachetStatusName(statuses []string, status int) string {
+	if status < 0 || status >= len(statuses) {
+		return ""
+	}
+	return statuses[status]
+}
+
+type cachetIncident struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Message     string `json:"message"`
+	Status      int    `json:"status"`
+	ComponentID int64  `json:"component_id"`
+	Permalink   string `json:"permalink"`
+}
+
+func (i *cachetIncident) incident() *incident {
+	inc := incident{
+		ID:      strconv.FormatInt(i.ID, 10),
+		Name:    i.Name,
+		Status:  cachetStatusName(cachetIncidentStatuses, i.Status),
+		Message: i.Message,
+		URL:     i.Permalink,
+	}
+	if i.ComponentID != 0 {
+		inc.ComponentIDs = []string{strconv.FormatInt(i.ComponentID, 10)}
+	}
+	return &inc
+}
+
+type cachetComponent struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+}
+
+func (c *cachetComponent) component() component {
+	return component{strconv.FormatInt(c.ID, 10), c.Name, cachetStatusName(cachetComponentStatuses, c.Status)}
+}
+
+func (a *cachetAPI) request(method, path string, body, result interface{}) error {
+	header := http.Header{}
+	header.Set("X-Cachet-Token", a.apiKey)
+	// Cachet wraps everything in "data"
+	var res struct {
+		Data interface{} `json:"data"`
+	}
+	res.Data = result
+	if result == nil {
+		return request(method, a.url+path, header, body, nil)
+	}
+	return request(method, a.url+path, header, body, &res)
+}
+
+func (a *cachetAPI) components() ([]component, error) {
+	var components []cachetComponent
+	if err := a.request("GET", "/components?per_page=1000", nil, &components); err != nil {
+		return nil, err
+	}
+	var res []component
+	for _, c := range components {
+		res = append(res, c.component())
+	}
+	return res, nil
+}
+
+func (a *cachetAPI) incident(id string) (*incident, error) {
+	var i cachetIncident
+	if err := a.request("GET", "/incidents/"+id, nil, &i); err != nil {
+		return nil, err
+	}
+	return i.incident(), nil
+}
+
+// setComponentStatuses sets the statuses of components, except the one which the incident set.
+func (a *cachetAPI) setComponentStatuses(statuses map[string]string, except string) error {
+	for id, status := range statuses {
+		if id == except {
+			continue
+		}
+		body := map[string]interface{}{"status": cachetStatus(cachetComponentStatuses, status)}
+		if err := a.request("PUT", "/components/"+id, body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIncident creates an incident. Cachet incidents have one component, so any others only
+// have their status set.
+func (a *cachetAPI) createIncident(c change) (*incident, error) {
+	body := map[string]interface{}{
+		"name":    c.Name,
+		"message": c.Message,
+		"status":  cachetStatus(cachetIncidentStatuses, c.Status),
+		"visible": 1,
+	}
+	var first string
+	if len(c.ComponentIDs) > 0 {
+		first = c.ComponentIDs[0]
+		body["component_id"] = first
+		body["component_status"] = cachetStatus(cachetComponentStatuses, c.ComponentStatus[first])
+	}
+	var i cachetIncident
+	if err := a.request("POST", "/incidents", body, &i); err != nil {
+		return nil, err
+	}
+	if err := a.setComponentStatuses(c.ComponentStatus, first); err != nil {
+		return nil, err
+	}
+	return i.incident(), nil
+}
+
+func (a *cachetAPI) updateIncident(id string, c change) (*incident, error) {
+	body := map[string]interface{}{
+		"status":  cachetStatus(cachetIncidentStatuses, c.Status),
+		"message": c.Message,
+	}
+	if err := a.request("POST", "/incidents/"+id+"/updates", body, nil); err != nil {
+		return nil, err
+	}
+	if err := a.setComponentStatuses(c.ComponentStatus, ""); err != nil {
+		return nil, err
+	}
+	inc, err := a.incident(id)
+	if err != nil {
+		return nil, err
+	}
+	inc.Status = c.Status
+	inc.Message = c.Message
+	return inc, nil
+}
@@ -0,0 +1,638 @@
+// Package statuspage implements a Service which sends status page incidents into rooms and updates
+// incidents from them.
+package statuspage
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Status Page service
+const ServiceType = "statuspage"
+
+// Status page providers
+const (
+	ProviderStatuspage = "statuspage"
+	ProviderCachet     = "cachet"
+)
+
+const (
+	defaultStatuspageURL = "https://api.statuspage.io/v1"
+	defaultImpact        = "partial_outage"
+	defaultResolution    = "This incident has been resolved."
+	maxBodyBytes         = 1024 * 1024
+)
+
+var (
+	openStatuses      = []string{"investigating", "identified", "monitoring"}
+	componentStatuses = []string{"operational", "degraded_performance", "partial_outage", "major_outage", "under_maintenance"}
+)
+
+// Service contains the Config fields for the Status Page service.
+//
+// This service sends incidents and component status changes from a status page into rooms, and
+// lets responders declare, update and resolve incidents on the status page from Matrix. It
+// supports Atlassian Statuspage (https://www.atlassian.com/software/statuspage) and Cachet
+// (https://cachethq.io).
+//
+// The status page should send webhooks to the webhook_url, which is populated by Go-NEB after
+// Service registration. If a secret is set, it must be added to the URL as "?secret=<secret>",
+// since status pages can't sign webhooks. Statuspage sends incident and component subscriber
+// notifications. Cachet should send {"event": "incident.updated", "data": <incident>} or
+// {"event": "component.updated", "data": <component>}, where the data is as in the Cachet API.
+//
+// Incidents are sent into the service's rooms, and keep being sent into rooms which have been
+// removed from the service since the incident was linked to them. Major and critical incidents and
+// major outages are delivered even during the room's quiet hours.
+//
+// If api_key is set, the allowed_users can manage incidents with the commands below. Incidents can
+// be declared in the service's rooms, and updated from them or from rooms the incident is in.
+// --component can be given more than once and is the name or ID of a component, which is set to the
+// --impact (degraded_performance, partial_outage, major_outage or under_maintenance; partial_outage
+// by default) and back to operational when the incident is resolved. --status is investigating,
+// identified or monitoring. Update and resolve apply to the incident which is open in the room, or
+// the one given with --incident.
+//
+// Commands supported:
+//    !status incident create "message" [--component X] [--impact I] [--status S]
+//    !status incident update "message" [--component X] [--impact I] [--status S] [--incident ID]
+//    !status incident resolve ["message"] [--component X] [--incident ID]
+//
+// Example JSON request:
+//   {
+//       "provider": "statuspage",
+//       "page_id": "kctbh9vrtdwd",
+//       "api_key": "2a7b9d4aac30956d537ac76850f4d78de30994703680056cc103862d53cf8074",
+//       "secret": "hunter2",
+//       "rooms": ["!incidents:localhost"],
+//       "allowed_users": ["@alice:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which the status page should send webhooks to. Populated by Go-NEB after Service
+	// registration.
+	WebhookURL string `json:"webhook_url"`
+	// Optional. "statuspage" or "cachet". Defaults to statuspage.
+	Provider string `json:"provider"`
+	// Optional. The URL of the status page API, e.g. "https://status.example.com/api/v1" for Cachet.
+	// Defaults to the Statuspage API.
+	APIURL string `json:"api_url"`
+	// Optional. The API key, which enables the commands.
+	APIKey string `json:"api_key"`
+	// The Statuspage page ID. Not used for Cachet.
+	PageID string `json:"page_id"`
+	// Optional. A secret which webhooks must have in their URL.
+	Secret string `json:"secret"`
+	// The rooms to send incidents and component status changes into.
+	Rooms []string `json:"rooms"`
+	// The users who can manage incidents. Required if api_key is set.
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Provider == "" {
+		s.Provider = ProviderStatuspage
+	}
+	switch s.Provider {
+	case ProviderStatuspage:
+		if s.APIURL == "" {
+			s.APIURL = defaultStatuspageURL
+		}
+		if s.APIKey != "" && s.PageID == "" {
+			return errors.New("page_id must be specified with api_key")
+		}
+	case ProviderCachet:
+		if s.APIKey != "" && s.APIURL == "" {
+			return errors.New("api_url must be specified for Cachet")
+		}
+	default:
+		return fmt.Errorf("Unknown provider '%s'", s.Provider)
+	}
+	if s.APIURL != "" {
+		u, err := url.Parse(s.APIURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("api_url must be an absolute URL")
+		}
+		s.APIURL = strings.TrimSuffix(s.APIURL, "/")
+	}
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room must be specified")
+	}
+	if s.APIKey != "" && len(s.AllowedUsers) == 0 {
+		return errors.New("allowed_users must be specified with api_key")
+	}
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+func (s *Service) api() statusPageAPI {
+	if s.Provider == ProviderCachet {
+		return &cachetAPI{url: s.APIURL, apiKey: s.APIKey}
+	}
+	apiURL := s.APIURL
+	if apiURL == "" {
+		apiURL = defaultStatuspageURL
+	}
+	return &atlassianAPI{url: apiURL, pageID: s.PageID, apiKey: s.APIKey}
+}
+
+func (s *Service) isAllowed(userID string) bool {
+	return contains(s.AllowedUsers, userID)
+}
+
+// isLinked returns true if an incident has been sent into or declared in a room.
+func (s *Service) isLinked(roomID, incidentID string) (bool, error) {
+	linked, err := database.GetServiceDB().LoadStatusPageIncidents(s.ServiceID(), incidentID)
+	if err != nil {
+		return false, err
+	}
+	for _, l := range linked {
+		if l.RoomID == roomID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func humanStatus(status string) string {
+	return strings.Replace(status, "_", " ", -1)
+}
+
+// componentChange is a change of a component's status.
+type componentChange struct {
+	component
+	OldStatus string
+}
+
+// parseWebhook parses the body of a webhook into an incident or a component change. Both are nil
+// if the webhook is about something else.
+func (s *Service) parseWebhook(body []byte) (*incident, *componentChange, error) {
+	if s.Provider == ProviderCachet {
+		var hook struct {
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case strings.HasPrefix(hook.Event, "incident"):
+			var i cachetIncident
+			if err := json.Unmarshal(hook.Data, &i); err != nil {
+				return nil, nil, err
+			}
+			return i.incident(), nil, nil
+		case strings.HasPrefix(hook.Event, "component"):
+			var c cachetComponent
+			if err := json.Unmarshal(hook.Data, &c); err != nil {
+				return nil, nil, err
+			}
+			return nil, &componentChange{component: c.component()}, nil
+		}
+		return nil, nil, nil
+	}
+	var hook struct {
+		Incident  *atlassianIncident `json:"incident"`
+		Component *struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Status string `json:"status"`
+		} `json:"component"`
+		ComponentUpdate *struct {
+			OldStatus string `json:"old_status"`
+			NewStatus string `json:"new_status"`
+		} `json:"component_update"`
+	}
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return nil, nil, err
+	}
+	if hook.Incident != nil {
+		return hook.Incident.incident(), nil, nil
+	}
+	if hook.Component != nil {
+		c := componentChange{component: component{hook.Component.ID, hook.Component.Name, hook.Component.Status}}
+		if hook.ComponentUpdate != nil {
+			c.Status = hook.ComponentUpdate.NewStatus
+			c.OldStatus = hook.ComponentUpdate.OldStatus
+		}
+		return nil, &c, nil
+	}
+	return nil, nil, nil
+}
+
+func (i *incident) message() gomatrix.HTMLMessage {
+	plain := []string{fmt.Sprintf("Incident: %s (%s)", i.Name, humanStatus(i.Status))}
+	formatted := []string{fmt.Sprintf("<strong>Incident: %s</strong> (%s)", html.EscapeString(i.Name), html.EscapeString(humanStatus(i.Status)))}
+	if i.Message != "" {
+		plain = append(plain, i.Message)
+		formatted = append(formatted, html.EscapeString(i.Message))
+	}
+	if i.URL != "" {
+		plain = append(plain, i.URL)
+		formatted = append(formatted, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(i.URL), html.EscapeString(i.URL)))
+	}
+	return gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Body:          strings.Join(plain, "\n"),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(formatted, "<br>"),
+	}
+}
+
+func (c *componentChange) message() gomatrix.HTMLMessage {
+	text := fmt.Sprintf("Component %s is now %s", c.Name, humanStatus(c.Status))
+	formatted := fmt.Sprintf("Component <strong>%s</strong> is now %s", html.EscapeString(c.Name), html.EscapeString(humanStatus(c.Status)))
+	if c.OldStatus != "" {
+		text += " (was " + humanStatus(c.OldStatus) + ")"
+		formatted += " (was " + html.EscapeString(humanStatus(c.OldStatus)) + ")"
+	}
+	return gomatrix.HTMLMessage{
+		MsgType:       "m.notice",
+		Body:          text,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+}
+
+// OnReceiveWebhook receives incident and component webhooks from the status page.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
+	logger := log.WithField("service_id", s.ServiceID())
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if s.Secret != "" && subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("secret")), []byte(s.Secret)) != 1 {
+		logger.Warn("Status page webhook has the wrong secret")
+		w.WriteHeader(401)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	inc, change, err := s.parseWebhook(body)
+	if err != nil {
+		logger.WithError(err).Error("Status page webhook received an invalid payload")
+		w.WriteHeader(400)
+		return
+	}
+	if inc != nil {
+		s.onIncident(cli, inc)
+	} else if change != nil {
+		msg := change.message()
+		for _, roomID := range s.Rooms {
+			if err := notify.Send(cli, roomID, msg, change.Status == "major_outage"); err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Failed to send component status to room")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// onIncident sends an incident into the service's rooms and the rooms it is linked to, and
+// updates the links.
+func (s *Service) onIncident(cli *gomatrix.Client, inc *incident) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"incident":   inc.ID,
+	})
+	db := database.GetServiceDB()
+	linked, err := db.LoadStatusPageIncidents(s.ServiceID(), inc.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load incident rooms")
+	}
+	rooms := append([]string{}, s.Rooms...)
+	for _, l := range linked {
+		if !contains(rooms, l.RoomID) {
+			rooms = append(rooms, l.RoomID)
+		}
+	}
+	msg := inc.message()
+	urgent := (inc.Impact == "major" || inc.Impact == "critical") && contains(openStatuses, inc.Status)
+	for _, roomID := range rooms {
+		if err := notify.Send(cli, roomID, msg, urgent); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send incident to room")
+		}
+		s.link(roomID, inc)
+	}
+}
+
+// link links an incident to a room, so that it can be updated from the room.
+func (s *Service) link(roomID string, inc *incident) {
+	err := database.GetServiceDB().StoreStatusPageIncident(types.StatusPageIncident{
+		ServiceID:        s.ServiceID(),
+		RoomID:           roomID,
+		IncidentID:       inc.ID,
+		Name:             inc.Name,
+		Status:           inc.Status,
+		URL:              inc.URL,
+		UpdatedTimestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": s.ServiceID(),
+			"incident":   inc.ID,
+			"room_id":    roomID,
+		}).Error("Failed to store incident room")
+	}
+}
+
+// Commands supported:
+//    !status incident create "message" [--component X] [--impact I] [--status S]
+//    !status incident update "message" [--component X] [--impact I] [--status S] [--incident ID]
+//    !status incident resolve ["message"] [--component X] [--incident ID]
+// There are no commands unless api_key is set.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	if s.APIKey == "" {
+		return nil
+	}
+	return []types.Command{
+		s.incidentCommand("create", s.cmdCreate),
+		s.incidentCommand("update", s.cmdUpdate),
+		s.incidentCommand("resolve", s.cmdResolve),
+	}
+}
+
+func (s *Service) incidentCommand(name string, run func(roomID string, opts *options) (string, error)) types.Command {
+	return types.Command{
+		Path: []string{"status", "incident", name},
+		Command: func(roomID, userID string, args []string) (interface{}, error) {
+			if !s.isAllowed(userID) {
+				return nil, errors.New("You aren't allowed to manage incidents")
+			}
+			opts, err := parseOptions(args)
+			if err != nil {
+				return nil, err
+			}
+			text, err := run(roomID, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &gomatrix.TextMessage{MsgType: "m.notice", Body: text}, nil
+		},
+	}
+}
+
+// options are the arguments to an incident command.
+type options struct {
+	message    string
+	components []string
+	impact     string
+	status     string
+	incident   string
+}
+
+func parseOptions(args []string) (*options, error) {
+	var opts options
+	var words []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			words = append(words, arg)
+			continue
+		}
+		name, value := arg[2:], ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		} else if i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if value == "" {
+			return nil, fmt.Errorf("--%s needs a value", name)
+		}
+		switch name {
+		case "component":
+			opts.components = append(opts.components, value)
+		case "impact":
+			opts.impact = value
+		case "status":
+			opts.status = value
+		case "incident":
+			opts.incident = strings.TrimPrefix(value, "#")
+		default:
+			return nil, fmt.Errorf("Unknown option --%s", name)
+		}
+	}
+	opts.message = strings.Join(words, " ")
+	if opts.impact == "" {
+		opts.impact = defaultImpact
+	} else if !contains(componentStatuses, opts.impact) || opts.impact == "operational" {
+		return nil, fmt.Errorf("--impact must be one of %s", strings.Join(componentStatuses[1:], ", "))
+	}
+	if opts.status != "" && !contains(openStatuses, opts.status) {
+		return nil, fmt.Errorf("--status must be one of %s", strings.Join(openStatuses, ", "))
+	}
+	return &opts, nil
+}
+
+// componentIDs looks up components by name or ID.
+func (s *Service) componentIDs(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	components, err := s.api().components()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		found := false
+		for _, c := range components {
+			if c.ID == name || strings.EqualFold(c.Name, name) {
+				ids = append(ids, c.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			var known []string
+			for _, c := range components {
+				known = append(known, c.Name)
+			}
+			return nil, fmt.Errorf("Unknown component '%s'. The components are: %s", name, strings.Join(known, ", "))
+		}
+	}
+	return ids, nil
+}
+
+// roomIncident returns the ID of the incident a command applies to.
+func (s *Service) roomIncident(roomID string, opts *options) (string, error) {
+	if opts.incident != "" {
+		return opts.incident, nil
+	}
+	open, err := database.GetServiceDB().LoadOpenStatusPageIncidents(s.ServiceID(), roomID)
+	if err != nil {
+		return "", err
+	}
+	switch len(open) {
+	case 0:
+		return "", errors.New("There is no open incident in this room. Use --incident <id>")
+	case 1:
+		return open[0].IncidentID, nil
+	}
+	var names []string
+	for _, i := range open {
+		names = append(names, fmt.Sprintf("%s (%s)", i.IncidentID, i.Name))
+	}
+	return "", fmt.Errorf("There are several open incidents in this room: %s. Use --incident <id>", strings.Join(names, ", "))
+}
+
+func (s *Service) cmdCreate(roomID string, opts *options) (string, error) {
+	if opts.message == "" {
+		return "", errors.New(`Usage: !status incident create "message" [--component X] [--impact I] [--status S]`)
+	}
+	if !contains(s.Rooms, roomID) {
+		return "", errors.New("Incidents can only be declared in the status page rooms")
+	}
+	ids, err := s.componentIDs(opts.components)
+	if err != nil {
+		return "", err
+	}
+	c := change{
+		Name:            opts.message,
+		Status:          opts.status,
+		Message:         opts.message,
+		ComponentIDs:    ids,
+		ComponentStatus: make(map[string]string),
+	}
+	if c.Status == "" {
+		c.Status = openStatuses[0]
+	}
+	for _, id := range ids {
+		c.ComponentStatus[id] = opts.impact
+	}
+	inc, err := s.api().createIncident(c)
+	if err != nil {
+		return "", err
+	}
+	s.link(roomID, inc)
+	return strings.TrimSpace(fmt.Sprintf("Created incident %s: %s (%s) %s", inc.ID, inc.Name, humanStatus(inc.Status), inc.URL)), nil
+}
+
+// update changes the incident which a command applies to, affecting any new components.
+func (s *Service) update(roomID string, opts *options, status, componentStatus string) (*incident, error) {
+	id, err := s.roomIncident(roomID, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Otherwise --incident could add any room to the incident's updates.
+	if !contains(s.Rooms, roomID) {
+		linked, err := s.isLinked(roomID, id)
+		if err != nil {
+			return nil, err
+		}
+		if !linked {
+			return nil, fmt.Errorf("Incident %s can't be updated from this room", id)
+		}
+	}
+	api := s.api()
+	current, err := api.incident(id)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(openStatuses, current.Status) {
+		return nil, fmt.Errorf("Incident %s is already %s", id, humanStatus(current.Status))
+	}
+	ids, err := s.componentIDs(opts.components)
+	if err != nil {
+		return nil, err
+	}
+	c := change{
+		Status:          status,
+		Message:         opts.message,
+		ComponentIDs:    current.ComponentIDs,
+		ComponentStatus: make(map[string]string),
+	}
+	if c.Status == "" {
+		c.Status = current.Status
+	}
+	for _, id := range ids {
+		if !contains(c.ComponentIDs, id) {
+			c.ComponentIDs = append(c.ComponentIDs, id)
+		}
+		c.ComponentStatus[id] = componentStatus
+	}
+	if status == "resolved" {
+		for _, id := range c.ComponentIDs {
+			c.ComponentStatus[id] = componentStatus
+		}
+	}
+	inc, err := api.updateIncident(id, c)
+	if err != nil {
+		return nil, err
+	}
+	s.link(roomID, inc)
+	return inc, nil
+}
+
+func (s *Service) cmdUpdate(roomID string, opts *options) (string, error) {
+	if opts.message == "" {
+		return "", errors.New(`Usage: !status incident update "message" [--component X] [--impact I] [--status S] [--incident ID]`)
+	}
+	inc, err := s.update(roomID, opts, opts.status, opts.impact)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Updated incident %s: %s (%s)", inc.ID, inc.Name, humanStatus(inc.Status)), nil
+}
+
+func (s *Service) cmdResolve(roomID string, opts *options) (string, error) {
+	if opts.status != "" {
+		return "", errors.New("--status can't be given when resolving an incident")
+	}
+	if opts.message == "" {
+		opts.message = defaultResolution
+	}
+	inc, err := s.update(roomID, opts, "resolved", "operational")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Resolved incident %s: %s", inc.ID, inc.Name), nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
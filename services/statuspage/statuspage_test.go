@@ -0,0 +1,338 @@
+package statuspage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type mockStore struct {
+	database.NopStorage
+	incidents []types.StatusPageIncident
+}
+
+func (s *mockStore) StoreStatusPageIncident(incident types.StatusPageIncident) error {
+	for i, existing := range s.incidents {
+		if existing.RoomID == incident.RoomID && existing.IncidentID == incident.IncidentID {
+			s.incidents[i] = incident
+			return nil
+		}
+	}
+	s.incidents = append(s.incidents, incident)
+	return nil
+}
+
+func (s *mockStore) LoadStatusPageIncidents(serviceID, incidentID string) (incidents []types.StatusPageIncident, err error) {
+	for _, i := range s.incidents {
+		if i.IncidentID == incidentID {
+			incidents = append(incidents, i)
+		}
+	}
+	return
+}
+
+func (s *mockStore) LoadOpenStatusPageIncidents(serviceID, roomID string) (incidents []types.StatusPageIncident, err error) {
+	for _, i := range s.incidents {
+		if i.RoomID == roomID && contains(openStatuses, i.Status) {
+			incidents = append(incidents, i)
+		}
+	}
+	return
+}
+
+// standIn is a local stand-in for a status page API, which records the requests it receives.
+type standIn struct {
+	header   string
+	token    string
+	handle   func(method, path string, body map[string]interface{}) interface{}
+	requests []string
+	bodies   []map[string]interface{}
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(s.header) != s.token {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error":"Could not authenticate"}`))
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.bodies = append(s.bodies, body)
+	res := s.handle(r.Method, r.URL.Path, body)
+	if res == nil {
+		w.WriteHeader(404)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func newService(t *testing.T, config string) (*Service, *mockStore, *[]testutils.SentMessage, *gomatrix.Client) {
+	store := &mockStore{}
+	database.SetServiceDB(store)
+	var sent []testutils.SentMessage
+	cli := testutils.NewMatrixClient(&sent, "")
+	return testutils.NewService(t, ServiceType, config, cli).(*Service), store, &sent, cli
+}
+
+// statuspageStandIn stands in for the Statuspage API of page "p1", with the components API and Web.
+func statuspageStandIn() *standIn {
+	incident := map[string]interface{}{}
+	return &standIn{
+		header: "Authorization",
+		token:  "OAuth key",
+		handle: func(method, path string, body map[string]interface{}) interface{} {
+			switch method + " " + path {
+			case "GET /pages/p1/components":
+				return []map[string]interface{}{
+					{"id": "c1", "name": "API", "status": "operational"},
+					{"id": "c2", "name": "Web", "status": "operational"},
+					{"id": "g1", "name": "Everything", "status": "operational", "group": true},
+				}
+			case "POST /pages/p1/incidents":
+				incident = map[string]interface{}{"id": "i1", "shortlink": "https://stspg.io/i1"}
+				fallthrough
+			case "PATCH /pages/p1/incidents/i1":
+				for k, v := range body["incident"].(map[string]interface{}) {
+					incident[k] = v
+				}
+				fallthrough
+			case "GET /pages/p1/incidents/i1":
+				// The API returns the incident's components rather than their new statuses
+				res := map[string]interface{}{}
+				for k, v := range incident {
+					res[k] = v
+				}
+				var components []map[string]interface{}
+				ids, _ := incident["component_ids"].([]interface{})
+				for _, id := range ids {
+					components = append(components, map[string]interface{}{"id": id})
+				}
+				res["components"] = components
+				return res
+			}
+			return nil
+		},
+	}
+}
+
+func TestStatuspageCommands(t *testing.T) {
+	api := statuspageStandIn()
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	s, store, _, cli := newService(t, `{
+		"api_url": "`+srv.URL+`",
+		"api_key": "key",
+		"page_id": "p1",
+		"rooms": ["!status:hyrule", "!inc:hyrule"],
+		"allowed_users": ["@zelda:hyrule"]
+	}`)
+
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!other:hyrule", "@zelda:hyrule", "status incident create API is down"); err == nil ||
+		len(api.requests) != 0 {
+		t.Errorf("Expected an incident to be refused outside the status page rooms, got %v", err)
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@link:hyrule", "status incident create API is down"); err == nil {
+		t.Errorf("Expected a user who isn't allowed to be refused")
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident create API is down --component Database"); err == nil ||
+		!strings.HasSuffix(err.Error(), "The components are: API, Web") {
+		t.Errorf("Expected an unknown component to be refused, got %v", err)
+	}
+	res, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident create API is down --component api --impact=major_outage")
+	if err != nil {
+		t.Fatalf("create returned error: %s", err)
+	}
+	if res != "Created incident i1: API is down (investigating) https://stspg.io/i1" {
+		t.Errorf("Unexpected create response: %s", res)
+	}
+	created := api.bodies[len(api.bodies)-1]["incident"].(map[string]interface{})
+	if created["status"] != "investigating" || created["components"].(map[string]interface{})["c1"] != "major_outage" {
+		t.Errorf("Unexpected incident: %v", created)
+	}
+	if len(store.incidents) != 1 || store.incidents[0].RoomID != "!inc:hyrule" {
+		t.Fatalf("Expected the incident to be linked to the room, got %v", store.incidents)
+	}
+
+	// Other rooms can't pick the incident, which would add them to its updates
+	requests := len(api.requests)
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!other:hyrule", "@zelda:hyrule", "status incident update Mine now --incident i1"); err == nil ||
+		len(api.requests) != requests || len(store.incidents) != 1 {
+		t.Errorf("Expected an update from a room without the incident to be refused, got %v", err)
+	}
+
+	// Updates apply to the room's incident
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!other:hyrule", "@zelda:hyrule", "status incident update Found it"); err == nil {
+		t.Errorf("Expected an update in a room without an incident to fail")
+	}
+	res, err = testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident update Found it --status identified --component Web")
+	if err != nil {
+		t.Fatalf("update returned error: %s", err)
+	}
+	if res != "Updated incident i1: API is down (identified)" {
+		t.Errorf("Unexpected update response: %s", res)
+	}
+	updated := api.bodies[len(api.bodies)-1]["incident"].(map[string]interface{})
+	if updated["body"] != "Found it" || len(updated["component_ids"].([]interface{})) != 2 ||
+		updated["components"].(map[string]interface{})["c2"] != "partial_outage" || updated["components"].(map[string]interface{})["c1"] != nil {
+		t.Errorf("Unexpected incident update: %v", updated)
+	}
+
+	res, err = testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident resolve")
+	if err != nil {
+		t.Fatalf("resolve returned error: %s", err)
+	}
+	if res != "Resolved incident i1: API is down" {
+		t.Errorf("Unexpected resolve response: %s", res)
+	}
+	resolved := api.bodies[len(api.bodies)-1]["incident"].(map[string]interface{})
+	components := resolved["components"].(map[string]interface{})
+	if resolved["status"] != "resolved" || components["c1"] != "operational" || components["c2"] != "operational" {
+		t.Errorf("Expected resolving to make the components operational, got %v", resolved)
+	}
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident resolve --incident i1"); err == nil ||
+		err.Error() != "Incident i1 is already resolved" {
+		t.Errorf("Expected resolving a resolved incident to fail, got %v", err)
+	}
+}
+
+func TestStatuspageWebhook(t *testing.T) {
+	s, store, sent, cli := newService(t, `{"secret": "hunter2", "rooms": ["!status:hyrule"]}`)
+	store.incidents = []types.StatusPageIncident{{RoomID: "!inc:hyrule", IncidentID: "i1", Status: "investigating"}}
+	post := func(query, body string) int {
+		req, _ := http.NewRequest("POST", "https://neb/services/hooks/id"+query, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, cli)
+		return w.Code
+	}
+
+	if code := post("?secret=wrong", `{}`); code != 401 {
+		t.Errorf("Expected the wrong secret to return 401, got %d", code)
+	}
+	code := post("?secret=hunter2", `{
+		"meta": {"unsubscribe": "http://statustest.flyingkleinbrothers.com:5000/?unsubscribe=j0vqr9kl3513"},
+		"page": {"id": "p1", "status_indicator": "major"},
+		"incident": {
+			"id": "i1", "name": "API is down", "status": "identified", "impact": "major",
+			"shortlink": "https://stspg.io/i1",
+			"incident_updates": [{"body": "Found it", "status": "identified"}, {"body": "Looking", "status": "investigating"}]
+		}
+	}`)
+	if code != 200 {
+		t.Fatalf("Expected incident webhook to return 200, got %d", code)
+	}
+	expected := "Incident: API is down (identified)\nFound it\nhttps://stspg.io/i1"
+	if len(*sent) != 2 || (*sent)[0].String() != "!status:hyrule "+expected || (*sent)[1].String() != "!inc:hyrule "+expected {
+		t.Errorf("Expected the incident in the service's room and the incident room, got %v", *sent)
+	}
+	if len(store.incidents) != 2 || store.incidents[0].Status != "identified" {
+		t.Errorf("Expected the incident rooms to be updated, got %v", store.incidents)
+	}
+
+	*sent = nil
+	post("?secret=hunter2", `{
+		"component_update": {"old_status": "operational", "new_status": "major_outage", "component_id": "c1"},
+		"component": {"id": "c1", "name": "API", "status": "major_outage"}
+	}`)
+	if len(*sent) != 1 || (*sent)[0].String() != "!status:hyrule Component API is now major outage (was operational)" {
+		t.Errorf("Unexpected component message: %v", *sent)
+	}
+}
+
+func TestCachet(t *testing.T) {
+	incidentStatus := 1.0
+	api := &standIn{
+		header: "X-Cachet-Token",
+		token:  "key",
+		handle: func(method, path string, body map[string]interface{}) interface{} {
+			switch method + " " + path {
+			case "GET /api/v1/components":
+				return map[string]interface{}{"data": []map[string]interface{}{
+					{"id": 1, "name": "API", "status": 1},
+					{"id": 2, "name": "Web", "status": 1},
+				}}
+			case "POST /api/v1/incidents/7/updates":
+				incidentStatus = body["status"].(float64)
+				fallthrough
+			case "POST /api/v1/incidents", "GET /api/v1/incidents/7":
+				return map[string]interface{}{"data": map[string]interface{}{
+					"id": 7, "name": "API is down", "message": "Looking", "status": incidentStatus,
+					"component_id": 1, "permalink": "https://status.hyrule/incidents/7",
+				}}
+			case "PUT /api/v1/components/1", "PUT /api/v1/components/2":
+				return map[string]interface{}{"data": map[string]interface{}{}}
+			}
+			return nil
+		},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	s, store, sent, cli := newService(t, `{
+		"provider": "cachet",
+		"api_url": "`+srv.URL+`/api/v1/",
+		"api_key": "key",
+		"rooms": ["!status:hyrule", "!inc:hyrule"],
+		"allowed_users": ["@zelda:hyrule"]
+	}`)
+
+	res, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident create API is down --component API --component Web")
+	if err != nil {
+		t.Fatalf("create returned error: %s", err)
+	}
+	if res != "Created incident 7: API is down (investigating) https://status.hyrule/incidents/7" {
+		t.Errorf("Unexpected create response: %s", res)
+	}
+	// Cachet incidents have one component, so the second is set separately
+	if strings.Join(api.requests, ", ") != "GET /api/v1/components, POST /api/v1/incidents, PUT /api/v1/components/2" {
+		t.Errorf("Unexpected Cachet requests: %v", api.requests)
+	}
+	if api.bodies[1]["component_id"] != "1" || api.bodies[1]["component_status"] != 3.0 || api.bodies[2]["status"] != 3.0 {
+		t.Errorf("Unexpected Cachet component statuses: %v", api.bodies)
+	}
+
+	// The incident can still be resolved from its room once the room is removed from the service
+	s.Rooms = []string{"!status:hyrule"}
+	if len(store.incidents) != 1 || store.incidents[0].RoomID != "!inc:hyrule" {
+		t.Fatalf("Expected the incident to be linked to the room, got %v", store.incidents)
+	}
+	api.requests = nil
+	if _, err := testutils.RunTextCommand(s.Commands(cli), "!inc:hyrule", "@zelda:hyrule", "status incident resolve Fixed"); err != nil {
+		t.Fatalf("resolve returned error: %s", err)
+	}
+	if api.requests[1] != "POST /api/v1/incidents/7/updates" || api.bodies[len(api.bodies)-3]["status"] != 4.0 {
+		t.Errorf("Expected an incident update which fixes it, got %v", api.requests)
+	}
+
+	req, _ := http.NewRequest("POST", "https://neb/services/hooks/id", strings.NewReader(`{
+		"event": "component.updated",
+		"data": {"id": 1, "name": "API", "status": 4}
+	}`))
+	s.OnReceiveWebhook(httptest.NewRecorder(), req, cli)
+	if len(*sent) != 1 || (*sent)[0].String() != "!status:hyrule Component API is now major outage" {
+		t.Errorf("Unexpected component message: %v", *sent)
+	}
+}
+
+func TestRegisterNeedsAllowedUsers(t *testing.T) {
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})}
+	srvc, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{"api_key": "key", "page_id": "p1", "rooms": ["!status:hyrule"]}`))
+	if err != nil {
+		t.Fatal("Failed to create statuspage service: ", err)
+	}
+	if err := srvc.Register(nil, cli); err == nil {
+		t.Errorf("Expected a service with an api_key but no allowed_users to be refused")
+	}
+}
@@ -0,0 +1,57 @@
+package synapseadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// adminRequest makes an admin API request with the admin access token. If body is not nil it is
+// sent as JSON, and if result is not nil the JSON response is decoded into it.
+func (s *Service) adminRequest(method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.HomeserverURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.AdminAccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		// Synapse returns standard Matrix errors, which are better to show than the raw body
+		var matrixErr struct {
+			ErrCode string `json:"errcode"`
+			Err     string `json:"error"`
+		}
+		resBody, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(resBody, &matrixErr) == nil && matrixErr.ErrCode != "" {
+			return fmt.Errorf("Homeserver returned %d: %s: %s", res.StatusCode, matrixErr.ErrCode, matrixErr.Err)
+		}
+		return fmt.Errorf("Homeserver returned %d", res.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
@@ -0,0 +1,493 @@
+// Package synapseadmin implements a Service which runs Synapse admin API operations from a Matrix room.
+package synapseadmin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Synapse Admin service
+const ServiceType = "synapseadmin"
+
+const defaultConfirmTimeoutSecs = 120
+
+// Service contains the Config fields for the Synapse Admin service.
+//
+// This service runs common Synapse admin API operations. Commands are only accepted in the
+// configured admin room, from the configured users. Destructive operations reply with a
+// confirmation code which the same user must send back with "!hs confirm <code>" before the
+// timeout, otherwise nothing happens.
+//
+// Commands supported:
+//    !hs user info @user:server
+//    !hs user deactivate @user:server [erase]
+//    !hs user reset-password @user:server
+//    !hs room info !room:server
+//    !hs room purge-history !room:server <age e.g. 30d>
+//    !hs room block !room:server
+//    !hs media quarantine mxc://server/mediaid
+//    !hs registration-token create [uses] [expiry e.g. 7d]
+//    !hs confirm <code>
+//
+// The new password from "reset-password" and the token from "registration-token create" are sent
+// to the user who ran the command in a new direct message room, so that they aren't kept in the
+// admin room's history. "reset-password" also logs out the user's devices.
+//
+// Example JSON request:
+//   {
+//       "homeserver_url": "https://matrix.example.com",
+//       "admin_access_token": "syt_YWRtaW4_...",
+//       "room_id": "!admins:example.com",
+//       "allowed_users": ["@alice:example.com", "@bob:example.com"],
+//       "confirm_timeout_secs": 120
+//   }
+type Service struct {
+	types.DefaultService
+	// The base URL of the homeserver's client-server API (which also serves the admin API).
+	HomeserverURL string `json:"homeserver_url"`
+	// An access token for a Synapse server admin.
+	AdminAccessToken string `json:"admin_access_token"`
+	// The room which commands are accepted in.
+	RoomID string `json:"room_id"`
+	// The users who can run commands. This cannot be empty.
+	AllowedUsers []string `json:"allowed_users"`
+	// Optional. How long a confirmation code is valid for. Defaults to 120.
+	ConfirmTimeoutSecs int `json:"confirm_timeout_secs"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the admin room.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if s.HomeserverURL == "" || s.AdminAccessToken == "" {
+		return errors.New("homeserver_url and admin_access_token must be specified")
+	}
+	if s.RoomID == "" {
+		return errors.New("room_id must be specified")
+	}
+	if len(s.AllowedUsers) == 0 {
+		return errors.New("At least one allowed user must be specified")
+	}
+	if s.ConfirmTimeoutSecs < 0 {
+		return errors.New("confirm_timeout_secs cannot be negative")
+	}
+	s.HomeserverURL = strings.TrimSuffix(s.HomeserverURL, "/")
+	if _, err := client.JoinRoom(s.RoomID, "", nil); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    s.RoomID,
+			"user_id":    client.UserID,
+		}).Error("Failed to join room")
+	}
+	return nil
+}
+
+func (s *Service) isAllowed(roomID, userID string) bool {
+	if roomID != s.RoomID {
+		return false
+	}
+	for _, u := range s.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// A pendingAction is a destructive operation waiting to be confirmed.
+type pendingAction struct {
+	serviceID   string
+	userID      string
+	description string
+	expires     time.Time
+	run         func() (interface{}, error)
+}
+
+var (
+	pendingMutex sync.Mutex
+	pending      = make(map[string]*pendingAction) // confirmation code => action
+)
+
+// confirmationCode is a variable so tests can make codes predictable.
+var confirmationCode = func() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requireConfirmation stores the action and asks the user to confirm it.
+func (s *Service) requireConfirmation(userID, description string, run func() (interface{}, error)) (interface{}, error) {
+	timeout := s.ConfirmTimeoutSecs
+	if timeout == 0 {
+		timeout = defaultConfirmTimeoutSecs
+	}
+	code := confirmationCode()
+	now := time.Now()
+	pendingMutex.Lock()
+	for c, action := range pending {
+		if now.After(action.expires) {
+			delete(pending, c)
+		}
+	}
+	pending[code] = &pendingAction{
+		serviceID:   s.ServiceID(),
+		userID:      userID,
+		description: description,
+		expires:     now.Add(time.Duration(timeout) * time.Second),
+		run:         run,
+	}
+	pendingMutex.Unlock()
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body: fmt.Sprintf(
+			"This will %s. Send '!hs confirm %s' within %d seconds to go ahead.", description, code, timeout,
+		),
+	}, nil
+}
+
+func (s *Service) cmdConfirm(userID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !hs confirm <code>")
+	}
+	pendingMutex.Lock()
+	action, ok := pending[args[0]]
+	if ok && action.serviceID == s.ServiceID() && action.userID == userID {
+		delete(pending, args[0])
+	} else {
+		ok = false
+	}
+	pendingMutex.Unlock()
+	if !ok || time.Now().After(action.expires) {
+		return nil, errors.New("Unknown or expired confirmation code")
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.ServiceID(),
+		"user_id":    userID,
+		"action":     action.description,
+	}).Info("Running confirmed admin action")
+	return action.run()
+}
+
+// Commands supported:
+//    !hs user info|deactivate|reset-password ...
+//    !hs room info|purge-history|block ...
+//    !hs media quarantine ...
+//    !hs registration-token create ...
+//    !hs confirm <code>
+// Commands from rooms other than the admin room, or from users who aren't allowed, are rejected.
+func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	handlers := []struct {
+		path    []string
+		command func(userID string, args []string) (interface{}, error)
+	}{
+		{[]string{"hs", "user", "info"}, s.cmdUserInfo},
+		{[]string{"hs", "user", "deactivate"}, s.cmdUserDeactivate},
+		{[]string{"hs", "user", "reset-password"}, func(userID string, args []string) (interface{}, error) {
+			return s.cmdUserResetPassword(cli, userID, args)
+		}},
+		{[]string{"hs", "room", "info"}, s.cmdRoomInfo},
+		{[]string{"hs", "room", "purge-history"}, s.cmdRoomPurgeHistory},
+		{[]string{"hs", "room", "block"}, s.cmdRoomBlock},
+		{[]string{"hs", "media", "quarantine"}, s.cmdMediaQuarantine},
+		{[]string{"hs", "registration-token", "create"}, func(userID string, args []string) (interface{}, error) {
+			return s.cmdRegistrationTokenCreate(cli, userID, args)
+		}},
+		{[]string{"hs", "confirm"}, s.cmdConfirm},
+	}
+	var commands []types.Command
+	for _, h := range handlers {
+		h := h
+		commands = append(commands, types.Command{
+			Path: h.path,
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if !s.isAllowed(roomID, userID) {
+					return nil, errors.New("You are not allowed to run admin commands here")
+				}
+				return h.command(userID, args)
+			},
+		})
+	}
+	return commands
+}
+
+func (s *Service) cmdUserInfo(userID string, args []string) (interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "@") {
+		return nil, errors.New("Usage: !hs user info @user:server")
+	}
+	var user struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayname"`
+		Admin       bool   `json:"admin"`
+		Deactivated bool   `json:"deactivated"`
+		ShadowBan   bool   `json:"shadow_banned"`
+		CreationTS  int64  `json:"creation_ts"`
+		ThreePIDs   []struct {
+			Medium  string `json:"medium"`
+			Address string `json:"address"`
+		} `json:"threepids"`
+	}
+	if err := s.adminRequest("GET", "/_synapse/admin/v2/users/"+url.PathEscape(args[0]), nil, &user); err != nil {
+		return nil, err
+	}
+	lines := []string{
+		fmt.Sprintf("%s (%s)", user.Name, user.DisplayName),
+		fmt.Sprintf("Admin: %t, deactivated: %t, shadow banned: %t", user.Admin, user.Deactivated, user.ShadowBan),
+	}
+	if user.CreationTS > 0 {
+		// Synapse returns seconds for older accounts' creation_ts and milliseconds for newer ones
+		created := time.Unix(user.CreationTS, 0)
+		if user.CreationTS > 1e11 {
+			created = time.Unix(0, user.CreationTS*int64(time.Millisecond))
+		}
+		lines = append(lines, "Created: "+created.UTC().Format(time.RFC3339))
+	}
+	for _, t := range user.ThreePIDs {
+		lines = append(lines, fmt.Sprintf("%s: %s", t.Medium, t.Address))
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+}
+
+func (s *Service) cmdUserDeactivate(userID string, args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 || !strings.HasPrefix(args[0], "@") || (len(args) == 2 && args[1] != "erase") {
+		return nil, errors.New("Usage: !hs user deactivate @user:server [erase]")
+	}
+	target := args[0]
+	erase := len(args) == 2
+	description := "deactivate " + target
+	if erase {
+		description += " and erase their messages"
+	}
+	return s.requireConfirmation(userID, description, func() (interface{}, error) {
+		body := map[string]bool{"erase": erase}
+		if err := s.adminRequest("POST", "/_synapse/admin/v1/deactivate/"+url.PathEscape(target), body, nil); err != nil {
+			return nil, err
+		}
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Deactivated " + target}, nil
+	})
+}
+
+func (s *Service) cmdUserResetPassword(cli *gomatrix.Client, userID string, args []string) (interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "@") {
+		return nil, errors.New("Usage: !hs user reset-password @user:server")
+	}
+	target := args[0]
+	return s.requireConfirmation(userID, "reset the password of "+target+" and log out their devices", func() (interface{}, error) {
+		password, err := randomPassword()
+		if err != nil {
+			return nil, err
+		}
+		body := map[string]interface{}{
+			"new_password":   password,
+			"logout_devices": true,
+		}
+		if err := s.adminRequest("POST", "/_synapse/admin/v1/reset_password/"+url.PathEscape(target), body, nil); err != nil {
+			return nil, err
+		}
+		err = sendDirectMessage(cli, userID, &gomatrix.TextMessage{
+			MsgType: "m.notice",
+			Body:    fmt.Sprintf("Reset the password of %s to: %s", target, password),
+		})
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("Failed to send new password")
+			return nil, fmt.Errorf("Reset the password of %s, but failed to send it to you. Reset it again to get a new one", target)
+		}
+		return &gomatrix.TextMessage{
+			MsgType: "m.notice",
+			Body:    fmt.Sprintf("Reset the password of %s. The new password has been sent to you in a direct message", target),
+		}, nil
+	})
+}
+
+// sendDirectMessage creates a direct message room with the user and sends a message into it.
+func sendDirectMessage(cli *gomatrix.Client, userID string, content interface{}) error {
+	room, err := cli.CreateRoom(&gomatrix.ReqCreateRoom{
+		Invite:   []string{userID},
+		IsDirect: true,
+		Preset:   "trusted_private_chat",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cli.SendMessageEvent(room.RoomID, "m.room.message", content)
+	return err
+}
+
+func (s *Service) cmdRoomInfo(userID string, args []string) (interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "!") {
+		return nil, errors.New("Usage: !hs room info !room:server")
+	}
+	var room struct {
+		RoomID             string `json:"room_id"`
+		Name               string `json:"name"`
+		CanonicalAlias     string `json:"canonical_alias"`
+		JoinedMembers      int    `json:"joined_members"`
+		JoinedLocalMembers int    `json:"joined_local_members"`
+		Creator            string `json:"creator"`
+		Version            string `json:"version"`
+		Encryption         string `json:"encryption"`
+		Public             bool   `json:"public"`
+		StateEvents        int    `json:"state_events"`
+	}
+	if err := s.adminRequest("GET", "/_synapse/admin/v1/rooms/"+url.PathEscape(args[0]), nil, &room); err != nil {
+		return nil, err
+	}
+	lines := []string{
+		fmt.Sprintf("%s %s %s", room.RoomID, room.CanonicalAlias, room.Name),
+		fmt.Sprintf("Members: %d (%d local)", room.JoinedMembers, room.JoinedLocalMembers),
+		fmt.Sprintf("Creator: %s, version: %s, public: %t", room.Creator, room.Version, room.Public),
+		fmt.Sprintf("State events: %d", room.StateEvents),
+	}
+	if room.Encryption != "" {
+		lines = append(lines, "Encryption: "+room.Encryption)
+	}
+	return &gomatrix.TextMessage{MsgType: "m.notice", Body: strings.Join(lines, "\n")}, nil
+}
+
+func (s *Service) cmdRoomPurgeHistory(userID string, args []string) (interface{}, error) {
+	if len(args) != 2 || !strings.HasPrefix(args[0], "!") {
+		return nil, errors.New("Usage: !hs room purge-history !room:server <age e.g. 30d>")
+	}
+	target := args[0]
+	age, err := parseDuration(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return s.requireConfirmation(userID, "purge the history of "+target+" older than "+args[1], func() (interface{}, error) {
+		body := map[string]interface{}{
+			"delete_local_events": false,
+			"purge_up_to_ts":      time.Now().Add(-age).UnixNano() / int64(time.Millisecond),
+		}
+		var res struct {
+			PurgeID string `json:"purge_id"`
+		}
+		if err := s.adminRequest("POST", "/_synapse/admin/v1/purge_history/"+url.PathEscape(target), body, &res); err != nil {
+			return nil, err
+		}
+		return &gomatrix.TextMessage{
+			MsgType: "m.notice",
+			Body:    fmt.Sprintf("Started purging history of %s (purge ID %s)", target, res.PurgeID),
+		}, nil
+	})
+}
+
+func (s *Service) cmdRoomBlock(userID string, args []string) (interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "!") {
+		return nil, errors.New("Usage: !hs room block !room:server")
+	}
+	target := args[0]
+	return s.requireConfirmation(userID, "block "+target+" on this server", func() (interface{}, error) {
+		body := map[string]bool{"block": true}
+		if err := s.adminRequest("PUT", "/_synapse/admin/v1/rooms/"+url.PathEscape(target)+"/block", body, nil); err != nil {
+			return nil, err
+		}
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Blocked " + target}, nil
+	})
+}
+
+func (s *Service) cmdMediaQuarantine(userID string, args []string) (interface{}, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "mxc://") {
+		return nil, errors.New("Usage: !hs media quarantine mxc://server/mediaid")
+	}
+	segs := strings.SplitN(strings.TrimPrefix(args[0], "mxc://"), "/", 2)
+	if len(segs) != 2 || segs[0] == "" || segs[1] == "" {
+		return nil, fmt.Errorf("'%s' is not a valid mxc:// URI", args[0])
+	}
+	target := args[0]
+	return s.requireConfirmation(userID, "quarantine "+target, func() (interface{}, error) {
+		path := "/_synapse/admin/v1/media/quarantine/" + url.PathEscape(segs[0]) + "/" + url.PathEscape(segs[1])
+		if err := s.adminRequest("POST", path, map[string]interface{}{}, nil); err != nil {
+			return nil, err
+		}
+		return &gomatrix.TextMessage{MsgType: "m.notice", Body: "Quarantined " + target}, nil
+	})
+}
+
+func (s *Service) cmdRegistrationTokenCreate(cli *gomatrix.Client, userID string, args []string) (interface{}, error) {
+	if len(args) > 2 {
+		return nil, errors.New("Usage: !hs registration-token create [uses] [expiry e.g. 7d]")
+	}
+	body := make(map[string]interface{})
+	if len(args) > 0 {
+		uses, err := strconv.Atoi(args[0])
+		if err != nil || uses <= 0 {
+			return nil, fmt.Errorf("'%s' is not a number of uses", args[0])
+		}
+		body["uses_allowed"] = uses
+	}
+	if len(args) > 1 {
+		expiry, err := parseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		body["expiry_time"] = time.Now().Add(expiry).UnixNano() / int64(time.Millisecond)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		UsesAllowed *int   `json:"uses_allowed"`
+		ExpiryTime  *int64 `json:"expiry_time"`
+	}
+	if err := s.adminRequest("POST", "/_synapse/admin/v1/registration_tokens/new", body, &token); err != nil {
+		return nil, err
+	}
+	var details string
+	if token.UsesAllowed != nil {
+		details += fmt.Sprintf(", valid for %d uses", *token.UsesAllowed)
+	}
+	if token.ExpiryTime != nil {
+		details += ", expires " + time.Unix(0, *token.ExpiryTime*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	}
+	err := sendDirectMessage(cli, userID, &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    "Created registration token " + token.Token + details,
+	})
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to send registration token")
+		// Nobody knows the token, so don't leave it usable
+		if err := s.adminRequest("DELETE", "/_synapse/admin/v1/registration_tokens/"+url.PathEscape(token.Token), nil, nil); err != nil {
+			log.WithError(err).Error("Failed to delete registration token")
+		}
+		return nil, errors.New("Created a registration token, but failed to send it to you. Create another one")
+	}
+	return &gomatrix.TextMessage{
+		MsgType: "m.notice",
+		Body:    "Created a registration token" + details + ". It has been sent to you in a direct message",
+	}, nil
+}
+
+// parseDuration parses an age such as "30d", "12h" or "90m".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("'%s' is not a duration such as 30d or 12h", s)
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package synapseadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// synapse stands in for the Synapse admin API, recording the requests it receives.
+type synapse struct {
+	requests []string
+	bodies   []map[string]interface{}
+}
+
+func (syn *synapse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer admin_token" {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`))
+		return
+	}
+	syn.requests = append(syn.requests, r.Method+" "+r.URL.EscapedPath())
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	syn.bodies = append(syn.bodies, body)
+	switch r.URL.EscapedPath() {
+	case "/_synapse/admin/v2/users/@link:hyrule":
+		w.Write([]byte(`{"name":"@link:hyrule","displayname":"Link","admin":false,"deactivated":false,
+			"creation_ts":1560432506,"threepids":[{"medium":"email","address":"link@hyrule"}]}`))
+	case "/_synapse/admin/v2/users/@nobody:hyrule":
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"User not found"}`))
+	case "/_synapse/admin/v1/purge_history/%21castle:hyrule":
+		w.Write([]byte(`{"purge_id":"abcdef"}`))
+	case "/_synapse/admin/v1/registration_tokens/new":
+		w.Write([]byte(`{"token":"abcd","uses_allowed":5,"expiry_time":null}`))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+// matrixRequests records the requests the bot makes to the homeserver's client-server API.
+var matrixRequests []string
+
+func newService(t *testing.T, url string) (*Service, []types.Command) {
+	matrixRequests = nil
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+		matrixRequests = append(matrixRequests, req.Method+" "+req.URL.Path+" "+string(body))
+		res := `{}`
+		if strings.HasSuffix(req.URL.Path, "/createRoom") {
+			res = `{"room_id":"!dm:hyrule"}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(res)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	s := testutils.NewService(t, ServiceType, `{
+		"homeserver_url": "`+url+`/",
+		"admin_access_token": "admin_token",
+		"room_id": "!admins:hyrule",
+		"allowed_users": ["@zelda:hyrule"]
+	}`, cli).(*Service)
+	return s, s.Commands(cli)
+}
+
+func TestAllowlist(t *testing.T) {
+	syn := &synapse{}
+	srv := httptest.NewServer(syn)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+
+	if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@ganon:hyrule", "hs user info @link:hyrule"); err == nil {
+		t.Errorf("Expected a user who isn't allowed to be rejected")
+	}
+	if _, err := testutils.RunTextCommand(cmds, "!other:hyrule", "@zelda:hyrule", "hs user info @link:hyrule"); err == nil {
+		t.Errorf("Expected a command from another room to be rejected")
+	}
+	if len(syn.requests) != 0 {
+		t.Errorf("Expected no admin API requests, got %v", syn.requests)
+	}
+
+	body, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs user info @link:hyrule")
+	if err != nil {
+		t.Fatalf("user info returned error: %s", err)
+	}
+	for _, want := range []string{"@link:hyrule (Link)", "Created: 2019-06-13T13:28:26Z", "email: link@hyrule"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected user info to contain %q, got:\n%s", want, body)
+		}
+	}
+	_, err = testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs user info @nobody:hyrule")
+	if err == nil || err.Error() != "Homeserver returned 404: M_NOT_FOUND: User not found" {
+		t.Errorf("Expected the Matrix error to be returned, got %v", err)
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	syn := &synapse{}
+	srv := httptest.NewServer(syn)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+	confirmationCode = func() string { return "c0ffee" }
+
+	body, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs room purge-history !castle:hyrule 30d")
+	if err != nil {
+		t.Fatalf("purge-history returned error: %s", err)
+	}
+	if !strings.Contains(body, "!hs confirm c0ffee") {
+		t.Fatalf("Expected to be asked to confirm, got %s", body)
+	}
+	if len(syn.requests) != 0 {
+		t.Fatalf("Expected nothing to happen before confirming, got %v", syn.requests)
+	}
+	// Only the user who asked can confirm
+	if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@ganon:hyrule", "hs confirm c0ffee"); err == nil {
+		t.Fatalf("Expected another user's confirmation to be rejected")
+	}
+	body, err = testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs confirm c0ffee")
+	if err != nil {
+		t.Fatalf("confirm returned error: %s", err)
+	}
+	if body != "Started purging history of !castle:hyrule (purge ID abcdef)" {
+		t.Errorf("Unexpected response: %s", body)
+	}
+	if len(syn.requests) != 1 || syn.requests[0] != "POST /_synapse/admin/v1/purge_history/%21castle:hyrule" {
+		t.Fatalf("Unexpected requests: %v", syn.requests)
+	}
+	if syn.bodies[0]["delete_local_events"] != false || syn.bodies[0]["purge_up_to_ts"] == nil {
+		t.Errorf("Unexpected purge request body: %v", syn.bodies[0])
+	}
+	// Codes can only be used once
+	if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs confirm c0ffee"); err == nil {
+		t.Errorf("Expected a used confirmation code to be rejected")
+	}
+
+	for text, want := range map[string]string{
+		"hs user deactivate @link:hyrule erase": "POST /_synapse/admin/v1/deactivate/@link:hyrule",
+		"hs room block !castle:hyrule":          "PUT /_synapse/admin/v1/rooms/%21castle:hyrule/block",
+		"hs media quarantine mxc://hyrule/abc":  "POST /_synapse/admin/v1/media/quarantine/hyrule/abc",
+		"hs user reset-password @link:hyrule":   "POST /_synapse/admin/v1/reset_password/@link:hyrule",
+	} {
+		syn.requests = nil
+		if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", text); err != nil {
+			t.Errorf("%s returned error: %s", text, err)
+			continue
+		}
+		if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs confirm c0ffee"); err != nil {
+			t.Errorf("%s: confirm returned error: %s", text, err)
+			continue
+		}
+		if len(syn.requests) != 1 || syn.requests[0] != want {
+			t.Errorf("%s: want request %s got %v", text, want, syn.requests)
+		}
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	syn := &synapse{}
+	srv := httptest.NewServer(syn)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+	confirmationCode = func() string { return "c0ffee" }
+	matrixRequests = nil
+
+	if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs user reset-password @link:hyrule"); err != nil {
+		t.Fatalf("reset-password returned error: %s", err)
+	}
+	body, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs confirm c0ffee")
+	if err != nil {
+		t.Fatalf("confirm returned error: %s", err)
+	}
+	password, _ := syn.bodies[0]["new_password"].(string)
+	if password == "" || strings.Contains(body, password) {
+		t.Errorf("Expected the new password not to be sent in the admin room, got %s", body)
+	}
+	// The password is sent to the admin who ran the command in a new DM
+	if len(matrixRequests) != 2 ||
+		!strings.HasPrefix(matrixRequests[0], "POST /_matrix/client/r0/createRoom") ||
+		!strings.Contains(matrixRequests[0], `"invite":["@zelda:hyrule"]`) ||
+		!strings.Contains(matrixRequests[0], `"is_direct":true`) ||
+		!strings.HasPrefix(matrixRequests[1], "PUT /_matrix/client/r0/rooms/!dm:hyrule/send/m.room.message/") ||
+		!strings.Contains(matrixRequests[1], password) {
+		t.Errorf("Expected the new password to be sent in a DM, got %v", matrixRequests)
+	}
+}
+
+func TestRegistrationToken(t *testing.T) {
+	syn := &synapse{}
+	srv := httptest.NewServer(syn)
+	defer srv.Close()
+	_, cmds := newService(t, srv.URL)
+	matrixRequests = nil
+
+	body, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs registration-token create 5 7d")
+	if err != nil {
+		t.Fatalf("registration-token create returned error: %s", err)
+	}
+	if body != "Created a registration token, valid for 5 uses. It has been sent to you in a direct message" {
+		t.Errorf("Unexpected response: %s", body)
+	}
+	// The token is sent to the admin who ran the command in a new DM
+	if len(matrixRequests) != 2 ||
+		!strings.HasPrefix(matrixRequests[0], "POST /_matrix/client/r0/createRoom") ||
+		!strings.Contains(matrixRequests[0], `"invite":["@zelda:hyrule"]`) ||
+		!strings.HasPrefix(matrixRequests[1], "PUT /_matrix/client/r0/rooms/!dm:hyrule/send/m.room.message/") ||
+		!strings.Contains(matrixRequests[1], "Created registration token abcd, valid for 5 uses") {
+		t.Errorf("Expected the token to be sent in a DM, got %v", matrixRequests)
+	}
+	if syn.bodies[0]["uses_allowed"] != float64(5) || syn.bodies[0]["expiry_time"] == nil {
+		t.Errorf("Unexpected request body: %v", syn.bodies[0])
+	}
+	if _, err := testutils.RunTextCommand(cmds, "!admins:hyrule", "@zelda:hyrule", "hs registration-token create lots"); err == nil {
+		t.Errorf("Expected an invalid number of uses to be rejected")
+	}
+}
@@ -0,0 +1,317 @@
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// The largest syslog message we will accept.
+const maxMessageSize = 64 * 1024
+
+// A listener receives syslog messages for a single service.
+type listener struct {
+	mu      sync.Mutex
+	service *Service
+	cli     *gomatrix.Client
+	config  string // addresses and aggregation window, to detect config changes
+
+	udpConn net.PacketConn
+	tcpLn   net.Listener
+	stop    chan struct{}
+	agg     *aggregator
+}
+
+var (
+	listenersMutex sync.Mutex
+	listeners      = make(map[string]*listener) // service ID => listener
+)
+
+// listenerFor returns the listener for this service, replacing it if the addresses or the
+// aggregation window have changed.
+func listenerFor(s *Service, cli *gomatrix.Client) *listener {
+	config := fmt.Sprintf("%s|%s|%s", s.UDPAddress, s.TCPAddress, s.aggregateWindow())
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	l := listeners[s.ServiceID()]
+	if l != nil && l.config == config {
+		l.mu.Lock()
+		l.service = s
+		l.cli = cli
+		l.mu.Unlock()
+		return l
+	}
+	if l != nil {
+		l.close()
+	}
+	l = &listener{
+		service: s,
+		cli:     cli,
+		config:  config,
+	}
+	listeners[s.ServiceID()] = l
+	return l
+}
+
+// stopListener stops listening for the given service ID.
+func stopListener(serviceID string) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	if l := listeners[serviceID]; l != nil {
+		l.close()
+		delete(listeners, serviceID)
+	}
+}
+
+func (l *listener) ensureListening() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		l.stop = make(chan struct{})
+		l.agg = newAggregator()
+		go l.flushLoop(l.stop, l.service.aggregateWindow())
+	}
+	if l.udpConn == nil && l.service.UDPAddress != "" {
+		conn, err := net.ListenPacket("udp", l.service.UDPAddress)
+		if err != nil {
+			return err
+		}
+		l.udpConn = conn
+		go l.serveUDP(conn)
+	}
+	if l.tcpLn == nil && l.service.TCPAddress != "" {
+		ln, err := net.Listen("tcp", l.service.TCPAddress)
+		if err != nil {
+			return err
+		}
+		l.tcpLn = ln
+		go l.serveTCP(ln)
+	}
+	return nil
+}
+
+func (l *listener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	if l.udpConn != nil {
+		l.udpConn.Close()
+		l.udpConn = nil
+	}
+	if l.tcpLn != nil {
+		l.tcpLn.Close()
+		l.tcpLn = nil
+	}
+}
+
+func (l *listener) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			if l.udpConn == conn {
+				// not closed by us, so listen again on the next poll
+				log.WithError(err).Error("Failed to read syslog message over UDP")
+				l.udpConn = nil
+			}
+			l.mu.Unlock()
+			return
+		}
+		l.handle(string(buf[:n]))
+	}
+}
+
+func (l *listener) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			if l.tcpLn == ln {
+				log.WithError(err).Error("Failed to accept syslog connection")
+				l.tcpLn = nil
+			}
+			l.mu.Unlock()
+			return
+		}
+		go l.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn reads messages which are either newline delimited or octet counted (RFC 6587).
+func (l *listener) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		line, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				log.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warn("Dropping syslog connection")
+			}
+			return
+		}
+		if line != "" {
+			l.handle(line)
+		}
+	}
+}
+
+// readFrame reads a single syslog message from a TCP stream.
+func readFrame(r *bufio.Reader) (string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		// octet counting: MSG-LEN SP SYSLOG-MSG
+		lenStr, err := r.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+		if err != nil || n > maxMessageSize {
+			return "", fmt.Errorf("invalid message length '%s'", lenStr)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// handle routes a single raw syslog message.
+func (l *listener) handle(raw string) {
+	l.mu.Lock()
+	s, cli, agg := l.service, l.cli, l.agg
+	l.mu.Unlock()
+	m, err := parseMessage(raw, time.Now())
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Debug("Ignoring malformed syslog message")
+		return
+	}
+	for roomID, urgent := range s.route(m) {
+		if agg.offer(roomID, m, urgent, s.MaxMessagesPerWindow) {
+			send(cli, roomID, formatMessage(m, ""), urgent)
+		}
+	}
+}
+
+func (l *listener) flushLoop(stop chan struct{}, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			cli, agg := l.cli, l.agg
+			l.mu.Unlock()
+			for _, p := range agg.flush() {
+				send(cli, p.roomID, p.content(), p.urgent)
+			}
+		}
+	}
+}
+
+type aggregateKey struct {
+	roomID, hostname, appName, message string
+}
+
+// A summary is sent at the end of an aggregation window for repeated or suppressed messages.
+type summary struct {
+	roomID     string
+	msg        *Message // the repeated message, or nil for a count of suppressed messages
+	count      int
+	suppressed int
+	urgent     bool
+}
+
+func (p *summary) content() gomatrix.HTMLMessage {
+	if p.msg != nil {
+		return formatMessage(p.msg, fmt.Sprintf("(repeated %d times)", p.count))
+	}
+	return gomatrix.HTMLMessage{
+		Body:          fmt.Sprintf("%d further syslog messages were suppressed by rate limiting", p.suppressed),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: fmt.Sprintf("<em>%d further syslog messages were suppressed by rate limiting</em>", p.suppressed),
+	}
+}
+
+// aggregator collapses repeated messages and rate limits rooms within a window.
+type aggregator struct {
+	mu         sync.Mutex
+	repeats    map[aggregateKey]*summary
+	order      []aggregateKey
+	sent       map[string]int // room ID => messages sent this window
+	suppressed map[string]int // room ID => messages dropped this window
+}
+
+func newAggregator() *aggregator {
+	a := &aggregator{}
+	a.reset()
+	return a
+}
+
+func (a *aggregator) reset() {
+	a.repeats = make(map[aggregateKey]*summary)
+	a.order = nil
+	a.sent = make(map[string]int)
+	a.suppressed = make(map[string]int)
+}
+
+// offer returns true if the message should be sent into the room now. Otherwise it is counted
+// as a repeat or as suppressed, to be summarised by flush.
+func (a *aggregator) offer(roomID string, m *Message, urgent bool, maxPerWindow int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := aggregateKey{roomID, m.Hostname, m.AppName, m.Message}
+	if p, ok := a.repeats[key]; ok {
+		p.count++
+		p.msg = m
+		return false
+	}
+	if maxPerWindow > 0 && a.sent[roomID] >= maxPerWindow {
+		a.suppressed[roomID]++
+		return false
+	}
+	a.repeats[key] = &summary{roomID: roomID, urgent: urgent}
+	a.order = append(a.order, key)
+	a.sent[roomID]++
+	return true
+}
+
+// flush returns the summaries for the window which just ended and starts a new one.
+func (a *aggregator) flush() []summary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var summaries []summary
+	for _, key := range a.order {
+		if p := a.repeats[key]; p.count > 0 {
+			summaries = append(summaries, *p)
+		}
+	}
+	for roomID, n := range a.suppressed {
+		summaries = append(summaries, summary{roomID: roomID, suppressed: n})
+	}
+	a.reset()
+	return summaries
+}
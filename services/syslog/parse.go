@@ -0,0 +1,172 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Facility names, indexed by facility code.
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Severity names, indexed by severity code. Lower is more severe.
+var severityNames = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// Message is a parsed syslog message.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	Message   string
+}
+
+// FacilityName returns the name of the message's facility e.g. "auth".
+func (m *Message) FacilityName() string {
+	return facilityNames[m.Facility]
+}
+
+// SeverityName returns the name of the message's severity e.g. "warning".
+func (m *Message) SeverityName() string {
+	return severityNames[m.Severity]
+}
+
+// parseFacility returns the facility code for the given name.
+func parseFacility(name string) (int, error) {
+	for i, n := range facilityNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown facility '%s'", name)
+}
+
+// parseSeverity returns the severity code for the given name. Common aliases are accepted.
+func parseSeverity(name string) (int, error) {
+	switch name {
+	case "panic":
+		return 0, nil
+	case "critical":
+		return 2, nil
+	case "error":
+		return 3, nil
+	case "warn":
+		return 4, nil
+	}
+	for i, n := range severityNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity '%s'", name)
+}
+
+// parseMessage parses an RFC 5424 or RFC 3164 syslog message. Messages which don't have a valid
+// timestamp or hostname are still accepted, as plenty of devices don't send them.
+func parseMessage(line string, now time.Time) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n\x00")
+	if !strings.HasPrefix(line, "<") {
+		return nil, errors.New("missing PRI")
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("malformed PRI")
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errors.New("malformed PRI")
+	}
+	msg := &Message{
+		Facility:  pri / 8,
+		Severity:  pri % 8,
+		Timestamp: now,
+	}
+	rest := line[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		parse5424(msg, rest[2:])
+	} else {
+		parse3164(msg, rest, now)
+	}
+	return msg, nil
+}
+
+// parse5424 parses the remainder of an RFC 5424 message after "<PRI>1 ":
+//   TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func parse5424(msg *Message, rest string) {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 6 {
+		msg.Message = rest
+		return
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		msg.Timestamp = ts
+	}
+	msg.Hostname = nilValue(fields[1])
+	msg.AppName = nilValue(fields[2])
+	// fields[3] and fields[4] are PROCID and MSGID, which we don't use.
+	msg.Message = strings.TrimPrefix(skipStructuredData(fields[5]), "\ufeff")
+}
+
+// skipStructuredData returns the MSG following the STRUCTURED-DATA at the start of s.
+func skipStructuredData(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " ")
+	}
+	inElement := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++ // skip escaped character
+		case s[i] == '[':
+			inElement = true
+		case s[i] == ']':
+			inElement = false
+		case s[i] == ' ' && !inElement:
+			return s[i+1:]
+		}
+	}
+	return ""
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// parse3164 parses the remainder of an RFC 3164 message after "<PRI>":
+//   Mmm dd hh:mm:ss HOSTNAME TAG: MSG
+func parse3164(msg *Message, rest string, now time.Time) {
+	const stampLen = len(time.Stamp)
+	if len(rest) > stampLen && rest[stampLen] == ' ' {
+		if ts, err := time.Parse(time.Stamp, rest[:stampLen]); err == nil {
+			// RFC 3164 timestamps have no year or time zone
+			msg.Timestamp = time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, now.Location())
+			rest = rest[stampLen+1:]
+			if sp := strings.IndexByte(rest, ' '); sp > 0 && !strings.HasSuffix(rest[:sp], ":") {
+				msg.Hostname = rest[:sp]
+				rest = rest[sp+1:]
+			}
+		}
+	}
+	// The TAG is alphanumeric, optionally followed by "[pid]", then a colon
+	if colon := strings.Index(rest, ": "); colon > 0 && !strings.ContainsAny(rest[:colon], " ") {
+		tag := rest[:colon]
+		if bracket := strings.IndexByte(tag, '['); bracket > 0 {
+			tag = tag[:bracket]
+		}
+		msg.AppName = tag
+		rest = rest[colon+2:]
+	}
+	msg.Message = rest
+}
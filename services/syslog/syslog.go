@@ -0,0 +1,328 @@
+// Package syslog implements a Service which receives syslog messages and sends them into Matrix rooms.
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType of the Syslog service.
+const ServiceType = "syslog"
+
+// How often to check that the listeners are still running.
+const healthCheckInterval = 30 * time.Second
+
+const defaultAggregateSecs = 60
+
+// Rule decides which syslog messages are sent into which rooms. Every condition which is set must
+// match for a message to be sent.
+type Rule struct {
+	// The list of rooms to send matching messages to. This cannot be empty.
+	Rooms []string `json:"rooms"`
+	// Optional. The facilities to match e.g. ["auth", "daemon", "local0"]. Matches all if empty.
+	Facilities []string `json:"facilities"`
+	// Optional. The least severe severity to match e.g. "warning" matches "warning", "err", "crit",
+	// "alert" and "emerg". Matches all if empty.
+	Severity string `json:"severity"`
+	// Optional. A regular expression which the sending host name must match.
+	HostRegex string `json:"host_regex"`
+	// Optional. A regular expression which the message text must match.
+	MessageRegex string `json:"message_regex"`
+	// Optional. True to deliver matching messages even if the room is in quiet hours.
+	Urgent bool `json:"urgent"`
+
+	facilities   map[int]bool
+	severity     int
+	hostRegex    *regexp.Regexp
+	messageRegex *regexp.Regexp
+}
+
+// compile parses the rule's conditions. It must be called before matches.
+func (r *Rule) compile() (err error) {
+	if len(r.Rooms) == 0 {
+		return errors.New("no rooms to send messages to")
+	}
+	r.facilities = make(map[int]bool)
+	for _, name := range r.Facilities {
+		f, err := parseFacility(name)
+		if err != nil {
+			return err
+		}
+		r.facilities[f] = true
+	}
+	r.severity = len(severityNames) - 1
+	if r.Severity != "" {
+		if r.severity, err = parseSeverity(r.Severity); err != nil {
+			return err
+		}
+	}
+	if r.HostRegex != "" {
+		if r.hostRegex, err = regexp.Compile(r.HostRegex); err != nil {
+			return fmt.Errorf("host_regex: %s", err)
+		}
+	}
+	if r.MessageRegex != "" {
+		if r.messageRegex, err = regexp.Compile(r.MessageRegex); err != nil {
+			return fmt.Errorf("message_regex: %s", err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(m *Message) bool {
+	if len(r.facilities) > 0 && !r.facilities[m.Facility] {
+		return false
+	}
+	if m.Severity > r.severity {
+		return false
+	}
+	if r.hostRegex != nil && !r.hostRegex.MatchString(m.Hostname) {
+		return false
+	}
+	if r.messageRegex != nil && !r.messageRegex.MatchString(m.Message) {
+		return false
+	}
+	return true
+}
+
+// Service contains the Config fields for the Syslog service.
+//
+// This service listens for syslog messages over UDP and/or TCP, in either RFC 5424 or RFC 3164
+// (BSD) format, and sends the messages which match a rule into Matrix rooms. TCP messages may be
+// newline delimited or use octet counting (RFC 6587).
+//
+// Identical messages from the same host are aggregated: the first is sent immediately, and any
+// repeats within the aggregation window are summarised as e.g. "(repeated 42 times)" when the
+// window ends. Each room is also limited to a maximum number of messages per window, with the
+// remainder being counted and reported at the end of the window.
+//
+// Example JSON request:
+//   {
+//       "udp_address": ":5514",
+//       "tcp_address": ":5514",
+//       "aggregate_secs": 60,
+//       "max_messages_per_window": 20,
+//       "rules": [
+//           {
+//               "rooms": ["!ewfug483gsfe:localhost"],
+//               "facilities": ["auth", "authpriv"],
+//               "severity": "warning"
+//           },
+//           {
+//               "rooms": ["!ewfug483gsfe:localhost"],
+//               "host_regex": "^core-router-\\d+$",
+//               "message_regex": "(?i)link down",
+//               "urgent": true
+//           }
+//       ]
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The address to listen for UDP syslog messages on, e.g. ":514".
+	UDPAddress string `json:"udp_address"`
+	// Optional. The address to listen for TCP syslog messages on, e.g. ":514".
+	TCPAddress string `json:"tcp_address"`
+	// Optional. How long to aggregate repeated messages for, in seconds. Defaults to 60.
+	AggregateSecs int `json:"aggregate_secs"`
+	// Optional. The maximum number of messages to send into each room per aggregation window.
+	// 0 means no limit.
+	MaxMessagesPerWindow int `json:"max_messages_per_window"`
+	// The rules which decide which messages are sent into which rooms.
+	Rules []Rule `json:"rules"`
+	// True if the service is unable to listen on the configured addresses. This is populated by
+	// Go-NEB. Use /getService to retrieve this value.
+	IsFailing bool `json:"is_failing"`
+
+	// The compiled copy of Rules which messages are routed with. Listeners read it while OnPoll
+	// replaces it, so it is guarded by rulesMutex.
+	rulesMutex sync.RWMutex
+	compiled   []Rule
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if len(s.Rules) == 0 {
+		// this is an error UNLESS the old service had some rules in which case they are deleting us
+		old, ok := oldService.(*Service)
+		if !ok || len(old.Rules) == 0 {
+			return errors.New("At least one rule must be specified")
+		}
+		return nil
+	}
+	if s.UDPAddress == "" && s.TCPAddress == "" {
+		return errors.New("At least one of udp_address or tcp_address must be specified")
+	}
+	for _, addr := range []string{s.UDPAddress, s.TCPAddress} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid address '%s': %s", addr, err)
+		}
+	}
+	if s.AggregateSecs < 0 || s.MaxMessagesPerWindow < 0 {
+		return errors.New("aggregate_secs and max_messages_per_window cannot be negative")
+	}
+	if err := s.compileRules(); err != nil {
+		return err
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// compileRules compiles a copy of the rules and swaps it in for routing.
+func (s *Service) compileRules() error {
+	rules := make([]Rule, len(s.Rules))
+	copy(rules, s.Rules)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("rules[%d]: %s", i, err)
+		}
+	}
+	s.rulesMutex.Lock()
+	s.compiled = rules
+	s.rulesMutex.Unlock()
+	return nil
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client) {
+	roomSet := make(map[string]bool)
+	for _, r := range s.Rules {
+		for _, roomID := range r.Rooms {
+			roomSet[roomID] = true
+		}
+	}
+	for roomID := range roomSet {
+		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+				"user_id":    client.UserID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// PostRegister deletes this service if there are no rules remaining.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rules) == 0 {
+		logger := log.WithFields(log.Fields{
+			"service_id":   s.ServiceID(),
+			"service_type": s.ServiceType(),
+		})
+		logger.Info("Deleting service: No rules remaining.")
+		polling.StopPolling(s)
+		stopListener(s.ServiceID())
+		if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+	}
+}
+
+// OnPoll makes sure the service is listening on the configured addresses.
+func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	// Services loaded from the database haven't been through Register
+	if err := s.compileRules(); err != nil {
+		logger.WithError(err).Error("Failed to compile rules")
+		return time.Now().Add(healthCheckInterval)
+	}
+	if err := listenerFor(s, cli).ensureListening(); err != nil {
+		logger.WithError(err).Error("Failed to listen for syslog messages")
+		s.setFailing(true)
+	} else {
+		s.setFailing(false)
+	}
+	return time.Now().Add(healthCheckInterval)
+}
+
+func (s *Service) setFailing(failing bool) {
+	if s.IsFailing == failing {
+		return
+	}
+	s.IsFailing = failing
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist failing state")
+	}
+}
+
+func (s *Service) aggregateWindow() time.Duration {
+	if s.AggregateSecs == 0 {
+		return defaultAggregateSecs * time.Second
+	}
+	return time.Duration(s.AggregateSecs) * time.Second
+}
+
+// route returns the rooms the message should be sent to, and whether it is urgent in each room.
+func (s *Service) route(m *Message) map[string]bool {
+	s.rulesMutex.RLock()
+	rules := s.compiled
+	s.rulesMutex.RUnlock()
+	rooms := make(map[string]bool)
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(m) {
+			continue
+		}
+		for _, roomID := range r.Rooms {
+			rooms[roomID] = rooms[roomID] || r.Urgent
+		}
+	}
+	return rooms
+}
+
+// formatMessage renders a syslog message, with a suffix such as "(repeated 3 times)".
+func formatMessage(m *Message, suffix string) gomatrix.HTMLMessage {
+	source := m.Hostname
+	if m.AppName != "" {
+		source = strings.TrimSpace(source + " " + m.AppName)
+	}
+	plain := fmt.Sprintf("[%s.%s] %s: %s", m.FacilityName(), m.SeverityName(), source, m.Message)
+	formatted := fmt.Sprintf(
+		"<strong>[%s.%s]</strong> %s: <code>%s</code>",
+		m.FacilityName(), m.SeverityName(), html.EscapeString(source), html.EscapeString(m.Message),
+	)
+	if suffix != "" {
+		plain += " " + suffix
+		formatted += " <em>" + html.EscapeString(suffix) + "</em>"
+	}
+	return gomatrix.HTMLMessage{
+		Body:          plain,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+}
+
+func send(cli *gomatrix.Client, roomID string, content interface{}, urgent bool) {
+	if err := notify.Send(cli, roomID, content, urgent); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    roomID,
+		}).Error("Failed to send syslog message to room")
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
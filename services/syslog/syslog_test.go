@@ -0,0 +1,283 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+var now = time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC)
+
+var parseTests = []struct {
+	line   string
+	expect Message
+}{
+	{
+		"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+		Message{
+			Facility:  4,
+			Severity:  2,
+			Timestamp: time.Date(2020, 10, 11, 22, 14, 15, 0, time.UTC),
+			Hostname:  "mymachine",
+			AppName:   "su",
+			Message:   "'su root' failed for lonvick on /dev/pts/8",
+		},
+	},
+	{
+		"<13>Feb  5 17:32:18 10.0.0.99 sshd[4321]: Accepted publickey for root",
+		Message{
+			Facility:  1,
+			Severity:  5,
+			Timestamp: time.Date(2020, 2, 5, 17, 32, 18, 0, time.UTC),
+			Hostname:  "10.0.0.99",
+			AppName:   "sshd",
+			Message:   "Accepted publickey for root",
+		},
+	},
+	{
+		// no timestamp or hostname, as sent by some embedded devices
+		"<190>kernel: link down on port 7",
+		Message{Facility: 23, Severity: 6, Timestamp: now, AppName: "kernel", Message: "link down on port 7"},
+	},
+	{
+		"<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 " +
+			`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event`,
+		Message{
+			Facility:  20,
+			Severity:  5,
+			Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+			Hostname:  "mymachine.example.com",
+			AppName:   "evntslog",
+			Message:   "An application event",
+		},
+	},
+	{
+		"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed",
+		Message{
+			Facility:  4,
+			Severity:  2,
+			Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+			Hostname:  "mymachine.example.com",
+			AppName:   "su",
+			Message:   "'su root' failed",
+		},
+	},
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, test := range parseTests {
+		msg, err := parseMessage(test.line, now)
+		if err != nil {
+			t.Errorf("parseMessage(%q): unexpected error %s", test.line, err)
+			continue
+		}
+		if !msg.Timestamp.Equal(test.expect.Timestamp) {
+			t.Errorf("parseMessage(%q): want timestamp %s got %s", test.line, test.expect.Timestamp, msg.Timestamp)
+		}
+		msg.Timestamp = test.expect.Timestamp
+		if *msg != test.expect {
+			t.Errorf("parseMessage(%q): want %+v got %+v", test.line, test.expect, *msg)
+		}
+	}
+	for _, bad := range []string{"no PRI here", "<>empty", "<999>too big"} {
+		if _, err := parseMessage(bad, now); err == nil {
+			t.Errorf("parseMessage(%q): expected error", bad)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("<13>one\n10 <13>two\nxx<13>three"))
+	for _, want := range []string{"<13>one", "<13>two\nxx", "<13>three"} {
+		got, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("readFrame: unexpected error %s", err)
+		}
+		if got != want {
+			t.Errorf("readFrame: want %q got %q", want, got)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	r := Rule{
+		Rooms:        []string{"!net:hyrule"},
+		Facilities:   []string{"local7"},
+		Severity:     "warning",
+		HostRegex:    "^router",
+		MessageRegex: "(?i)link down",
+	}
+	if err := r.compile(); err != nil {
+		t.Fatalf("compile: unexpected error %s", err)
+	}
+	matching := Message{Facility: 23, Severity: 3, Hostname: "router1", Message: "Link down on port 7"}
+	if !r.matches(&matching) {
+		t.Errorf("Expected %+v to match", matching)
+	}
+	for _, m := range []Message{
+		{Facility: 22, Severity: 3, Hostname: "router1", Message: "Link down on port 7"},
+		{Facility: 23, Severity: 5, Hostname: "router1", Message: "Link down on port 7"},
+		{Facility: 23, Severity: 3, Hostname: "switch1", Message: "Link down on port 7"},
+		{Facility: 23, Severity: 3, Hostname: "router1", Message: "Link up on port 7"},
+	} {
+		if r.matches(&m) {
+			t.Errorf("Expected %+v not to match", m)
+		}
+	}
+	bad := Rule{Rooms: []string{"!net:hyrule"}, Severity: "loud"}
+	if err := bad.compile(); err == nil {
+		t.Errorf("Expected unknown severity to fail to compile")
+	}
+}
+
+// Run with -race: OnPoll recompiles the rules while listeners route messages with them.
+func TestRouteWhileRecompiling(t *testing.T) {
+	s := &Service{Rules: []Rule{{Rooms: []string{"!net:hyrule"}, HostRegex: "^router", Urgent: true}}}
+	if err := s.compileRules(); err != nil {
+		t.Fatalf("compileRules: unexpected error %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.compileRules()
+		}
+	}()
+	m := &Message{Hostname: "router1", Message: "link down"}
+	for i := 0; i < 100; i++ {
+		if rooms := s.route(m); !rooms["!net:hyrule"] {
+			t.Fatalf("Expected message to be routed urgently to !net:hyrule, got %+v", rooms)
+		}
+	}
+	<-done
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator()
+	m := &Message{Hostname: "router1", Message: "link down"}
+	if !a.offer("!room:hyrule", m, false, 2) {
+		t.Fatalf("Expected first message to be sent")
+	}
+	for i := 0; i < 41; i++ {
+		if a.offer("!room:hyrule", m, false, 2) {
+			t.Fatalf("Expected repeated message not to be sent")
+		}
+	}
+	if !a.offer("!room:hyrule", &Message{Hostname: "router2", Message: "link down"}, false, 2) {
+		t.Fatalf("Expected message from another host to be sent")
+	}
+	if a.offer("!room:hyrule", &Message{Hostname: "router3", Message: "link down"}, false, 2) {
+		t.Fatalf("Expected message over the rate limit not to be sent")
+	}
+	summaries := a.flush()
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 summaries, got %+v", summaries)
+	}
+	if body := summaries[0].content().Body; body != "[kern.emerg] router1: link down (repeated 41 times)" {
+		t.Errorf("Unexpected repeat summary: %s", body)
+	}
+	if summaries[1].suppressed != 1 {
+		t.Errorf("Expected 1 suppressed message, got %+v", summaries[1])
+	}
+	if !a.offer("!room:hyrule", m, false, 2) {
+		t.Errorf("Expected message to be sent in the next window")
+	}
+}
+
+func TestListener(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var mu sync.Mutex
+	var sent []gomatrix.HTMLMessage
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/join/") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg gomatrix.HTMLMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		sent = append(sent, msg)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:hyrule"}`)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	srv, err := types.CreateService("id", ServiceType, "@navi:hyrule", []byte(`{
+		"udp_address": "127.0.0.1:0",
+		"tcp_address": "127.0.0.1:0",
+		"rules": [{
+			"rooms": ["!auth:hyrule"],
+			"facilities": ["auth"]
+		}]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create syslog service: ", err)
+	}
+	s := srv.(*Service)
+	if err := s.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register syslog service: ", err)
+	}
+	s.OnPoll(cli)
+	defer stopListener(s.ServiceID())
+	l := listenerFor(s, cli)
+
+	udp, err := net.Dial("udp", l.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Failed to dial UDP listener: ", err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("<34>Oct 11 22:14:15 mymachine su: 'su root' failed"))
+	udp.Write([]byte("<13>Oct 11 22:14:15 mymachine cron: ignored"))
+
+	tcp, err := net.Dial("tcp", l.tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial TCP listener: ", err)
+	}
+	defer tcp.Close()
+	tcp.Write([]byte("<38>1 2003-10-11T22:14:15.003Z gate sshd - - - Accepted password\n"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(sent)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 messages, got %+v", sent)
+	}
+	bodies := sent[0].Body + "\n" + sent[1].Body
+	if !strings.Contains(bodies, "[auth.crit] mymachine su: 'su root' failed") ||
+		!strings.Contains(bodies, "[auth.info] gate sshd: Accepted password") {
+		t.Errorf("Unexpected messages: %s", bodies)
+	}
+}
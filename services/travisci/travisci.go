@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/notify"
+	"github.com/matrix-org/go-neb/statusboard"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	log "github.com/sirupsen/logrus"
@@ -42,7 +44,8 @@ var httpClient = &http.Client{}
 //           "!ewfug483gsfe:localhost": {
 //               repos: {
 //                   "matrix-org/go-neb": {
-//                       template: "%{repository}#%{build_number} (%{branch} - %{commit} : %{author}): %{message}\nBuild details : %{build_url}"
+//                       template: "%{repository}#%{build_number} (%{branch} - %{commit} : %{author}): %{message}\nBuild details : %{build_url}",
+//                       status_entry: "go-neb CI"
 //                   }
 //               }
 //           }
@@ -79,6 +82,9 @@ type Service struct {
 			//   compare_url: commit change view URL
 			//   build_url: URL of the build detail
 			Template string `json:"template"`
+			// Optional. The name of an entry on the room's status board which will be updated with
+			// the result of each build, e.g. "main branch CI". See package statusboard.
+			StatusEntry string `json:"status_entry"`
 		} `json:"repos"`
 	} `json:"rooms"`
 }
@@ -231,10 +237,17 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 				"message": msg,
 				"room_id": roomID,
 			}).Print("Sending Travis-CI notification to room")
-			if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+			if e := notify.Send(cli, roomID, msg, false); e != nil {
 				logger.WithError(e).WithField("room_id", roomID).Print(
 					"Failed to send Travis-CI notification to room.")
 			}
+			if repoData.StatusEntry != "" {
+				status := fmt.Sprintf("%s (#%s on %s)", notif.StatusMessage, notif.Number, notif.Branch)
+				if e := statusboard.Publish(cli, roomID, repoData.StatusEntry, status); e != nil {
+					logger.WithError(e).WithField("room_id", roomID).Print(
+						"Failed to update status board.")
+				}
+			}
 		}
 	}
 	w.WriteHeader(200)
@@ -0,0 +1,304 @@
+// Package statusboard maintains a persistent, at-a-glance status summary in Matrix rooms.
+//
+// Services publish named entries for a room with Publish, e.g. "main branch CI" => "passing". Go-NEB
+// combines every entry for a room into a single status board which is kept up to date as entries
+// change. Entries which have not been refreshed recently are marked as stale.
+//
+// By default the board is a single pinned message which is edited in place. A room can instead
+// use its topic as the board, or change how long entries stay fresh, by sending a
+// `m.room.bot.options` state event for the bot user which has the following `content`:
+//
+//  {
+//    "status_board": {
+//      "mode": "topic",
+//      "stale_after_mins": 120
+//    }
+//  }
+//
+// "mode" is either "message" (the default) or "topic". "stale_after_mins" defaults to 60.
+package statusboard
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// Board modes
+const (
+	ModeMessage = "message"
+	ModeTopic   = "topic"
+)
+
+const defaultStaleAfterMins = 60
+
+// How often to check whether entries have gone stale.
+const refreshInterval = 1 * time.Minute
+
+var clientPool *clients.Clients
+
+// Only one board is rendered at a time so we never create two messages for the same room.
+var renderMutex sync.Mutex
+
+// SetClients sets a pool of clients for refreshing status boards.
+func SetClients(clis *clients.Clients) {
+	clientPool = clis
+}
+
+// Options represents the "status_board" section of a room's bot options.
+type Options struct {
+	// Either "message" or "topic". Defaults to "message".
+	Mode string `json:"mode"`
+	// How long an entry can go without being published before it is marked stale. Defaults to 60.
+	StaleAfterMins int `json:"stale_after_mins"`
+}
+
+func optionsFor(userID, roomID string) Options {
+	opts := Options{
+		Mode:           ModeMessage,
+		StaleAfterMins: defaultStaleAfterMins,
+	}
+	botOpts, err := database.GetServiceDB().LoadBotOptions(userID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{
+				log.ErrorKey:  err,
+				"room_id":     roomID,
+				"bot_user_id": userID,
+			}).Error("Failed to load bot options")
+		}
+		return opts
+	}
+	sbOpts, ok := botOpts.Options["status_board"]
+	if !ok {
+		return opts
+	}
+	// Round-trip through JSON to get at the typed fields.
+	b, err := json.Marshal(sbOpts)
+	if err == nil {
+		err = json.Unmarshal(b, &opts)
+	}
+	if err != nil {
+		log.WithError(err).WithField("status_board", sbOpts).Error("Failed to parse status board options")
+	}
+	if opts.Mode != ModeTopic {
+		opts.Mode = ModeMessage
+	}
+	if opts.StaleAfterMins <= 0 {
+		opts.StaleAfterMins = defaultStaleAfterMins
+	}
+	return opts
+}
+
+// Publish sets the entry with the given name on the status board for the given room, then updates
+// the board. The entry is owned by the client's user ID.
+func Publish(cli *gomatrix.Client, roomID, name, text string) error {
+	err := database.GetServiceDB().StoreStatusEntry(types.StatusEntry{
+		UserID:    cli.UserID,
+		RoomID:    roomID,
+		Name:      name,
+		Text:      text,
+		Timestamp: time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		return err
+	}
+	return update(cli, roomID, time.Now())
+}
+
+// Remove deletes the entry with the given name from the status board for the given room, then
+// updates the board.
+func Remove(cli *gomatrix.Client, roomID, name string) error {
+	if err := database.GetServiceDB().DeleteStatusEntry(cli.UserID, roomID, name); err != nil {
+		return err
+	}
+	return update(cli, roomID, time.Now())
+}
+
+// Start periodically refreshing status boards so that stale entries are marked.
+func Start() error {
+	go func() {
+		for {
+			refresh(time.Now())
+			time.Sleep(refreshInterval)
+		}
+	}()
+	return nil
+}
+
+func refresh(now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Errorf("status board refresh panicked!\n%s", debug.Stack())
+		}
+	}()
+	boards, err := database.GetServiceDB().LoadStatusBoards()
+	if err != nil {
+		log.WithError(err).Error("Failed to load status boards")
+		return
+	}
+	for _, b := range boards {
+		cli, err := clientPool.Client(b.UserID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", b.UserID).Error("Failed to load client for status board")
+			continue
+		}
+		if err := update(cli, b.RoomID, now); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    b.RoomID,
+				"user_id":    b.UserID,
+			}).Error("Failed to refresh status board")
+		}
+	}
+}
+
+// update re-renders the board for the given room and sends it into the room if it has changed.
+func update(cli *gomatrix.Client, roomID string, now time.Time) error {
+	renderMutex.Lock()
+	defer renderMutex.Unlock()
+
+	db := database.GetServiceDB()
+	entries, err := db.LoadStatusEntries(cli.UserID, roomID)
+	if err != nil {
+		return err
+	}
+	board, err := db.LoadStatusBoard(cli.UserID, roomID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	board.UserID = cli.UserID
+	board.RoomID = roomID
+
+	opts := optionsFor(cli.UserID, roomID)
+	staleBefore := now.Add(-time.Duration(opts.StaleAfterMins)*time.Minute).UnixNano() / 1000000
+	plain, formatted := render(entries, staleBefore, opts.Mode)
+	if plain == board.Text {
+		return nil // nothing to do
+	}
+
+	logger := log.WithFields(log.Fields{
+		"room_id": roomID,
+		"user_id": cli.UserID,
+		"mode":    opts.Mode,
+	})
+	if opts.Mode == ModeTopic {
+		topic := struct {
+			Topic string `json:"topic"`
+		}{plain}
+		if _, err := cli.SendStateEvent(roomID, "m.room.topic", "", topic); err != nil {
+			return err
+		}
+	} else {
+		msg := gomatrix.HTMLMessage{
+			Body:          plain,
+			MsgType:       "m.notice",
+			Format:        "org.matrix.custom.html",
+			FormattedBody: formatted,
+		}
+		if board.EventID == "" {
+			resp, err := cli.SendMessageEvent(roomID, "m.room.message", msg)
+			if err != nil {
+				return err
+			}
+			board.EventID = resp.EventID
+			if err := pinEvent(cli, roomID, board.EventID); err != nil {
+				logger.WithError(err).Warn("Failed to pin status board")
+			}
+		} else if _, err := cli.SendMessageEvent(roomID, "m.room.message", editOf(board.EventID, msg)); err != nil {
+			return err
+		}
+	}
+	logger.Info("Updated status board")
+	board.Text = plain
+	return db.StoreStatusBoard(board)
+}
+
+// render returns the plain text and HTML forms of the board.
+func render(entries []types.StatusEntry, staleBefore int64, mode string) (string, string) {
+	if len(entries) == 0 {
+		return "No status entries.", "<em>No status entries.</em>"
+	}
+	var plain []string
+	var formatted bytes.Buffer
+	formatted.WriteString("<ul>")
+	for _, e := range entries {
+		stale := ""
+		if e.Timestamp < staleBefore {
+			updated := time.Unix(0, e.Timestamp*1000000).UTC().Format("2006-01-02 15:04 MST")
+			stale = fmt.Sprintf(" (stale since %s)", updated)
+		}
+		plain = append(plain, fmt.Sprintf("%s: %s%s", e.Name, e.Text, stale))
+		formatted.WriteString(fmt.Sprintf(
+			"<li><strong>%s</strong>: %s<em>%s</em></li>",
+			html.EscapeString(e.Name), html.EscapeString(e.Text), html.EscapeString(stale),
+		))
+	}
+	formatted.WriteString("</ul>")
+	if mode == ModeTopic {
+		return strings.Join(plain, " | "), ""
+	}
+	return strings.Join(plain, "\n"), formatted.String()
+}
+
+// editOf returns the content for an event which replaces the given event with msg.
+func editOf(eventID string, msg gomatrix.HTMLMessage) interface{} {
+	return struct {
+		gomatrix.HTMLMessage
+		NewContent gomatrix.HTMLMessage `json:"m.new_content"`
+		RelatesTo  struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+		} `json:"m.relates_to"`
+	}{
+		HTMLMessage: gomatrix.HTMLMessage{
+			Body:          "* " + msg.Body,
+			MsgType:       msg.MsgType,
+			Format:        msg.Format,
+			FormattedBody: "* " + msg.FormattedBody,
+		},
+		NewContent: msg,
+		RelatesTo: struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+		}{"m.replace", eventID},
+	}
+}
+
+// pinEvent adds the event to the room's pinned events.
+func pinEvent(cli *gomatrix.Client, roomID, eventID string) error {
+	var pinned struct {
+		Pinned []string `json:"pinned"`
+	}
+	// The room may not have any pinned events yet, in which case this 404s. Any other error means
+	// the existing pins are unknown, and sending the event would unpin them.
+	err := cli.StateEvent(roomID, "m.room.pinned_events", "", &pinned)
+	if httpErr, ok := err.(gomatrix.HTTPError); ok {
+		if respErr, ok := httpErr.WrappedError.(gomatrix.RespError); ok && respErr.ErrCode == "M_NOT_FOUND" {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range pinned.Pinned {
+		if id == eventID {
+			return nil
+		}
+	}
+	pinned.Pinned = append(pinned.Pinned, eventID)
+	_, err = cli.SendStateEvent(roomID, "m.room.pinned_events", "", pinned)
+	return err
+}
@@ -0,0 +1,208 @@
+package statusboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type mockStore struct {
+	database.NopStorage
+	options map[string]interface{}
+	entries map[string]types.StatusEntry
+	board   types.StatusBoard
+}
+
+func (s *mockStore) LoadBotOptions(userID, roomID string) (types.BotOptions, error) {
+	return types.BotOptions{UserID: userID, RoomID: roomID, Options: s.options}, nil
+}
+
+func (s *mockStore) StoreStatusEntry(e types.StatusEntry) error {
+	s.entries[e.Name] = e
+	return nil
+}
+
+func (s *mockStore) LoadStatusEntries(userID, roomID string) (entries []types.StatusEntry, err error) {
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	return
+}
+
+func (s *mockStore) LoadStatusBoard(userID, roomID string) (types.StatusBoard, error) {
+	return s.board, nil
+}
+
+func (s *mockStore) StoreStatusBoard(board types.StatusBoard) error {
+	s.board = board
+	return nil
+}
+
+type sentEvent struct {
+	path    string
+	content map[string]interface{}
+}
+
+// buildTestClient returns a client for a room which has a pinned event. If pinsErr is set, fetching
+// the pinned events fails with it instead.
+func buildTestClient(sent *[]sentEvent, pinsErr *gomatrix.RespError, pinsStatus int) *gomatrix.Client {
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && strings.Contains(req.URL.Path, "/state/m.room.pinned_events") {
+			if pinsErr != nil {
+				body, _ := json.Marshal(pinsErr)
+				return &http.Response{StatusCode: pinsStatus, Body: ioutil.NopCloser(bytes.NewBuffer(body))}, nil
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"pinned":["$existing:hyrule"]}`)),
+			}, nil
+		}
+		if req.Method != "PUT" {
+			return nil, fmt.Errorf("Unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		*sent = append(*sent, sentEvent{req.URL.Path, content})
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$board:hyrule"}`)),
+		}, nil
+	})
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	return cli
+}
+
+func TestPublishMessage(t *testing.T) {
+	store := &mockStore{entries: make(map[string]types.StatusEntry)}
+	database.SetServiceDB(store)
+	var sent []sentEvent
+	cli := buildTestClient(&sent, nil, 0)
+
+	if err := Publish(cli, "!room:hyrule", "main branch CI", "passing"); err != nil {
+		t.Fatalf("Publish returned error: %s", err)
+	}
+	// Expect a message and then the pinned events update
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %v", len(sent), sent)
+	}
+	if !strings.Contains(sent[0].path, "/send/m.room.message") || sent[0].content["body"] != "main branch CI: passing" {
+		t.Errorf("Unexpected board message: %v", sent[0])
+	}
+	pinned, _ := sent[1].content["pinned"].([]interface{})
+	if !strings.Contains(sent[1].path, "/state/m.room.pinned_events") || len(pinned) != 2 {
+		t.Errorf("Expected board to be pinned alongside existing pins, got %v", sent[1])
+	}
+	if store.board.EventID != "$board:hyrule" {
+		t.Errorf("Expected board event ID to be stored, got %s", store.board.EventID)
+	}
+
+	// Publishing the same text again is a no-op
+	if err := Publish(cli, "!room:hyrule", "main branch CI", "passing"); err != nil {
+		t.Fatalf("Publish returned error: %s", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("Expected no new events for unchanged board, got %d", len(sent))
+	}
+
+	// Changing an entry edits the existing message
+	if err := Publish(cli, "!room:hyrule", "main branch CI", "failing"); err != nil {
+		t.Fatalf("Publish returned error: %s", err)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("Expected an edit event, got %d events", len(sent))
+	}
+	relatesTo, _ := sent[2].content["m.relates_to"].(map[string]interface{})
+	if relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != "$board:hyrule" {
+		t.Errorf("Expected an edit of the board message, got %v", sent[2].content)
+	}
+	newContent, _ := sent[2].content["m.new_content"].(map[string]interface{})
+	if newContent["body"] != "main branch CI: failing" {
+		t.Errorf("Unexpected edited body: %v", newContent)
+	}
+}
+
+func TestPinFailures(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		err    gomatrix.RespError
+		pins   int
+	}{
+		// A room without pinned events
+		{404, gomatrix.RespError{ErrCode: "M_NOT_FOUND", Err: "Event not found."}, 1},
+		// The existing pins are unknown, so they mustn't be replaced
+		{500, gomatrix.RespError{ErrCode: "M_UNKNOWN", Err: "Internal server error"}, 0},
+		{403, gomatrix.RespError{ErrCode: "M_FORBIDDEN", Err: "You don't have permission"}, 0},
+	} {
+		store := &mockStore{entries: make(map[string]types.StatusEntry)}
+		database.SetServiceDB(store)
+		var sent []sentEvent
+		cli := buildTestClient(&sent, &tc.err, tc.status)
+
+		if err := Publish(cli, "!room:hyrule", "main branch CI", "passing"); err != nil {
+			t.Fatalf("Publish returned error: %s", err)
+		}
+		var pinned []interface{}
+		pins := 0
+		for _, ev := range sent {
+			if strings.Contains(ev.path, "/state/m.room.pinned_events") {
+				pinned, _ = ev.content["pinned"].([]interface{})
+				pins++
+			}
+		}
+		if pins != tc.pins || (pins == 1 && len(pinned) != 1) {
+			t.Errorf("%d: Expected %d pinned events update, got %v", tc.status, tc.pins, sent)
+		}
+		if store.board.EventID != "$board:hyrule" {
+			t.Errorf("%d: Expected the board to be stored even if it couldn't be pinned, got %+v", tc.status, store.board)
+		}
+	}
+}
+
+func TestPublishTopic(t *testing.T) {
+	store := &mockStore{
+		entries: make(map[string]types.StatusEntry),
+		options: map[string]interface{}{
+			"status_board": map[string]interface{}{"mode": "topic"},
+		},
+	}
+	database.SetServiceDB(store)
+	var sent []sentEvent
+	cli := buildTestClient(&sent, nil, 0)
+
+	if err := Publish(cli, "!room:hyrule", "alerts", "2 firing"); err != nil {
+		t.Fatalf("Publish returned error: %s", err)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0].path, "/state/m.room.topic") {
+		t.Fatalf("Expected a single topic update, got %v", sent)
+	}
+	if sent[0].content["topic"] != "alerts: 2 firing" {
+		t.Errorf("Unexpected topic: %v", sent[0].content["topic"])
+	}
+}
+
+func TestRenderStale(t *testing.T) {
+	now := time.Date(2020, 1, 1, 14, 0, 0, 0, time.UTC)
+	entries := []types.StatusEntry{
+		{Name: "alerts", Text: "2 firing", Timestamp: now.UnixNano() / 1000000},
+		{Name: "deploy", Text: "v1.2.3", Timestamp: now.Add(-2*time.Hour).UnixNano() / 1000000},
+	}
+	staleBefore := now.Add(-1*time.Hour).UnixNano() / 1000000
+	plain, _ := render(entries, staleBefore, ModeTopic)
+	want := "alerts: 2 firing | deploy: v1.2.3 (stale since 2020-01-01 12:00 UTC)"
+	if plain != want {
+		t.Errorf("TestRenderStale: want %q got %q", want, plain)
+	}
+}
@@ -1,7 +1,15 @@
 package testutils
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
 )
 
 // MockTransport implements RoundTripper
@@ -26,3 +34,89 @@ func NewRoundTripper(roundTrip func(*http.Request) (*http.Response, error)) http
 	rt.RT = roundTrip
 	return rt
 }
+
+// SentMessage is a m.room.message event which a client from NewMatrixClient sent.
+type SentMessage struct {
+	RoomID  string
+	Content map[string]interface{}
+}
+
+// Body returns the body of the message.
+func (m SentMessage) Body() string {
+	body, _ := m.Content["body"].(string)
+	return body
+}
+
+// String returns the room ID and body of the message, separated by a space.
+func (m SentMessage) String() string {
+	return m.RoomID + " " + m.Body()
+}
+
+// NewMatrixClient returns a client for @navi:hyrule whose requests all succeed. The m.room.message
+// events it sends are given the ID eventID, and are appended to sent if it isn't nil.
+func NewMatrixClient(sent *[]SentMessage, eventID string) *gomatrix.Client {
+	cli, _ := gomatrix.NewClient("https://hyrule", "@navi:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if sent != nil && strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			var content map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&content)
+			roomID := strings.Split(strings.SplitN(req.URL.Path, "/rooms/", 2)[1], "/")[0]
+			*sent = append(*sent, SentMessage{roomID, content})
+		}
+		res, _ := json.Marshal(map[string]string{"event_id": eventID})
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(res)),
+		}, nil
+	})}
+	return cli
+}
+
+// NewService creates a service with the ID "id" from its JSON config and registers it, failing
+// the test if either fails.
+func NewService(t *testing.T, serviceType, config string, cli *gomatrix.Client) types.Service {
+	srv, err := types.CreateService("id", serviceType, cli.UserID, []byte(config))
+	if err != nil {
+		t.Fatalf("Failed to create %s service: %s", serviceType, err)
+	}
+	if err := srv.Register(nil, cli); err != nil {
+		t.Fatalf("Failed to register %s service: %s", serviceType, err)
+	}
+	return srv
+}
+
+// RunCommand runs the command with the longest path which matches the text, as if userID had
+// sent it in roomID. It returns nil if no command matches.
+func RunCommand(cmds []types.Command, roomID, userID, text string) (interface{}, error) {
+	args := strings.Fields(text)
+	var best *types.Command
+	for i := range cmds {
+		if cmds[i].Matches(args) && (best == nil || len(cmds[i].Path) > len(best.Path)) {
+			best = &cmds[i]
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.Command(roomID, userID, args[len(best.Path):])
+}
+
+// RunTextCommand is like RunCommand, but returns the body of the message which the command
+// responded with.
+func RunTextCommand(cmds []types.Command, roomID, userID, text string) (string, error) {
+	res, err := RunCommand(cmds, roomID, userID, text)
+	if err != nil {
+		return "", err
+	}
+	switch msg := res.(type) {
+	case *gomatrix.TextMessage:
+		return msg.Body, nil
+	case gomatrix.TextMessage:
+		return msg.Body, nil
+	case *gomatrix.HTMLMessage:
+		return msg.Body, nil
+	case gomatrix.HTMLMessage:
+		return msg.Body, nil
+	}
+	return "", nil
+}
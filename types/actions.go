@@ -3,6 +3,8 @@ package types
 import (
 	"regexp"
 	"strings"
+
+	"github.com/matrix-org/gomatrix"
 )
 
 // A Command is something that a user invokes by sending a message starting with '!'
@@ -14,6 +16,9 @@ type Command struct {
 	Arguments []string
 	Help      string
 	Command   func(roomID, userID string, arguments []string) (content interface{}, err error)
+	// Optional. Called instead of Command with the event which invoked the command, for commands
+	// which need more than the room and sender, such as the message which the event replies to.
+	EventCommand func(event *gomatrix.Event, arguments []string) (content interface{}, err error)
 }
 
 // An Expansion is something that actives when the user sends any message
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,6 +20,204 @@ type BotOptions struct {
 	Options     map[string]interface{}
 }
 
+// QueuedNotification is a notification which was held back from a room, e.g. because the
+// room was in quiet hours when it was sent. Content is the JSON encoded event content.
+type QueuedNotification struct {
+	UserID    string
+	RoomID    string
+	Content   json.RawMessage
+	Timestamp int64 // unix milliseconds
+}
+
+// EmailDigestEntry is a notification waiting to be emailed to a recipient as part of a digest.
+// Content is the JSON encoded event content.
+type EmailDigestEntry struct {
+	Address   string
+	UserID    string
+	RoomID    string
+	Content   json.RawMessage
+	Timestamp int64 // unix milliseconds
+}
+
+// StatusEntry is a single named entry on a room's status board, e.g. "main branch CI: passing".
+type StatusEntry struct {
+	UserID    string
+	RoomID    string
+	Name      string
+	Text      string
+	Timestamp int64 // unix milliseconds of the last update
+}
+
+// StatusBoard is the rendered status board for a bot user in a room.
+type StatusBoard struct {
+	UserID string
+	RoomID string
+	// The event ID of the status board message, if the board is a message.
+	EventID string
+	// The last text which was rendered into the room.
+	Text string
+}
+
+// RoomStats are the aggregate activity counts for a room on a single day. No per-user data is kept.
+type RoomStats struct {
+	ServiceID string
+	RoomID    string
+	// The UTC day, as YYYY-MM-DD.
+	Day      string
+	Messages int64
+	Joins    int64
+	Leaves   int64
+	// The number of distinct members who sent a message.
+	ActiveMembers int64
+}
+
+// Ticket is a helpdesk ticket: a conversation between a user in a DM room and staff in a thread
+// in a triage room.
+type Ticket struct {
+	ServiceID string
+	// The ticket number, unique per service.
+	TicketID int64
+	// The user who opened the ticket.
+	UserID string
+	// The DM room with the user.
+	DMRoomID string
+	// The event ID of the thread root in the triage room.
+	ThreadEventID string
+	// One of "open", "claimed" or "resolved".
+	Status string
+	// The staff member who claimed the ticket, if any.
+	Assignee string
+	// Timestamps in milliseconds.
+	OpenedTimestamp    int64
+	LastUserTimestamp  int64
+	LastStaffTimestamp int64
+	RemindedTimestamp  int64
+}
+
+// ApprovalRequest is a request from a pipeline for people in a room to approve something, such as a
+// deployment.
+type ApprovalRequest struct {
+	ServiceID string
+	// The request number, unique per service.
+	RequestID int64
+	// The room the request was posted into, and the event ID of the message.
+	RoomID  string
+	EventID string
+	Title   string
+	// Optional details about what is being approved, and a link to it.
+	Description string
+	URL         string
+	// The number of approvals needed.
+	RequiredApprovals int
+	// One of "pending", "approved", "rejected" or "timed_out".
+	Status string
+	// Optional. Where to POST the decision.
+	CallbackURL string
+	// One of "" if there is nothing to deliver, "pending", "delivered" or "failed".
+	CallbackStatus   string
+	CallbackAttempts int
+	// Timestamps in milliseconds. DecidedTimestamp is 0 while the request is pending.
+	CreatedTimestamp int64
+	ExpiresTimestamp int64
+	DecidedTimestamp int64
+}
+
+// ApprovalAuditEntry is something which happened to an approval request, such as a user approving
+// it or its callback being delivered.
+type ApprovalAuditEntry struct {
+	ServiceID string
+	RequestID int64
+	// The user who did it, or "" if it was Go-NEB.
+	UserID string
+	// e.g. "requested", "approved", "rejected", "timed_out", "callback_delivered"
+	Action string
+	// Optional. A comment or error message.
+	Detail    string
+	Timestamp int64 // unix milliseconds
+}
+
+// MonitoringProblem is a problem reported by a monitoring system such as Zabbix or Icinga, which
+// stays open until it recovers.
+type MonitoringProblem struct {
+	ServiceID string
+	// The problem number, unique per service.
+	ProblemID int64
+	// Identifies the problem in notifications about it, e.g. the Zabbix event ID or the Icinga
+	// host and service.
+	Key string
+	// "zabbix", "icinga" or "nagios".
+	Source string
+	// The host, and the service on the host if the problem is with a service.
+	Host    string
+	Service string
+	// The severity, normalised to "critical", "warning" or "info", and as the monitoring system
+	// reported it.
+	Severity string
+	State    string
+	Summary  string
+	URL      string
+	// The ID of the problem in the monitoring system's API, if it differs from the key.
+	ExternalID string
+	// One of "problem", "acknowledged" or "recovered".
+	Status string
+	// Who acknowledged the problem and why, if it has been acknowledged.
+	AckedBy    string
+	AckComment string
+	// Timestamps in milliseconds.
+	OpenedTimestamp  int64
+	UpdatedTimestamp int64
+}
+
+// StatusPageIncident links an incident on a status page to a room it was announced or declared in.
+type StatusPageIncident struct {
+	ServiceID  string
+	RoomID     string
+	IncidentID string
+	Name       string
+	// The incident's status on the status page, e.g. "investigating" or "resolved".
+	Status string
+	URL    string
+	// When the incident was last updated, in milliseconds.
+	UpdatedTimestamp int64
+}
+
+// SearchMessage is a message in the search index.
+type SearchMessage struct {
+	ServiceID string
+	RoomID    string
+	EventID   string
+	Sender    string
+	Body      string
+	// The message's origin_server_ts, in milliseconds.
+	Timestamp int64
+}
+
+// SearchQuery is a search of the messages indexed for a room.
+type SearchQuery struct {
+	ServiceID string
+	RoomID    string
+	// Messages must contain all of the terms.
+	Terms []string
+	// Optional. Only messages from this user.
+	Sender string
+	// Optional. Only messages sent at or after After and before Before, in milliseconds.
+	After  int64
+	Before int64
+	// The maximum number of messages to return, newest first.
+	Limit int
+}
+
+// ThreadStats is the number of replies to a thread in a room on a single day.
+type ThreadStats struct {
+	ServiceID string
+	RoomID    string
+	// The UTC day, as YYYY-MM-DD.
+	Day string
+	// The event ID of the thread root.
+	ThreadID string
+	Replies  int64
+}
+
 // Poller represents a thing which can poll. Services should implement this method signature to support polling.
 type Poller interface {
 	// OnPoll is called when the poller should poll. Return the timestamp when you want to be polled again.
@@ -26,6 +225,40 @@ type Poller interface {
 	OnPoll(client *gomatrix.Client) time.Time
 }
 
+// EventListener represents a thing which wants to see room events. Services should implement this method
+// signature to be told about every m.room.message, m.room.member, m.reaction and m.room.redaction event in
+// rooms the service user is in, including events which aren't commands.
+type EventListener interface {
+	OnReceiveEvent(client *gomatrix.Client, event *gomatrix.Event)
+}
+
+// MultiSender represents a service which sends messages as users other than its ServiceUserID.
+// Services should implement this method signature so that the clients for those users are checked
+// when the service is configured.
+type MultiSender interface {
+	// SenderUserIDs returns the user IDs the service sends messages as, other than ServiceUserID.
+	SenderUserIDs() []string
+}
+
+// Senders maps room IDs to the user ID which a service should send messages into that room as,
+// in place of its ServiceUserID. Each user ID must have a configured client. Rooms which are not
+// in the map are sent to as the ServiceUserID.
+type Senders map[string]string
+
+// UserIDs returns the distinct user IDs which messages are sent as.
+func (s Senders) UserIDs() []string {
+	var userIDs []string
+	seen := make(map[string]bool)
+	for _, userID := range s {
+		if !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
 // A Service is the configuration for a bot service.
 type Service interface {
 	// Return the user ID of this service.